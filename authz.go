@@ -0,0 +1,572 @@
+package hbone
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/costinm/hbone/h2"
+)
+
+// Authorization for inbound streams, using the same model as Istio
+// AuthorizationPolicy: https://istio.io/latest/docs/reference/config/security/authorization-policy/
+//
+// - AUDIT policies are only logged.
+// - If any DENY policy matches, the request is denied.
+// - If there are ALLOW policies, at least one must match.
+// - If there are no ALLOW policies, only peers in the same trust domain and
+// namespace are allowed (any authenticated peer if the local namespace is not
+// known). Unauthenticated peers are only allowed from the SecureCIDR networks.
+
+const (
+	AuthzAllow = "ALLOW"
+	AuthzDeny  = "DENY"
+	AuthzAudit = "AUDIT"
+)
+
+// AuthzPolicy is an authorization policy. The fields follow the Istio
+// AuthorizationPolicy spec, so policies can be loaded from Istio objects.
+type AuthzPolicy struct {
+	// Name of the policy, reported in logs. For policies loaded from Istio
+	// objects, namespace/name.
+	Name string `json:"name,omitempty"`
+
+	// Action is ALLOW (default), DENY or AUDIT.
+	Action string `json:"action,omitempty"`
+
+	// Rules - the policy matches if any rule matches. A policy without rules
+	// never matches, a rule without fields matches everything.
+	Rules []*AuthzRule `json:"rules,omitempty"`
+}
+
+type authzPolicy AuthzPolicy
+
+// UnmarshalJSON rejects unknown fields - the policy would otherwise ignore
+// Istio fields that are not supported, like requestPrincipals, and an ALLOW
+// rule using them would match all requests.
+func (p *AuthzPolicy) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode((*authzPolicy)(p)); err != nil {
+		return fmt.Errorf("authz policy: %w", err)
+	}
+	return nil
+}
+
+// AuthzRule matches if all the From, To and When sections match.
+type AuthzRule struct {
+	// From matches if any source matches.
+	From []*AuthzFrom `json:"from,omitempty"`
+	// To matches if any operation matches.
+	To []*AuthzTo `json:"to,omitempty"`
+	// When matches if all conditions match.
+	When []*AuthzCondition `json:"when,omitempty"`
+}
+
+type AuthzFrom struct {
+	Source *AuthzSource `json:"source,omitempty"`
+}
+
+type AuthzTo struct {
+	Operation *AuthzOperation `json:"operation,omitempty"`
+}
+
+// AuthzSource matches the peer. Values support exact, prefix ("abc*"), suffix
+// ("*abc") and presence ("*") matches.
+type AuthzSource struct {
+	// Principals are SPIFFE IDs without the spiffe:// prefix, TD/ns/NS/sa/SA.
+	Principals    []string `json:"principals,omitempty"`
+	NotPrincipals []string `json:"notPrincipals,omitempty"`
+
+	Namespaces    []string `json:"namespaces,omitempty"`
+	NotNamespaces []string `json:"notNamespaces,omitempty"`
+
+	// TrustDomains and ServiceAccounts are not part of the Istio API.
+	TrustDomains []string `json:"trustDomains,omitempty"`
+	// ServiceAccounts are in the form NS/SA or SA.
+	ServiceAccounts []string `json:"serviceAccounts,omitempty"`
+
+	IPBlocks    []string `json:"ipBlocks,omitempty"`
+	NotIPBlocks []string `json:"notIpBlocks,omitempty"`
+}
+
+// AuthzOperation matches the request.
+type AuthzOperation struct {
+	Hosts    []string `json:"hosts,omitempty"`
+	NotHosts []string `json:"notHosts,omitempty"`
+
+	Ports    []string `json:"ports,omitempty"`
+	NotPorts []string `json:"notPorts,omitempty"`
+
+	Methods    []string `json:"methods,omitempty"`
+	NotMethods []string `json:"notMethods,omitempty"`
+
+	Paths    []string `json:"paths,omitempty"`
+	NotPaths []string `json:"notPaths,omitempty"`
+}
+
+// AuthzCondition matches an attribute. Supported keys: request.headers[NAME],
+// source.ip, source.namespace, source.principal, destination.port,
+// destination.principal, destination.namespace, connection.sni.
+//
+// The destination identity is only known for gateway streams forwarded over
+// mTLS. Gateway streams are authorized before dialing - with the destination
+// conditions treated as matching for ALLOW and not matching for DENY - and
+// again after the upstream identity is known.
+type AuthzCondition struct {
+	Key       string   `json:"key"`
+	Values    []string `json:"values,omitempty"`
+	NotValues []string `json:"notValues,omitempty"`
+}
+
+// AuthzRequest holds the attributes of an inbound stream used for authorization.
+type AuthzRequest struct {
+	Peer     *h2.PeerMetadata
+	SourceIP net.IP
+	Host     string
+	Port     int
+	SNI      string
+	Method   string
+	Path     string
+	Header   http.Header
+
+	// Gateway is set for streams forwarded to a non-local destination.
+	Gateway bool
+	// Destination is the identity of the upstream for gateway streams, nil
+	// if not yet dialed or not using mTLS.
+	Destination *h2.PeerMetadata
+}
+
+// AuthzResult is the result of evaluating the policies.
+type AuthzResult struct {
+	Allow bool
+	// Policy and Rule are the matched policy and rule index, empty if
+	// the default was used.
+	Policy string
+	Rule   int
+	Reason string
+}
+
+// istioPolicy is the Istio AuthorizationPolicy object.
+type istioPolicy struct {
+	Kind     string `json:"kind"`
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Spec map[string]json.RawMessage `json:"spec"`
+}
+
+// ParseAuthorizationPolicy parses an Istio AuthorizationPolicy object, in
+// JSON format. The workload selector is ignored - the policy applies to this
+// node. CUSTOM policies and unsupported fields are rejected.
+func ParseAuthorizationPolicy(data []byte) (*AuthzPolicy, error) {
+	ip := &istioPolicy{}
+	err := json.Unmarshal(data, ip)
+	if err != nil {
+		return nil, err
+	}
+	if ip.Kind != "AuthorizationPolicy" {
+		return nil, fmt.Errorf("unexpected kind %q", ip.Kind)
+	}
+	delete(ip.Spec, "selector")
+	delete(ip.Spec, "targetRef")
+	delete(ip.Spec, "targetRefs")
+	spec, err := json.Marshal(ip.Spec)
+	if err != nil {
+		return nil, err
+	}
+	p := &AuthzPolicy{}
+	if err := json.Unmarshal(spec, p); err != nil {
+		return nil, err
+	}
+	p.Name = ip.Metadata.Namespace + "/" + ip.Metadata.Name
+	return p, p.Validate()
+}
+
+// Validate checks the action and condition keys.
+func (p *AuthzPolicy) Validate() error {
+	switch p.Action {
+	case "":
+		p.Action = AuthzAllow
+	case AuthzAllow, AuthzDeny, AuthzAudit:
+	default:
+		return fmt.Errorf("policy %s: unsupported action %q", p.Name, p.Action)
+	}
+	for _, r := range p.Rules {
+		for _, c := range r.When {
+			if _, ok := (&AuthzRequest{}).attr(c.Key); !ok {
+				return fmt.Errorf("policy %s: unsupported condition %q", p.Name, c.Key)
+			}
+		}
+	}
+	return nil
+}
+
+// validAuthorizationPolicies returns the valid policies and the validation
+// errors. Invalid policies are dropped - an invalid DENY policy, or one with
+// an unknown action, is replaced with a policy denying all streams, so the
+// node fails closed until the config is fixed.
+func validAuthorizationPolicies(ps []*AuthzPolicy) ([]*AuthzPolicy, error) {
+	var res []*AuthzPolicy
+	var errs []error
+	for _, p := range ps {
+		err := p.Validate()
+		if err == nil {
+			res = append(res, p)
+			continue
+		}
+		errs = append(errs, err)
+		switch p.Action {
+		case AuthzAllow, AuthzAudit:
+		default:
+			res = append(res, &AuthzPolicy{Name: p.Name, Action: AuthzDeny, Rules: []*AuthzRule{{}}})
+		}
+	}
+	return res, errors.Join(errs...)
+}
+
+// AddAuthorizationPolicy adds a policy to the node.
+func (hb *HBone) AddAuthorizationPolicy(p *AuthzPolicy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	hb.m.Lock()
+	hb.AuthzPolicies = append(hb.AuthzPolicies, p)
+	hb.m.Unlock()
+	return nil
+}
+
+// SetAuthorizationPolicies replaces the policies. If any policy is
+// invalid, the existing policies are not changed.
+func (hb *HBone) SetAuthorizationPolicies(ps []*AuthzPolicy) error {
+	for _, p := range ps {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+	}
+	hb.m.Lock()
+	hb.AuthzPolicies = ps
+	hb.m.Unlock()
+	return nil
+}
+
+// Authorize evaluates the policies for an inbound request.
+func (hb *HBone) Authorize(req *AuthzRequest) *AuthzResult {
+	hb.m.RLock()
+	policies := hb.AuthzPolicies
+	hb.m.RUnlock()
+
+	hasAllow := false
+	var allow *AuthzResult
+	for _, p := range policies {
+		ri := p.match(req, p.Action == AuthzDeny)
+		switch p.Action {
+		case AuthzAudit:
+			if ri >= 0 {
+				hb.log.Info("Authz audit", "policy", p.Name, "rule", ri, "peer", req.Peer,
+					"method", req.Method, "host", req.Host, "path", req.Path)
+			}
+		case AuthzDeny:
+			if ri >= 0 {
+				return &AuthzResult{Policy: p.Name, Rule: ri, Reason: "denied by policy"}
+			}
+		case AuthzAllow, "":
+			hasAllow = true
+			if ri >= 0 && allow == nil {
+				allow = &AuthzResult{Allow: true, Policy: p.Name, Rule: ri}
+			}
+		default:
+			// Not validated - fail closed.
+			return &AuthzResult{Policy: p.Name, Rule: -1, Reason: "unsupported action"}
+		}
+	}
+	if allow != nil {
+		return allow
+	}
+	if hasAllow {
+		return &AuthzResult{Rule: -1, Reason: "no matching allow policy"}
+	}
+	return hb.authorizeDefault(req)
+}
+
+// authorizeDefault allows peers in the same trust domain and namespace.
+// Nodes without a configured namespace allow all authenticated peers.
+// Unauthenticated peers - plain text H2C, non-SPIFFE certificates - are only
+// allowed from the SecureCIDR networks.
+func (hb *HBone) authorizeDefault(req *AuthzRequest) *AuthzResult {
+	if req.Peer == nil || req.Peer.Principal == "" {
+		if ipInBlocks(hb.SecureCIDR, req.SourceIP) {
+			return &AuthzResult{Allow: true, Rule: -1}
+		}
+		return &AuthzResult{Rule: -1, Reason: "not authenticated"}
+	}
+	if hb.Namespace == "" {
+		return &AuthzResult{Allow: true, Rule: -1}
+	}
+	if req.Peer.Namespace != hb.Namespace {
+		return &AuthzResult{Rule: -1, Reason: "namespace mismatch"}
+	}
+	if hb.ID != nil && hb.ID.TrustDomain != "" && req.Peer.TrustDomain != hb.ID.TrustDomain {
+		return &AuthzResult{Rule: -1, Reason: "trust domain mismatch"}
+	}
+	return &AuthzResult{Allow: true, Rule: -1}
+}
+
+// match returns the index of the first matching rule, or -1.
+// Conditions on attributes not yet known match only if deny is false,
+// conditions on unsupported attributes only if deny is true.
+func (p *AuthzPolicy) match(req *AuthzRequest, deny bool) int {
+	for i, r := range p.Rules {
+		if r.match(req, deny) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *AuthzRule) match(req *AuthzRequest, deny bool) bool {
+	if len(r.From) > 0 {
+		found := false
+		for _, f := range r.From {
+			if f.Source == nil || f.Source.match(req) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.To) > 0 {
+		found := false
+		for _, t := range r.To {
+			if t.Operation == nil || t.Operation.match(req) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, c := range r.When {
+		if req.pending(c.Key) {
+			if deny {
+				return false
+			}
+			continue
+		}
+		v, ok := req.attr(c.Key)
+		if !ok {
+			// Unsupported key - DENY rules match, ALLOW rules don't.
+			if deny {
+				continue
+			}
+			return false
+		}
+		if !matchList(c.Values, c.NotValues, v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *AuthzSource) match(req *AuthzRequest) bool {
+	var principal, ns, sa, td string
+	if req.Peer != nil {
+		principal = strings.TrimPrefix(req.Peer.Principal, "spiffe://")
+		ns = req.Peer.Namespace
+		sa = req.Peer.ServiceAccount
+		td = req.Peer.TrustDomain
+		if principal == "" {
+			// Not authenticated - baggage values are not trusted.
+			ns, sa = "", ""
+		}
+	}
+	if !matchList(s.Principals, s.NotPrincipals, principal) ||
+		!matchList(s.Namespaces, s.NotNamespaces, ns) ||
+		!matchList(s.TrustDomains, nil, td) {
+		return false
+	}
+	if len(s.ServiceAccounts) > 0 && sa != "" {
+		if !matchAny(s.ServiceAccounts, sa) && !matchAny(s.ServiceAccounts, ns+"/"+sa) {
+			return false
+		}
+	} else if len(s.ServiceAccounts) > 0 {
+		return false
+	}
+	if len(s.IPBlocks) > 0 && !ipInBlocks(s.IPBlocks, req.SourceIP) {
+		return false
+	}
+	if len(s.NotIPBlocks) > 0 && ipInBlocks(s.NotIPBlocks, req.SourceIP) {
+		return false
+	}
+	return true
+}
+
+func (o *AuthzOperation) match(req *AuthzRequest) bool {
+	port := ""
+	if req.Port != 0 {
+		port = strconv.Itoa(req.Port)
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return matchList(o.Hosts, o.NotHosts, host) &&
+		matchList(o.Ports, o.NotPorts, port) &&
+		matchList(o.Methods, o.NotMethods, req.Method) &&
+		matchList(o.Paths, o.NotPaths, req.Path)
+}
+
+// attr returns the value of a condition key, and false if the key is not
+// supported.
+func (req *AuthzRequest) attr(key string) (string, bool) {
+	if strings.HasPrefix(key, "request.headers[") && strings.HasSuffix(key, "]") {
+		if req.Header == nil {
+			return "", true
+		}
+		return req.Header.Get(key[len("request.headers[") : len(key)-1]), true
+	}
+	switch key {
+	case "source.ip":
+		if req.SourceIP == nil {
+			return "", true
+		}
+		return req.SourceIP.String(), true
+	case "source.namespace":
+		if req.Peer == nil || req.Peer.Principal == "" {
+			return "", true
+		}
+		return req.Peer.Namespace, true
+	case "source.principal":
+		if req.Peer == nil {
+			return "", true
+		}
+		return strings.TrimPrefix(req.Peer.Principal, "spiffe://"), true
+	case "destination.port":
+		return strconv.Itoa(req.Port), true
+	case "destination.namespace":
+		if req.Destination == nil || req.Destination.Principal == "" {
+			return "", true
+		}
+		return req.Destination.Namespace, true
+	case "destination.principal":
+		if req.Destination == nil {
+			return "", true
+		}
+		return strings.TrimPrefix(req.Destination.Principal, "spiffe://"), true
+	case "connection.sni":
+		return req.SNI, true
+	}
+	return "", false
+}
+
+// pending returns true if the key is a destination identity attribute of a
+// gateway stream that was not dialed yet.
+func (req *AuthzRequest) pending(key string) bool {
+	return req.Gateway && req.Destination == nil &&
+		(key == "destination.principal" || key == "destination.namespace")
+}
+
+// matchList returns true if v matches one of the values (or values is empty)
+// and none of the notValues.
+func matchList(values, notValues []string, v string) bool {
+	if len(values) > 0 && !matchAny(values, v) {
+		return false
+	}
+	if len(notValues) > 0 && matchAny(notValues, v) {
+		return false
+	}
+	return true
+}
+
+func matchAny(values []string, v string) bool {
+	for _, m := range values {
+		if matchValue(m, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchValue implements the Istio string match: exact, prefix*, *suffix, or
+// '*' for any non-empty value.
+func matchValue(m, v string) bool {
+	switch {
+	case m == "*":
+		return v != ""
+	case strings.HasPrefix(m, "*"):
+		return strings.HasSuffix(v, m[1:])
+	case strings.HasSuffix(m, "*"):
+		return strings.HasPrefix(v, m[:len(m)-1])
+	}
+	return m == v
+}
+
+func ipInBlocks(blocks []string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, b := range blocks {
+		if !strings.Contains(b, "/") {
+			if net.ParseIP(b).Equal(ip) {
+				return true
+			}
+			continue
+		}
+		_, n, err := net.ParseCIDR(b)
+		if err == nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// errAuthzDenied is returned when a stream is denied.
+var errAuthzDenied = errors.New("RBAC: access denied")
+
+// authorizeStream builds the AuthzRequest for a stream and evaluates the
+// policies. Denials are logged with the matched policy and rule.
+func (hb *HBone) authorizeStream(stream *h2.H2Stream, sni string) error {
+	return hb.authorizeRequest(stream, streamAuthzRequest(stream, sni))
+}
+
+// streamAuthzRequest returns the authorization attributes of a stream.
+func streamAuthzRequest(stream *h2.H2Stream, sni string) *AuthzRequest {
+	r := stream.Request
+	req := &AuthzRequest{
+		Peer:   stream.Peer,
+		Host:   r.Host,
+		SNI:    sni,
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Header: r.Header,
+	}
+	if ta, ok := stream.Conn().RemoteAddr().(*net.TCPAddr); ok {
+		req.SourceIP = ta.IP
+	}
+	if _, p, err := net.SplitHostPort(r.Host); err == nil {
+		req.Port, _ = strconv.Atoi(p)
+	} else if ta, ok := stream.Conn().LocalAddr().(*net.TCPAddr); ok {
+		req.Port = ta.Port
+	}
+	return req
+}
+
+func (hb *HBone) authorizeRequest(stream *h2.H2Stream, req *AuthzRequest) error {
+	res := hb.Authorize(req)
+	if res.Allow {
+		return nil
+	}
+	hb.log.Warn("Authz denied", "policy", res.Policy, "rule", res.Rule, "reason", res.Reason,
+		"stream", stream.Id, "peer", stream.Peer, "source", req.SourceIP,
+		"method", req.Method, "host", req.Host, "path", req.Path, "destination", req.Destination)
+	return errAuthzDenied
+}
@@ -0,0 +1,176 @@
+package hbone
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/costinm/hbone/h2"
+)
+
+func TestAuthz(t *testing.T) {
+	hb := New(nil, &MeshSettings{Namespace: "bob"})
+
+	alice := &h2.PeerMetadata{Principal: "spiffe://cluster.local/ns/alice/sa/default",
+		TrustDomain: "cluster.local", Namespace: "alice", ServiceAccount: "default"}
+	bob := &h2.PeerMetadata{Principal: "spiffe://cluster.local/ns/bob/sa/default",
+		TrustDomain: "cluster.local", Namespace: "bob", ServiceAccount: "default"}
+
+	// Default: same namespace only
+	if hb.Authorize(&AuthzRequest{Peer: alice}).Allow {
+		t.Fatal("Expecting deny for other namespace")
+	}
+	if !hb.Authorize(&AuthzRequest{Peer: bob}).Allow {
+		t.Fatal("Expecting allow for same namespace")
+	}
+
+	p, err := ParseAuthorizationPolicy([]byte(`{"kind":"AuthorizationPolicy",
+		"metadata":{"name":"allow-alice","namespace":"bob"},
+		"spec":{"rules":[{"from":[{"source":{"principals":["cluster.local/ns/alice/*"]}}],
+			"to":[{"operation":{"ports":["8080"],"methods":["CONNECT"]}}]}]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hb.AddAuthorizationPolicy(p)
+	hb.AddAuthorizationPolicy(&AuthzPolicy{Name: "deny-header", Action: AuthzDeny,
+		Rules: []*AuthzRule{{When: []*AuthzCondition{{Key: "request.headers[x-deny]", Values: []string{"*"}}}}}})
+
+	if r := hb.Authorize(&AuthzRequest{Peer: alice, Port: 8080, Method: "CONNECT"}); !r.Allow || r.Policy != "bob/allow-alice" {
+		t.Fatal("Expecting allow", r)
+	}
+	if hb.Authorize(&AuthzRequest{Peer: alice, Port: 9090, Method: "CONNECT"}).Allow {
+		t.Fatal("Expecting deny for other port")
+	}
+	// With an ALLOW policy, the default no longer applies
+	if hb.Authorize(&AuthzRequest{Peer: bob, Port: 8080, Method: "CONNECT"}).Allow {
+		t.Fatal("Expecting deny for bob")
+	}
+	r := hb.Authorize(&AuthzRequest{Peer: alice, Port: 8080, Method: "CONNECT",
+		Header: http.Header{"X-Deny": []string{"1"}}})
+	if r.Allow || r.Policy != "deny-header" || r.Rule != 0 {
+		t.Fatal("Expecting deny", r)
+	}
+}
+
+func TestAuthzGateway(t *testing.T) {
+	hb := New(nil, &MeshSettings{Namespace: "gw"})
+
+	alice := &h2.PeerMetadata{Principal: "spiffe://cluster.local/ns/alice/sa/default",
+		TrustDomain: "cluster.local", Namespace: "alice", ServiceAccount: "default"}
+	bob := &h2.PeerMetadata{Principal: "spiffe://cluster.local/ns/bob/sa/default",
+		TrustDomain: "cluster.local", Namespace: "bob", ServiceAccount: "default"}
+
+	hb.AddAuthorizationPolicy(&AuthzPolicy{Name: "alice-to-bob",
+		Rules: []*AuthzRule{{From: []*AuthzFrom{{Source: &AuthzSource{Namespaces: []string{"alice"}}}},
+			When: []*AuthzCondition{{Key: "destination.namespace", Values: []string{"bob"}}}}}})
+	hb.AddAuthorizationPolicy(&AuthzPolicy{Name: "deny-db", Action: AuthzDeny,
+		Rules: []*AuthzRule{{When: []*AuthzCondition{{Key: "destination.principal", Values: []string{"*/sa/db"}}}}}})
+
+	// Before dialing the destination conditions are not known.
+	req := &AuthzRequest{Peer: alice, Host: "10.1.1.1:8080", Method: "CONNECT", Gateway: true}
+	if r := hb.Authorize(req); !r.Allow {
+		t.Fatal("Expecting allow before dial", r)
+	}
+	if hb.Authorize(&AuthzRequest{Peer: bob, Method: "CONNECT", Gateway: true}).Allow {
+		t.Fatal("Expecting deny for bob")
+	}
+
+	req.Destination = bob
+	if r := hb.Authorize(req); !r.Allow {
+		t.Fatal("Expecting allow for bob destination", r)
+	}
+	req.Destination = &h2.PeerMetadata{}
+	if hb.Authorize(req).Allow {
+		t.Fatal("Expecting deny for unauthenticated destination")
+	}
+	req.Destination = &h2.PeerMetadata{Principal: "spiffe://cluster.local/ns/bob/sa/db", Namespace: "bob"}
+	if r := hb.Authorize(req); r.Allow || r.Policy != "deny-db" {
+		t.Fatal("Expecting deny for db", r)
+	}
+}
+
+func TestAuthzInvalid(t *testing.T) {
+	alice := &h2.PeerMetadata{Principal: "spiffe://cluster.local/ns/alice/sa/default",
+		TrustDomain: "cluster.local", Namespace: "alice", ServiceAccount: "default"}
+	allowAll := &AuthzPolicy{Name: "allow-all", Rules: []*AuthzRule{{}}}
+
+	// Invalid policies are dropped - invalid DENY fails closed.
+	hb := New(nil, &MeshSettings{AuthzPolicies: []*AuthzPolicy{allowAll,
+		{Name: "bad-deny", Action: AuthzDeny, Rules: []*AuthzRule{{When: []*AuthzCondition{{Key: "source.nope"}}}}},
+		{Name: "bad-allow", Rules: []*AuthzRule{{When: []*AuthzCondition{{Key: "source.nope"}}}}}}})
+	if len(hb.AuthzPolicies) != 2 {
+		t.Fatal("Expecting invalid allow dropped", hb.AuthzPolicies)
+	}
+	if r := hb.Authorize(&AuthzRequest{Peer: alice}); r.Allow || r.Policy != "bad-deny" {
+		t.Error("Expecting deny for invalid DENY policy", r)
+	}
+
+	hb = New(nil, &MeshSettings{AuthzPolicies: []*AuthzPolicy{allowAll, {Name: "custom", Action: "CUSTOM"}}})
+	if r := hb.Authorize(&AuthzRequest{Peer: alice}); r.Allow {
+		t.Error("Expecting deny for unknown action", r)
+	}
+
+	// Policies changed without validation fail closed.
+	hb = New(nil, &MeshSettings{})
+	hb.AuthzPolicies = []*AuthzPolicy{allowAll, {Name: "custom", Action: "CUSTOM"}}
+	if r := hb.Authorize(&AuthzRequest{Peer: alice}); r.Allow || r.Reason != "unsupported action" {
+		t.Error("Expecting deny for unknown action", r)
+	}
+	hb.AuthzPolicies = []*AuthzPolicy{allowAll, {Name: "deny", Action: AuthzDeny,
+		Rules: []*AuthzRule{{When: []*AuthzCondition{{Key: "source.nope", Values: []string{"x"}}}}}}}
+	if r := hb.Authorize(&AuthzRequest{Peer: alice}); r.Allow || r.Policy != "deny" {
+		t.Error("Expecting DENY with unsupported condition to match", r)
+	}
+	hb.AuthzPolicies = []*AuthzPolicy{{Name: "allow", Action: AuthzAllow,
+		Rules: []*AuthzRule{{When: []*AuthzCondition{{Key: "source.nope", NotValues: []string{"x"}}}}}}}
+	if r := hb.Authorize(&AuthzRequest{Peer: alice}); r.Allow {
+		t.Error("Expecting ALLOW with unsupported condition to not match", r)
+	}
+}
+
+func TestAuthzUnsupportedFields(t *testing.T) {
+	for _, spec := range []string{
+		`{"rules":[{"from":[{"source":{"requestPrincipals":["*"]}}]}]}`,
+		`{"rules":[{"from":[{"source":{"remoteIpBlocks":["10.0.0.0/8"]}}]}]}`,
+		`{"action":"DENY","rules":[{"from":[{"source":{"notRequestPrincipals":["*"]}}]}]}`,
+		`{"rules":[{"to":[{"operation":{"other":["x"]}}]}]}`,
+	} {
+		_, err := ParseAuthorizationPolicy([]byte(`{"kind":"AuthorizationPolicy",
+			"metadata":{"name":"p","namespace":"bob"},"spec":` + spec + `}`))
+		if err == nil {
+			t.Error("Expecting unsupported field to be rejected", spec)
+		}
+		if err := json.Unmarshal([]byte(`{"authzPolicies":[`+spec+`]}`), &MeshSettings{}); err == nil {
+			t.Error("Expecting unsupported field to be rejected in settings", spec)
+		}
+	}
+
+	// The workload selector is ignored.
+	p, err := ParseAuthorizationPolicy([]byte(`{"kind":"AuthorizationPolicy",
+		"metadata":{"name":"p","namespace":"bob"},
+		"spec":{"selector":{"matchLabels":{"app":"a"}},"rules":[{"from":[{"source":{"ipBlocks":["10.0.0.0/8"]}}]}]}}`))
+	if err != nil || len(p.Rules) != 1 || p.Rules[0].From[0].Source.IPBlocks[0] != "10.0.0.0/8" {
+		t.Error("Unexpected policy", p, err)
+	}
+}
+
+func TestAuthzDefaultUnauthenticated(t *testing.T) {
+	for _, ns := range []string{"", "bob"} {
+		hb := New(nil, &MeshSettings{Namespace: ns})
+		// Baggage namespace without a principal is not trusted.
+		for _, peer := range []*h2.PeerMetadata{nil, {Namespace: "bob"}} {
+			if r := hb.Authorize(&AuthzRequest{Peer: peer, SourceIP: net.ParseIP("10.1.1.1")}); r.Allow {
+				t.Error("Expecting deny for unauthenticated peer", ns, peer)
+			}
+		}
+
+		hb.SecureCIDR = []string{"10.1.0.0/16"}
+		if r := hb.Authorize(&AuthzRequest{SourceIP: net.ParseIP("10.1.1.1")}); !r.Allow {
+			t.Error("Expecting allow for secure network", ns)
+		}
+		if r := hb.Authorize(&AuthzRequest{SourceIP: net.ParseIP("10.2.1.1")}); r.Allow {
+			t.Error("Expecting deny for other network", ns)
+		}
+	}
+}
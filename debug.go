@@ -0,0 +1,369 @@
+package hbone
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/costinm/hbone/h2"
+)
+
+// Debug endpoints, returning JSON. Intended for the admin port, bound to
+// localhost - the responses include config and peer identities.
+//
+// - /debug/clusters - config, endpoints and connections of each cluster
+// - /debug/connections - accepted and dialed H2 connections
+// - /debug/streams - active streams
+// - /debug/listeners
+// - /debug/certs - workload and listener certificates, with expiry
+// - /debug/config_dump - the effective MeshSettings
+
+// HandleDebug registers the debug endpoints on the mux.
+func (hb *HBone) HandleDebug(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/clusters", hb.debugJSON(hb.debugClusters))
+	mux.HandleFunc("/debug/connections", hb.debugJSON(hb.debugConnections))
+	mux.HandleFunc("/debug/streams", hb.debugJSON(hb.debugStreams))
+	mux.HandleFunc("/debug/listeners", hb.debugJSON(hb.debugListeners))
+	mux.HandleFunc("/debug/certs", hb.debugJSON(hb.debugCerts))
+	mux.HandleFunc("/debug/config_dump", hb.debugJSON(hb.ConfigDump))
+}
+
+func (hb *HBone) debugJSON(f func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(f()); err != nil {
+			hb.log.Warn("Debug encode error", "path", r.URL.Path, "err", err)
+		}
+	}
+}
+
+// trackConn records an accepted H2 connection, until HandleStreams returns.
+func (hb *HBone) trackConn(st *h2.H2Transport) func() {
+	hb.m.Lock()
+	if hb.serverConns == nil {
+		hb.serverConns = map[*h2.H2Transport]struct{}{}
+	}
+	hb.serverConns[st] = struct{}{}
+	hb.m.Unlock()
+	return func() {
+		hb.m.Lock()
+		delete(hb.serverConns, st)
+		hb.m.Unlock()
+	}
+}
+
+// ConnInfo is the debug info for a H2 connection.
+type ConnInfo struct {
+	*h2.TransportInfo
+
+	// Peer is the identity from the peer certificate, if using mTLS.
+	Peer string `json:"peer,omitempty"`
+
+	// Cluster is set for dialed connections.
+	Cluster string `json:"cluster,omitempty"`
+}
+
+func connInfo(t *h2.H2Transport, cluster string) *ConnInfo {
+	ci := &ConnInfo{TransportInfo: t.Info(), Cluster: cluster}
+	if tc, ok := t.Conn().(*tls.Conn); ok {
+		cs := tc.ConnectionState()
+		p := &h2.PeerMetadata{}
+		if p.SetTLSPeer(&cs) {
+			ci.Peer = p.Principal
+		}
+	}
+	return ci
+}
+
+// transports returns the accepted and dialed H2 connections, with the
+// cluster name for dialed ones.
+func (hb *HBone) transports() ([]*h2.H2Transport, []string) {
+	var res []*h2.H2Transport
+	var names []string
+	hb.m.RLock()
+	for st := range hb.serverConns {
+		res = append(res, st)
+		names = append(names, "")
+	}
+	for _, c := range hb.clusterList() {
+		for _, epc := range c.EndpointCon {
+			if ct, ok := epc.transport().(*h2.H2ClientTransport); ok {
+				res = append(res, &ct.H2Transport)
+				names = append(names, c.Addr)
+			}
+		}
+	}
+	hb.m.RUnlock()
+	return res, names
+}
+
+// clusterList returns the unique clusters, including the ones for H2R
+// connections, sorted by address. Called with the lock held.
+func (hb *HBone) clusterList() []*Cluster {
+	seen := map[*Cluster]bool{}
+	var res []*Cluster
+	for _, c := range hb.Clusters {
+		if !seen[c] {
+			seen[c] = true
+			res = append(res, c)
+		}
+	}
+	for _, c := range hb.h2r {
+		res = append(res, c)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Addr < res[j].Addr })
+	return res
+}
+
+func (hb *HBone) debugConnections() interface{} {
+	ts, names := hb.transports()
+	res := make([]*ConnInfo, 0, len(ts))
+	for i, t := range ts {
+		res = append(res, connInfo(t, names[i]))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Start.Before(res[j].Start) })
+	return res
+}
+
+func (hb *HBone) debugStreams() interface{} {
+	ts, _ := hb.transports()
+	res := []*h2.StreamInfo{}
+	for _, t := range ts {
+		res = append(res, t.StreamsInfo()...)
+	}
+	return res
+}
+
+// ClusterInfo is the debug info for a cluster.
+type ClusterInfo struct {
+	Addr           string            `json:"addr"`
+	ID             string            `json:"id,omitempty"`
+	VIP            string            `json:"vip,omitempty"`
+	SNI            string            `json:"sni,omitempty"`
+	TokenSource    string            `json:"tokenSource,omitempty"`
+	ConnectTimeout string            `json:"connectTimeout,omitempty"`
+	Framing        string            `json:"framing,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	Dynamic        bool              `json:"dynamic,omitempty"`
+	LastUsed       time.Time         `json:"lastUsed,omitempty"`
+	Endpoints      []*Endpoint       `json:"endpoints,omitempty"`
+
+	// Connections are the connections to endpoints - the LB state.
+	Connections []*EndpointConInfo `json:"connections,omitempty"`
+}
+
+// EndpointConInfo is the debug info for a connection to an endpoint.
+type EndpointConInfo struct {
+	Endpoint string    `json:"endpoint,omitempty"`
+	Start    time.Time `json:"start"`
+	SSLEnd   time.Time `json:"sslEnd,omitempty"`
+
+	// Healthy is false if the connection can't take new streams.
+	Healthy bool      `json:"healthy"`
+	Conn    *ConnInfo `json:"conn,omitempty"`
+}
+
+func (hb *HBone) debugClusters() interface{} {
+	hb.m.RLock()
+	clusters := hb.clusterList()
+	hb.m.RUnlock()
+	res := make([]*ClusterInfo, 0, len(clusters))
+	for _, c := range clusters {
+		res = append(res, NewClusterInfo(c))
+	}
+	return res
+}
+
+// NewClusterInfo returns the debug info for the cluster. The endpoints and
+// connections are copied with the lock held - must not be called with the
+// lock held.
+func NewClusterInfo(c *Cluster) *ClusterInfo {
+	ci := &ClusterInfo{Addr: c.Addr, ID: c.ID, VIP: c.VIP, SNI: c.SNI, TokenSource: c.TokenSource,
+		Framing: c.Framing, Labels: c.Labels, Dynamic: c.Dynamic}
+	if c.ConnectTimeout != 0 {
+		ci.ConnectTimeout = c.ConnectTimeout.String()
+	}
+	var epcs []*EndpointCon
+	if c.hb != nil {
+		c.hb.m.RLock()
+	}
+	ci.LastUsed = c.LastUsed
+	ci.Endpoints = append(ci.Endpoints, c.Endpoints...)
+	epcs = append(epcs, c.EndpointCon...)
+	if c.hb != nil {
+		c.hb.m.RUnlock()
+	}
+	for _, epc := range epcs {
+		epc.mu.Lock()
+		ei := &EndpointConInfo{Start: epc.ConnectionStart, SSLEnd: epc.SSLEnd}
+		rt := epc.rt
+		epc.mu.Unlock()
+		if epc.Endpoint != nil {
+			ei.Endpoint = epc.Endpoint.Address
+		}
+		if ct, ok := rt.(*h2.H2ClientTransport); ok {
+			ei.Healthy = ct.CanTakeNewRequest()
+			ei.Conn = connInfo(&ct.H2Transport, c.Addr)
+		}
+		ci.Connections = append(ci.Connections, ei)
+	}
+	return ci
+}
+
+// ListenerInfo is the debug info for a listener.
+type ListenerInfo struct {
+	Name          string   `json:"name"`
+	Address       string   `json:"address,omitempty"`
+	Bound         string   `json:"bound,omitempty"`
+	Protocol      string   `json:"protocol,omitempty"`
+	ForwardTo     string   `json:"forwardTo,omitempty"`
+	ALPN          []string `json:"alpn,omitempty"`
+	ProxyProtocol bool     `json:"proxyProtocol,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+func (hb *HBone) debugListeners() interface{} {
+	hb.m.RLock()
+	defer hb.m.RUnlock()
+	res := []*ListenerInfo{}
+	for n, l := range hb.Listeners {
+		li := &ListenerInfo{Name: n, Address: l.Address, Protocol: l.Protocol, ForwardTo: l.ForwardTo,
+			ALPN: l.ALPN, ProxyProtocol: l.ProxyProtocol}
+		if l.NetListener != nil {
+			li.Bound = l.NetListener.Addr().String()
+		}
+		if l.state.err != nil {
+			li.Error = l.state.err.Error()
+		}
+		res = append(res, li)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// CertInfo is the debug info for a certificate chain.
+type CertInfo struct {
+	// Name is "workload" or the listener and domain.
+	Name      string      `json:"name"`
+	ExpiresIn string      `json:"expiresIn"`
+	Chain     []*CertItem `json:"chain"`
+}
+
+// CertItem is one certificate in a chain.
+type CertItem struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	Serial    string    `json:"serial"`
+	DNS       []string  `json:"dns,omitempty"`
+	URIs      []string  `json:"uris,omitempty"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+}
+
+func (hb *HBone) debugCerts() interface{} {
+	res := []*CertInfo{}
+	if conf := hb.Auth.GenerateTLSConfigServer(); conf != nil {
+		var c *tls.Certificate
+		if len(conf.Certificates) > 0 {
+			c = &conf.Certificates[0]
+		} else if conf.GetCertificate != nil {
+			c, _ = conf.GetCertificate(&tls.ClientHelloInfo{})
+		}
+		if ci := certInfo("workload", c); ci != nil {
+			res = append(res, ci)
+		}
+	}
+	hb.m.RLock()
+	defer hb.m.RUnlock()
+	for n, l := range hb.Listeners {
+		for d, c := range l.state.certs {
+			if ci := certInfo(n+"/"+d, c); ci != nil {
+				res = append(res, ci)
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+func certInfo(name string, c *tls.Certificate) *CertInfo {
+	if c == nil || len(c.Certificate) == 0 {
+		return nil
+	}
+	ci := &CertInfo{Name: name}
+	for _, der := range c.Certificate {
+		x, err := x509.ParseCertificate(der)
+		if err != nil {
+			continue
+		}
+		it := &CertItem{Subject: x.Subject.String(), Issuer: x.Issuer.String(),
+			Serial: x.SerialNumber.String(), DNS: x.DNSNames,
+			NotBefore: x.NotBefore, NotAfter: x.NotAfter}
+		for _, u := range x.URIs {
+			it.URIs = append(it.URIs, u.String())
+		}
+		ci.Chain = append(ci.Chain, it)
+	}
+	if len(ci.Chain) > 0 {
+		ci.ExpiresIn = time.Until(ci.Chain[0].NotAfter).Round(time.Second).String()
+	}
+	return ci
+}
+
+// RedactedJSON returns the settings as a JSON map without secrets, for debug
+// output. Auth and AdminToken are removed, Env values and listener proxyAuth
+// are replaced.
+func (ms *MeshSettings) RedactedJSON() (map[string]interface{}, error) {
+	c := *ms
+	c.Auth = nil
+	c.AdminToken = ""
+	if ms.Env != nil {
+		c.Env = map[string]string{}
+		for k := range ms.Env {
+			c.Env[k] = redacted
+		}
+	}
+	b, err := json.Marshal(&c)
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]interface{}{}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, err
+	}
+	ls, _ := res["listeners"].(map[string]interface{})
+	for _, l := range ls {
+		if l, ok := l.(map[string]interface{}); ok && l["proxyAuth"] != nil {
+			l["proxyAuth"] = redacted
+		}
+	}
+	return res, nil
+}
+
+const redacted = "REDACTED"
+
+// ConfigDump returns the effective settings. Clusters are replaced with the
+// debug info - the config may include token providers and TLS configs.
+func (hb *HBone) ConfigDump() interface{} {
+	hb.m.RLock()
+	ms := *hb.MeshSettings
+	clusters := hb.clusterList()
+	hb.m.RUnlock()
+	ms.Clusters = nil
+
+	res, err := ms.RedactedJSON()
+	if err != nil {
+		return map[string]string{"error": err.Error()}
+	}
+	cl := map[string]*ClusterInfo{}
+	for _, c := range clusters {
+		cl[c.Addr] = NewClusterInfo(c)
+	}
+	res["clusters"] = cl
+	return res
+}
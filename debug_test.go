@@ -0,0 +1,150 @@
+package hbone
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDebug(t *testing.T) {
+	dir := t.TempDir()
+	writeCert(t, filepath.Join(dir, "example"), "example.com")
+
+	hb := New(nil, &MeshSettings{})
+	hb.Listeners = map[string]*Listener{
+		"ingress": {Address: "127.0.0.1:0", Protocol: "https",
+			Certs: map[string]string{"example.com": filepath.Join(dir, "example")}},
+	}
+
+	if _, err := hb.Listeners["ingress"].TLSConfig(hb); err != nil {
+		t.Fatal(err)
+	}
+	hb.AddService(&Cluster{Addr: "echo.test.svc:8080", TokenSource: "k8s"},
+		&Endpoint{Address: "10.0.0.1:8080"})
+
+	mux := http.NewServeMux()
+	hb.HandleDebug(mux)
+	get := func(path string, v interface{}) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != 200 {
+			t.Fatal(path, w.Code)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatal(path, err, w.Body.String())
+		}
+	}
+
+	var clusters []*ClusterInfo
+	get("/debug/clusters", &clusters)
+	if len(clusters) != 1 || clusters[0].Addr != "echo.test.svc:8080" || clusters[0].TokenSource != "k8s" ||
+		len(clusters[0].Endpoints) != 1 {
+		t.Error("Unexpected clusters", clusters)
+	}
+
+	var listeners []*ListenerInfo
+	get("/debug/listeners", &listeners)
+	if len(listeners) != 1 || listeners[0].Name != "ingress" || listeners[0].Protocol != "https" {
+		t.Error("Unexpected listeners", listeners)
+	}
+
+	var certs []*CertInfo
+	get("/debug/certs", &certs)
+	found := false
+	for _, c := range certs {
+		if c.Name == "ingress/example.com" {
+			found = true
+			if len(c.Chain) != 1 || c.Chain[0].DNS[0] != "example.com" || c.ExpiresIn == "" {
+				t.Error("Unexpected cert", c)
+			}
+		}
+	}
+	if !found {
+		t.Error("Missing listener cert", certs)
+	}
+
+	var conns []*ConnInfo
+	get("/debug/connections", &conns)
+	var streams []interface{}
+	get("/debug/streams", &streams)
+
+	hb.Listeners["proxy"] = &Listener{Address: "-", Protocol: "http_proxy", ProxyAuth: "user:secret"}
+	hb.Env["TOKEN"] = "secret"
+	hb.AdminToken = "secret"
+	dump := map[string]interface{}{}
+	get("/debug/config_dump", &dump)
+	if cl, ok := dump["clusters"].(map[string]interface{}); !ok || cl["echo.test.svc:8080"] == nil {
+		t.Error("Unexpected config dump", dump)
+	}
+	if b, _ := json.Marshal(dump); strings.Contains(string(b), "secret") {
+		t.Error("Config dump includes secrets", string(b))
+	}
+	if hb.Auth == nil || hb.GetCluster("echo.test.svc:8080") == nil ||
+		hb.Listeners["proxy"].ProxyAuth != "user:secret" || hb.Env["TOKEN"] != "secret" {
+		t.Error("Config dump modified the settings")
+	}
+}
+
+func TestDebugConcurrent(t *testing.T) {
+	ca := newTestCA(t)
+	app := serveTest(t, func(c net.Conn) {
+		io.Copy(c, c)
+		c.Close()
+	})
+	_, appPort, _ := net.SplitHostPort(app.Addr().String())
+
+	bob := New(ca.auth(t, "test", "bob"), &MeshSettings{Namespace: "test",
+		Ports: map[string]string{"tcp": "9000:" + appPort}})
+	bobAddr := serveTest(t, bob.HandleAcceptedH2).Addr().String()
+
+	alice := New(ca.auth(t, "test", "alice"), &MeshSettings{Namespace: "test"})
+	alice.AddService(&Cluster{Addr: "bob.test.svc:9000"},
+		&Endpoint{Address: "bob.test.svc:9000", HBoneAddress: bobAddr})
+
+	muxes := []*http.ServeMux{http.NewServeMux(), http.NewServeMux()}
+	alice.HandleDebug(muxes[0])
+	bob.HandleDebug(muxes[1])
+
+	// The debug handlers run while connections are dialed and streams
+	// transfer data - run with -race.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for _, mux := range muxes {
+				for _, p := range []string{"/debug/clusters", "/debug/connections", "/debug/streams"} {
+					w := httptest.NewRecorder()
+					mux.ServeHTTP(w, httptest.NewRequest("GET", p, nil))
+					if w.Code != 200 {
+						t.Error(p, w.Code)
+					}
+				}
+			}
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		nc, err := alice.DialContext(context.Background(), "tcp", "bob.test.svc:9000")
+		checkEcho(t, nc, err)
+	}
+	close(done)
+	wg.Wait()
+
+	c := NewClusterInfo(alice.GetCluster("bob.test.svc:9000"))
+	if len(c.Connections) != 1 || c.Connections[0].Conn == nil || c.Connections[0].Start.IsZero() {
+		t.Error("Unexpected cluster connections", c.Connections)
+	}
+}
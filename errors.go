@@ -0,0 +1,294 @@
+package hbone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/costinm/hbone/h2"
+)
+
+// Error signalling for CONNECT and POST streams.
+//
+// Failures before the stream is established are reported with a HTTP status
+// and a Proxy-Status header (RFC 9209):
+// - 403 - denied by policy or port not declared
+// - 502 - connection refused, DNS or other dial errors
+// - 503 - server overloaded
+// - 504 - connect timeout
+//
+// Failures after the 200 was sent reset the stream with CONNECT_ERROR.
+//
+// Only the error type and generic details are sent to the peer - dial errors
+// may include local addresses and are logged.
+//
+// On the client, Cluster.Dial returns a *ProxyError with the status and
+// details, or status 0 if the stream was reset before the response.
+
+// HeaderProxyStatus is the RFC 9209 response header.
+const HeaderProxyStatus = "proxy-status"
+
+// Proxy-Status error types, from RFC 9209.
+const (
+	ProxyErrDenied                 = "http_request_denied"
+	ProxyErrRequest                = "http_request_error"
+	ProxyErrConnectionRefused      = "connection_refused"
+	ProxyErrConnectionTimeout      = "connection_timeout"
+	ProxyErrConnectionLimit        = "connection_limit_reached"
+	ProxyErrDNS                    = "dns_error"
+	ProxyErrDNSTimeout             = "dns_timeout"
+	ProxyErrDestinationUnavailable = "destination_unavailable"
+)
+
+// errOverloaded is returned when the server is shedding load.
+var errOverloaded = errors.New("server overloaded")
+
+// ProxyError is returned when dialing a stream is rejected by the proxy or
+// the destination.
+type ProxyError struct {
+	// Status is the HTTP status, 0 if the stream was reset before the
+	// response headers.
+	Status int
+
+	// Proxy, ErrorType and Details are from the Proxy-Status header, if set.
+	Proxy     string
+	ErrorType string
+	Details   string
+}
+
+func (e *ProxyError) Error() string {
+	s := "hbone: status " + strconv.Itoa(e.Status)
+	if e.Status == 0 {
+		s = "hbone: stream reset"
+	}
+	if e.ErrorType != "" {
+		s += " " + e.ErrorType
+	}
+	if e.Proxy != "" {
+		s += " from " + e.Proxy
+	}
+	if e.Details != "" {
+		s += ": " + e.Details
+	}
+	return s
+}
+
+// Temporary returns true if the error is likely to go away on retry, possibly
+// using a different endpoint.
+func (e *ProxyError) Temporary() bool {
+	return e.Status == 0 || e.Status == http.StatusServiceUnavailable
+}
+
+// newProxyError creates the error for a non-200 response. Streams reset
+// before the response headers have status 0.
+func newProxyError(res *http.Response) *ProxyError {
+	pe := &ProxyError{Status: res.StatusCode}
+	if res.StatusCode == 0 {
+		pe.ErrorType, pe.Details = resetError(res.Body)
+		return pe
+	}
+	ParseProxyStatus(res.Header.Get(HeaderProxyStatus), pe)
+	return pe
+}
+
+// resetError returns the Proxy-Status error type and details for a stream
+// without response headers. Streams the server didn't process - refused
+// or rejected by GOAWAY - are reported as connection_limit_reached.
+func resetError(body io.Reader) (string, string) {
+	s, ok := body.(*h2.H2Stream)
+	if !ok {
+		return ProxyErrDestinationUnavailable, ""
+	}
+	code, reset := s.ResetCode()
+	switch {
+	case s.Unprocessed() && reset:
+		return ProxyErrConnectionLimit, "stream reset: " + code.String()
+	case s.Unprocessed():
+		return ProxyErrConnectionLimit, "connection draining"
+	case reset:
+		return ProxyErrDestinationUnavailable, "stream reset: " + code.String()
+	}
+	return ProxyErrDestinationUnavailable, ""
+}
+
+// ParseProxyStatus sets the proxy, error type and details from the first
+// member of a Proxy-Status header with an error.
+func ParseProxyStatus(h string, pe *ProxyError) {
+	for _, m := range splitQuoted(h, ',') {
+		parts := splitQuoted(m, ';')
+		params := map[string]string{}
+		for _, p := range parts[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) == 2 {
+				params[kv[0]] = unquote(kv[1])
+			}
+		}
+		if params["error"] == "" {
+			continue
+		}
+		pe.Proxy = unquote(strings.TrimSpace(parts[0]))
+		pe.ErrorType = params["error"]
+		pe.Details = params["details"]
+		return
+	}
+}
+
+// splitQuoted splits s on sep, ignoring separators inside quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var res []string
+	inQ, esc, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case esc:
+			esc = false
+		case s[i] == '\\' && inQ:
+			esc = true
+		case s[i] == '"':
+			inQ = !inQ
+		case s[i] == sep && !inQ:
+			res = append(res, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(res, s[start:])
+}
+
+func unquote(v string) string {
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return v
+	}
+	v = v[1 : len(v)-1]
+	return strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(v)
+}
+
+// publicErrors can be sent to peers as details.
+var publicErrors = []error{errAuthzDenied, errOverloaded, errLocalDest}
+
+// publicDetails returns the details of an error that can be sent to peers.
+// Dial errors include local addresses and ports and are only logged - the
+// peer gets the error type. The details from the next hop are kept.
+func publicDetails(err error) string {
+	var pe *ProxyError
+	if errors.As(err, &pe) {
+		return pe.Details
+	}
+	for _, e := range publicErrors {
+		if errors.Is(err, e) {
+			return e.Error()
+		}
+	}
+	return ""
+}
+
+// errorText returns the response body for an error sent to a peer.
+func errorText(status int, err error) string {
+	if d := publicDetails(err); d != "" {
+		return d
+	}
+	return http.StatusText(status)
+}
+
+// proxyStatus returns the Proxy-Status header value, using sf-string
+// quoting for the details. Only the public details are included.
+func (hb *HBone) proxyStatus(errType string, err error) string {
+	name := hb.ServiceNode
+	if name == "" {
+		name = "hbone"
+	}
+	v := name + "; error=" + errType
+	if d := publicDetails(err); d != "" {
+		d = strings.Map(func(r rune) rune {
+			if r < 0x20 || r > 0x7e {
+				return ' '
+			}
+			return r
+		}, d)
+		d = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(d)
+		v += `; details="` + d + `"`
+	}
+	var pe *ProxyError
+	if errors.As(err, &pe) && pe.Status != 0 {
+		v += "; received-status=" + strconv.Itoa(pe.Status)
+	}
+	return v
+}
+
+// dialStatus maps a dial error to the HTTP status and Proxy-Status error type.
+func dialStatus(err error) (int, string) {
+	var pe *ProxyError
+	var dnsErr *net.DNSError
+	var ne net.Error
+	switch {
+	case errors.Is(err, errAuthzDenied), errors.Is(err, errLocalDest):
+		return http.StatusForbidden, ProxyErrDenied
+	case errors.Is(err, errOverloaded):
+		return http.StatusServiceUnavailable, ProxyErrConnectionLimit
+	case errors.As(err, &pe):
+		// Error from the next hop, in gateway mode.
+		if pe.Status == 0 {
+			return http.StatusBadGateway, ProxyErrDestinationUnavailable
+		}
+		t := pe.ErrorType
+		if t == "" {
+			t = ProxyErrDestinationUnavailable
+		}
+		return pe.Status, t
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsTimeout {
+			return http.StatusGatewayTimeout, ProxyErrDNSTimeout
+		}
+		return http.StatusBadGateway, ProxyErrDNS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return http.StatusGatewayTimeout, ProxyErrConnectionTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return http.StatusBadGateway, ProxyErrConnectionRefused
+	}
+	return http.StatusBadGateway, ProxyErrDestinationUnavailable
+}
+
+// streamError responds with the status and a Proxy-Status header, and closes
+// the stream. Must be called before the response headers are sent. The error
+// is logged, the peer only gets the public details.
+func (hb *HBone) streamError(stream *h2.H2Stream, status int, errType string, err error) {
+	if err != nil {
+		hb.log.Info("Stream error", "stream", stream.Id, "peer", stream.Peer,
+			"status", status, "type", errType, "err", err)
+	}
+	stream.Response.Header.Set(HeaderProxyStatus, hb.proxyStatus(errType, err))
+	stream.WriteHeader(status)
+	stream.Write([]byte(errorText(status, err)))
+	stream.CloseWrite()
+	stream.Close()
+}
+
+// denyStream responds with 403 and closes the stream.
+func (hb *HBone) denyStream(stream *h2.H2Stream, err error) {
+	hb.streamError(stream, http.StatusForbidden, ProxyErrDenied, err)
+}
+
+// dialError responds with the status matching a dial error.
+func (hb *HBone) dialError(stream *h2.H2Stream, err error) {
+	status, t := dialStatus(err)
+	hb.streamError(stream, status, t, err)
+}
+
+// checkResponse returns a *ProxyError if the response to a CONNECT or POST
+// is not 200. The response body is closed.
+func checkResponse(res *http.Response) error {
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+	if res.Body != nil {
+		res.Body.Close()
+	}
+	if res.Request == nil {
+		return newProxyError(res)
+	}
+	return fmt.Errorf("dial %s: %w", res.Request.Host, newProxyError(res))
+}
@@ -0,0 +1,78 @@
+package hbone
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestProxyStatus(t *testing.T) {
+	hb := New(nil, &MeshSettings{ServiceNode: "gw-1"})
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+	_, err := net.Dial("tcp", addr)
+	if status, typ := dialStatus(err); status != http.StatusBadGateway || typ != ProxyErrConnectionRefused {
+		t.Fatal("Unexpected status for refused", status, typ, err)
+	}
+	if status, _ := dialStatus(errAuthzDenied); status != http.StatusForbidden {
+		t.Fatal("Unexpected status for denied", status)
+	}
+	if status, _ := dialStatus(errOverloaded); status != http.StatusServiceUnavailable {
+		t.Fatal("Unexpected status for overload", status)
+	}
+
+	res := &http.Response{StatusCode: http.StatusBadGateway, Header: http.Header{},
+		Request: &http.Request{Host: "10.1.1.1:8080"}}
+	// Local dial errors are not sent.
+	if ps := hb.proxyStatus(ProxyErrConnectionRefused, err); ps != "gw-1; error=connection_refused" {
+		t.Fatal("Unexpected details", ps)
+	}
+	if d := errorText(http.StatusBadGateway, err); d != "Bad Gateway" {
+		t.Fatal("Unexpected body", d)
+	}
+
+	// Details from the next hop are kept.
+	res.Header.Set(HeaderProxyStatus, hb.proxyStatus(ProxyErrConnectionRefused,
+		&ProxyError{Status: 502, Details: `dial "a;b", refused`}))
+	err = checkResponse(res)
+	var pe *ProxyError
+	if !errors.As(err, &pe) {
+		t.Fatal("Expecting ProxyError", err)
+	}
+	if pe.Status != 502 || pe.Proxy != "gw-1" || pe.ErrorType != ProxyErrConnectionRefused ||
+		pe.Details != `dial "a;b", refused` {
+		t.Fatalf("Unexpected error %#v", pe)
+	}
+
+	// Gateway: the status from the next hop is kept.
+	if status, typ := dialStatus(pe); status != 502 || typ != ProxyErrConnectionRefused {
+		t.Fatal("Unexpected status for next hop", status, typ)
+	}
+}
+
+func TestStreamReset(t *testing.T) {
+	ca := newTestCA(t)
+	// Always shedding load - streams are refused before the headers.
+	srv := New(ca.auth(t, "test", "srv"), &MeshSettings{Namespace: "test",
+		Limits: ServerLimits{MaxGoroutines: 1}})
+	srvAddr := serveTest(t, srv.HandleAcceptedH2).Addr().String()
+
+	client := New(ca.auth(t, "test", "client"), &MeshSettings{Namespace: "test"})
+	client.AddService(&Cluster{Addr: "srv.test.svc:8080"},
+		&Endpoint{Address: "srv.test.svc:8080", HBoneAddress: srvAddr})
+
+	_, err := client.DialContext(context.Background(), "tcp", "srv.test.svc:8080")
+	var pe *ProxyError
+	if !errors.As(err, &pe) {
+		t.Fatal("Expecting ProxyError", err)
+	}
+	if pe.Status != 0 || pe.ErrorType != ProxyErrConnectionLimit || !pe.Temporary() ||
+		!strings.Contains(pe.Details, "REFUSED_STREAM") {
+		t.Errorf("Unexpected error %#v", pe)
+	}
+}
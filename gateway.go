@@ -0,0 +1,177 @@
+package hbone
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/costinm/hbone/h2"
+)
+
+// Gateway mode: CONNECT streams for destinations that are not local are
+// forwarded using the clusters - re-originating HBONE if the destination is
+// a known cluster, or plain TCP otherwise. This is the 'east-west gateway'
+// or PEP role.
+//
+// The peer is authorized for the destination before dialing. If the upstream
+// is using mTLS, the policies are evaluated again with the destination
+// identity (destination.principal and destination.namespace conditions).
+//
+// Destinations on the node itself - by name or IP - are never dialed
+// directly: they are handled as local streams, using the declared ports.
+
+// isLocalDest returns true if the host of a CONNECT authority is this node:
+// empty, localhost, the hostname, a loopback IP or one of the IPs of the node.
+func isLocalDest(stream *h2.H2Stream, hostPort string) bool {
+	return isLocalAddr(stream.Conn().LocalAddr(), hostPort)
+}
+
+// isLocalAddr is isLocalDest for a connection accepted on local. Names are
+// not resolved - dialRemote rejects other names resolving to the node.
+func isLocalAddr(local net.Addr, hostPort string) bool {
+	host := hostPort
+	if h, _, err := net.SplitHostPort(hostPort); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		hn, _ := os.Hostname()
+		return strings.EqualFold(host, strings.TrimSuffix(hn, "."))
+	}
+	return isLocalIP(local, ip)
+}
+
+// isLocalIP returns true for loopback and unspecified IPs, the IP the
+// connection was accepted on and the IPs of the node.
+func isLocalIP(local net.Addr, ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	if ta, ok := local.(*net.TCPAddr); ok && ta.IP.Equal(ip) {
+		return true
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// errLocalDest is returned for gateway destinations resolving to the node -
+// local ports are only reachable if declared, using ResolvePort.
+var errLocalDest = errors.New("destination is local")
+
+// dialRemote dials a gateway destination that is not a cluster, using plain
+// TCP. The name is resolved first, and rejected if any of the IPs is local.
+// The resolved IPs are dialed, so the check can't be bypassed by returning
+// a different answer to the dialer.
+func (hb *HBone) dialRemote(ctx context.Context, local net.Addr, hostPort string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if isLocalIP(local, ip.IP) {
+			return nil, errLocalDest
+		}
+	}
+	d := &net.Dialer{Timeout: hb.ConnectTimeout.Duration}
+	for _, ip := range ips {
+		var nc net.Conn
+		nc, err = d.DialContext(ctx, "tcp", net.JoinHostPort(ip.IP.String(), port))
+		if err == nil {
+			return nc, nil
+		}
+	}
+	return nil, err
+}
+
+// gatewayStream forwards a CONNECT stream to a non-local destination.
+func (hb *HBone) gatewayStream(st *h2.H2Transport, stream *h2.H2Stream, log *slog.Logger) {
+	host := stream.Request.Host
+
+	req := streamAuthzRequest(stream, "")
+	req.Gateway = true
+	if err := hb.authorizeRequest(stream, req); err != nil {
+		hb.denyStream(stream, err)
+		return
+	}
+
+	log.Info("Gateway-START", "host", host)
+	nc, dest, err := hb.dialGateway(stream, host)
+	if err != nil {
+		log.Warn("Gateway dial error", "dest", host, "err", err)
+		hb.dialError(stream, err)
+		return
+	}
+
+	req.Destination = dest
+	if err := hb.authorizeRequest(stream, req); err != nil {
+		nc.Close()
+		hb.denyStream(stream, err)
+		return
+	}
+
+	snc := acceptFraming(stream)
+	stream.Response.Status = "200"
+	stream.Response.Header.Add("x-status", "200")
+	st.WriteHeader(stream)
+
+	proxyErr := hb.Proxy(nc, snc, snc, host)
+	log.Info("Gateway-END", "host", host, "dest", dest, "err", proxyErr)
+}
+
+// dialGateway connects to a non-local destination. Returns the identity of
+// the upstream - empty if it is not using mTLS. The dial is canceled if the
+// stream is closed.
+func (hb *HBone) dialGateway(stream *h2.H2Stream, host string) (net.Conn, *h2.PeerMetadata, error) {
+	ctx := stream.Context()
+	dest := &h2.PeerMetadata{}
+	c := hb.GetCluster(host)
+	if c == nil {
+		c = hb.h2rCluster(host)
+	}
+	if c == nil {
+		nc, err := hb.dialRemote(ctx, stream.Conn().LocalAddr(), host)
+		return nc, dest, err
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, "CONNECT", "https://"+host, nil)
+	req.Host = host
+	// The destination sees the gateway as peer - pass the original client.
+	if ip := hb.originalSource(stream); ip != nil {
+		if ip.To4() == nil {
+			req.Header.Set("forwarded", "for=\"["+ip.String()+"]\"")
+		} else {
+			req.Header.Set("forwarded", "for="+ip.String())
+		}
+	}
+	epc, nc, err := c.dial(ctx, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tc, ok := nc.(*tls.Conn); ok {
+		// Tunnel over an untrusted proxy - the inner mTLS is the destination.
+		cs := tc.ConnectionState()
+		dest.SetTLSPeer(&cs)
+	} else if tc, ok := epc.tlsCon.(*tls.Conn); ok {
+		cs := tc.ConnectionState()
+		dest.SetTLSPeer(&cs)
+	}
+	return nc, dest, nil
+}
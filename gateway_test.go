@@ -0,0 +1,118 @@
+package hbone
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/costinm/hbone/h2"
+)
+
+func TestGateway(t *testing.T) {
+	ca := newTestCA(t)
+	app := serveTest(t, func(c net.Conn) {
+		io.Copy(c, c)
+		c.Close()
+	})
+	_, appPort, _ := net.SplitHostPort(app.Addr().String())
+
+	bob := New(ca.auth(t, "test", "bob"), &MeshSettings{Namespace: "test",
+		Ports: map[string]string{"tcp": "9000:" + appPort}})
+	bobAddr := serveTest(t, bob.HandleAcceptedH2).Addr().String()
+
+	gw := New(ca.auth(t, "test", "gw"), &MeshSettings{Namespace: "test", Gateway: true})
+	gw.AddService(&Cluster{Addr: "bob.test.svc:9000"},
+		&Endpoint{Address: "bob.test.svc:9000", HBoneAddress: bobAddr})
+	gwAddr := serveTest(t, gw.HandleAcceptedH2).Addr().String()
+
+	alice := New(ca.auth(t, "test", "alice"), &MeshSettings{Namespace: "test"})
+	for _, h := range []string{"bob.test.svc:9000", "nope.invalid:80"} {
+		alice.AddService(&Cluster{Addr: h}, &Endpoint{Address: h, HBoneAddress: gwAddr})
+	}
+	ctx := context.Background()
+
+	t.Run("cluster", func(t *testing.T) {
+		// Streams are closed after each echo - the upstream connection is
+		// shared and stays usable.
+		for i := 0; i < 3; i++ {
+			nc, err := alice.DialContext(ctx, "tcp", "bob.test.svc:9000")
+			checkEcho(t, nc, err)
+		}
+		c := gw.GetCluster("bob.test.svc:9000")
+		if len(c.EndpointCon) != 1 {
+			t.Fatal("Expecting one upstream connection", len(c.EndpointCon))
+		}
+		ct, ok := c.EndpointCon[0].rt.(*h2.H2ClientTransport)
+		if !ok || !ct.CanTakeNewRequest() {
+			t.Error("Upstream connection closed with the stream")
+		}
+	})
+
+	t.Run("dial-error", func(t *testing.T) {
+		nc, err := alice.DialContext(ctx, "tcp", "nope.invalid:80")
+		if err == nil {
+			defer nc.Close()
+			nc.SetDeadline(time.Now().Add(5 * time.Second))
+			nc.Write([]byte("hello"))
+			_, err = nc.Read(make([]byte, 5))
+		}
+		var pe *ProxyError
+		if !errors.As(err, &pe) || pe.Status != http.StatusBadGateway || pe.ErrorType != ProxyErrDNS {
+			t.Error("Expecting DNS error from the gateway", err)
+		}
+	})
+
+	t.Run("local", func(t *testing.T) {
+		// The gateway has no declared ports - names for the node are
+		// local and rejected.
+		for _, h := range []string{"LOCALHOST.:" + appPort, "a.localhost:" + appPort} {
+			alice.AddService(&Cluster{Addr: h}, &Endpoint{Address: h, HBoneAddress: gwAddr})
+			nc, err := alice.DialContext(ctx, "tcp", h)
+			if err == nil {
+				nc.SetDeadline(time.Now().Add(5 * time.Second))
+				nc.Write([]byte("hello"))
+				_, err = nc.Read(make([]byte, 5))
+				nc.Close()
+			}
+			var pe *ProxyError
+			if !errors.As(err, &pe) || pe.Status != http.StatusForbidden {
+				t.Error("Expecting local destination to be denied", h, err)
+			}
+		}
+	})
+}
+
+func TestIsLocalAddr(t *testing.T) {
+	hn, _ := os.Hostname()
+	for _, h := range []string{"", "localhost:80", "LOCALHOST", "localhost.:80", "a.localhost:80",
+		"127.0.0.2:80", "[::1]:80", "0.0.0.0:80", strings.ToUpper(hn) + ".:80"} {
+		if !isLocalAddr(nil, h) {
+			t.Error("Expecting local", h)
+		}
+	}
+	if isLocalAddr(nil, "example.com:80") || isLocalAddr(nil, "10.255.1.1:80") {
+		t.Error("Expecting not local")
+	}
+}
+
+func TestDialRemote(t *testing.T) {
+	hb := New(nil, &MeshSettings{Gateway: true})
+	app := serveTest(t, func(c net.Conn) { c.Close() })
+	_, port, _ := net.SplitHostPort(app.Addr().String())
+	// Names resolving to the node are rejected - even if not detected as
+	// local before resolving.
+	for _, h := range []string{"localhost", "127.0.0.1", "::1"} {
+		if _, err := hb.dialRemote(context.Background(), nil, net.JoinHostPort(h, port)); !errors.Is(err, errLocalDest) {
+			t.Error("Expecting local destination error", h, err)
+		}
+	}
+	if s, _ := dialStatus(errLocalDest); s != http.StatusForbidden {
+		t.Error("Unexpected status", s)
+	}
+}
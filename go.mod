@@ -1,6 +1,6 @@
 module github.com/costinm/hbone
 
-go 1.19
+go 1.21
 
 replace github.com/costinm/meshauth => ../meshauth
 
@@ -10,3 +10,5 @@ require (
 	github.com/costinm/meshauth v0.0.0-20221013185453-bb5aae6632f8
 	golang.org/x/net v0.1.0
 )
+
+require golang.org/x/text v0.4.0 // indirect
@@ -21,7 +21,6 @@ package h2
 import (
 	"bytes"
 	"fmt"
-	"log"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -626,7 +625,7 @@ func (l *loopyWriter) headerHandler(h *headerFrame) error {
 	if l.side == serverSide && h.streamID%2 == 1 {
 		str, ok := l.estdStreams[h.streamID]
 		if !ok {
-			log.Printf("transport: loopy doesn't recognize the stream: %d", h.streamID)
+			l.mux.Log.Warn("transport: loopy doesn't recognize the stream", "stream", h.streamID)
 			return nil
 		}
 		// Case 1.A: Server is responding back with headers.
@@ -676,7 +675,7 @@ func (l *loopyWriter) writeHeader(streamID uint32, endStream bool, hf []hpack.He
 	l.hBuf.Reset()
 	for _, f := range hf {
 		if err := l.hEnc.WriteField(f); err != nil {
-			log.Printf("transport: loopyWriter.writeHeader encountered error while encoding headers: %v", err)
+			l.mux.Log.Warn("transport: loopyWriter.writeHeader encountered error while encoding headers", "stream", streamID, "err", err)
 		}
 	}
 	var (
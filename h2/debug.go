@@ -0,0 +1,138 @@
+package h2
+
+import (
+	"crypto/tls"
+	"sync/atomic"
+	"time"
+)
+
+// TransportInfo is a snapshot of the state of a connection, for debug
+// endpoints.
+type TransportInfo struct {
+	ID     uint64    `json:"id"`
+	Server bool      `json:"server"`
+	Remote string    `json:"remote,omitempty"`
+	Local  string    `json:"local,omitempty"`
+	ALPN   string    `json:"alpn,omitempty"`
+	Start  time.Time `json:"start"`
+
+	// LastRead is the time of the last frame received.
+	LastRead time.Time `json:"lastRead,omitempty"`
+
+	ActiveStreams    int   `json:"activeStreams"`
+	StreamsStarted   int64 `json:"streamsStarted"`
+	StreamsSucceeded int64 `json:"streamsSucceeded"`
+	StreamsFailed    int64 `json:"streamsFailed"`
+
+	// SendWindow is the connection-level send flow control window, -1 if the
+	// connection is closed.
+	SendWindow int64 `json:"sendWindow"`
+
+	// MaxStreams is the max concurrent streams - set by the peer for client
+	// connections, by this side for server connections.
+	MaxStreams uint32 `json:"maxStreams,omitempty"`
+
+	Closing bool `json:"closing,omitempty"`
+}
+
+// StreamInfo is a snapshot of the state of a stream.
+type StreamInfo struct {
+	Conn   uint64        `json:"conn"`
+	ID     uint32        `json:"id"`
+	Method string        `json:"method,omitempty"`
+	Host   string        `json:"host,omitempty"`
+	Path   string        `json:"path,omitempty"`
+	Peer   *PeerMetadata `json:"peer,omitempty"`
+	Open   time.Time     `json:"open"`
+
+	SentBytes int64 `json:"sentBytes"`
+	RcvdBytes int64 `json:"rcvdBytes"`
+
+	// SendQuota is the remaining send window, RecvWindow and RecvPending
+	// the receive window and the data not yet read by the app.
+	SendQuota   int32  `json:"sendQuota"`
+	RecvWindow  uint32 `json:"recvWindow"`
+	RecvPending uint32 `json:"recvPending"`
+
+	ReadClosed  bool `json:"readClosed,omitempty"`
+	WriteClosed bool `json:"writeClosed,omitempty"`
+}
+
+// Info returns a snapshot of the connection state.
+func (t *H2Transport) Info() *TransportInfo {
+	ti := &TransportInfo{
+		ID:               t.connectionID,
+		Server:           t.IsServer(),
+		Start:            t.StartTime,
+		StreamsStarted:   atomic.LoadInt64(&t.streamsStarted),
+		StreamsSucceeded: atomic.LoadInt64(&t.streamsSucceeded),
+		StreamsFailed:    atomic.LoadInt64(&t.streamsFailed),
+		SendWindow:       t.getOutFlowWindow(),
+	}
+	if lr := atomic.LoadInt64(&t.LastRead); lr != 0 {
+		ti.LastRead = time.Unix(0, lr)
+	}
+	if t.conn != nil {
+		ti.Remote = t.conn.RemoteAddr().String()
+		ti.Local = t.conn.LocalAddr().String()
+		if tc, ok := t.conn.(*tls.Conn); ok {
+			ti.ALPN = tc.ConnectionState().NegotiatedProtocol
+		}
+	}
+	t.mu.Lock()
+	ti.ActiveStreams = len(t.activeStreams)
+	ti.Closing = t.closing
+	t.mu.Unlock()
+	ti.MaxStreams = t.maxStreams
+	return ti
+}
+
+// StreamsInfo returns a snapshot of the active streams.
+func (t *H2Transport) StreamsInfo() []*StreamInfo {
+	t.mu.Lock()
+	// The peer and the flow control state are set after the stream is
+	// added, with the lock held.
+	type active struct {
+		s    *H2Stream
+		peer *PeerMetadata
+		out  *writeQuota
+		in   *inFlow
+	}
+	streams := make([]active, 0, len(t.activeStreams))
+	for _, s := range t.activeStreams {
+		streams = append(streams, active{s, s.Peer, s.outFlow, s.inFlow})
+	}
+	t.mu.Unlock()
+
+	res := make([]*StreamInfo, 0, len(streams))
+	for _, a := range streams {
+		s := a.s
+		si := &StreamInfo{
+			Conn:        t.connectionID,
+			ID:          s.Id,
+			Peer:        a.peer,
+			Open:        s.Open,
+			SentBytes:   atomic.LoadInt64(&s.SentBytes),
+			RcvdBytes:   atomic.LoadInt64(&s.RcvdBytes),
+			ReadClosed:  atomic.LoadUint32(&s.readClosed) != 0,
+			WriteClosed: atomic.LoadUint32(&s.writeClosed) != 0,
+		}
+		if r := s.Request; r != nil {
+			si.Method = r.Method
+			si.Host = r.Host
+			if r.URL != nil {
+				si.Path = r.URL.Path
+			}
+		}
+		if a.out != nil {
+			si.SendQuota = atomic.LoadInt32(&a.out.quota)
+		}
+		if f := a.in; f != nil {
+			f.mu.Lock()
+			si.RecvWindow, si.RecvPending = f.limit, f.pendingData
+			f.mu.Unlock()
+		}
+		res = append(res, si)
+	}
+	return res
+}
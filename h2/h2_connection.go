@@ -23,7 +23,7 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math"
 	"net"
 	"net/http"
@@ -166,6 +166,10 @@ type H2Transport struct {
 
 	// Time of the accept() or dial
 	StartTime time.Time
+
+	// Log is the logger for the transport, with the connection ID and side
+	// as attributes. Set from H2Config.Logger, defaults to h2.Log.
+	Log *slog.Logger
 }
 
 // H2ClientTransport implements the ClientTransport interface with HTTP2.
@@ -243,6 +247,7 @@ func NewConnection(ctx context.Context, opts H2Config) (_ *H2ClientTransport, er
 		nextID:                1,
 		StartTime:             time.Now(),
 		opts:                  &opts,
+		Log:                   opts.logger(),
 	}
 
 	t := &H2ClientTransport{
@@ -370,6 +375,7 @@ func (t *H2ClientTransport) StartConn(conn net.Conn) (err error) {
 	}
 
 	t.connectionID = atomic.AddUint64(&clientConnectionCounter, 1)
+	t.Log = t.Log.With("conn", t.connectionID, "side", "client")
 
 	if err := t.framer.writer.Flush(); err != nil {
 		t.Close(err)
@@ -379,7 +385,7 @@ func (t *H2ClientTransport) StartConn(conn net.Conn) (err error) {
 	go func() {
 		err := t.loopy.run()
 		if err != nil {
-			log.Printf("transport: loopyWriter.run returning. Err: %v", err)
+			t.Log.Debug("transport: loopyWriter.run returning", "err", err)
 		}
 		// Do not close the transport.  Let reader goroutine handle it since
 		// there might be data in the buffers.
@@ -795,8 +801,8 @@ func (t *H2Transport) handleData(f *frame.DataFrame) {
 			//buffer.Reset()
 			//buffer.Write(f.Data())
 
-			s.RcvdBytes += len(f.Data())
-			s.RcvdPackets++
+			atomic.AddInt64(&s.RcvdBytes, int64(len(f.Data())))
+			atomic.AddInt64(&s.RcvdPackets, 1)
 			s.LastRead = time.Now()
 			s.inFrameList.Put(nio.RecvMsg{Buffer: bytes.NewBuffer(f.Data())})
 		}
@@ -829,6 +835,9 @@ func (t *H2Transport) handleRSTStream(f *frame.RSTStreamFrame) {
 		atomic.StoreUint32(&s.unprocessed, 1)
 	}
 
+	s.rstCode = f.ErrCode
+	atomic.StoreUint32(&s.rstReceived, 1)
+
 	statusCode, ok := http2ErrConvTab[f.ErrCode]
 	if !ok {
 		statusCode = Unknown
@@ -1076,7 +1085,7 @@ func (t *H2Transport) operateResponseHeaders(f *frame.MetaHeadersFrame) {
 			if trailer {
 				v, err := decodeMetadataHeader(hf.Name, hf.Value)
 				if err != nil {
-					log.Printf("Failed to decode metadata header (%q, %q): %v", hf.Name, hf.Value, err)
+					t.Log.Warn("Failed to decode metadata trailer", "stream", s.Id, "name", hf.Name, "value", hf.Value, "err", err)
 					break
 				}
 				s.Response.Trailer.Add(hf.Name, v)
@@ -1086,7 +1095,7 @@ func (t *H2Transport) operateResponseHeaders(f *frame.MetaHeadersFrame) {
 				}
 				v, err := decodeMetadataHeader(hf.Name, hf.Value)
 				if err != nil {
-					log.Printf("Failed to decode metadata header (%q, %q): %v", hf.Name, hf.Value, err)
+					t.Log.Warn("Failed to decode metadata header", "stream", s.Id, "name", hf.Name, "value", hf.Value, "err", err)
 					break
 				}
 				s.Response.Header.Add(hf.Name, v)
@@ -1183,7 +1192,7 @@ func (t *H2ClientTransport) reader() {
 		case *frame.WindowUpdateFrame:
 			t.handleWindowUpdate(frame)
 		default:
-			log.Printf("transport: H2ClientTransport.reader got unhandled frame type %v.", frame)
+			t.Log.Warn("transport: H2ClientTransport.reader got unhandled frame type", "frame", frame)
 		}
 	}
 }
@@ -1301,6 +1310,12 @@ func (t *H2Transport) getOutFlowWindow() int64 {
 	}
 }
 
+// ConnectionID returns the ID of the connection, unique for the client or server
+// side. Used in logs and debug info.
+func (t *H2Transport) ConnectionID() uint64 {
+	return t.connectionID
+}
+
 func (t *H2Transport) Conn() net.Conn {
 	return t.conn
 }
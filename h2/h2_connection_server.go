@@ -24,7 +24,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"math"
 	"net"
 	"net/http"
@@ -191,6 +190,7 @@ func NewServerConnection(conn net.Conn, config *ServerConfig, ev *Events) (_ *H2
 		goAway:            make(chan struct{}),
 		nextID:            2,
 		StartTime:         time.Now(),
+		Log:               config.logger(),
 	}
 	t.Events.Add(*ev)
 
@@ -208,6 +208,7 @@ func NewServerConnection(conn net.Conn, config *ServerConfig, ev *Events) (_ *H2
 	}
 
 	t.connectionID = atomic.AddUint64(&serverConnectionCounter, 1)
+	t.Log = t.Log.With("conn", t.connectionID, "side", "server")
 	t.framer.writer.Flush()
 
 	defer func() {
@@ -234,7 +235,7 @@ func NewServerConnection(conn net.Conn, config *ServerConfig, ev *Events) (_ *H2
 	go func() {
 		t.loopy.ssGoAwayHandler = t.outgoingGoAwayHandler
 		if err := t.loopy.run(); err != nil {
-			log.Printf("transport: loopyWriter.run returning. Err: %v", err)
+			t.Log.Debug("transport: loopyWriter.run returning", "err", err)
 		}
 		t.conn.Close()
 		t.controlBuf.finish()
@@ -337,7 +338,7 @@ func (t *H2Transport) operateAcceptHeaders(rfr *frame.MetaHeadersFrame) error {
 			v, err := decodeMetadataHeader(hf.Name, hf.Value)
 			if err != nil {
 				headerError = true
-				log.Printf("Failed to decode metadata header (%q, %q): %v", hf.Name, hf.Value, err)
+				t.Log.Warn("Failed to decode metadata header", "stream", streamID, "name", hf.Name, "value", hf.Value, "err", err)
 				break
 			}
 			s.Request.Header.Add(hf.Name, v)
@@ -393,7 +394,10 @@ func (t *H2Transport) operateAcceptHeaders(rfr *frame.MetaHeadersFrame) error {
 		s.ctx, s.cancel = context.WithCancel(context.Background())
 	}
 	s.ctxDone = s.ctx.Done()
+	// The stream is active - StreamsInfo reads the quota with the lock held.
+	t.mu.Lock()
 	s.outFlow = newWriteQuota(defaultWriteQuota, s.ctxDone)
+	t.mu.Unlock()
 	s.inFrameList = nio.NewRecvBuffer(s.ctxDone, t.bufferPool.put, nil)
 	// Register the stream with loopy.
 	t.controlBuf.put(&registerStream{
@@ -424,7 +428,7 @@ func (t *H2Transport) HandleStreams() {
 		atomic.StoreInt64(&t.LastRead, time.Now().UnixNano())
 		if err != nil {
 			if se, ok := err.(frame.StreamError); ok {
-				log.Printf("transport: H2Transport.HandleStreams encountered http2.StreamError: %v", se)
+				t.Log.Info("transport: H2Transport.HandleStreams encountered http2.StreamError", "stream", se.StreamID, "err", se)
 
 				t.mu.Lock()
 				s := t.activeStreams[se.StreamID]
@@ -449,7 +453,7 @@ func (t *H2Transport) HandleStreams() {
 				t.Close(err)
 				return
 			}
-			log.Printf("transport: H2Transport.HandleStreams failed to readBlocking frame: %v", err)
+			t.Log.Warn("transport: H2Transport.HandleStreams failed to read frame", "err", err)
 
 			t.Close(err)
 			return
@@ -477,7 +481,7 @@ func (t *H2Transport) HandleStreams() {
 		case *frame.GoAwayFrame:
 			// TODO: Handle GoAway from the client appropriately.
 		default:
-			log.Printf("transport: H2Transport.HandleStreams found unhandled frame type %v.", tfr)
+			t.Log.Warn("transport: H2Transport.HandleStreams found unhandled frame type", "frame", tfr)
 		}
 	}
 }
@@ -575,7 +579,7 @@ func (t *H2Transport) handlePing(f *frame.PingFrame) {
 
 	if t.pingStrikes > maxPingStrikes {
 		// Send goaway and close the connection.
-		log.Printf("transport: Got too many pings from the client, closing the connection.")
+		t.Log.Warn("transport: Got too many pings from the client, closing the connection")
 
 		t.controlBuf.put(&goAway{code: frame.ErrCodeEnhanceYourCalm, debugData: []byte("too_many_pings"), closeConn: true})
 	}
@@ -602,7 +606,7 @@ func (t *H2Transport) checkForHeaderListSize(it interface{}) bool {
 	var sz int64
 	for _, f := range hdrFrame.hf {
 		if sz += int64(f.Size()); sz > int64(*t.maxSendHeaderListSize) {
-			log.Printf("header list size to send violates the maximum size (%d bytes) set by client", *t.maxSendHeaderListSize)
+			t.Log.Warn("header list size to send violates the maximum size set by client", "max", *t.maxSendHeaderListSize)
 
 			return false
 		}
@@ -730,7 +734,7 @@ func (t *H2Transport) Send(s *H2Stream, b []byte, start, end int, last bool) err
 	if last {
 		s.setWriteClosed(1)
 	}
-	s.SentPackets++
+	atomic.AddInt64(&s.SentPackets, 1)
 
 	data := b
 	df := &dataFrame{
@@ -757,6 +761,7 @@ func (t *H2Transport) Send(s *H2Stream, b []byte, start, end int, last bool) err
 			waitOrConsumeQuota(int32(dataLen)); err != nil {
 			return t.streamContextErr(s)
 		}
+		atomic.AddInt64(&s.SentBytes, int64(dataLen))
 	}
 
 	err := t.controlBuf.put(df)
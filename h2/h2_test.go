@@ -291,3 +291,19 @@ func checkSttreams(t *testing.T, serverStream *H2Stream, clientStream *H2Stream,
 	}
 	// TODO: verify stats, field status, events
 }
+
+func TestBaggage(t *testing.T) {
+	md := &PeerMetadata{Cluster: "c1", Namespace: "ns1", Workload: "wl", Service: "svc", Revision: "v1"}
+	b := md.Baggage()
+	if b != "k8s.cluster.name=c1,k8s.namespace.name=ns1,k8s.deployment.name=wl,service.name=svc,service.version=v1" {
+		t.Fatal(b)
+	}
+	p := ParseBaggage(b + ",other=x;prop=1")
+	if *p != (PeerMetadata{Cluster: "c1", Namespace: "ns1", Workload: "wl", WorkloadType: "deployment",
+		Service: "svc", Revision: "v1"}) {
+		t.Fatalf("%+v", p)
+	}
+	if ParseBaggage("other=x") != nil {
+		t.Fatal("Expecting nil for unknown keys")
+	}
+}
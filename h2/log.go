@@ -0,0 +1,14 @@
+package h2
+
+import "log/slog"
+
+// Log is the default logger for H2 transports, used if H2Config.Logger is not set.
+// Each transport adds the connection ID and side, streams add the stream ID.
+var Log = slog.Default().With("component", "h2")
+
+func (c *H2Config) logger() *slog.Logger {
+	if c != nil && c.Logger != nil {
+		return c.Logger
+	}
+	return Log
+}
@@ -0,0 +1,220 @@
+package h2
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net/url"
+	"strings"
+)
+
+// HeaderBaggage carries the peer metadata, using the W3C baggage format and
+// the keys used by ztunnel.
+const HeaderBaggage = "baggage"
+
+// Baggage keys, compatible with ztunnel and the OpenTelemetry resource
+// conventions.
+const (
+	baggageCluster        = "k8s.cluster.name"
+	baggageNamespace      = "k8s.namespace.name"
+	baggageServiceAccount = "k8s.serviceaccount.name"
+	baggageService        = "service.name"
+	baggageRevision       = "service.version"
+	baggageRegion         = "cloud.region"
+	baggageZone           = "cloud.availability_zone"
+)
+
+// Workload types used in the k8s.TYPE.name baggage key.
+var workloadTypes = []string{"deployment", "daemonset", "statefulset", "replicaset",
+	"job", "cronjob", "pod"}
+
+// PeerMetadata holds information about the workload on the other end of a
+// stream. The client sends it in the baggage header, the server parses it
+// and sets H2Stream.Peer.
+//
+// Namespace, ServiceAccount and TrustDomain are replaced with the values from
+// the peer certificate when the stream is using mTLS - baggage is not
+// authenticated.
+type PeerMetadata struct {
+	Cluster        string `json:"cluster,omitempty"`
+	Namespace      string `json:"namespace,omitempty"`
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+
+	// Workload name and type (deployment, pod, job, etc).
+	Workload     string `json:"workload,omitempty"`
+	WorkloadType string `json:"workloadType,omitempty"`
+
+	// Canonical service and revision.
+	Service  string `json:"service,omitempty"`
+	Revision string `json:"revision,omitempty"`
+
+	Region string `json:"region,omitempty"`
+	Zone   string `json:"zone,omitempty"`
+
+	// Principal is the spiffe identity from the peer certificate, if any.
+	Principal   string `json:"principal,omitempty"`
+	TrustDomain string `json:"trustDomain,omitempty"`
+}
+
+// Baggage returns the metadata encoded as a baggage header value.
+func (p *PeerMetadata) Baggage() string {
+	if p == nil {
+		return ""
+	}
+	var sb strings.Builder
+	add := func(k, v string) {
+		if v == "" {
+			return
+		}
+		if sb.Len() > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(k)
+		sb.WriteString("=")
+		sb.WriteString(url.PathEscape(v))
+	}
+	add(baggageCluster, p.Cluster)
+	add(baggageNamespace, p.Namespace)
+	add(baggageServiceAccount, p.ServiceAccount)
+	if p.Workload != "" {
+		wt := p.WorkloadType
+		if wt == "" {
+			wt = "deployment"
+		}
+		add("k8s."+wt+".name", p.Workload)
+	}
+	add(baggageService, p.Service)
+	add(baggageRevision, p.Revision)
+	add(baggageRegion, p.Region)
+	add(baggageZone, p.Zone)
+	return sb.String()
+}
+
+// ParseBaggage parses a baggage header value. Unknown keys and entry
+// properties are ignored. Returns nil if no known key is found.
+func ParseBaggage(h string) *PeerMetadata {
+	if h == "" {
+		return nil
+	}
+	p := &PeerMetadata{}
+	found := false
+	for _, e := range strings.Split(h, ",") {
+		if i := strings.Index(e, ";"); i >= 0 {
+			e = e[:i]
+		}
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		k := strings.TrimSpace(kv[0])
+		v, err := url.PathUnescape(strings.TrimSpace(kv[1]))
+		if err != nil || v == "" {
+			continue
+		}
+		known := true
+		switch k {
+		case baggageCluster:
+			p.Cluster = v
+		case baggageNamespace:
+			p.Namespace = v
+		case baggageServiceAccount:
+			p.ServiceAccount = v
+		case baggageService:
+			p.Service = v
+		case baggageRevision:
+			p.Revision = v
+		case baggageRegion:
+			p.Region = v
+		case baggageZone:
+			p.Zone = v
+		default:
+			known = p.parseWorkload(k, v)
+		}
+		found = found || known
+	}
+	if !found {
+		return nil
+	}
+	return p
+}
+
+func (p *PeerMetadata) parseWorkload(k, v string) bool {
+	for _, wt := range workloadTypes {
+		if k == "k8s."+wt+".name" {
+			// Prefer the most specific controller - pod is used only if nothing else.
+			if p.Workload == "" || p.WorkloadType == "pod" {
+				p.Workload = v
+				p.WorkloadType = wt
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// SetTLSPeer sets the identity from the peer certificate, overriding the
+// unauthenticated baggage values. Only spiffe://TD/ns/NS/sa/SA identities are
+// used.
+func (p *PeerMetadata) SetTLSPeer(cs *tls.ConnectionState) bool {
+	if cs == nil || len(cs.PeerCertificates) == 0 {
+		return false
+	}
+	for _, u := range cs.PeerCertificates[0].URIs {
+		if u.Scheme != "spiffe" {
+			continue
+		}
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if len(parts) != 4 || parts[0] != "ns" || parts[2] != "sa" {
+			continue
+		}
+		p.Principal = u.String()
+		p.TrustDomain = u.Host
+		p.Namespace = parts[1]
+		p.ServiceAccount = parts[3]
+		return true
+	}
+	return false
+}
+
+// Labels returns the metadata as Istio telemetry labels, with the given
+// prefix ("source" or "destination"). Unknown values are "unknown", like in
+// Istio.
+func (p *PeerMetadata) Labels(prefix string) map[string]string {
+	if p == nil {
+		p = &PeerMetadata{}
+	}
+	l := map[string]string{}
+	set := func(k, v string) {
+		if v == "" {
+			v = "unknown"
+		}
+		l[prefix+"_"+k] = v
+	}
+	set("cluster", p.Cluster)
+	set("workload", p.Workload)
+	set("workload_namespace", p.Namespace)
+	set("principal", p.Principal)
+	set("canonical_service", p.Service)
+	set("canonical_revision", p.Revision)
+	return l
+}
+
+// LogValue implements slog.LogValuer, for access logs.
+func (p *PeerMetadata) LogValue() slog.Value {
+	if p == nil {
+		return slog.Value{}
+	}
+	attrs := []slog.Attr{}
+	add := func(k, v string) {
+		if v != "" {
+			attrs = append(attrs, slog.String(k, v))
+		}
+	}
+	add("principal", p.Principal)
+	add("ns", p.Namespace)
+	add("sa", p.ServiceAccount)
+	add("workload", p.Workload)
+	add("service", p.Service)
+	add("revision", p.Revision)
+	add("cluster", p.Cluster)
+	return slog.GroupValue(attrs...)
+}
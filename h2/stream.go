@@ -27,7 +27,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"strconv"
@@ -114,6 +114,11 @@ type H2Stream struct {
 	Request  *http.Request
 	Response *http.Response
 
+	// Peer is the metadata of the remote workload, from the baggage header
+	// and peer certificate. Set by the server for accepted streams, with
+	// SetPeer once the stream is active.
+	Peer *PeerMetadata
+
 	// Error causing the close of the stream - stream reset, connection errors, etc
 	// trReader.Err contains any read error - including io.EOF, which indicates successful read close.
 	Error error
@@ -140,6 +145,9 @@ type H2Stream struct {
 	bytesReceived uint32 // indicates whether any bytes have been received on this stream
 	unprocessed   uint32 // set if the server sends a refused stream or GOAWAY including this stream
 
+	rstReceived uint32        // set when a RST_STREAM is received, after rstCode
+	rstCode     frame.ErrCode // error code of the received RST_STREAM
+
 	writeDeadline time.Time
 
 	// grpc is set if the stream is working in grpc mode, based on content type.
@@ -180,7 +188,7 @@ func (s *H2Stream) WriteHeader(statusCode int) {
 
 	if !s.isHeaderSent() { // Headers haven't been written yet.
 		if err := s.Transport().WriteHeader(s); err != nil {
-			log.Println("WriteHeader", err)
+			s.Transport().Log.Warn("WriteHeader", "stream", s.Id, "err", err)
 			return
 		}
 	}
@@ -207,6 +215,15 @@ func (s *H2Stream) CloseError(code uint32) {
 	s.Transport().closeStream(s, nil, true, frame.ErrCode(code))
 }
 
+// ResetWrite implements nio.ResetWriter. Used by proxies when the other side
+// of the connection failed - the stream is reset with CONNECT_ERROR
+// (RFC 9113 8.5) instead of sending a FIN.
+func (s *H2Stream) ResetWrite(err error) error {
+	s.setWriteClosed(2)
+	s.CloseError(uint32(frame.ErrCodeConnect))
+	return nil
+}
+
 // Send EOS/FIN.
 //
 // Client: send FIN
@@ -220,14 +237,10 @@ func (s *H2Stream) CloseWrite() error {
 
 	// TODO: use this only if trailer are present
 	if len(s.Response.Trailer) > 0 {
-		if nio.Debug {
-			log.Println("Server sends CloseWrite() with trailer", s.Id)
-		}
+		s.Transport().Log.Debug("CloseWrite() with trailer", "stream", s.Id)
 		return s.Transport().writeTrailer(s)
 	} else {
-		if nio.Debug {
-			log.Println("Server sends CloseWrite()", s.Id)
-		}
+		s.Transport().Log.Debug("CloseWrite()", "stream", s.Id)
 		return s.Transport().Write(s, nil, nil, true)
 	}
 }
@@ -268,7 +281,7 @@ func (s *H2Stream) Close() error {
 	// Send a END_STREAM (if not already sent)
 
 	// TODO: if write buffers are not empty, still send RST, empty write buf and unblock.
-	log.Println("Stream Close()", s.Id)
+	s.Transport().Log.Debug("Stream Close()", "stream", s.Id)
 
 	s.Transport().closeStream(s, nil, false, frame.ErrCode(0))
 
@@ -296,6 +309,15 @@ func (s *H2Stream) Conn() net.Conn {
 	return s.Transport().conn
 }
 
+// SetPeer sets the peer metadata. The transport lock is held, StreamsInfo
+// reads it for active streams.
+func (s *H2Stream) SetPeer(p *PeerMetadata) {
+	t := s.Transport()
+	t.mu.Lock()
+	s.Peer = p
+	t.mu.Unlock()
+}
+
 func (hc *H2Stream) Transport() *H2Transport {
 	if hc.ct != nil {
 		return hc.ct
@@ -330,7 +352,7 @@ func (s *H2Stream) swapState(st streamState) streamState {
 func (s *H2Stream) setReadClosed(mode uint32, err error) {
 	old := atomic.SwapUint32(&s.readClosed, mode)
 	if old != 0 {
-		log.Println("setReadClose: Double close", s.Error, s.inFrameList.Err)
+		s.Transport().Log.Debug("setReadClose: Double close", "stream", s.Id, "err", s.Error, "readErr", s.inFrameList.Err)
 		return
 	}
 	//if s.trReader.Err == nil {
@@ -355,6 +377,21 @@ func (s *H2Stream) getState() streamState {
 	return streamState(atomic.LoadUint32((*uint32)(&s.state)))
 }
 
+// ResetCode returns the error code of the RST_STREAM received from the
+// peer, and false if the peer did not reset the stream.
+func (s *H2Stream) ResetCode() (frame.ErrCode, bool) {
+	if atomic.LoadUint32(&s.rstReceived) == 0 {
+		return 0, false
+	}
+	return s.rstCode, true
+}
+
+// Unprocessed returns true if the peer did not process the stream - it was
+// refused, or above the last stream of a GOAWAY. The request can be retried.
+func (s *H2Stream) Unprocessed() bool {
+	return atomic.LoadUint32(&s.unprocessed) == 1
+}
+
 func (s *H2Stream) WaitHeaders() {
 	if s.headerChan == nil {
 		// On the server headerChan is always nil since a stream originates
@@ -535,6 +572,10 @@ type H2Config struct {
 
 	// KeepaliveParams stores the keepalive parameters.
 	KeepaliveParams ClientParameters
+
+	// Logger is used by the transport and its streams. Any slog.Handler can
+	// be used. If nil, h2.Log is used.
+	Logger *slog.Logger `json:"-"`
 }
 
 // ServerConfig consists of all the configurations to establish a server transport.
@@ -936,7 +977,7 @@ func (hc *H2Stream) SendRaw(b []byte, start, end int, last bool) error {
 // Framed sending/receiving.
 func (hc *H2Stream) Send(b *nio.Buffer) error {
 
-	hc.SentPackets++
+	atomic.AddInt64(&hc.SentPackets, 1)
 
 	frameLen := b.Len()
 
@@ -0,0 +1,402 @@
+package hbone
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/costinm/hbone/h2"
+	"github.com/costinm/hbone/nio"
+)
+
+// H2R - reverse connections, for nodes without inbound connectivity (NAT,
+// serverless):
+// - the node dials the gateway using mTLS and ALPN "h2r", with the service
+// name as SNI, and serves H2 streams on the connection - the roles are
+// reversed.
+// - the gateway authenticates the node, opens a H2 client on the accepted
+// connection and registers it as an EndpointCon for the service.
+// - streams for the service on the gateway - DialContext or gateway streams
+// from other nodes - are opened on the reverse connection, and forwarded by
+// the node to the local ports like any accepted stream.
+//
+// The service is name.namespace, from an SNI in the form
+// name.namespace.svc[.domain]. Only hosts in this form are sent to reverse
+// connections - other names, like example.com, are never captured. The name and namespace must match the
+// service account and namespace of the node, unless the principal is
+// allowed in H2RServices. The authz policies are checked for the
+// registration. Reverse connections are accepted on the hbone port only if
+// Gateway is set, and on listeners with protocol h2r.
+//
+// Both sides send keepalive pings, the node reconnects with backoff and the
+// gateway removes the endpoint when the connection is closed.
+
+// ALPNH2R is the ALPN for reverse connections.
+const ALPNH2R = "h2r"
+
+const (
+	// h2rKeepalive is the ping interval on idle reverse connections. NATs
+	// and load balancers may drop idle connections after a few minutes.
+	h2rKeepalive        = 30 * time.Second
+	h2rKeepaliveTimeout = 20 * time.Second
+
+	h2rMinBackoff = 50 * time.Millisecond
+	h2rMaxBackoff = 30 * time.Second
+)
+
+// ErrH2RNotConnected is returned when dialing a service that doesn't have
+// a reverse connection.
+var ErrH2RNotConnected = errors.New("h2r: no reverse connection")
+
+var errH2RNoALPN = errors.New("h2r: not supported by the gateway")
+
+// serverTLSConfig returns the config for accepted mTLS connections. If h2r
+// is set the h2r ALPN is also accepted.
+func (hb *HBone) serverTLSConfig(h2r bool) *tls.Config {
+	conf := hb.Auth.GenerateTLSConfigServer()
+	if conf == nil || !h2r {
+		return conf
+	}
+	for _, p := range conf.NextProtos {
+		if p == ALPNH2R {
+			return conf
+		}
+	}
+	conf = conf.Clone()
+	conf.NextProtos = append(conf.NextProtos, ALPNH2R)
+	return conf
+}
+
+// HandlerH2RConn handles a connection on a dedicated H2R port - only
+// reverse connections are accepted.
+func (hb *HBone) HandlerH2RConn(conn net.Conn) {
+	if !hb.acceptConn() {
+		hb.log.Warn("Connection limit reached", "remote", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	defer hb.releaseConn()
+	defer conn.Close()
+	t0 := time.Now()
+
+	tlsConn := tls.Server(conn, hb.serverTLSConfig(true))
+	if err := nio.HandshakeTimeout(tlsConn, hb.HandsahakeTimeout, conn); err != nil {
+		return
+	}
+	if alpn := tlsConn.ConnectionState().NegotiatedProtocol; alpn != ALPNH2R {
+		hb.log.Warn("Invalid alpn", "alpn", alpn, "remote", conn.RemoteAddr())
+		return
+	}
+	hb.handleH2R(tlsConn, t0)
+}
+
+// handleH2R registers an accepted reverse connection, after the handshake.
+// Blocks until the connection is closed.
+func (hb *HBone) handleH2R(conn *tls.Conn, t0 time.Time) {
+	cs := conn.ConnectionState()
+	peer := &h2.PeerMetadata{}
+	if !peer.SetTLSPeer(&cs) {
+		hb.log.Warn("H2R without peer identity", "remote", conn.RemoteAddr())
+		return
+	}
+	svc, err := hb.h2rService(cs.ServerName, peer)
+	if err != nil {
+		hb.log.Warn("H2R rejected", "remote", conn.RemoteAddr(), "peer", peer.Principal, "err", err)
+		return
+	}
+	req := &AuthzRequest{Peer: peer, Host: svc, SNI: cs.ServerName, Method: "CONNECT"}
+	if ta, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		req.SourceIP = ta.IP
+	}
+	if ta, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		req.Port = ta.Port
+	}
+	if err := hb.authorize(req); err != nil {
+		return
+	}
+
+	ct, err := h2.NewConnection(context.Background(), h2.H2Config{
+		MaxFrameSize: 262144,
+		Logger:       hb.H2Logger(),
+		KeepaliveParams: h2.ClientParameters{
+			Time:                h2rKeepalive,
+			Timeout:             h2rKeepaliveTimeout,
+			PermitWithoutStream: true,
+		},
+	})
+	if err != nil {
+		return
+	}
+	okch := make(chan struct{}, 1)
+	ct.Events.OnEvent(h2.Event_Settings, h2.EventHandlerFunc(func(evt h2.EventType, t *h2.H2Transport, s *h2.H2Stream, f *nio.Buffer) {
+		select {
+		case okch <- struct{}{}:
+		default:
+		}
+	}))
+	ct.Events.Add(hb.Events)
+	ct.StartTime = t0
+	if err := ct.StartConn(conn); err != nil {
+		return
+	}
+	select {
+	case <-okch:
+	case <-ct.Error():
+		return
+	case <-time.After(hb.HandsahakeTimeout):
+		ct.Close(errors.New("h2r: settings timeout"))
+		return
+	}
+
+	ep := &EndpointCon{
+		Endpoint: &Endpoint{
+			Address: conn.RemoteAddr().String(),
+			Labels:  map[string]string{"h2r": "1"},
+		},
+		rt:              ct,
+		tlsCon:          conn,
+		streamCon:       conn.NetConn(),
+		ConnectionStart: t0,
+		SSLEnd:          time.Now(),
+	}
+	hb.registerH2R(svc, ep, ct)
+	hb.log.Info("H2R connected", "service", svc, "peer", peer.Principal, "remote", conn.RemoteAddr())
+
+	<-ct.Error()
+
+	hb.deregisterH2R(svc, ep, ct)
+	hb.log.Info("H2R disconnected", "service", svc, "peer", peer.Principal, "remote", conn.RemoteAddr(),
+		"dur", time.Since(t0))
+}
+
+// h2rService returns the service registered by a reverse connection. The
+// SNI is the service host - the name of the service account in the namespace
+// of the peer, or a service allowing the peer in H2RServices. Without SNI
+// the service account is used.
+func (hb *HBone) h2rService(sni string, peer *h2.PeerMetadata) (string, error) {
+	if sni == "" {
+		if peer.ServiceAccount == "" || peer.Namespace == "" {
+			return "", errors.New("missing service name")
+		}
+		return peer.ServiceAccount + "." + peer.Namespace, nil
+	}
+	svc, ok := h2rKey(sni)
+	parts := strings.Split(svc, ".")
+	if !ok || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("invalid service %q", sni)
+	}
+	if parts[0] == peer.ServiceAccount && parts[1] == peer.Namespace {
+		return svc, nil
+	}
+	principal := strings.TrimPrefix(peer.Principal, "spiffe://")
+	for _, p := range hb.H2RServices[svc] {
+		if principal != "" && matchValue(p, principal) {
+			return svc, nil
+		}
+	}
+	return "", fmt.Errorf("service %q not allowed for %s/%s", sni, peer.Namespace, peer.ServiceAccount)
+}
+
+// h2rKey returns the service for a cluster-local host - name.namespace for
+// name.namespace.svc[.domain]. Returns false for other hosts, which are not
+// sent to reverse connections.
+func h2rKey(host string) (string, bool) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if i := strings.Index(host, ".svc"); i > 0 && (len(host) == i+4 || host[i+4] == '.') {
+		return host[:i], true
+	}
+	return "", false
+}
+
+// registerH2R adds the reverse connection to the cluster for the service.
+// The newest connection is used first - older ones may be dead and not yet
+// detected.
+func (hb *HBone) registerH2R(svc string, ep *EndpointCon, ct *h2.H2ClientTransport) {
+	hb.m.Lock()
+	if hb.h2r == nil {
+		hb.h2r = map[string]*Cluster{}
+	}
+	c := hb.h2r[svc]
+	if c == nil {
+		c = &Cluster{Addr: svc, hb: hb, Dynamic: true, h2r: true}
+		hb.h2r[svc] = c
+	}
+	ep.Cluster = c
+	c.Endpoints = append([]*Endpoint{ep.Endpoint}, c.Endpoints...)
+	c.EndpointCon = append([]*EndpointCon{ep}, c.EndpointCon...)
+	c.LastUsed = time.Now()
+	hb.H2RConn[&ct.H2Transport] = ep
+	cb := hb.H2RCallback
+	hb.m.Unlock()
+
+	if cb != nil {
+		cb(svc, &ct.H2Transport)
+	}
+}
+
+// deregisterH2R removes a closed reverse connection.
+func (hb *HBone) deregisterH2R(svc string, ep *EndpointCon, ct *h2.H2ClientTransport) {
+	var next *h2.H2Transport
+	hb.m.Lock()
+	delete(hb.H2RConn, &ct.H2Transport)
+	c := hb.h2r[svc]
+	if c != nil {
+		for i, e := range c.EndpointCon {
+			if e == ep {
+				c.EndpointCon = append(c.EndpointCon[:i:i], c.EndpointCon[i+1:]...)
+				c.Endpoints = append(c.Endpoints[:i:i], c.Endpoints[i+1:]...)
+				break
+			}
+		}
+		if len(c.EndpointCon) == 0 {
+			delete(hb.h2r, svc)
+		} else if nt, ok := c.EndpointCon[0].transport().(*h2.H2ClientTransport); ok {
+			next = &nt.H2Transport
+		}
+	}
+	cb := hb.H2RCallback
+	hb.m.Unlock()
+
+	if cb != nil {
+		cb(svc, next)
+	}
+}
+
+// h2rCluster returns the cluster for a service connected with H2R, for a
+// cluster-local host:port or host.
+func (hb *HBone) h2rCluster(addr string) *Cluster {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	key, ok := h2rKey(host)
+	if !ok {
+		return nil
+	}
+	hb.m.RLock()
+	c := hb.h2r[key]
+	hb.m.RUnlock()
+	return c
+}
+
+// DialReverse opens a stream to addr (host:port) using a reverse connection
+// of the service. Returns ErrH2RNotConnected if the service is not
+// connected.
+func (hb *HBone) DialReverse(ctx context.Context, addr string) (net.Conn, error) {
+	c := hb.h2rCluster(addr)
+	if c == nil {
+		return nil, ErrH2RNotConnected
+	}
+	req, _ := http.NewRequestWithContext(ctx, "CONNECT", "https://"+addr, nil)
+	req.Host = addr
+	return c.Dial(ctx, req)
+}
+
+// SNIAddr returns the host:port for a SNI - the Istio
+// 'outbound_.PORT_.SUBSET.HOST' form, or a host name using port 443.
+func SNIAddr(sni string) string {
+	if strings.HasPrefix(sni, "outbound_.") {
+		parts := strings.SplitN(sni, ".", 4)
+		if len(parts) == 4 {
+			return net.JoinHostPort(parts[3], strings.TrimSuffix(parts[1], "_"))
+		}
+	}
+	return net.JoinHostPort(sni, "443")
+}
+
+// reverseMux returns a reverse connection that can take new streams,
+// excluding the failed ones.
+func (c *Cluster) reverseMux(failed ...*EndpointCon) (*EndpointCon, error) {
+	c.hb.m.RLock()
+	defer c.hb.m.RUnlock()
+	for _, ep := range c.EndpointCon {
+		if slices.Contains(failed, ep) {
+			continue
+		}
+		if ct, ok := ep.transport().(*h2.H2ClientTransport); ok && ct.CanTakeNewRequest() {
+			return ep, nil
+		}
+	}
+	return nil, ErrH2RNotConnected
+}
+
+// DialH2R connects to a H2R gateway at addr, and serves the streams opened
+// by the gateway. The SNI of the cluster is the service name registered on
+// the gateway.
+//
+// Not blocking - returns the error of the first attempt, the node
+// reconnects with backoff until ctx is done.
+func DialH2R(ctx context.Context, hc *EndpointCon, addr string) error {
+	tc, err := hc.dialH2R(ctx, addr)
+	go hc.serveH2R(ctx, addr, tc)
+	return err
+}
+
+// dialH2R opens a mTLS connection to the gateway, using the h2r ALPN.
+func (hc *EndpointCon) dialH2R(ctx context.Context, addr string) (net.Conn, error) {
+	c := hc.Cluster
+	if c.TLSClientConfig == nil {
+		conf := c.hb.Auth.GenerateTLSConfigClientRoots(c.SNI, c.trustRoots())
+		if conf == nil {
+			return nil, errors.New("h2r: mTLS is required")
+		}
+		conf = conf.Clone()
+		conf.NextProtos = []string{ALPNH2R}
+		c.TLSClientConfig = conf
+	}
+	nc, err := hc.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	tc, ok := nc.(*tls.Conn)
+	if !ok || tc.ConnectionState().NegotiatedProtocol != ALPNH2R {
+		nc.Close()
+		return nil, errH2RNoALPN
+	}
+	return tc, nil
+}
+
+// serveH2R serves the streams on the connection to the gateway, and
+// reconnects when it is closed.
+func (hc *EndpointCon) serveH2R(ctx context.Context, addr string, tc net.Conn) {
+	hb := hc.Cluster.hb
+	backoff := h2rMinBackoff
+	for {
+		if tc != nil {
+			t0 := time.Now()
+			hb.log.Info("H2R connected", "gate", addr, "sni", hc.Cluster.SNI)
+			stop := context.AfterFunc(ctx, func() {
+				tc.Close()
+			})
+			conf := hb.h2ServerConfig()
+			conf.KeepaliveParams = h2.ServerParameters{Time: h2rKeepalive, Timeout: h2rKeepaliveTimeout}
+			conf.KeepalivePolicy = h2.EnforcementPolicy{MinTime: h2rKeepalive / 2, PermitWithoutStream: true}
+			hb.startH2ServerMux(tc, t0, conf)
+			stop()
+			tc.Close()
+			hb.log.Info("H2R disconnected", "gate", addr, "dur", time.Since(t0))
+			if time.Since(t0) > h2rMaxBackoff {
+				backoff = h2rMinBackoff
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, h2rMaxBackoff)
+
+		var err error
+		tc, err = hc.dialH2R(ctx, addr)
+		if err != nil {
+			hb.log.Debug("H2R dial error", "gate", addr, "err", err, "backoff", backoff)
+			tc = nil
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package hbone
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/costinm/hbone/h2"
+)
+
+// testCA issues spiffe certificates. The generated configs verify the peer
+// against the CA, not the host name - like the mesh auth.
+type testCA struct {
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{key: key, cert: cert, pool: pool}
+}
+
+type testAuth struct {
+	cert tls.Certificate
+	pool *x509.CertPool
+}
+
+func (ca *testCA) auth(t *testing.T, ns, sa string) *testAuth {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	u, _ := url.Parse("spiffe://cluster.local/ns/" + ns + "/sa/" + sa)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		URIs:         []*url.URL{u},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testAuth{cert: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool: ca.pool}
+}
+
+func (a *testAuth) GenerateTLSConfigServer() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{a.cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    a.pool,
+		NextProtos:   []string{"h2"},
+	}
+}
+
+func (a *testAuth) GenerateTLSConfigClient(name string) *tls.Config {
+	return a.GenerateTLSConfigClientRoots(name, nil)
+}
+
+func (a *testAuth) GenerateTLSConfigClientRoots(name string, pool *x509.CertPool) *tls.Config {
+	if pool == nil {
+		pool = a.pool
+	}
+	return &tls.Config{
+		Certificates:       []tls.Certificate{a.cert},
+		ServerName:         name,
+		NextProtos:         []string{"h2"},
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return errors.New("no peer certificate")
+			}
+			c, err := x509.ParseCertificate(raw[0])
+			if err != nil {
+				return err
+			}
+			_, err = c.Verify(x509.VerifyOptions{Roots: pool})
+			return err
+		},
+	}
+}
+
+// serveTest accepts connections on a local port with the handler.
+func serveTest(t *testing.T, h func(net.Conn)) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go h(c)
+		}
+	}()
+	return l
+}
+
+func checkEcho(t *testing.T, nc net.Conn, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+	nc.Write([]byte("hello"))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(nc, b); err != nil || string(b) != "hello" {
+		t.Fatal("Unexpected echo", string(b), err)
+	}
+}
+
+func TestH2R(t *testing.T) {
+	ca := newTestCA(t)
+	app := serveTest(t, func(c net.Conn) {
+		io.Copy(c, c)
+		c.Close()
+	})
+	_, appPort, _ := net.SplitHostPort(app.Addr().String())
+
+	gate := New(ca.auth(t, "test", "gate"), &MeshSettings{Gateway: true})
+	events := make(chan string, 10)
+	gate.H2RCallback = func(svc string, t *h2.H2Transport) {
+		if t == nil {
+			svc += " closed"
+		}
+		events <- svc
+	}
+	gl := serveTest(t, gate.HandleAcceptedH2)
+	gateAddr := gl.Addr().String()
+
+	waitEvent := func(want string) {
+		t.Helper()
+		select {
+		case e := <-events:
+			if e != want {
+				t.Fatal("Unexpected event", e, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for", want)
+		}
+	}
+
+	// bob has no inbound connectivity - port 9000 is forwarded to the app.
+	bob := New(ca.auth(t, "test", "bob"), &MeshSettings{Namespace: "test",
+		Ports: map[string]string{"tcp": "9000:" + appPort}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := bob.AddService(&Cluster{Addr: "h2r-gate", SNI: "bob.test.svc.cluster.local"})
+	err := DialH2R(ctx, &EndpointCon{Cluster: c, Endpoint: &Endpoint{Address: gateAddr}}, gateAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitEvent("bob.test")
+
+	t.Run("gate", func(t *testing.T) {
+		nc, err := gate.DialContext(ctx, "tcp", "bob.test.svc:9000")
+		checkEcho(t, nc, err)
+	})
+
+	t.Run("sni", func(t *testing.T) {
+		nc, err := gate.DialReverse(ctx, SNIAddr("outbound_.9000_._.bob.test.svc.cluster.local"))
+		checkEcho(t, nc, err)
+		if _, err := gate.DialReverse(ctx, SNIAddr("alice.test.svc.cluster.local")); !errors.Is(err, ErrH2RNotConnected) {
+			t.Error("Expecting not connected", err)
+		}
+	})
+
+	t.Run("alice-gate-bob", func(t *testing.T) {
+		alice := New(ca.auth(t, "test", "alice"), &MeshSettings{Namespace: "test"})
+		alice.AddService(&Cluster{Addr: "bob.test.svc.cluster.local:9000"},
+			&Endpoint{Address: "bob.test.svc.cluster.local:9000", HBoneAddress: gateAddr})
+		nc, err := alice.DialContext(ctx, "tcp", "bob.test.svc.cluster.local:9000")
+		checkEcho(t, nc, err)
+	})
+
+	t.Run("other-namespace", func(t *testing.T) {
+		ctx2, cancel2 := context.WithCancel(ctx)
+		defer cancel2()
+		c := bob.AddService(&Cluster{Addr: "h2r-other", SNI: "bob.other.svc"})
+		DialH2R(ctx2, &EndpointCon{Cluster: c, Endpoint: &Endpoint{Address: gateAddr}}, gateAddr)
+		time.Sleep(200 * time.Millisecond)
+		if gate.h2rCluster("bob.other.svc:9000") != nil {
+			t.Error("Registered service in other namespace")
+		}
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		// A failed reverse connection is not retried - the next one is used.
+		c := gate.h2rCluster("bob.test.svc:9000")
+		calls := 0
+		bad := &EndpointCon{Cluster: c, Endpoint: &Endpoint{Address: "failed"},
+			rt: roundTripFunc(func(*http.Request) (*http.Response, error) {
+				calls++
+				return nil, errors.New("failed")
+			})}
+		req, _ := http.NewRequestWithContext(ctx, "CONNECT", "https://bob.test.svc:9000", nil)
+		res, epc, err := c.rt(bad, req)
+		if err != nil || epc == bad || calls != 1 {
+			t.Fatal("Unexpected retry", err, calls)
+		}
+		res.Body.Close()
+	})
+
+	if _, err := gate.DialContext(ctx, "tcp", "alice.test:9000"); err == nil {
+		t.Error("Expecting error for unknown service")
+	}
+
+	cancel()
+	waitEvent("bob.test closed")
+	if gate.h2rCluster("bob.test.svc:9000") != nil || len(gate.H2RConn) != 0 {
+		t.Error("Reverse connection not removed")
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestH2RRegistration(t *testing.T) {
+	ca := newTestCA(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// register dials the gateway as sa, registering sni. Returns the service
+	// registered on the gateway, if any, and the dial error.
+	register := func(gate *HBone, addr, sa, sni string) (*Cluster, error) {
+		t.Helper()
+		hb := New(ca.auth(t, "test", sa), &MeshSettings{Namespace: "test"})
+		c := hb.AddService(&Cluster{Addr: "h2r-gate", SNI: sni})
+		ctx, cancel := context.WithCancel(ctx)
+		t.Cleanup(cancel)
+		err := DialH2R(ctx, &EndpointCon{Cluster: c, Endpoint: &Endpoint{Address: addr}}, addr)
+		var rc *Cluster
+		for i := 0; i < 50 && rc == nil; i++ {
+			time.Sleep(10 * time.Millisecond)
+			rc = gate.h2rCluster(sni)
+		}
+		return rc, err
+	}
+
+	gate := New(ca.auth(t, "test", "gate"), &MeshSettings{Namespace: "test", Gateway: true,
+		H2RServices: map[string][]string{"shared.test": {"cluster.local/ns/test/sa/carol"}},
+		AuthzPolicies: []*AuthzPolicy{{Name: "deny-eve", Action: AuthzDeny, Rules: []*AuthzRule{{
+			From: []*AuthzFrom{{Source: &AuthzSource{Principals: []string{"cluster.local/ns/test/sa/eve"}}}}}}}}})
+	gateAddr := serveTest(t, gate.HandleAcceptedH2).Addr().String()
+
+	for _, tc := range []struct {
+		name, sa, sni string
+		ok            bool
+	}{
+		{"service-account", "bob", "bob.test.svc", true},
+		{"other-service", "bob", "alice.test.svc", false},
+		{"not-allowed", "bob", "shared.test.svc", false},
+		{"allowed", "carol", "shared.test.svc", true},
+		{"authz-denied", "eve", "eve.test.svc", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rc, _ := register(gate, gateAddr, tc.sa, tc.sni)
+			if (rc != nil) != tc.ok {
+				t.Error("Unexpected registration", rc != nil)
+			}
+		})
+	}
+
+	t.Run("not-cluster-local", func(t *testing.T) {
+		// The service example in namespace com can't capture example.com.
+		egress := New(ca.auth(t, "test", "egress"), &MeshSettings{Gateway: true})
+		egressAddr := serveTest(t, egress.HandleAcceptedH2).Addr().String()
+		dial := func(sni string) {
+			hb := New(ca.auth(t, "com", "example"), &MeshSettings{Namespace: "com"})
+			c := hb.AddService(&Cluster{Addr: "h2r-gate", SNI: sni})
+			ctx, cancel := context.WithCancel(ctx)
+			t.Cleanup(cancel)
+			DialH2R(ctx, &EndpointCon{Cluster: c, Endpoint: &Endpoint{Address: egressAddr}}, egressAddr)
+		}
+		dial("example.com")
+		time.Sleep(100 * time.Millisecond)
+		egress.m.RLock()
+		n := len(egress.h2r)
+		egress.m.RUnlock()
+		if n != 0 {
+			t.Error("Registered a service that is not cluster-local")
+		}
+		dial("example.com.svc")
+		var rc *Cluster
+		for i := 0; i < 50 && rc == nil; i++ {
+			time.Sleep(10 * time.Millisecond)
+			rc = egress.h2rCluster("example.com.svc.cluster.local:443")
+		}
+		if rc == nil {
+			t.Fatal("Expecting example.com.svc registered")
+		}
+		if egress.h2rCluster("example.com:443") != nil {
+			t.Error("example.com captured by the reverse connection")
+		}
+		if _, err := egress.DialReverse(ctx, "example.com:443"); !errors.Is(err, ErrH2RNotConnected) {
+			t.Error("Expecting example.com not sent to the reverse connection", err)
+		}
+	})
+
+	t.Run("not-gateway", func(t *testing.T) {
+		node := New(ca.auth(t, "test", "node"), &MeshSettings{Namespace: "test"})
+		rc, err := register(node, serveTest(t, node.HandleAcceptedH2).Addr().String(), "dave", "dave.test.svc")
+		if err == nil || rc != nil {
+			t.Error("Expecting h2r to be rejected", err, rc != nil)
+		}
+
+		// A listener with protocol h2r accepts reverse connections.
+		rc, err = register(node, serveTest(t, node.HandlerH2RConn).Addr().String(), "dave", "dave.test.svc")
+		if err != nil || rc == nil {
+			t.Error("Expecting h2r listener to accept", err)
+		}
+	})
+}
+
+func TestH2RKey(t *testing.T) {
+	for in, want := range map[string]string{
+		"bob.test.svc.cluster.local": "bob.test",
+		"bob.test.svc":               "bob.test",
+		"Bob.Test.Svc.":              "bob.test",
+		// Not cluster-local - never sent to reverse connections.
+		"bob.test":                  "",
+		"bob.test.svcx.example.com": "",
+		"example.com.":              "",
+	} {
+		if got, ok := h2rKey(in); got != want || ok != (want != "") {
+			t.Errorf("%s: got %s %v want %s", in, got, ok, want)
+		}
+	}
+}
+
+func TestSNIAddr(t *testing.T) {
+	for in, want := range map[string]string{
+		"outbound_.9090_._.prometheus.mon.svc.cluster.local": "prometheus.mon.svc.cluster.local:9090",
+		"outbound_.8080_.v1.bob.test.svc.cluster.local":      "bob.test.svc.cluster.local:8080",
+		"bob.test.svc.cluster.local":                         "bob.test.svc.cluster.local:443",
+		"outbound_.9090":                                     "outbound_.9090:443",
+	} {
+		if got := SNIAddr(in); got != want {
+			t.Errorf("%s: got %s want %s", in, got, want)
+		}
+	}
+}
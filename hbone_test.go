@@ -20,7 +20,7 @@ func TestHBone(t *testing.T) {
 
 	// RoundTripStart an echo handler on bob. Equivalent with a pod listening on that port.
 	// The service is 'default.bob:8080'
-	eh := &echo.EchoHandler{Debug: Debug}
+	eh := &echo.EchoHandler{}
 	ehL, err := eh.Start(":14130")
 	if err != nil {
 		t.Fatal(err)
@@ -181,7 +181,7 @@ func TestHBone(t *testing.T) {
 
 	})
 
-	ehServerFirst := &echo.EchoHandler{ServerFirst: true, Debug: Debug}
+	ehServerFirst := &echo.EchoHandler{ServerFirst: true}
 	ehSFL, err := ehServerFirst.Start(":0")
 	if err != nil {
 		t.Fatal(err)
@@ -219,6 +219,32 @@ func TestHBone(t *testing.T) {
 		// TODO: check the headers, etc
 	})
 
+	alice.AddService(&Cluster{Addr: "framed.bob:6000", Framing: FramingClose},
+		&Endpoint{Address: ehSFL.Addr().String(), HBoneAddress: bobHBAddr})
+
+	// Same as above, using the framed stream with in-band FIN
+	t.Run("framed-alice-bob-serverFirst", func(t *testing.T) {
+		nc, err := alice.DialContext(ctx, "tcp", "framed.bob:6000")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := nc.(*nio.FramedConn); !ok {
+			t.Fatalf("Expecting framed conn, got %T", nc)
+		}
+		EchoClient2(t, nc, nc, true)
+
+		nc.(nio.CloseWriter).CloseWrite()
+
+		n, err := nc.Read(readB)
+		if n == 0 {
+			t.Fatal("Read after close write failed")
+		}
+		n, err = nc.Read(readB)
+		if err != io.EOF {
+			t.Fatal("Expecting EOF", n, err)
+		}
+	})
+
 	// Verify server first protocols work, using Close
 	t.Run("plain-alice-bob-serverFirst-close", func(t *testing.T) {
 		nc, err := alice.DialContext(ctx, "tcp", "default.bob:6000")
@@ -6,29 +6,24 @@ import (
 	"crypto/x509"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"os"
 	"runtime/debug"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/costinm/hbone/h2"
+	"github.com/costinm/hbone/h2/frame"
 	"github.com/costinm/hbone/nio"
 	"github.com/costinm/hbone/nio/syscall"
 	"github.com/costinm/meshauth"
 )
 
-// Debug for dev support, will log verbose info.
-// Avoiding dependency on logging - eventually a trace interface will be provided
-// so any logger can be used.
-var Debug = false
-
 // MeshSettings holds the settings for a mesh node.
 type MeshSettings struct {
 	// Identity of the node. If empty, will be detected from env (provisioning)
@@ -39,12 +34,19 @@ type MeshSettings struct {
 
 	// Ports is the equivalent of container ports in k8s.
 	// Name follows the same conventions as Istio and should match the port name in the Service.
+	// The name prefix sets the app protocol (http, http2/h2c, grpc, tcp).
+	// Value is the port, or SERVICE_PORT:CONTAINER_PORT to remap.
 	// Port "*" means 'any' port - if set, allows connections to any port by number.
 	// env variables named: PORT_name=value, with the default PORT_http=8080
-	// TODO: refine the 'wildcard' to indicate http1/2 protocol
+	// Inbound streams are only forwarded to declared ports, see ResolvePort.
 	// TODO: this can be populated from a WorkloadGroup object, loaded from XDS or mesh env.
 	Ports map[string]string
 
+	// LocalHosts maps the Host of HTTP requests without a port to a port name
+	// or number in Ports. Requests with a port in Host use that port, others
+	// the first http port.
+	LocalHosts map[string]string `json:"localHosts,omitempty"`
+
 	// Hub or user project WorkloadID. If set, will be used to lookup clusters.
 	//ProjectId      string
 	Namespace      string
@@ -101,6 +103,10 @@ type MeshSettings struct {
 
 	AdminPort string
 
+	// AdminToken is the bearer token required for the config API on the
+	// admin port. If empty, only local clients can change the config.
+	AdminToken string `json:"adminToken,omitempty"`
+
 	// Envoy/Istio
 
 	// ServiceCluster is mapped to Istio canonical service and envoy --serviceCluster
@@ -116,10 +122,81 @@ type MeshSettings struct {
 	// It will show up in x-envoy-downstream-service-node
 	ServiceNode string
 
+	// LocalProxyProtocol enables sending a PROXY protocol header when
+	// forwarding accepted streams to the local application, so the app sees
+	// the peer address instead of localhost. "v2" includes the peer SPIFFE
+	// identity as a TLV (nio.ProxyTLVSpiffe), "v1" only the addresses.
+	LocalProxyProtocol string `json:"localProxyProtocol,omitempty"`
+
+	// LocalTransparent enables preserving the original client IP when
+	// forwarding accepted streams to the local application, using
+	// IP_TRANSPARENT. The app is dialed on the IP the stream was received on
+	// instead of localhost. Requires CAP_NET_ADMIN and the routing rules in
+	// docs/transparent.md.
+	LocalTransparent bool `json:"localTransparent,omitempty"`
+
+	// TransparentMark is the SO_MARK used for transparent connections, default
+	// 1337 (same as Istio TPROXY mode).
+	TransparentMark int `json:"transparentMark,omitempty"`
+
+	// TrustedProxies are the peers allowed to set the original client IP in
+	// the 'forwarded' and 'x-forwarded-for' headers - gateways and waypoints.
+	// Entries are principals (TD/ns/NS/sa/SA, with the authz prefix and
+	// suffix matches) or IPs and CIDRs of the peer connection. The headers
+	// from other peers are ignored.
+	TrustedProxies []string `json:"trustedProxies,omitempty"`
+
+	// H2RServices are the services that can be registered with reverse
+	// connections by other identities, by name.namespace, with the allowed
+	// principals (same format as TrustedProxies). By default only the
+	// service with the name of the service account, in the namespace of the
+	// peer, can be registered.
+	H2RServices map[string][]string `json:"h2rServices,omitempty"`
+
+	// AuthzPolicies are evaluated for each inbound stream. If empty, only
+	// peers in the same trust domain and namespace are allowed. Istio
+	// AuthorizationPolicy objects can be converted with ParseAuthorizationPolicy.
+	AuthzPolicies []*AuthzPolicy `json:"authzPolicies,omitempty"`
+
+	// Routes are the static HTTP routes, evaluated in order for HTTP requests
+	// received on the HBONE port and HTTP listeners.
+	Routes []*Route `json:"routes,omitempty"`
+
+	// Limits configures overload protection for the HBONE server.
+	Limits ServerLimits `json:"limits,omitempty"`
+
+	// XFCC sets how the x-forwarded-client-cert header is handled for HTTP
+	// requests forwarded to the local app - "sanitize_set" (default),
+	// "sanitize", "forward" or "append", same as Envoy.
+	XFCC string `json:"xfcc,omitempty"`
+
+	// Gateway enables forwarding CONNECT streams for destinations that are
+	// not local - another pod IP or service - using Dial, which may
+	// re-originate HBONE. Used for east-west gateways and PEPs. If false, all
+	// streams are forwarded to localhost.
+	// The peer is authorized for the destination host before dialing, and the
+	// destination identity (if the upstream is using mTLS) after.
+	Gateway bool `json:"gateway,omitempty"`
+
+	// Metadata is sent to peers in the baggage header of CONNECT and POST
+	// tunnels. Namespace and ServiceAccount default to the settings above,
+	// Service defaults to ServiceCluster.
+	Metadata *h2.PeerMetadata `json:"metadata,omitempty"`
+
 	// AccessLog enables logging HTTP and stream close stats (sort of access log)
 	// Setting it to "-" disables.
 	// TODO: can be a well-known cluster, address ,etc
 	AccessLog string `json:"accessLog,omitempty"`
+
+	// LogLevel is the minimum log level for each component - "hbone", "h2",
+	// "nio", "urpc", "hboned". The "*" key applies to components not listed.
+	// Values are slog level names (debug, info, warn, error) or "trace".
+	// If not set, the level of the Logger handler is used.
+	LogLevel map[string]string `json:"logLevel,omitempty"`
+
+	// Logger is the base logger, defaults to slog.Default(). Any slog.Handler
+	// can be used - each component adds a 'component' attribute.
+	Logger *slog.Logger `json:"-"`
 }
 
 type Duration struct {
@@ -192,8 +269,22 @@ type HBone struct {
 	// - sts - federated google access tokens associated with GCP identity pools.
 	AuthProviders map[string]func(context.Context, string) (string, error)
 
-	// rp is used when HBone is used to proxy to a local http/1.1 server.
-	rp *httputil.ReverseProxy
+	// limits is the state for the Limits settings.
+	limits limiter
+
+	// localProxies are the reverse proxies to local app ports, by protocol
+	// and port. Created on first use.
+	localProxies map[string]*httputil.ReverseProxy
+
+	// clusterProxies are the reverse proxies to mesh clusters, for routes and
+	// https listeners.
+	clusterProxies map[string]*httputil.ReverseProxy
+
+	// serverConns are the accepted H2 connections, for debug.
+	serverConns map[*h2.H2Transport]struct{}
+
+	// localForwards are the listeners for LocalForward ports.
+	localForwards map[int]net.Listener
 
 	// h2Server is the server used for accepting HBONE connections
 	//h2Server *http2.Server
@@ -202,10 +293,12 @@ type HBone struct {
 	//h2t *http2.Transport
 
 	// Mux is used for HTTP and gRPC handler exposed externally.
-	// The HTTP server on localhost:15000 uses http.DefaultMux - which is used by pprof
-	// and others by default.
 	Mux *http.ServeMux
 
+	// AdminMux has the debug, config and metrics handlers, served on the admin
+	// listener (localhost:15000). Not exposed to the mesh.
+	AdminMux *http.ServeMux
+
 	Handlers map[string]Handler
 
 	// EndpointResolver hooks into the Dial process and return the configured
@@ -213,16 +306,36 @@ type HBone struct {
 	// additional local configs.
 	EndpointResolver func(sni string) *EndpointCon
 
-	m           sync.RWMutex
-	H2RConn     map[*h2.H2Transport]*EndpointCon
+	m sync.RWMutex
+
+	// H2RConn are the accepted reverse connections, with the endpoint
+	// registered for the node.
+	H2RConn map[*h2.H2Transport]*EndpointCon
+
+	// H2RCallback is called when the reverse connections for a service
+	// change, with the connection used for new streams - nil if the service
+	// is no longer connected.
 	H2RCallback func(string, *h2.H2Transport)
 
+	// h2r are the clusters for services connected with H2R, by service name.
+	h2r map[string]*Cluster
+
 	Client *http.Client
 
 	http1SChan chan net.Conn
 	http1CChan chan net.Conn
 
 	Http11Transport *http.Transport
+
+	// log is the logger for the hbone component.
+	log *slog.Logger
+	// h2Log is passed to the H2 transports created by this node.
+	h2Log *slog.Logger
+	// nioLog is used for the copy in Proxy.
+	nioLog *slog.Logger
+
+	// baggage is the encoded Metadata, sent on tunnels.
+	baggage string
 }
 
 // Handler is a handler for net.Conn with metadata.
@@ -297,6 +410,7 @@ func NewMesh(ms *MeshSettings) *HBone {
 		Client:        http.DefaultClient,
 		Handlers:      map[string]Handler{},
 		Mux:           http.NewServeMux(),
+		AdminMux:      http.NewServeMux(),
 		AuthProviders: map[string]func(context.Context, string) (string, error){},
 		//&http2.Transport{
 		//	ReadIdleTimeout: 10000 * time.Second,
@@ -307,6 +421,13 @@ func NewMesh(ms *MeshSettings) *HBone {
 	}
 	//hb.h2t.ConnPool = hb
 
+	hb.SetLogger(ms.Logger)
+	hb.initMetadata()
+	if ps, err := validAuthorizationPolicies(ms.AuthzPolicies); err != nil {
+		hb.log.Error("Invalid authz policies, dropped", "err", err)
+		ms.AuthzPolicies = ps
+	}
+
 	hb.Http11Transport = &http.Transport{
 		DialContext: hb.DialContext,
 		// If not set, DialContext and TLSClientConfig are used
@@ -336,13 +457,6 @@ func NewMesh(ms *MeshSettings) *HBone {
 		ms.ConnectTimeout.Duration = 5 * time.Second
 	}
 
-	// Init the HTTP reverse proxy, for apps listening for HTTP/1.1 on 8080
-	// This is used for serverless but also support regular pods.
-	// TODO: customize the port.
-	// TODO: add a h2 reverse proxy as well on 8082, and grpc on 8081
-	u, _ := url.Parse("http://127.0.0.1:8080")
-	hb.rp = httputil.NewSingleHostReverseProxy(u)
-
 	return hb
 }
 
@@ -363,12 +477,18 @@ func NewMesh(ms *MeshSettings) *HBone {
 // TLS handshake.
 // conn may be a wrapped connection.
 func (hb *HBone) HandleAcceptedH2(conn net.Conn) {
+	if !hb.acceptConn() {
+		hb.log.Warn("Connection limit reached", "remote", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	defer hb.releaseConn()
 	if hb.TCPUserTimeout != 0 {
 		syscall.SetTCPUserTimeout(conn, hb.TCPUserTimeout)
 	}
 	t0 := time.Now()
 
-	conf := hb.Auth.GenerateTLSConfigServer()
+	conf := hb.serverTLSConfig(hb.Gateway)
 	defer conn.Close()
 	tlsConn := tls.Server(conn, conf)
 
@@ -378,31 +498,50 @@ func (hb *HBone) HandleAcceptedH2(conn net.Conn) {
 	}
 
 	alpn := tlsConn.ConnectionState().NegotiatedProtocol
+	if alpn == ALPNH2R && hb.Gateway {
+		hb.handleH2R(tlsConn, t0)
+		return
+	}
 	if alpn != "h2" {
-		log.Println("Invalid alpn")
+		hb.log.Warn("Invalid alpn", "alpn", alpn, "remote", conn.RemoteAddr())
 	}
 
-	hb.startH2ServerMux(tlsConn, t0)
+	hb.startH2ServerMux(tlsConn, t0, hb.h2ServerConfig())
 }
 
 // HandleAcceptedH2C handles a plain text H2 connection, for example
 // in case of secure networks.
 func (hb *HBone) HandleAcceptedH2C(conn net.Conn) {
+	if !hb.acceptConn() {
+		hb.log.Warn("Connection limit reached", "remote", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	defer hb.releaseConn()
 	if hb.TCPUserTimeout != 0 {
 		// only for TCPConn - if this is used for tls no effect
 		syscall.SetTCPUserTimeout(conn, hb.TCPUserTimeout)
 	}
-	hb.startH2ServerMux(conn, time.Now())
+	hb.startH2ServerMux(conn, time.Now(), hb.h2ServerConfig())
+}
+
+// h2ServerConfig returns the config for accepted H2 connections.
+func (hb *HBone) h2ServerConfig() *h2.ServerConfig {
+	return &h2.ServerConfig{
+		H2Config: h2.H2Config{
+			//MaxFrameSize:          1 << 22,
+			//InitialConnWindowSize: 1 << 26,
+			//InitialWindowSize:     1 << 25,
+			Logger: hb.H2Logger(),
+		},
+		MaxStreams: hb.Limits.MaxStreamsPerConnection,
+	}
 }
 
-func (hb *HBone) startH2ServerMux(conn net.Conn, startT time.Time) {
-	st, err := h2.NewServerConnection(conn, &h2.ServerConfig{
-		//MaxFrameSize:          1 << 22,
-		//InitialConnWindowSize: 1 << 26,
-		//InitialWindowSize:     1 << 25,
-	}, &hb.Events)
+func (hb *HBone) startH2ServerMux(conn net.Conn, startT time.Time, conf *h2.ServerConfig) {
+	st, err := h2.NewServerConnection(conn, conf, &hb.Events)
 	if err != nil {
-		log.Println("H2 server err", err)
+		hb.log.Info("H2 server err", "remote", conn.RemoteAddr(), "err", err)
 		conn.Close()
 		return
 	}
@@ -414,12 +553,13 @@ func (hb *HBone) startH2ServerMux(conn net.Conn, startT time.Time) {
 	}
 
 	st.TraceCtx = func(ctx context.Context, s string) context.Context {
-		//log.Println("Trace", s)
+		//hb.log.Debug("Trace", "path", s)
 		return ctx
 	}
 
 	st.MuxEvent(h2.Event_Connect_Done)
 
+	defer hb.trackConn(st)()
 	// blocks - read frames
 	st.HandleStreams()
 }
@@ -443,66 +583,68 @@ func (hb *HBone) handleH2Stream(st *h2.H2Transport, stream *h2.H2Stream) {
 
 	go func() {
 		r := stream.Request
+		stream.SetPeer(peerMetadata(stream))
+		log := hb.log.With("conn", st.ConnectionID(), "stream", stream.Id, "peer", stream.Peer)
 
-		tunMode := r.Header.Get("x-tun")
-		if r.Method == "POST" && tunMode != "" {
-			_, p, err := net.SplitHostPort(tunMode)
-
-			stream.Response.Status = "200"
-			stream.Response.Header.Add("x-status", "200")
-			st.WriteHeader(stream)
-
-			// Create a stream, used for Proxy with caching.
-			conf := hb.Auth.GenerateTLSConfigServer()
-			tls := tls.Server(stream, conf)
-
-			err = nio.HandshakeTimeout(tls, hb.HandsahakeTimeout, nil)
-			if err != nil {
-				stream.Close()
-				log.Println("HBD-MTLS: error inner mTLS ", err)
-				return
-			}
-			log.Println("HBD-MTLS:", tls.ConnectionState())
-
-			// TODO: All Istio checks go here. The TLS handshake doesn't check
-			// root cert or anything - this is proof of concept only, to eval
-			// perf.
-
-			// TODO: allow user to customize app port, protocol.
-			// TODO: if protocol is not matching wire protocol, convert.
-
-			hb.HandleTCPProxy(tls, tls, "localhost:"+p)
+		if hb.overloaded() {
+			stream.CloseError(uint32(frame.ErrCodeRefusedStream))
+			return
+		}
+		release, err := hb.acquireStream(peerKey(stream))
+		if err != nil {
+			log.Warn("Stream limit reached", "err", err)
+			stream.Response.Header.Set("retry-after", "1")
+			hb.streamError(stream, http.StatusServiceUnavailable, ProxyErrConnectionLimit, err)
+			return
+		}
+		defer release()
 
+		if r.Method == "POST" && r.Header.Get("x-tun") != "" {
+			hb.tunStream(st, stream, log)
 			return
 		}
 
 		// For connect, the requestURI is the same as host - probably for backward compat
 		hbSvc := r.Header.Get("x-service")
-		if r.Method == "CONNECT" || r.Method == "POST" && hbSvc != "" {
-			// TODO: verify host is endpoint IP ?
-			// TODO: support gateway mode
+		isConnect := r.Method == "CONNECT" || r.Method == "POST" && hbSvc != ""
+		if isConnect && hb.Gateway && !isLocalDest(stream, r.Host) {
+			hb.gatewayStream(st, stream, log)
+			return
+		}
+
+		if err := hb.authorizeStream(stream, ""); err != nil {
+			hb.denyStream(stream, err)
+			return
+		}
 
+		if isConnect {
 			host := stream.Request.Host
-			log.Println("HBone-START", stream.Id, host, r.Header)
+			log.Info("HBone-START", "host", host, "headers", r.Header)
 
+			// Without gateway mode, all streams go to the local app.
 			_, p, _ := net.SplitHostPort(host)
-			// TODO: verify host is endpoint IP ?
-			// TODO: support gateway mode
-
-			hostPort := "localhost:" + p
+			port, err := hb.ResolvePort(p)
+			if err != nil {
+				log.Warn("Port not allowed", "host", host, "err", err)
+				hb.denyStream(stream, err)
+				return
+			}
+			hostPort := "localhost:" + strconv.Itoa(port.TargetPort)
 
-			nc, err := net.Dial("tcp", hostPort)
+			nc, err := hb.dialLocal(stream, hostPort)
 			if err != nil {
-				log.Println("Error dialing ", hostPort, err)
+				log.Warn("Error dialing", "dest", hostPort, "err", err)
+				hb.dialError(stream, err)
 				return
 			}
 
+			snc := acceptFraming(stream)
 			stream.Response.Status = "200"
 			stream.Response.Header.Add("x-status", "200")
 			st.WriteHeader(stream)
 
-			proxyErr := Proxy(nc, stream, stream, hostPort)
-			log.Println("HBone-END: ", stream.Id, host, proxyErr)
+			proxyErr := hb.Proxy(nc, snc, snc, hostPort)
+			log.Info("HBone-END", "host", host, "err", proxyErr)
 
 			return
 		}
@@ -523,6 +665,17 @@ func (hb *HBone) handleH2Stream(st *h2.H2Transport, stream *h2.H2Stream) {
 	}()
 }
 
+// acceptFraming checks if the client requested a framed stream. If the framing
+// is supported, the response header is set and the stream is wrapped.
+// Must be called before the response headers are sent.
+func acceptFraming(stream *h2.H2Stream) net.Conn {
+	if stream.Request.Header.Get(HeaderFraming) != FramingClose {
+		return stream
+	}
+	stream.Response.Header.Set(HeaderFraming, FramingClose)
+	return nio.NewFramedConn(stream)
+}
+
 // HBoneAcceptedConn keeps track of one accepted H2 connection.
 type HBoneAcceptedConn struct {
 	hb     *HBone
@@ -539,14 +692,11 @@ func (hac *HBoneAcceptedConn) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	host := r.Host
 
 	defer func() {
-		log.Println(r.Method, r.URL, r.Proto, host, r.Header, r.RemoteAddr,
-			time.Since(t0), proxyErr)
+		hac.hb.log.Info("HTTP", "stream", hac.stream.Id, "method", r.Method, "url", r.URL,
+			"proto", r.Proto, "host", host, "remote", r.RemoteAddr, "peer", hac.stream.Peer,
+			"dur", time.Since(t0), "err", proxyErr)
 
 		if r := recover(); r != nil {
-			fmt.Println("Recovered in hbone", r)
-
-			debug.PrintStack()
-
 			// find out exactly what the error was and set err
 			var err error
 
@@ -558,9 +708,7 @@ func (hac *HBoneAcceptedConn) ServeHTTP(w http.ResponseWriter, r *http.Request)
 			default:
 				err = errors.New("Unknown panic")
 			}
-			if err != nil {
-				fmt.Println("ERRROR: ", err)
-			}
+			hac.hb.log.Error("Recovered in hbone", "err", err, "stack", string(debug.Stack()))
 		}
 	}()
 
@@ -581,21 +729,78 @@ func (hac *HBoneAcceptedConn) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Make sure xfcc header is removed
-	r.Header.Del("x-forwarded-client-cert")
-	hac.hb.rp.ServeHTTP(w, r)
+	if rt := hac.hb.matchRoute(r); rt != nil {
+		hac.hb.setXFCC(r, streamTLSState(hac.stream))
+		hac.hb.serveRoute(rt, w, r)
+		moveTrailers(hac.stream)
+		return
+	}
+
+	port, err := hac.hb.localPort(host)
+	if err != nil {
+		proxyErr = err
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	hac.hb.setXFCC(r, streamTLSState(hac.stream))
+	hac.hb.localProxy(port).ServeHTTP(w, r)
+	moveTrailers(hac.stream)
+}
+
+// dialLocal connects to the local application for an accepted stream. If
+// LocalProxyProtocol is set, the PROXY header with the peer address and
+// identity is sent first.
+func (hb *HBone) dialLocal(stream *h2.H2Stream, hostPort string) (net.Conn, error) {
+	var nc net.Conn
+	var err error
+	if hb.LocalTransparent {
+		nc, err = hb.dialTransparent(stream, hostPort)
+	} else {
+		nc, err = net.Dial("tcp", hostPort)
+	}
+	if err != nil || hb.LocalProxyProtocol == "" {
+		return nc, err
+	}
+
+	src := stream.Conn().RemoteAddr()
+	// The destination is the endpoint address requested by the client, if it
+	// is an IP - otherwise the local address we dialed.
+	dst := nc.RemoteAddr()
+	if ta, err := net.ResolveTCPAddr("tcp", stream.Request.Host); err == nil && ta.IP != nil {
+		dst = ta
+	}
+
+	var hdr []byte
+	if hb.LocalProxyProtocol == "v1" {
+		hdr = nio.ProxyHeaderV1(src, dst)
+	} else {
+		tlvs := []nio.ProxyTLV{}
+		if stream.Request.Host != "" {
+			tlvs = append(tlvs, nio.ProxyTLV{Type: nio.ProxyTLVAuthority, Value: []byte(stream.Request.Host)})
+		}
+		if stream.Peer != nil && stream.Peer.Principal != "" {
+			tlvs = append(tlvs, nio.ProxyTLV{Type: nio.ProxyTLVSpiffe, Value: []byte(stream.Peer.Principal)})
+		}
+		hdr = nio.ProxyHeaderV2(src, dst, tlvs...)
+	}
+	if _, err = nc.Write(hdr); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return nc, nil
 }
 
 // HandleTCPProxy connects and forwards r/w to the hostPort
 func (hb *HBone) HandleTCPProxy(w io.Writer, r io.Reader, hostPort string) error {
-	log.Println("net.RoundTripStart", hostPort)
+	hb.log.Debug("HandleTCPProxy", "dest", hostPort)
 	nc, err := net.Dial("tcp", hostPort)
 	if err != nil {
-		log.Println("Error dialing ", hostPort, err)
+		hb.log.Warn("Error dialing", "dest", hostPort, "err", err)
 		return err
 	}
 
-	return Proxy(nc, r, w, hostPort)
+	return hb.Proxy(nc, r, w, hostPort)
 }
 
 // HttpClient returns a http.Client configured with the specified root CA, and reasonable settings.
@@ -619,7 +824,7 @@ func (hb *HBone) HttpClient(caCert []byte) *http.Client {
 	if caCert != nil && len(caCert) > 0 {
 		roots := x509.NewCertPool()
 		if !roots.AppendCertsFromPEM(caCert) {
-			log.Println("Failed to decode PEM")
+			hb.log.Warn("Failed to decode PEM")
 		}
 		tr.TLSClientConfig = &tls.Config{
 			RootCAs: roots,
@@ -702,10 +907,27 @@ type Listener struct {
 
 	// Certificates to use.
 	// Key is a domain, *.domain or *.
+	// Value is a directory with tls.crt and tls.key, or 'cert.pem,key.pem'.
 	Certs map[string]string
 
-	NetListener net.Listener `json:-`
+	// ClientCA is a PEM file with the roots for client certificates, for TLS
+	// listeners. If set, clients must present a valid certificate.
+	ClientCA string `json:"clientCA,omitempty"`
+
+	// ProxyProtocol is set if the listener is behind a TCP load balancer sending
+	// the PROXY protocol (v1 or v2). The accepted connections report the
+	// original client address.
+	ProxyProtocol bool `json:"proxyProtocol,omitempty"`
+
+	// ProxyAuth is the 'user:password' required in the Proxy-Authorization
+	// header, for http_proxy listeners. If empty, no auth is required.
+	ProxyAuth string `json:"proxyAuth,omitempty"`
+
+	NetListener net.Listener `json:"-"`
 	//PortHandler ugate.Handler `json:-`
+
+	once  sync.Once
+	state listenerState
 }
 
 func (l *Listener) Accept() (net.Conn, error) {
@@ -719,12 +941,42 @@ func (l *Listener) Addr() net.Addr {
 	return l.NetListener.Addr()
 }
 
+// GetListener returns the listener with the name, or nil.
+func (hb *HBone) GetListener(name string) *Listener {
+	hb.m.RLock()
+	defer hb.m.RUnlock()
+	return hb.Listeners[name]
+}
+
+// AddListener adds or replaces the listener with the name, returning the
+// replaced listener. Starting and closing the listeners is done by the
+// caller.
+func (hb *HBone) AddListener(name string, l *Listener) *Listener {
+	hb.m.Lock()
+	defer hb.m.Unlock()
+	if hb.Listeners == nil {
+		hb.Listeners = map[string]*Listener{}
+	}
+	old := hb.Listeners[name]
+	hb.Listeners[name] = l
+	return old
+}
+
+// RemoveListener removes the listener with the name, returning it.
+func (hb *HBone) RemoveListener(name string) *Listener {
+	hb.m.Lock()
+	defer hb.m.Unlock()
+	l := hb.Listeners[name]
+	delete(hb.Listeners, name)
+	return l
+}
+
 // Dealing with capture
 
 // HanldeTUN is called when a TCP egress connection is intercepted via TProxy or TUN (gVisor or lwip)
 // target is the destination address, la is the local address (the connection will have it reversed).
 func (hb *HBone) HandleTUN(nc net.Conn, target *net.TCPAddr, la *net.TCPAddr) {
-	log.Println("TProxy TCP ", target, la)
+	hb.log.Debug("TProxy TCP", "dest", target, "src", la)
 	dest := target.String()
 
 	rc, err := hb.Dial("tcp", dest)
@@ -732,12 +984,12 @@ func (hb *HBone) HandleTUN(nc net.Conn, target *net.TCPAddr, la *net.TCPAddr) {
 		nc.Close()
 		return
 	}
-	Proxy(rc, nc, nc, dest)
+	hb.Proxy(rc, nc, nc, dest)
 	return
 }
 
 func (hb *HBone) HandleUdp(dstAddr net.IP, dstPort uint16,
 	localAddr net.IP, localPort uint16,
 	data []byte) {
-	log.Println("TProxy UDP ", dstAddr, dstPort, localAddr, localPort, len(data))
+	hb.log.Debug("TProxy UDP", "dst", dstAddr, "dstPort", dstPort, "src", localAddr, "srcPort", localPort, "len", len(data))
 }
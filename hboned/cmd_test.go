@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/costinm/hbone"
+)
+
+func TestParseForward(t *testing.T) {
+	for _, tc := range []struct {
+		in, bind, dest string
+		ok             bool
+	}{
+		{"8080:echo.test.svc:80", "127.0.0.1:8080", "echo.test.svc:80", true},
+		{"0.0.0.0:8080:echo.test.svc:80", "0.0.0.0:8080", "echo.test.svc:80", true},
+		{":8080:10.1.1.1:80", ":8080", "10.1.1.1:80", true},
+		{"8080:echo.test.svc", "", "", false},
+		{"8080", "", "", false},
+		{"a:b:c:d:e", "", "", false},
+	} {
+		bind, dest, err := parseForward(tc.in)
+		if (err == nil) != tc.ok || bind != tc.bind || dest != tc.dest {
+			t.Error("Unexpected forward", tc.in, bind, dest, err)
+		}
+	}
+}
+
+func TestParseRemoteForward(t *testing.T) {
+	for _, tc := range []struct {
+		in, name, port string
+		ok             bool
+	}{
+		{"8080:80", "tcp-8080", "8080:80", true},
+		{"8080:localhost:80", "tcp-8080", "8080:80", true},
+		{"8080:127.0.0.1:80", "tcp-8080", "8080:80", true},
+		{"8080:10.1.1.1:80", "", "", false},
+		{"8080", "", "", false},
+		{"x:80", "", "", false},
+		{"8080:0", "", "", false},
+		{"70000:80", "", "", false},
+	} {
+		name, port, err := parseRemoteForward(tc.in)
+		if (err == nil) != tc.ok || name != tc.name || port != tc.port {
+			t.Error("Unexpected remote forward", tc.in, name, port, err)
+		}
+	}
+}
+
+func TestAdminAddress(t *testing.T) {
+	for _, tc := range []struct {
+		listeners map[string]*hbone.Listener
+		addr      string
+	}{
+		{nil, "127.0.0.1:15000"},
+		{map[string]*hbone.Listener{"15008": {Protocol: "hbone"}}, "127.0.0.1:15000"},
+		{map[string]*hbone.Listener{"15100": {Protocol: "admin"}}, "127.0.0.1:15100"},
+		{map[string]*hbone.Listener{"admin": {Protocol: "admin", Address: ":15200"}}, "127.0.0.1:15200"},
+		{map[string]*hbone.Listener{"admin": {Protocol: "admin", Address: "0.0.0.0:15200"}}, "127.0.0.1:15200"},
+		{map[string]*hbone.Listener{"admin": {Protocol: "admin", Address: "[::]:15200"}}, "127.0.0.1:15200"},
+		{map[string]*hbone.Listener{"admin": {Protocol: "admin", Address: "10.1.1.1:15200"}}, "10.1.1.1:15200"},
+	} {
+		if a := dialAddress(adminAddress(&hbone.MeshSettings{Listeners: tc.listeners})); a != tc.addr {
+			t.Error("Unexpected admin address", tc.listeners, a)
+		}
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
 
@@ -90,9 +89,7 @@ func GKE2RestCluster(ctx context.Context, uk *hbone.HBone, token string, p strin
 	if err != nil {
 		return nil, err
 	}
-	if hbone.Debug {
-		log.Println(string(rd))
-	}
+	uk.ComponentLogger("gcp").Debug("GKE clusters", "project", p, "res", string(rd))
 
 	cl := &Clusters{}
 	err = json.Unmarshal(rd, cl)
@@ -126,7 +123,7 @@ func GetCluster(ctx context.Context, uk *hbone.HBone, token, path string) (*hbon
 	parts := strings.Split(path, "/")
 	p := parts[2]
 	res, err := uk.Client.Do(req)
-	log.Println(res.StatusCode)
+	uk.ComponentLogger("gcp").Debug("GKE cluster", "path", path, "status", res.StatusCode)
 	rd, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return nil, err
@@ -154,16 +151,16 @@ func Hub2RestClusters(ctx context.Context, uk *hbone.HBone, tok, p string) ([]*h
 		"https://gkehub.googleapis.com/v1/projects/"+p+"/locations/-/memberships", nil)
 	req.Header.Add("authorization", "Bearer "+tok)
 
+	log := uk.ComponentLogger("gcp")
 	res, err := uk.Client.Do(req)
-	log.Println(res.StatusCode)
 	rd, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return nil, err
 	}
 	cl := []*hbone.Cluster{}
-	log.Println(string(rd))
+	log.Debug("Hub memberships", "project", p, "status", res.StatusCode, "res", string(rd))
 	if res.StatusCode == 403 {
-		log.Println("Hub not authorized ", string(rd))
+		log.Warn("Hub not authorized", "project", p, "res", string(rd))
 		// This is not considered an error - but user intent.
 		return cl, nil
 	}
@@ -178,7 +175,7 @@ func Hub2RestClusters(ctx context.Context, uk *hbone.HBone, tok, p string) ([]*h
 			if strings.HasPrefix(ca, "//container.googleapis.com") {
 				rc, err := GetCluster(ctx, uk, tok, ca[len("//container.googleapis.com"):])
 				if err != nil {
-					log.Println("Failed to get ", ca, err)
+					log.Warn("Failed to get GKE cluster", "cluster", ca, "err", err)
 				} else {
 					uk.AddService(rc)
 					cl = append(cl, rc)
@@ -206,7 +203,7 @@ func GcpSecret(ctx context.Context, uk *hbone.HBone, token, p, n, v string) ([]b
 	req.Header.Add("authorization", "Bearer "+token)
 
 	res, err := uk.Client.Do(req)
-	log.Println(res.StatusCode)
+	uk.ComponentLogger("gcp").Debug("GCP secret", "project", p, "name", n, "status", res.StatusCode)
 	rd, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return nil, err
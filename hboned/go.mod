@@ -1,6 +1,6 @@
 module github.com/costinm/hbone/hboned
 
-go 1.18
+go 1.21
 
 replace github.com/costinm/hbone => ./..
 
@@ -26,6 +26,7 @@ require (
 	github.com/kr/pretty v0.1.0 // indirect
 	golang.org/x/net v0.1.0 // indirect
 	golang.org/x/sys v0.1.0 // indirect
+	golang.org/x/text v0.4.0 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/protobuf v1.28.1 // indirect
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
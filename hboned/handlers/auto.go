@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"net"
+	"strings"
+
+	"github.com/costinm/hbone"
+	"github.com/costinm/hbone/nio"
+)
+
+// HandleAutoConn detects the protocol of the connection and dispatches to
+// the matching handler. Used when a single port is exposed - Cloud Run or a
+// single load balancer port.
+//
+// - TLS: Istio SNI ('outbound_.') or ALPN ('istio*') are routed by SNI, other
+// TLS connections are HBONE mTLS.
+// - h2c prior knowledge: HBONE over plain text.
+// - HTTP/1.1: local HTTP handlers and app.
+// - SOCKS5: only from localhost, to avoid an open proxy.
+// - PROXY header: only if trustProxy is set - the listener is behind a load
+// balancer. The header is optional.
+func HandleAutoConn(hb *hbone.HBone, conn net.Conn, trustProxy bool) {
+	log := hb.ComponentLogger("auto")
+	bc, proto, err := nio.SniffConn(conn)
+	if err == nil && proto == nio.SniffProxy {
+		if !trustProxy {
+			log.Warn("PROXY header on untrusted listener", "remote", conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+		var pc *nio.ProxyConn
+		pc, err = nio.AcceptProxyHeader(bc)
+		if err == nil {
+			bc, proto, err = nio.SniffConn(pc)
+		}
+	}
+	if err != nil {
+		log.Warn("Protocol detection failed", "remote", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+
+	switch proto {
+	case nio.SniffTLS:
+		ch, err := nio.ParseClientHello(bc.Reader)
+		if err != nil {
+			log.Warn("Invalid TLS", "remote", conn.RemoteAddr(), "err", err)
+			conn.Close()
+			return
+		}
+		if isIstioSNI(ch) {
+			HandleSNIConn(hb, bc)
+			return
+		}
+		hb.HandleAcceptedH2(bc)
+	case nio.SniffH2C:
+		hb.HandleAcceptedH2C(bc)
+	case nio.SniffHTTP:
+		hb.HandleAcceptedHTTP(bc)
+	case nio.SniffSOCKS5:
+		if !isLoopback(bc.RemoteAddr()) {
+			log.Warn("SOCKS from non-local address", "remote", bc.RemoteAddr())
+			conn.Close()
+			return
+		}
+		err = HandleSocksConn(hb, bc)
+		if err != nil {
+			log.Warn("Error handling SOCKS", "remote", bc.RemoteAddr(), "err", err)
+		}
+	default:
+		log.Warn("Unexpected protocol", "proto", proto, "remote", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// isIstioSNI returns true for connections from Istio sidecars, using SNI
+// routing to the destination.
+func isIstioSNI(ch *nio.ClientHelloMsg) bool {
+	if strings.HasPrefix(ch.ServerName, "outbound_.") {
+		return true
+	}
+	for _, a := range ch.ALPN {
+		if strings.HasPrefix(a, "istio") {
+			return true
+		}
+	}
+	return false
+}
+
+func isLoopback(a net.Addr) bool {
+	ta, ok := a.(*net.TCPAddr)
+	return ok && ta.IP.IsLoopback()
+}
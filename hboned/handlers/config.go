@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/costinm/hbone"
+	"sigs.k8s.io/yaml"
+)
+
+// Runtime config API, on the admin port. Bodies are YAML or JSON, with the
+// same format as the entries in hbone.yaml.
+//
+// - PUT|DELETE /config/clusters/NAME - NAME is the key in Clusters.
+// - PUT /config/clusters/NAME/endpoints - replace the endpoints (list).
+// - POST /config/clusters/NAME/endpoints - add an endpoint.
+// - DELETE /config/clusters/NAME/endpoints/ADDRESS
+// - PUT|DELETE /config/listeners/NAME - the listener is restarted.
+// - PUT|DELETE /config/localforward/PORT - the body is the destination.
+//
+// GET returns the current value.
+//
+// If AdminToken is set, requests must include it as a bearer token,
+// otherwise only local clients are allowed, and changes must include the
+// x-hbone-admin header. Browsers can't send it to another origin without a
+// CORS preflight, which is not allowed - a web page can't make changes.
+
+const configPrefix = "/config/"
+
+// maxConfigBody is the max size of a config request.
+const maxConfigBody = 1 << 20
+
+// HeaderAdmin is required on config changes from local clients, if
+// AdminToken is not set.
+const HeaderAdmin = "x-hbone-admin"
+
+// InitConfigAPI registers the config API on the mux.
+func InitConfigAPI(hb *hbone.HBone, mux *http.ServeMux) {
+	mux.Handle(configPrefix, ConfigHandler(hb))
+}
+
+// ConfigHandler returns the handler for the config API.
+func ConfigHandler(hb *hbone.HBone) http.HandlerFunc {
+	log := hb.ComponentLogger("config")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(hb, r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, configPrefix), "/")
+		if len(parts) < 2 || parts[1] == "" {
+			http.NotFound(w, r)
+			return
+		}
+		var body []byte
+		if r.Method == http.MethodPut || r.Method == http.MethodPost {
+			var err error
+			body, err = io.ReadAll(io.LimitReader(r.Body, maxConfigBody))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		var res interface{}
+		status, err := http.StatusOK, error(nil)
+		switch parts[0] {
+		case "clusters":
+			res, status, err = configCluster(hb, r.Method, parts[1:], body)
+		case "listeners":
+			res, status, err = configListener(hb, r.Method, parts[1], body)
+		case "localforward":
+			res, status, err = configLocalForward(hb, r.Method, parts[1], body)
+		default:
+			status, err = http.StatusNotFound, errors.New("not found")
+		}
+		if r.Method != http.MethodGet {
+			log.Info("Config", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr,
+				"status", status, "err", err)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if res == nil {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// adminAuthorized checks the bearer token. If no token is configured, the
+// client must be local, using a local Host, and changes must have the
+// HeaderAdmin header.
+func adminAuthorized(hb *hbone.HBone, r *http.Request) bool {
+	if hb.AdminToken != "" {
+		tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return ok && subtle.ConstantTimeCompare([]byte(tok), []byte(hb.AdminToken)) == 1
+	}
+	if !loopbackClient(r) || !localHost(r.Host) {
+		return false
+	}
+	return r.Method == http.MethodGet || r.Method == http.MethodHead || r.Header.Get(HeaderAdmin) != ""
+}
+
+// AdminHandler returns the handler for the admin listener. Requests from local
+// clients must use a local Host - other names are used by web pages with DNS
+// rebinding, to reach the port from the browser.
+func AdminHandler(hb *hbone.HBone, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if loopbackClient(r) && !localHost(r.Host) {
+			hb.ComponentLogger("admin").Warn("Invalid admin host", "host", r.Host, "remote", r.RemoteAddr)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// loopbackClient returns true if the request is from a loopback address.
+func loopbackClient(r *http.Request) bool {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// localHost returns true if the Host header is localhost or a loopback IP,
+// with an optional port.
+func localHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+var errMethod = errors.New("method not allowed")
+
+func configCluster(hb *hbone.HBone, method string, parts []string, body []byte) (interface{}, int, error) {
+	name := parts[0]
+	if len(parts) > 1 && parts[1] == "endpoints" {
+		return configEndpoints(hb, method, name, parts[2:], body)
+	}
+	if len(parts) > 1 {
+		return nil, http.StatusNotFound, errors.New("not found")
+	}
+	switch method {
+	case http.MethodGet:
+		c := hb.GetCluster(name)
+		if c == nil {
+			return nil, http.StatusNotFound, errors.New("cluster not found")
+		}
+		return hbone.NewClusterInfo(c), http.StatusOK, nil
+	case http.MethodPut:
+		c := &hbone.Cluster{}
+		if err := yaml.Unmarshal(body, c); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if err := hb.SetCluster(name, c); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		return hbone.NewClusterInfo(c), http.StatusOK, nil
+	case http.MethodDelete:
+		if hb.RemoveCluster(name) == nil {
+			return nil, http.StatusNotFound, errors.New("cluster not found")
+		}
+		return nil, http.StatusNoContent, nil
+	}
+	return nil, http.StatusMethodNotAllowed, errMethod
+}
+
+func configEndpoints(hb *hbone.HBone, method, name string, parts []string, body []byte) (interface{}, int, error) {
+	c := hb.GetCluster(name)
+	if c == nil {
+		return nil, http.StatusNotFound, errors.New("cluster not found")
+	}
+	switch {
+	case method == http.MethodGet && len(parts) == 0:
+		return hbone.NewClusterInfo(c).Endpoints, http.StatusOK, nil
+	case method == http.MethodPut && len(parts) == 0:
+		var eps []*hbone.Endpoint
+		if err := yaml.Unmarshal(body, &eps); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		for i, ep := range eps {
+			if err := ep.Validate(); err != nil {
+				return nil, http.StatusBadRequest, errors.New("endpoints[" + strconv.Itoa(i) + "]: " + err.Error())
+			}
+		}
+		c.UpdateEndpoints(eps)
+		return eps, http.StatusOK, nil
+	case method == http.MethodPost && len(parts) == 0:
+		ep := &hbone.Endpoint{}
+		if err := yaml.Unmarshal(body, ep); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if err := ep.Validate(); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		c.AddEndpoint(ep)
+		return ep, http.StatusCreated, nil
+	case method == http.MethodDelete && len(parts) == 1:
+		if !c.RemoveEndpoint(parts[0]) {
+			return nil, http.StatusNotFound, errors.New("endpoint not found")
+		}
+		return nil, http.StatusNoContent, nil
+	}
+	return nil, http.StatusMethodNotAllowed, errMethod
+}
+
+func configListener(hb *hbone.HBone, method, name string, body []byte) (interface{}, int, error) {
+	switch method {
+	case http.MethodGet:
+		l := hb.GetListener(name)
+		if l == nil {
+			return nil, http.StatusNotFound, errors.New("listener not found")
+		}
+		return listenerJSON(l), http.StatusOK, nil
+	case http.MethodPut:
+		l := &hbone.Listener{}
+		if err := yaml.Unmarshal(body, l); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if l.Address == "" {
+			l.Address = name
+		}
+		if err := ValidateListener(hb, l); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		old := hb.GetListener(name)
+		StopListener(old)
+		if err := StartListener(hb, l); err != nil {
+			if old != nil {
+				// Keep the old listener if the new one can't be started.
+				if rerr := StartListener(hb, old); rerr != nil {
+					err = fmt.Errorf("%w, restarting old listener: %v", err, rerr)
+				}
+			}
+			return nil, http.StatusConflict, err
+		}
+		hb.AddListener(name, l)
+		return listenerJSON(l), http.StatusOK, nil
+	case http.MethodDelete:
+		l := hb.RemoveListener(name)
+		if l == nil {
+			return nil, http.StatusNotFound, errors.New("listener not found")
+		}
+		StopListener(l)
+		return nil, http.StatusNoContent, nil
+	}
+	return nil, http.StatusMethodNotAllowed, errMethod
+}
+
+// listenerJSON returns the listener config, without ProxyAuth.
+func listenerJSON(l *hbone.Listener) interface{} {
+	res := map[string]interface{}{}
+	b, _ := json.Marshal(l)
+	json.Unmarshal(b, &res)
+	if res["proxyAuth"] != nil {
+		res["proxyAuth"] = "REDACTED"
+	}
+	return res
+}
+
+func configLocalForward(hb *hbone.HBone, method, ports string, body []byte) (interface{}, int, error) {
+	port, err := strconv.Atoi(ports)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	switch method {
+	case http.MethodGet:
+		dest := hb.LocalForwardDest(port)
+		if dest == "" {
+			return nil, http.StatusNotFound, errors.New("forward not found")
+		}
+		return dest, http.StatusOK, nil
+	case http.MethodPut:
+		var dest string
+		if err := yaml.Unmarshal(body, &dest); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if err := hb.StartLocalForward(port, dest); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		return dest, http.StatusOK, nil
+	case http.MethodDelete:
+		if !hb.StopLocalForward(port) {
+			return nil, http.StatusNotFound, errors.New("forward not found")
+		}
+		return nil, http.StatusNoContent, nil
+	}
+	return nil, http.StatusMethodNotAllowed, errMethod
+}
@@ -0,0 +1,321 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/costinm/hbone"
+)
+
+// configRequest calls the config API from the remote address, returning the
+// status and the decoded JSON body. The Host is local and the admin header
+// is set, unless overridden by hdr ("host" sets the Host).
+func configRequest(t *testing.T, h http.Handler, remote, method, path, body string, hdr ...string) (int, map[string]interface{}) {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.RemoteAddr = remote
+	r.Host = "localhost:15000"
+	r.Header.Set(HeaderAdmin, "1")
+	for i := 0; i < len(hdr); i += 2 {
+		if hdr[i] == "host" {
+			r.Host = hdr[i+1]
+			continue
+		}
+		r.Header.Set(hdr[i], hdr[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	res := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &res)
+	return w.Code, res
+}
+
+func TestConfigAuth(t *testing.T) {
+	hb := hbone.New(nil, &hbone.MeshSettings{})
+	hb.AddService(&hbone.Cluster{Addr: "echo.test.svc:8080"})
+	mux := http.NewServeMux()
+	InitConfigAPI(hb, mux)
+	const path = "/config/clusters/echo.test.svc:8080"
+
+	for _, tc := range []struct {
+		remote string
+		code   int
+	}{
+		{"127.0.0.1:1234", 200},
+		{"[::1]:1234", 200},
+		{"10.1.1.1:1234", http.StatusUnauthorized},
+	} {
+		if code, _ := configRequest(t, mux, tc.remote, "GET", path, ""); code != tc.code {
+			t.Error("Unexpected status without token", tc.remote, code)
+		}
+	}
+
+	// Without a token, a web page can't make changes - it can't set the
+	// admin header, and DNS rebinding uses another Host.
+	for _, tc := range []struct {
+		hdr  []string
+		code int
+	}{
+		{[]string{HeaderAdmin, ""}, http.StatusUnauthorized},
+		{[]string{"host", "evil.example.com:15000"}, http.StatusUnauthorized},
+		{[]string{"host", "127.0.0.1:15000"}, http.StatusNoContent},
+	} {
+		hb.AddService(&hbone.Cluster{Addr: "echo.test.svc:8080"})
+		if code, _ := configRequest(t, mux, "127.0.0.1:1234", "DELETE", path, "", tc.hdr...); code != tc.code {
+			t.Error("Unexpected status for change", tc.hdr, code)
+		}
+	}
+	hb.AddService(&hbone.Cluster{Addr: "echo.test.svc:8080"})
+
+	// With a token, local clients must also use it.
+	hb.AdminToken = "secret"
+	for _, tc := range []struct {
+		auth string
+		code int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer other", http.StatusUnauthorized},
+		{"Basic secret", http.StatusUnauthorized},
+		{"Bearer secret", 200},
+	} {
+		for _, remote := range []string{"127.0.0.1:1234", "10.1.1.1:1234"} {
+			if code, _ := configRequest(t, mux, remote, "GET", path, "", "Authorization", tc.auth); code != tc.code {
+				t.Error("Unexpected status", remote, tc.auth, code)
+			}
+		}
+	}
+}
+
+func TestConfigClusters(t *testing.T) {
+	hb := hbone.New(nil, &hbone.MeshSettings{})
+	h := ConfigHandler(hb)
+	req := func(method, path, body string) (int, map[string]interface{}) {
+		t.Helper()
+		return configRequest(t, h, "127.0.0.1:1234", method, "/config/"+path, body)
+	}
+
+	if code, _ := req("GET", "clusters/echo", ""); code != http.StatusNotFound {
+		t.Error("Expecting not found", code)
+	}
+	if code, _ := req("PUT", "clusters/echo", "addr: [invalid"); code != http.StatusBadRequest {
+		t.Error("Expecting bad request for invalid yaml", code)
+	}
+	if code, _ := req("PUT", "clusters/echo", "addr: echo.test.svc"); code != http.StatusBadRequest {
+		t.Error("Expecting bad request for invalid cluster", code)
+	}
+	code, res := req("PUT", "clusters/echo", "addr: echo.test.svc:8080\nlabels:\n  a: b\n")
+	if code != 200 || res["addr"] != "echo.test.svc:8080" {
+		t.Fatal("Unexpected PUT", code, res)
+	}
+	if hb.GetCluster("echo.test.svc:8080") == nil || hb.GetCluster("echo") == nil {
+		t.Error("Cluster not added")
+	}
+
+	code, _ = req("PUT", "clusters/echo/endpoints", "- address: 10.0.0.1:8080\n- address: 10.0.0.2:8080\n")
+	if code != 200 || len(hbone.NewClusterInfo(hb.GetCluster("echo")).Endpoints) != 2 {
+		t.Error("Unexpected endpoints PUT", code)
+	}
+	if code, _ := req("PUT", "clusters/echo/endpoints", "- address: 10.0.0.1\n"); code != http.StatusBadRequest {
+		t.Error("Expecting invalid endpoint", code)
+	}
+	if code, _ := req("POST", "clusters/echo/endpoints", "address: 10.0.0.3:8080"); code != http.StatusCreated {
+		t.Error("Unexpected endpoints POST", code)
+	}
+	if code, _ := req("DELETE", "clusters/echo/endpoints/10.0.0.1:8080", ""); code != http.StatusNoContent {
+		t.Error("Unexpected endpoint DELETE", code)
+	}
+	if code, _ := req("DELETE", "clusters/echo/endpoints/10.0.0.1:8080", ""); code != http.StatusNotFound {
+		t.Error("Expecting endpoint not found", code)
+	}
+	code, res = req("GET", "clusters/echo", "")
+	if eps, _ := res["endpoints"].([]interface{}); code != 200 || len(eps) != 2 {
+		t.Error("Unexpected GET", code, res)
+	}
+	if code, _ := req("POST", "clusters/echo", ""); code != http.StatusMethodNotAllowed {
+		t.Error("Expecting method not allowed", code)
+	}
+
+	if code, _ := req("DELETE", "clusters/echo", ""); code != http.StatusNoContent {
+		t.Error("Unexpected DELETE", code)
+	}
+	if hb.GetCluster("echo") != nil || hb.GetCluster("echo.test.svc:8080") != nil {
+		t.Error("Cluster not removed")
+	}
+	if code, _ := req("DELETE", "clusters/echo", ""); code != http.StatusNotFound {
+		t.Error("Expecting not found", code)
+	}
+	if code, _ := req("GET", "other/x", ""); code != http.StatusNotFound {
+		t.Error("Expecting not found for unknown type", code)
+	}
+}
+
+func TestConfigListeners(t *testing.T) {
+	hb := hbone.New(nil, &hbone.MeshSettings{})
+	h := ConfigHandler(hb)
+	req := func(method, path, body string) (int, map[string]interface{}) {
+		t.Helper()
+		return configRequest(t, h, "127.0.0.1:1234", method, "/config/"+path, body)
+	}
+	accepting := func(l *hbone.Listener) bool {
+		c, err := net.Dial("tcp", l.NetListener.Addr().String())
+		if err != nil {
+			return false
+		}
+		c.Close()
+		return true
+	}
+
+	if code, _ := req("PUT", "listeners/sni", "protocol: nope\naddress: 127.0.0.1:0"); code != http.StatusBadRequest {
+		t.Error("Expecting invalid protocol", code)
+	}
+	if code, _ := req("PUT", "listeners/proxy", "protocol: http_proxy\naddress: 0.0.0.0:0"); code != http.StatusBadRequest {
+		t.Error("Expecting http_proxy without auth to be rejected", code)
+	}
+
+	code, _ := req("PUT", "listeners/sni", "protocol: sni\naddress: 127.0.0.1:0")
+	l1 := hb.GetListener("sni")
+	if code != 200 || l1 == nil || !accepting(l1) {
+		t.Fatal("Listener not started", code)
+	}
+	t.Cleanup(func() { StopListener(hb.GetListener("sni")) })
+
+	t.Run("restart", func(t *testing.T) {
+		code, _ := req("PUT", "listeners/sni", "protocol: sni\naddress: 127.0.0.1:0")
+		l2 := hb.GetListener("sni")
+		if code != 200 || l2 == l1 || !accepting(l2) {
+			t.Fatal("Listener not replaced", code)
+		}
+		if accepting(l1) {
+			t.Error("Old listener not closed")
+		}
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		busy, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer busy.Close()
+		old := hb.GetListener("sni")
+		code, _ := req("PUT", "listeners/sni", "protocol: sni\naddress: "+busy.Addr().String())
+		if code != http.StatusConflict {
+			t.Fatal("Expecting conflict", code)
+		}
+		if l := hb.GetListener("sni"); l != old || !accepting(l) {
+			t.Error("Old listener not restarted")
+		}
+	})
+
+	t.Run("redacted", func(t *testing.T) {
+		code, res := req("PUT", "listeners/proxy", "protocol: http_proxy\naddress: 127.0.0.1:0\nproxyAuth: user:secret")
+		if code != 200 || res["proxyAuth"] != "REDACTED" {
+			t.Error("Unexpected PUT response", code, res)
+		}
+		code, res = req("GET", "listeners/proxy", "")
+		if code != 200 || res["proxyAuth"] != "REDACTED" || res["protocol"] != "http_proxy" {
+			t.Error("Unexpected GET response", code, res)
+		}
+		if hb.GetListener("proxy").ProxyAuth != "user:secret" {
+			t.Error("Listener modified")
+		}
+	})
+
+	l := hb.GetListener("proxy")
+	if code, _ := req("DELETE", "listeners/proxy", ""); code != http.StatusNoContent {
+		t.Error("Unexpected DELETE", code)
+	}
+	if hb.GetListener("proxy") != nil || accepting(l) {
+		t.Error("Listener not removed")
+	}
+	if code, _ := req("DELETE", "listeners/proxy", ""); code != http.StatusNotFound {
+		t.Error("Expecting not found", code)
+	}
+}
+
+func TestConfigLocalForward(t *testing.T) {
+	hb := hbone.New(nil, &hbone.MeshSettings{})
+	h := ConfigHandler(hb)
+	req := func(method, path, body string) int {
+		t.Helper()
+		code, _ := configRequest(t, h, "127.0.0.1:1234", method, "/config/"+path, body)
+		return code
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+
+	if code := req("PUT", "localforward/x", "echo:80"); code != http.StatusBadRequest {
+		t.Error("Expecting invalid port", code)
+	}
+	if code := req("PUT", "localforward/"+port, "echo"); code != http.StatusBadRequest {
+		t.Error("Expecting invalid destination", code)
+	}
+	if code := req("PUT", "localforward/"+port, "echo.test.svc:8080"); code != 200 {
+		t.Fatal("Unexpected PUT", code)
+	}
+	if hb.LocalForwardDest(l.Addr().(*net.TCPAddr).Port) != "echo.test.svc:8080" {
+		t.Error("Forward not added")
+	}
+	if code := req("GET", "localforward/"+port, ""); code != 200 {
+		t.Error("Unexpected GET", code)
+	}
+	if code := req("DELETE", "localforward/"+port, ""); code != http.StatusNoContent {
+		t.Error("Unexpected DELETE", code)
+	}
+	if code := req("GET", "localforward/"+port, ""); code != http.StatusNotFound {
+		t.Error("Expecting not found", code)
+	}
+}
+
+func TestAdminListener(t *testing.T) {
+	hb := hbone.New(nil, &hbone.MeshSettings{})
+	InitExpvar(hb)
+	InitConfigAPI(hb, hb.AdminMux)
+	// A port alone binds 127.0.0.1.
+	l := &hbone.Listener{Address: "0", Protocol: "admin"}
+	if err := StartListener(hb, l); err != nil {
+		t.Fatal(err)
+	}
+	defer StopListener(l)
+	if a := l.NetListener.Addr().(*net.TCPAddr); !a.IP.IsLoopback() {
+		t.Error("Admin listener not on loopback", a)
+	}
+
+	// The config API and debug handlers are on the admin mux, requests with
+	// a non-local Host are rejected.
+	addr := l.NetListener.Addr().String()
+	for _, tc := range []struct {
+		host, path string
+		code       int
+	}{
+		{addr, "/debug/clusters", 200},
+		{"localhost", "/config/clusters/none", http.StatusNotFound},
+		{"evil.example.com", "/debug/clusters", http.StatusForbidden},
+	} {
+		r, _ := http.NewRequest("GET", "http://"+addr+tc.path, nil)
+		r.Host = tc.host
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tc.code {
+			t.Error("Unexpected status", tc.host, tc.path, res.StatusCode)
+		}
+	}
+	r := httptest.NewRequest("GET", "/debug/clusters", nil)
+	r.Host = "localhost"
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Error("Admin handlers registered on the default mux", w.Code)
+	}
+}
@@ -1,8 +1,8 @@
 package handlers
 
 import (
-	"log"
-	"net/http"
+	"expvar"
+	"net/http/pprof"
 	"time"
 
 	"github.com/costinm/hbone"
@@ -12,15 +12,26 @@ import (
 )
 
 func InitExpvar(hb *hbone.HBone) {
+	log := hb.ComponentLogger("access")
 
 	hb.OnEvent(h2.EventStreamStart, h2.EventHandlerFunc(func(evt h2.EventType, t *h2.H2Transport, s *h2.H2Stream, f *nio.Buffer) {
 	}))
 
 	hb.OnEvent(h2.EventStreamClosed, h2.EventHandlerFunc(func(evt h2.EventType, t *h2.H2Transport, s *h2.H2Stream, f *nio.Buffer) {
 		// TODO: Access log format, json, proto ?
-		log.Println("Stream", s.Request.URL, time.Since(s.Open))
+		log.Info("Stream", "conn", t.ConnectionID(), "stream", s.Id, "url", s.Request.URL,
+			"peer", s.Peer, "dur", time.Since(s.Open))
 	}))
 
 	// WIP: write expvar metrics using prometheus format (text)
-	http.HandleFunc("/metrics", tel.HandleMetrics)
+	mux := hb.AdminMux
+	mux.HandleFunc("/metrics", tel.HandleMetrics)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	hb.HandleDebug(mux)
 }
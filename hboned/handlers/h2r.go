@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/costinm/hbone"
@@ -17,6 +18,8 @@ import (
 //
 // Either SNI or bob's cert SAN can be used to identify the cluster this belongs to.
 //
+// This is implemented in hbone.DialH2R (bob) and HBone.HandlerH2RConn (gate) - on
+// the hbone port with ALPN=h2r, or on a listener with protocol 'h2r'.
 
 // Alternative protocol using infra/POST (no changes to H2 or TLS, single connection, double mux):
 // - Bob connects to regular hbone/POST port, starts a regular HBone H2 connection
@@ -25,35 +28,29 @@ import (
 // - Option 2: Gate adds the stream to a 'listeners' list, forwards incoming stream directly
 //   ( no encapsulation ).
 
-// New implementation - extended H2 stack.
-
-// WIP: RemoteForward is similar with ssh -R remotePort.
-// Will use the H2R protocol to open a remote H2C connection
-// attached to the Hbone remote server.
+// RemoteForward is similar with ssh -R: the node keeps a reverse (H2R)
+// connection to the gateway at hg, and is registered on the gateway as
+// sn.ns. Streams for sn.ns:PORT on the gateway are forwarded to the local
+// ports, using Ports. Reconnects until the process exits.
 func RemoteForward(hb *hbone.HBone, hg, sn, ns string) *hbone.EndpointCon {
-	attachC := &hbone.Cluster{
-		ID:   "h2r-" + hg,
-		Addr: sn + "." + ns + ":15009",
-		SNI:  fmt.Sprintf("outbound_.%s_._.%s.%s.svc.cluster.local", "15009", sn, ns),
-	}
-	hb.AddService(attachC, &hbone.Endpoint{
-		Address: attachC.Addr,
-		Labels: map[string]string{
-			"h2r": "1",
-		},
+	attachC := hb.AddService(&hbone.Cluster{
+		Addr: "h2r-" + hg,
+		SNI:  fmt.Sprintf("%s.%s.svc.cluster.local", sn, ns),
 	})
 
 	attachE := &hbone.EndpointCon{
 		Endpoint: &hbone.Endpoint{
-			Address: attachC.Addr,
+			Address: hg,
+			Labels: map[string]string{
+				"h2r": "1",
+			},
 		},
 		Cluster: attachC,
 	}
 
-	//go func() {
-	//	_, err := DialH2R(context.Background(), attachE, hg)
-	//	log.Println("H2R connected", hg, err)
-	//}()
+	if err := hbone.DialH2R(context.Background(), attachE, hg); err != nil {
+		hb.ComponentLogger("h2r").Warn("H2R connect failed, retrying", "gate", hg, "sni", attachC.SNI, "err", err)
+	}
 
 	return attachE
 }
@@ -74,64 +71,3 @@ func RemoteForward(hb *hbone.HBone, hg, sn, ns string) *hbone.EndpointCon {
 //
 //	return m.rt.(*http2.ClientConn), nil
 //}
-//
-//func (hb *HBone) MarkDead(conn *http2.ClientConn) {
-//	hb.m.Lock()
-//	sni := hb.H2RConn[conn]
-//
-//	if sni != nil {
-//		log.Println("H2RSNI: MarkDead ", sni)
-//	}
-//	delete(hb.H2RConn, conn)
-//	hb.m.Unlock()
-//
-//}
-
-//// HandleH2RConn takes a connection on the H2R port or on a stream and
-//// implements a reverse connection.
-//func (hb *HBone) HandlerH2RConn(conn net.Conn) {
-//	conf := hb.Auth.GenerateTLSConfigServer()
-//
-//	tls := tls.Server(conn, conf)
-//
-//	err := nio.HandshakeTimeout(tls, hb.HandsahakeTimeout, conn)
-//	if err != nil {
-//		conn.Close()
-//		return
-//	}
-//
-//	// At this point we have the client identity, and we know it's in the trust domain and right CA.
-//	// TODO: save the endpoint.
-//
-//	// TODO: construct the SNI header, save it in the map
-//	// TODO: validate the trust domain, root cert, etc
-//
-//	sni := tls.ConnectionState().ServerName
-//	if Debug {
-//		log.Println("H2RSNI: accepted ", sni)
-//	}
-//	ctx := context.Background()
-//
-//	c, _ := hb.Cluster(ctx, sni)
-//
-//	// not blocking. Will write the 'preface' and start reading.
-//	// When done, MarkDead on the conn pool in the transport is called.
-//	rt, err := hb.h2t.NewClientConn(tls)
-//	if err != nil {
-//		conn.Close()
-//		return
-//	}
-//
-//	ec := &EndpointCon{
-//		c:        c,
-//		Endpoint: &Endpoint{Address: sni},
-//		rt:       rt,
-//	}
-//	hb.m.Lock()
-//	c.EndpointCon = append(c.EndpointCon, ec)
-//	hb.m.Unlock()
-//
-//	hb.H2RConn[rt] = ec
-//
-//	// TODO: track the active connections in hb, for close purpose.
-//}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/costinm/hbone"
+)
+
+// HTTP/1.1 forward proxy, for apps using HTTP_PROXY/HTTPS_PROXY.
+//
+// - CONNECT host:port - tunnel using hb.Dial, like SOCKS.
+// - absolute URI (GET http://host/path) - the request is forwarded using the
+// mesh cluster for the host, or directly for hosts not in the mesh.
+//
+// If auth is set ('user:password'), requests must include a matching Basic
+// Proxy-Authorization header.
+
+// hopHeaders are removed from forwarded requests and responses.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// HandleHTTPProxyConn serves a HTTP proxy connection. Blocks until the
+// connection is closed.
+func HandleHTTPProxyConn(hb *hbone.HBone, conn net.Conn, auth string) error {
+	log := hb.ComponentLogger("http_proxy")
+	defer conn.Close()
+	if !hb.AcceptConn() {
+		log.Warn("Connection limit reached", "remote", conn.RemoteAddr())
+		return nil
+	}
+	defer hb.ReleaseConn()
+	br := bufio.NewReader(conn)
+	// Connections to hosts outside the mesh are reused for this client.
+	direct := &http.Transport{
+		DialContext: hb.DialContext,
+	}
+	defer direct.CloseIdleConnections()
+
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		t0 := time.Now()
+
+		if !checkProxyAuth(req, auth) {
+			writeProxyResponse(conn, http.StatusProxyAuthRequired,
+				http.Header{"Proxy-Authenticate": {`Basic realm="hbone"`}}, nil)
+			return nil
+		}
+
+		release, err := hb.AcquireStream(conn.RemoteAddr().String())
+		if err != nil {
+			log.Warn("Stream limit reached", "remote", conn.RemoteAddr(), "err", err)
+			writeProxyResponse(conn, http.StatusServiceUnavailable,
+				http.Header{"Retry-After": {"1"}}, nil)
+			return nil
+		}
+
+		if req.Method == http.MethodConnect {
+			defer release()
+			nc, err := hb.Dial("tcp", req.Host)
+			if err != nil {
+				log.Warn("Error dialing", "dest", req.Host, "err", err)
+				writeProxyResponse(conn, proxyErrStatus(err), nil, err)
+				return err
+			}
+			_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			if err != nil {
+				nc.Close()
+				return err
+			}
+			err = hb.Proxy(nc, br, conn, req.Host)
+			log.Info("CONNECT", "dest", req.Host, "remote", conn.RemoteAddr(),
+				"dur", time.Since(t0), "err", err)
+			return err
+		}
+
+		if req.URL.Host == "" {
+			writeProxyResponse(conn, http.StatusBadRequest, nil, errors.New("absolute URI required"))
+			return nil
+		}
+
+		res, err := proxyRoundTrip(hb, direct, req)
+		log.Info("HTTP", "method", req.Method, "url", req.URL, "remote", conn.RemoteAddr(),
+			"dur", time.Since(t0), "err", err)
+		if err != nil {
+			release()
+			writeProxyResponse(conn, proxyErrStatus(err), nil, err)
+			return err
+		}
+		removeHopHeaders(res.Header)
+		err = res.Write(conn)
+		res.Body.Close()
+		release()
+		if err != nil {
+			return err
+		}
+		if req.Close || res.Close {
+			return nil
+		}
+	}
+}
+
+// proxyRoundTrip forwards an absolute-URI request, using the mesh cluster
+// for the host if one is defined.
+func proxyRoundTrip(hb *hbone.HBone, direct http.RoundTripper, req *http.Request) (*http.Response, error) {
+	req.RequestURI = ""
+	removeHopHeaders(req.Header)
+
+	hostPort := req.URL.Host
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		port := "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+		hostPort = net.JoinHostPort(hostPort, port)
+	}
+	if c := hb.GetCluster(hostPort); c != nil {
+		return c.RoundTrip(req)
+	}
+	return direct.RoundTrip(req)
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, c := range h.Values("Connection") {
+		for _, k := range strings.Split(c, ",") {
+			h.Del(strings.TrimSpace(k))
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+// checkProxyAuth verifies the Basic Proxy-Authorization header, if auth is
+// set. The header is removed from the request.
+func checkProxyAuth(req *http.Request, auth string) bool {
+	h := req.Header.Get("Proxy-Authorization")
+	req.Header.Del("Proxy-Authorization")
+	if auth == "" {
+		return true
+	}
+	if !strings.HasPrefix(h, "Basic ") {
+		return false
+	}
+	dec, err := base64.StdEncoding.DecodeString(h[6:])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(dec, []byte(auth)) == 1
+}
+
+// proxyErrStatus returns the status for a dial or forwarding error.
+func proxyErrStatus(err error) int {
+	var pe *hbone.ProxyError
+	var ne net.Error
+	switch {
+	case errors.As(err, &pe) && pe.Status != 0:
+		return pe.Status
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// writeProxyResponse writes a response generated by the proxy. The
+// connection is closed after the response.
+func writeProxyResponse(w io.Writer, status int, h http.Header, err error) {
+	body := ""
+	if err != nil {
+		body = err.Error()
+	}
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	h.Write(w)
+	fmt.Fprintf(w, "Content-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+}
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/costinm/hbone"
+)
+
+// serveConns accepts connections on a local port with the handler.
+func serveConns(t *testing.T, h func(net.Conn)) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go h(c)
+		}
+	}()
+	return l
+}
+
+func TestHTTPProxy(t *testing.T) {
+	hb := hbone.New(nil, &hbone.MeshSettings{})
+	echo := serveConns(t, func(c net.Conn) {
+		io.Copy(c, c)
+		c.Close()
+	})
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s auth=%q conn=%q", r.Method, r.URL.Path,
+			r.Header.Get("Proxy-Authorization"), r.Header.Get("X-Hop"))
+	}))
+	defer app.Close()
+
+	const auth = "user:pass"
+	open := serveConns(t, func(c net.Conn) { HandleHTTPProxyConn(hb, c, "") })
+	authed := serveConns(t, func(c net.Conn) { HandleHTTPProxyConn(hb, c, auth) })
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte(auth))
+
+	// request sends a raw request, returning the response and the conn.
+	request := func(l net.Listener, req string) (*http.Response, net.Conn, *bufio.Reader) {
+		t.Helper()
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(c, req)
+		br := bufio.NewReader(c)
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, c, br
+	}
+
+	t.Run("connect", func(t *testing.T) {
+		res, c, br := request(open, "CONNECT "+echo.Addr().String()+" HTTP/1.1\r\n\r\n")
+		if res.StatusCode != 200 {
+			t.Fatal("Unexpected status", res.StatusCode)
+		}
+		c.Write([]byte("hello"))
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(br, b); err != nil || string(b) != "hello" {
+			t.Fatal("Unexpected echo", string(b), err)
+		}
+	})
+
+	t.Run("connect-error", func(t *testing.T) {
+		res, _, _ := request(open, "CONNECT 127.0.0.1:1 HTTP/1.1\r\n\r\n")
+		if res.StatusCode != http.StatusBadGateway {
+			t.Error("Unexpected status", res.StatusCode)
+		}
+	})
+
+	t.Run("absolute-uri", func(t *testing.T) {
+		// Hop-by-hop headers, including the ones listed in Connection, are
+		// not forwarded.
+		res, _, _ := request(open, "GET "+app.URL+"/path HTTP/1.1\r\nHost: x\r\n"+
+			"Connection: x-hop\r\nX-Hop: 1\r\n\r\n")
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != 200 || string(body) != `GET /path auth="" conn=""` {
+			t.Fatal("Unexpected response", res.StatusCode, string(body))
+		}
+	})
+
+	t.Run("relative-uri", func(t *testing.T) {
+		res, _, _ := request(open, "GET /path HTTP/1.1\r\nHost: x\r\n\r\n")
+		if res.StatusCode != http.StatusBadRequest {
+			t.Error("Unexpected status", res.StatusCode)
+		}
+	})
+
+	t.Run("auth", func(t *testing.T) {
+		for _, h := range []string{"", "Proxy-Authorization: Basic dXNlcjpub3Bl\r\n",
+			"Proxy-Authorization: Bearer " + auth + "\r\n"} {
+			res, _, _ := request(authed, "GET "+app.URL+"/ HTTP/1.1\r\nHost: x\r\n"+h+"\r\n")
+			if res.StatusCode != http.StatusProxyAuthRequired || res.Header.Get("Proxy-Authenticate") == "" {
+				t.Error("Expecting auth required", h, res.StatusCode)
+			}
+		}
+		res, _, _ := request(authed, "CONNECT "+echo.Addr().String()+" HTTP/1.1\r\n\r\n")
+		if res.StatusCode != http.StatusProxyAuthRequired {
+			t.Error("Expecting auth required for CONNECT", res.StatusCode)
+		}
+
+		res, _, _ = request(authed, "GET "+app.URL+"/ HTTP/1.1\r\nHost: x\r\nProxy-Authorization: "+basic+"\r\n\r\n")
+		body, _ := io.ReadAll(res.Body)
+		// The credentials are not forwarded.
+		if res.StatusCode != 200 || string(body) != `GET / auth="" conn=""` {
+			t.Error("Unexpected response", res.StatusCode, string(body))
+		}
+		res, _, _ = request(authed, "CONNECT "+echo.Addr().String()+" HTTP/1.1\r\nProxy-Authorization: "+basic+"\r\n\r\n")
+		if res.StatusCode != 200 {
+			t.Error("Unexpected CONNECT status", res.StatusCode)
+		}
+	})
+}
+
+func TestHTTPProxyLimits(t *testing.T) {
+	hb := hbone.New(nil, &hbone.MeshSettings{Limits: hbone.ServerLimits{MaxConnections: 1,
+		StreamRate: 0.001, StreamBurst: 1}})
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer app.Close()
+	l := serveConns(t, func(c net.Conn) { HandleHTTPProxyConn(hb, c, "") })
+	dial := func() (net.Conn, *bufio.Reader) {
+		t.Helper()
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		return c, bufio.NewReader(c)
+	}
+	get := "GET " + app.URL + "/ HTTP/1.1\r\nHost: x\r\n\r\n"
+
+	c, br := dial()
+	io.WriteString(c, get)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil || res.StatusCode != 200 {
+		t.Fatal("Unexpected response", res, err)
+	}
+	io.Copy(io.Discard, res.Body)
+
+	// The first connection is still open.
+	c2, _ := dial()
+	io.WriteString(c2, get)
+	if _, err := c2.Read(make([]byte, 1)); err == nil {
+		t.Error("Expecting connection limit")
+	}
+
+	// Rate limit - the burst was used by the first request.
+	io.WriteString(c, get)
+	res, err = http.ReadResponse(br, nil)
+	if err != nil || res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal("Expecting rate limit", res, err)
+	}
+}
+
+func TestValidateHTTPProxyListener(t *testing.T) {
+	hb := hbone.New(nil, &hbone.MeshSettings{})
+	for _, tc := range []struct {
+		addr, auth string
+		ok         bool
+	}{
+		{"3128", "", true},
+		{"127.0.0.1:3128", "", true},
+		{"localhost:3128", "", true},
+		{"[::1]:3128", "", true},
+		{":3128", "", false},
+		{"0.0.0.0:3128", "", false},
+		{"10.1.1.1:3128", "", false},
+		{":3128", "user:pass", true},
+		{"0.0.0.0:3128", "user:pass", true},
+	} {
+		err := ValidateListener(hb, &hbone.Listener{Address: tc.addr, Protocol: "http_proxy", ProxyAuth: tc.auth})
+		if (err == nil) != tc.ok {
+			t.Error("Unexpected validation", tc.addr, tc.auth, err)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/costinm/hbone"
+	"sigs.k8s.io/yaml"
+)
+
+// Config loading. The config is read from:
+// - HBONE_CFG_YAML - inline config, used instead of the files.
+// - the path parameter or HBONE_CFG - comma separated files or directories.
+// Directories include all .yaml, .yml and .json files, sorted by name.
+// - default: hbone.yaml and the conf.d directory, if they exist.
+//
+// Files are merged in order: settings in later files replace the earlier
+// ones, map entries (clusters, listeners, ports, env) are added or replaced
+// by key, lists are replaced. Unknown settings are logged and ignored - the
+// files may be shared with other tools or versions.
+//
+// The HBONE_* environment variables are applied after the files (see
+// hbone.MeshSettings.ApplyEnv), then the defaults and validation.
+
+// MeshConfigFiles returns the config files for the path, or the default
+// files.
+func MeshConfigFiles(path string) ([]string, error) {
+	if path == "" {
+		path = os.Getenv("HBONE_CFG")
+	}
+	optional := path == ""
+	if optional {
+		path = "hbone.yaml,conf.d"
+	}
+	var files []string
+	for _, p := range strings.Split(path, ",") {
+		p = strings.TrimSpace(p)
+		st, err := os.Stat(p)
+		if err != nil {
+			if optional && os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if !st.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		des, err := os.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, de := range des {
+			switch filepath.Ext(de.Name()) {
+			case ".yaml", ".yml", ".json":
+				if !de.IsDir() {
+					names = append(names, filepath.Join(p, de.Name()))
+				}
+			}
+		}
+		sort.Strings(names)
+		files = append(files, names...)
+	}
+	return files, nil
+}
+
+// LoadMeshConfig loads the config files and the environment into hc,
+// applies the defaults and validates the result.
+func LoadMeshConfig(hc *hbone.MeshSettings, path string) error {
+	if cfg := os.Getenv("HBONE_CFG_YAML"); cfg != "" {
+		unknown, err := decodeMeshConfig(hc, []byte(cfg))
+		if err != nil {
+			return fmt.Errorf("HBONE_CFG_YAML: %w", err)
+		}
+		warnUnknown("HBONE_CFG_YAML", unknown)
+	} else {
+		files, err := MeshConfigFiles(path)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			data, err := os.ReadFile(f)
+			if err != nil {
+				return err
+			}
+			unknown, err := decodeMeshConfig(hc, data)
+			if err != nil {
+				return fmt.Errorf("%s: %w", f, err)
+			}
+			warnUnknown(f, unknown)
+		}
+	}
+
+	if err := hc.ApplyEnv(os.Environ()); err != nil {
+		return err
+	}
+	if hc.Ports == nil {
+		hc.Ports = map[string]string{}
+	}
+	if len(hc.Ports) == 0 {
+		hc.Ports["http"] = "8080"
+	}
+	hc.SetDefaults()
+
+	if authz := os.Getenv("HBONE_AUTHZ"); authz != "" {
+		if err := LoadAuthorizationPolicies(hc, authz); err != nil {
+			return err
+		}
+	}
+	return hc.Validate()
+}
+
+// decodeMeshConfig merges a YAML or JSON config into hc. Unknown settings are
+// ignored and returned.
+func decodeMeshConfig(hc *hbone.MeshSettings, data []byte) ([]string, error) {
+	j, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(j)) == 0 || string(j) == "null" {
+		return nil, nil
+	}
+	if err := json.Unmarshal(j, hc); err != nil {
+		var te *json.UnmarshalTypeError
+		if errors.As(err, &te) {
+			return nil, fmt.Errorf("%s: expecting %s, got %s", te.Field, te.Type, te.Value)
+		}
+		return nil, err
+	}
+
+	// The strict decoder stops at the first unknown field - check each
+	// top level setting.
+	var top map[string]json.RawMessage
+	json.Unmarshal(j, &top)
+	var unknown []string
+	for k, v := range top {
+		kv, _ := json.Marshal(map[string]json.RawMessage{k: v})
+		dec := json.NewDecoder(bytes.NewReader(kv))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&hbone.MeshSettings{}); err != nil {
+			if f, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+				f = strings.Trim(f, `"`)
+				if !strings.EqualFold(f, k) {
+					f = k + "." + f
+				}
+				unknown = append(unknown, f)
+			}
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+func warnUnknown(src string, unknown []string) {
+	if len(unknown) > 0 {
+		slog.Warn("Unknown config settings, ignored", "src", src, "settings", unknown)
+	}
+}
+
+// PrintMeshConfig writes the effective config as YAML, without secrets.
+func PrintMeshConfig(w io.Writer, hc *hbone.MeshSettings) error {
+	m, err := hc.RedactedJSON()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	y, err := yaml.JSONToYAML(b)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(y)
+	return err
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/costinm/hbone"
+)
+
+func TestPrintMeshConfig(t *testing.T) {
+	hc := &hbone.MeshSettings{
+		Namespace:  "test",
+		AdminToken: "secret",
+		Env:        map[string]string{"TOKEN": "secret"},
+		Listeners: map[string]*hbone.Listener{
+			"proxy": {Address: "-", Protocol: "http_proxy", ProxyAuth: "user:secret"},
+		},
+	}
+	var b bytes.Buffer
+	if err := PrintMeshConfig(&b, hc); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	if strings.Contains(out, "secret") || !strings.Contains(out, "TOKEN:") ||
+		!strings.Contains(out, "proxyAuth: REDACTED") {
+		t.Error("Unexpected config", out)
+	}
+	if hc.Env["TOKEN"] != "secret" || hc.Listeners["proxy"].ProxyAuth != "user:secret" {
+		t.Error("Settings modified")
+	}
+}
+
+func TestLoadTestdata(t *testing.T) {
+	for _, f := range []string{"../testdata/alice/hbone.yaml", "../testdata/bob/hbone.yaml"} {
+		hc := &hbone.MeshSettings{}
+		if err := LoadMeshConfig(hc, f); err != nil {
+			t.Error(err)
+			continue
+		}
+		hb := hbone.New(nil, hc)
+		for name, l := range hc.Listeners {
+			if l.Address == "" {
+				l.Address = name
+			}
+			if err := ValidateListener(hb, l); err != nil {
+				t.Error(f, err)
+			}
+		}
+	}
+}
+
+func TestLoadMeshConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, cfg string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(cfg), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	a := write("a.yaml", "namespace: a\nclusters:\n  c1:\n    addr: c1.svc:80\n")
+	b := write("b.yaml", "namespace: b\nunknown: 1\nclusters:\n  c2:\n    addr: c2.svc:80\n    other: x\n")
+
+	// Unknown settings are ignored, later files replace settings.
+	hc := &hbone.MeshSettings{}
+	if err := LoadMeshConfig(hc, a+","+b); err != nil {
+		t.Fatal(err)
+	}
+	if hc.Namespace != "b" || hc.Clusters["c1"] == nil || hc.Clusters["c2"] == nil {
+		t.Error("Unexpected merge", hc.Namespace, hc.Clusters)
+	}
+	unknown, err := decodeMeshConfig(&hbone.MeshSettings{}, []byte("namespace: b\nunknown: 1\nclusters:\n  c2:\n    other: x\n"))
+	if err != nil || strings.Join(unknown, ",") != "clusters.other,unknown" {
+		t.Error("Unexpected unknown settings", unknown, err)
+	}
+
+	for _, cfg := range []string{
+		"namespace: [a]",
+		"clusters:\n  c1:\n    addr: c1.svc\n",
+		"localForward:\n  8080: echo\n",
+		"clusters: [",
+	} {
+		if err := LoadMeshConfig(&hbone.MeshSettings{}, write("bad.yaml", cfg)); err == nil {
+			t.Error("Expecting error", cfg)
+		}
+	}
+}
@@ -1,48 +1,303 @@
 package handlers
 
 import (
-	"context"
-	"fmt"
-	"log"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/costinm/hbone"
 )
 
+// GCE metadata server emulation, allowing Google client libraries, Envoy and
+// gRPC to run unmodified on non-GCP nodes.
+//
+// Values are from the environment or hb.Env (mesh-env):
+// - PROJECT_ID, PROJECT_NUMBER
+// - ZONE, defaults to CLUSTER_LOCATION
+// - INSTANCE_NAME, defaults to the hostname; INSTANCE_ID
+// - GSA - the service account email, defaults to k8s-NAMESPACE@PROJECT_ID.iam.gserviceaccount.com
+// - CLUSTER_NAME, CLUSTER_LOCATION and MDS_ATTR_name - instance attributes
+//
+// Tokens are from AuthProviders "gsa" (access tokens with empty audience, ID
+// tokens otherwise) or "gcp" (access tokens only). ID tokens requested with
+// format=full don't include the google.compute_engine claims.
+
+const mdsPrefix = "/computeMetadata/v1/"
+
+// mdsAccessTokenTTL is returned as expires_in for access tokens - the token
+// providers don't return the expiry, clients will refresh early.
+const mdsAccessTokenTTL = 5 * time.Minute
+
+// InitMDS registers the metadata handler on hb.Mux, for local clients only -
+// hb.Mux is also used for requests from the mesh. A listener with protocol
+// "mds" (for example on 169.254.169.254:80) serves all clients that can reach
+// it - the address must be loopback or link-local.
 func InitMDS(hb *hbone.HBone) {
-	hb.Mux.HandleFunc("/computeMetadata/v1/instance/service-accounts/", MDSHandler(hb))
+	h := MDSHandler(hb)
+	hb.Mux.HandleFunc(mdsPrefix, func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			http.Error(w, "Metadata only available to local clients", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	})
+}
+
+// mdsDir is a metadata directory. Keys are the path names, converted to
+// camel case in recursive JSON unless rawKeys is set.
+type mdsDir struct {
+	entries map[string]interface{}
+	rawKeys bool
 }
 
-// Adapter emulating MDS using an authenticator (K8S or GCP)
-// Allows Envoy, gRPC to work without extra code to handle token exchanges.
-// "aud" is the special provider returning access and audience tokens.
+// MDSHandler serves the metadata server paths.
+// Envoy request: Metadata-Flavor:[Google] X-Envoy-Expected-Rq-Timeout-Ms:[1000] X-Envoy-Internal:[true]
 func MDSHandler(hb *hbone.HBone) func(writer http.ResponseWriter, request *http.Request) {
-	return func(writer http.ResponseWriter, request *http.Request) {
-		// Envoy request: Metadata-Flavor:[Google] X-Envoy-Expected-Rq-Timeout-Ms:[1000] X-Envoy-Internal:[true]
-		pathc := strings.Split(request.URL.RawQuery, "=")
-		if len(pathc) != 2 {
-			log.Println("Token error", request.URL.RawQuery)
-			writer.WriteHeader(500)
+	log := hb.ComponentLogger("mds")
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Metadata-Flavor", "Google")
+		// Same as GCE - prevent SSRF and requests from proxies.
+		if r.Header.Get("Metadata-Flavor") != "Google" || r.Header.Get("X-Forwarded-For") != "" {
+			http.Error(w, "Missing Metadata-Flavor:Google header", http.StatusForbidden)
 			return
 		}
-		aud := pathc[1]
-		tp := hb.AuthProviders["gsa"]
-		if tp == nil {
-			tp = hb.AuthProviders["gcp"]
-		}
-		if tp == nil {
-			writer.WriteHeader(500)
+		p := strings.TrimPrefix(r.URL.Path, mdsPrefix)
+		q := r.URL.Query()
+		parts := strings.Split(strings.TrimSuffix(p, "/"), "/")
+
+		email := mdsEmail(hb)
+		if len(parts) == 4 && parts[0] == "instance" && parts[1] == "service-accounts" &&
+			(parts[3] == "token" || parts[3] == "identity") {
+			if parts[2] != "default" && parts[2] != email {
+				http.Error(w, "Unknown service account", http.StatusNotFound)
+				return
+			}
+			// format=full adds the google.compute_engine claims, which the
+			// token providers can't set - the standard token is returned.
+			if f := q.Get("format"); f != "" && f != "standard" {
+				log.Debug("Token format not supported, using standard", "format", f)
+			}
+			mdsToken(hb, log, w, r, parts[3], q.Get("audience"))
 			return
 		}
-		tok, err := tp(context.Background(), aud)
-		if err != nil {
-			log.Println("Token error", err, pathc)
-			writer.WriteHeader(500)
+
+		var v interface{} = mdsTree(hb, email)
+		if p != "" {
+			for _, n := range parts {
+				d, ok := v.(*mdsDir)
+				if !ok {
+					v = nil
+					break
+				}
+				v = d.entries[n]
+			}
+		}
+		if v == nil {
+			http.NotFound(w, r)
 			return
 		}
-		writer.WriteHeader(200)
-		log.Println(aud, tok)
-		fmt.Fprintf(writer, "%s", tok)
+
+		if q.Get("recursive") == "true" {
+			if _, ok := v.(*mdsDir); ok {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(mdsJSON(v))
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/text")
+		switch v := v.(type) {
+		case string:
+			w.Write([]byte(v))
+		case []string:
+			w.Write([]byte(strings.Join(v, "\n") + "\n"))
+		case *mdsDir:
+			var names []string
+			for k, e := range v.entries {
+				if _, ok := e.(*mdsDir); ok {
+					k += "/"
+				}
+				names = append(names, k)
+			}
+			sort.Strings(names)
+			w.Write([]byte(strings.Join(names, "\n") + "\n"))
+		}
+	}
+}
+
+// mdsToken writes an access token (JSON) or an ID token for the audience.
+func mdsToken(hb *hbone.HBone, log *slog.Logger, w http.ResponseWriter, r *http.Request, kind, aud string) {
+	if kind == "identity" && aud == "" {
+		http.Error(w, "audience is required", http.StatusBadRequest)
+		return
+	}
+	tp := hb.AuthProviders["gsa"]
+	if tp == nil && kind == "token" {
+		tp = hb.AuthProviders["gcp"]
+	}
+	if tp == nil {
+		http.Error(w, "No token provider", http.StatusNotFound)
+		return
+	}
+	if kind == "token" {
+		aud = ""
+	}
+	tok, err := tp(r.Context(), aud)
+	if err != nil {
+		log.Warn("Token error", "aud", aud, "err", err)
+		http.Error(w, "Token error", http.StatusInternalServerError)
+		return
+	}
+	log.Debug("Token", "kind", kind, "aud", aud)
+	if kind == "identity" {
+		w.Header().Set("Content-Type", "application/text")
+		w.Write([]byte(tok))
+		return
+	}
+	exp := jwtExpiry(tok)
+	if exp <= 0 {
+		exp = int(mdsAccessTokenTTL.Seconds())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": tok,
+		"expires_in":   exp,
+		"token_type":   "Bearer",
+	})
+}
+
+// jwtExpiry returns the seconds until the token expires, if the token is a
+// JWT.
+func jwtExpiry(tok string) int {
+	parts := strings.Split(tok, ".")
+	if len(parts) != 3 {
+		return 0
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return 0
+	}
+	var c struct {
+		Exp int64 `json:"exp"`
+	}
+	if json.Unmarshal(b, &c) != nil || c.Exp == 0 {
+		return 0
+	}
+	return int(time.Until(time.Unix(c.Exp, 0)).Seconds())
+}
+
+func mdsEmail(hb *hbone.HBone) string {
+	if gsa := hb.GetEnv("GSA", ""); gsa != "" {
+		return gsa
+	}
+	ns := hb.Namespace
+	if ns == "" {
+		ns = "default"
+	}
+	return "k8s-" + ns + "@" + hb.GetEnv("PROJECT_ID", "") + ".iam.gserviceaccount.com"
+}
+
+// mdsTree returns the metadata, excluding tokens.
+func mdsTree(hb *hbone.HBone, email string) *mdsDir {
+	projectID := hb.GetEnv("PROJECT_ID", "")
+	projectNumber := hb.GetEnv("PROJECT_NUMBER", "")
+	zone := hb.GetEnv("ZONE", hb.GetEnv("CLUSTER_LOCATION", ""))
+	hostname, _ := os.Hostname()
+	name := hb.GetEnv("INSTANCE_NAME", hostname)
+
+	attrs := map[string]interface{}{}
+	if v := hb.GetEnv("CLUSTER_NAME", ""); v != "" {
+		attrs["cluster-name"] = v
+	}
+	if v := hb.GetEnv("CLUSTER_LOCATION", ""); v != "" {
+		attrs["cluster-location"] = v
+	}
+	addAttr := func(k, v string) {
+		if strings.HasPrefix(k, "MDS_ATTR_") && v != "" {
+			attrs[k[len("MDS_ATTR_"):]] = v
+		}
+	}
+	for k, v := range hb.Env {
+		addAttr(k, v)
+	}
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		addAttr(k, v)
+	}
+
+	sa := func() *mdsDir {
+		return &mdsDir{entries: map[string]interface{}{
+			"email":   email,
+			"aliases": []string{"default"},
+			"scopes":  []string{"https://www.googleapis.com/auth/cloud-platform"},
+		}}
+	}
+	instance := map[string]interface{}{
+		"name":       name,
+		"hostname":   hostname,
+		"attributes": &mdsDir{entries: attrs, rawKeys: true},
+		"service-accounts": &mdsDir{rawKeys: true, entries: map[string]interface{}{
+			"default": sa(),
+			email:     sa(),
+		}},
+	}
+	if zone != "" {
+		instance["zone"] = "projects/" + projectNumber + "/zones/" + zone
+	}
+	if id := hb.GetEnv("INSTANCE_ID", ""); id != "" {
+		instance["id"] = id
+	}
+	project := map[string]interface{}{
+		"project-id": projectID,
+	}
+	if projectNumber != "" {
+		project["numeric-project-id"] = projectNumber
+	}
+	return &mdsDir{entries: map[string]interface{}{
+		"project":  &mdsDir{entries: project},
+		"instance": &mdsDir{entries: instance},
+	}}
+}
+
+// mdsJSON converts a metadata value to the recursive JSON form.
+func mdsJSON(v interface{}) interface{} {
+	d, ok := v.(*mdsDir)
+	if !ok {
+		return v
+	}
+	res := map[string]interface{}{}
+	for k, e := range d.entries {
+		if d.rawKeys {
+			res[k] = mdsJSON(e)
+			continue
+		}
+		// Numeric values are JSON numbers.
+		if s, ok := e.(string); ok && (k == "id" || k == "numeric-project-id") {
+			if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+				res[camelCase(k)] = n
+				continue
+			}
+		}
+		res[camelCase(k)] = mdsJSON(e)
+	}
+	return res
+}
+
+// camelCase converts a metadata path name (project-id) to the JSON key
+// (projectId).
+func camelCase(s string) string {
+	parts := strings.Split(s, "-")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
 	}
+	return strings.Join(parts, "")
 }
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/costinm/hbone"
+)
+
+func TestMDS(t *testing.T) {
+	hb := hbone.New(nil, &hbone.MeshSettings{Namespace: "test", Env: map[string]string{
+		"PROJECT_ID":        "p1",
+		"PROJECT_NUMBER":    "123",
+		"CLUSTER_LOCATION":  "us-central1-c",
+		"CLUSTER_NAME":      "c1",
+		"INSTANCE_NAME":     "vm1",
+		"MDS_ATTR_my-attr":  "v1",
+		"MDS_ATTR_empty":    "",
+		"INSTANCE_ID":       "42",
+		"UNRELATED_SETTING": "x",
+	}})
+	hb.AuthProviders["gsa"] = func(ctx context.Context, aud string) (string, error) {
+		if aud == "fail" {
+			return "", errors.New("token error")
+		}
+		return "tok:" + aud, nil
+	}
+	s := httptest.NewServer(http.HandlerFunc(MDSHandler(hb)))
+	defer s.Close()
+
+	get := func(path string, h ...string) (int, string) {
+		t.Helper()
+		r, _ := http.NewRequest("GET", s.URL+mdsPrefix+path, nil)
+		r.Header.Set("Metadata-Flavor", "Google")
+		for i := 0; i < len(h); i += 2 {
+			r.Header.Set(h[i], h[i+1])
+		}
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.Header.Get("Metadata-Flavor") != "Google" {
+			t.Error("Missing response Metadata-Flavor", path)
+		}
+		b, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+	const email = "k8s-test@p1.iam.gserviceaccount.com"
+
+	for _, tc := range []struct {
+		path string
+		code int
+		body string
+	}{
+		{"project/project-id", 200, "p1"},
+		{"project/numeric-project-id", 200, "123"},
+		{"project/", 200, "numeric-project-id\nproject-id\n"},
+		{"", 200, "instance/\nproject/\n"},
+		{"instance/zone", 200, "projects/123/zones/us-central1-c"},
+		{"instance/name", 200, "vm1"},
+		{"instance/id", 200, "42"},
+		{"instance/attributes/", 200, "cluster-location\ncluster-name\nmy-attr\n"},
+		{"instance/attributes/my-attr", 200, "v1"},
+		{"instance/service-accounts/", 200, "default/\n" + email + "/\n"},
+		{"instance/service-accounts/default/email", 200, email},
+		{"instance/service-accounts/" + email + "/aliases", 200, "default\n"},
+		{"instance/missing", 404, ""},
+		{"project/project-id/x", 404, ""},
+
+		{"instance/service-accounts/default/token", 200, ""},
+		{"instance/service-accounts/" + email + "/identity?audience=a1", 200, "tok:a1"},
+		{"instance/service-accounts/default/identity?audience=a1&format=standard", 200, "tok:a1"},
+		{"instance/service-accounts/default/identity?audience=a1&format=full&licenses=TRUE", 200, "tok:a1"},
+		{"instance/service-accounts/default/identity", 400, ""},
+		{"instance/service-accounts/default/identity?audience=fail", 500, ""},
+		{"instance/service-accounts/other@p1.iam.gserviceaccount.com/token", 404, ""},
+	} {
+		code, body := get(tc.path)
+		if code != tc.code || (tc.body != "" && body != tc.body) {
+			t.Errorf("%s: unexpected response %d %q", tc.path, code, body)
+		}
+	}
+
+	t.Run("token", func(t *testing.T) {
+		_, body := get("instance/service-accounts/default/token?audience=ignored")
+		var tok struct {
+			AccessToken string `json:"access_token"`
+			ExpiresIn   int    `json:"expires_in"`
+			TokenType   string `json:"token_type"`
+		}
+		if err := json.Unmarshal([]byte(body), &tok); err != nil {
+			t.Fatal(err, body)
+		}
+		// Access tokens don't have an audience.
+		if tok.AccessToken != "tok:" || tok.TokenType != "Bearer" || tok.ExpiresIn <= 0 {
+			t.Error("Unexpected token", tok)
+		}
+	})
+
+	t.Run("recursive", func(t *testing.T) {
+		code, body := get("?recursive=true")
+		var res struct {
+			Project struct {
+				ProjectID        string `json:"projectId"`
+				NumericProjectID int64  `json:"numericProjectId"`
+			} `json:"project"`
+			Instance struct {
+				ID              int64                             `json:"id"`
+				Attributes      map[string]string                 `json:"attributes"`
+				ServiceAccounts map[string]map[string]interface{} `json:"serviceAccounts"`
+			} `json:"instance"`
+		}
+		if err := json.Unmarshal([]byte(body), &res); code != 200 || err != nil {
+			t.Fatal(code, err, body)
+		}
+		if res.Project.ProjectID != "p1" || res.Project.NumericProjectID != 123 || res.Instance.ID != 42 {
+			t.Error("Unexpected recursive response", body)
+		}
+		// Attribute and service account names are not converted.
+		if res.Instance.Attributes["my-attr"] != "v1" || res.Instance.ServiceAccounts[email]["email"] != email {
+			t.Error("Unexpected raw keys", body)
+		}
+		// Values are returned as text.
+		if _, body := get("project/project-id?recursive=true"); body != "p1" {
+			t.Error("Unexpected recursive value", body)
+		}
+	})
+
+	t.Run("flavor", func(t *testing.T) {
+		for _, h := range [][]string{
+			{"Metadata-Flavor", ""},
+			{"Metadata-Flavor", "Other"},
+			{"X-Forwarded-For", "10.1.1.1"},
+		} {
+			if code, _ := get("project/project-id", h...); code != http.StatusForbidden {
+				t.Error("Expecting forbidden", h, code)
+			}
+		}
+	})
+}
+
+func TestInitMDS(t *testing.T) {
+	hb := hbone.New(nil, &hbone.MeshSettings{Env: map[string]string{"PROJECT_ID": "p1"}})
+	InitMDS(hb)
+	for _, tc := range []struct {
+		remote string
+		code   int
+	}{
+		{"127.0.0.1:1234", 200},
+		{"[::1]:1234", 200},
+		{"10.1.1.1:1234", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest("GET", mdsPrefix+"project/project-id", nil)
+		r.RemoteAddr = tc.remote
+		r.Header.Set("Metadata-Flavor", "Google")
+		w := httptest.NewRecorder()
+		hb.Mux.ServeHTTP(w, r)
+		if w.Code != tc.code {
+			t.Error("Unexpected status", tc.remote, w.Code)
+		}
+	}
+}
+
+func TestValidateMDSListener(t *testing.T) {
+	hb := hbone.New(nil, &hbone.MeshSettings{})
+	for _, tc := range []struct {
+		addr string
+		ok   bool
+	}{
+		{"8080", true},
+		{"127.0.0.1:80", true},
+		{"169.254.169.254:80", true},
+		{"[fe80::1]:80", true},
+		{":80", false},
+		{"0.0.0.0:80", false},
+		{"10.1.1.1:80", false},
+	} {
+		err := ValidateListener(hb, &hbone.Listener{Address: tc.addr, Protocol: "mds"})
+		if (err == nil) != tc.ok {
+			t.Error("Unexpected validation", tc.addr, err)
+		}
+	}
+}
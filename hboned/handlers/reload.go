@@ -0,0 +1,311 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/costinm/hbone"
+)
+
+// Hot reload of the config files. The files are polled, and changes to
+// clusters, listeners, localForward, routes and authzPolicies are applied
+// incrementally:
+// - unchanged entries are not touched, keeping their connections.
+// - removed listeners are closed - accepted connections are not interrupted.
+// - changed clusters are replaced, connections to the old endpoints are
+// closed after the active streams finish.
+//
+// The file is the source of truth - entries added with the config API are
+// removed on the next change. Changes to other settings require a restart.
+//
+// If the new config is invalid it is rejected and the running config is not
+// changed. The status is available at /debug/config_reload on the admin
+// mux.
+
+// defaultConfigPoll is the interval for checking the config file.
+const defaultConfigPoll = 5 * time.Second
+
+// ConfigWatcher applies changes in the config file.
+type ConfigWatcher struct {
+	hb       *hbone.HBone
+	path     string
+	interval time.Duration
+	log      *slog.Logger
+
+	// files is the version of the config files, checked by the poll loop.
+	files string
+
+	mu      sync.Mutex
+	applied *meshConfigRaw
+	status  ConfigStatus
+}
+
+// ConfigStatus is the result of the last reload.
+type ConfigStatus struct {
+	Path    string    `json:"path"`
+	Version int       `json:"version"`
+	Applied time.Time `json:"applied,omitempty"`
+
+	// Error is set if the last change was rejected or partially applied.
+	Error    string    `json:"error,omitempty"`
+	Rejected time.Time `json:"rejected,omitempty"`
+
+	// Restart lists the changed settings that are only applied on restart.
+	Restart []string `json:"restart,omitempty"`
+}
+
+// meshConfigRaw is the effective config, with the reloadable sections kept
+// as raw JSON to detect changed entries.
+type meshConfigRaw struct {
+	Clusters      map[string]json.RawMessage `json:"clusters"`
+	Listeners     map[string]json.RawMessage `json:"listeners"`
+	LocalForward  map[int]string             `json:"localForward"`
+	Routes        json.RawMessage            `json:"routes"`
+	AuthzPolicies json.RawMessage            `json:"authzPolicies"`
+
+	// other are the remaining settings, by lower case key.
+	other map[string]json.RawMessage
+}
+
+// marshalMeshConfigRaw returns the effective config, split in sections.
+func marshalMeshConfigRaw(ms *hbone.MeshSettings) (*meshConfigRaw, error) {
+	c := *ms
+	c.Auth = nil
+	j, err := json.Marshal(&c)
+	if err != nil {
+		return nil, err
+	}
+	raw := &meshConfigRaw{}
+	all := map[string]json.RawMessage{}
+	if err := json.Unmarshal(j, raw); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(j, &all); err != nil {
+		return nil, err
+	}
+	raw.other = map[string]json.RawMessage{}
+	for k, v := range all {
+		switch k = strings.ToLower(k); k {
+		case "clusters", "listeners", "localforward", "routes", "authzpolicies":
+		default:
+			raw.other[k] = v
+		}
+	}
+	return raw, nil
+}
+
+// WatchMeshConfig starts polling the config files, if the config is loaded
+// from files. The status is registered on mux, if not nil.
+func WatchMeshConfig(ctx context.Context, hb *hbone.HBone, mux *http.ServeMux, path string, interval time.Duration) *ConfigWatcher {
+	if os.Getenv("HBONE_CFG_YAML") != "" {
+		return nil
+	}
+	if interval == 0 {
+		interval = defaultConfigPoll
+	}
+	w := &ConfigWatcher{hb: hb, path: path, interval: interval, log: hb.ComponentLogger("config")}
+	w.status.Path = path
+	if path == "" {
+		w.status.Path = os.Getenv("HBONE_CFG")
+	}
+
+	// The running config was loaded from the current files.
+	w.files = w.filesVersion()
+	w.applied = &meshConfigRaw{}
+	if ms, err := w.load(); err == nil {
+		w.applied, _ = marshalMeshConfigRaw(ms)
+	}
+
+	if mux != nil {
+		mux.Handle("/debug/config_reload", w)
+	}
+	go w.run(ctx)
+	return w
+}
+
+// ServeHTTP returns the reload status.
+func (w *ConfigWatcher) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(w.Status())
+}
+
+// Status returns the result of the last reload.
+func (w *ConfigWatcher) Status() ConfigStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.status
+}
+
+func (w *ConfigWatcher) run(ctx context.Context) {
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if v := w.filesVersion(); v != w.files {
+				w.files = v
+				w.Reload()
+			}
+		}
+	}
+}
+
+// filesVersion returns the names, sizes and modification times of the
+// config files.
+func (w *ConfigWatcher) filesVersion() string {
+	files, err := MeshConfigFiles(w.path)
+	if err != nil {
+		return err.Error()
+	}
+	var sb strings.Builder
+	for _, f := range files {
+		if st, err := os.Stat(f); err == nil {
+			fmt.Fprintf(&sb, "%s %d %d\n", f, st.Size(), st.ModTime().UnixNano())
+		}
+	}
+	return sb.String()
+}
+
+// load reads the config files, with the same processing as on startup.
+func (w *ConfigWatcher) load() (*hbone.MeshSettings, error) {
+	ms := &hbone.MeshSettings{}
+	if err := LoadMeshConfig(ms, w.path); err != nil {
+		return nil, err
+	}
+	for name, l := range ms.Listeners {
+		if err := ValidateListener(w.hb, l); err != nil {
+			return nil, fmt.Errorf("listeners[%q]: %w", name, err)
+		}
+	}
+	return ms, nil
+}
+
+// Reload loads the config files and applies the changes. Returns an error
+// if the config was rejected or could not be fully applied.
+func (w *ConfigWatcher) Reload() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	ms, err := w.load()
+	var raw *meshConfigRaw
+	if err == nil {
+		raw, err = marshalMeshConfigRaw(ms)
+	}
+	if err != nil {
+		w.status.Error = err.Error()
+		w.status.Rejected = time.Now()
+		w.log.Warn("Config rejected", "path", w.status.Path, "err", err)
+		return err
+	}
+
+	errs := w.apply(raw, ms)
+	w.applied = raw
+	w.status.Version++
+	w.status.Applied = time.Now()
+	w.status.Error = ""
+	if errs != nil {
+		w.status.Error = errs.Error()
+	}
+	w.log.Info("Config reloaded", "path", w.status.Path, "version", w.status.Version,
+		"restart", w.status.Restart, "err", errs)
+	return errs
+}
+
+// apply makes the changes from the applied config. Errors applying an entry
+// are returned, the other changes are still applied.
+func (w *ConfigWatcher) apply(raw *meshConfigRaw, ms *hbone.MeshSettings) error {
+	hb := w.hb
+	old := w.applied
+	var errs []error
+
+	for name := range old.Clusters {
+		if _, ok := raw.Clusters[name]; !ok {
+			hb.RemoveCluster(name)
+		}
+	}
+	for name, c := range ms.Clusters {
+		if bytes.Equal(old.Clusters[name], raw.Clusters[name]) {
+			continue
+		}
+		if err := hb.SetCluster(name, c); err != nil {
+			errs = append(errs, fmt.Errorf("clusters.%s: %w", name, err))
+		}
+	}
+
+	for name := range old.Listeners {
+		if _, ok := raw.Listeners[name]; !ok {
+			StopListener(hb.RemoveListener(name))
+		}
+	}
+	for name, l := range ms.Listeners {
+		if bytes.Equal(old.Listeners[name], raw.Listeners[name]) {
+			continue
+		}
+		ol := hb.GetListener(name)
+		StopListener(ol)
+		if err := StartListener(hb, l); err != nil {
+			errs = append(errs, fmt.Errorf("listeners.%s: %w", name, err))
+			if ol != nil {
+				if err := StartListener(hb, ol); err != nil {
+					errs = append(errs, fmt.Errorf("listeners.%s: restarting old listener: %w", name, err))
+				}
+			}
+			continue
+		}
+		hb.AddListener(name, l)
+	}
+
+	for port := range old.LocalForward {
+		if _, ok := raw.LocalForward[port]; !ok {
+			hb.StopLocalForward(port)
+		}
+	}
+	// A changed destination keeps the listener - the port is not released.
+	for port, dest := range raw.LocalForward {
+		if old.LocalForward[port] == dest {
+			continue
+		}
+		if err := hb.StartLocalForward(port, dest); err != nil {
+			errs = append(errs, fmt.Errorf("localForward.%d: %w", port, err))
+		}
+	}
+
+	if !bytes.Equal(old.Routes, raw.Routes) {
+		if err := hb.SetRoutes(ms.Routes); err != nil {
+			errs = append(errs, fmt.Errorf("routes: %w", err))
+		}
+	}
+	if !bytes.Equal(old.AuthzPolicies, raw.AuthzPolicies) {
+		if err := hb.SetAuthorizationPolicies(ms.AuthzPolicies); err != nil {
+			errs = append(errs, fmt.Errorf("authzPolicies: %w", err))
+		}
+	}
+
+	var restart []string
+	for k, v := range raw.other {
+		if !bytes.Equal(old.other[k], v) {
+			restart = append(restart, k)
+		}
+	}
+	for k := range old.other {
+		if _, ok := raw.other[k]; !ok {
+			restart = append(restart, k)
+		}
+	}
+	sort.Strings(restart)
+	w.status.Restart = restart
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/costinm/hbone"
+)
+
+func TestConfigReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hbone.yaml")
+	write := func(cfg string) {
+		if err := os.WriteFile(path, []byte(cfg), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`
+clusters:
+  a:
+    addr: a.test.svc:8080
+  b:
+    addr: b.test.svc:8080
+listeners:
+  sni:
+    address: 127.0.0.1:0
+    protocol: sni
+routes:
+- name: r1
+  backends:
+  - cluster: a
+`)
+
+	// Same steps as on startup.
+	hc := &hbone.MeshSettings{}
+	if err := LoadMeshConfig(hc, path); err != nil {
+		t.Fatal(err)
+	}
+	hb := hbone.New(nil, hc)
+	for _, l := range hc.Listeners {
+		if err := StartListener(hb, l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() { StopListener(hb.GetListener("sni")) })
+	sni := hb.GetListener("sni")
+	clusterB := hb.GetCluster("b")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mux := http.NewServeMux()
+	// Long interval - Reload is called directly.
+	w := WatchMeshConfig(ctx, hb, mux, path, time.Hour)
+	// The status can be registered on other muxes.
+	WatchMeshConfig(ctx, hb, http.NewServeMux(), path, time.Hour)
+
+	accepting := func(l *hbone.Listener) bool {
+		c, err := net.Dial("tcp", l.NetListener.Addr().String())
+		if err != nil {
+			return false
+		}
+		c.Close()
+		return true
+	}
+
+	write(`
+clusters:
+  b:
+    addr: b.test.svc:8080
+  c:
+    addr: c.test.svc:8080
+listeners:
+  sni:
+    address: 127.0.0.1:0
+    protocol: sni
+    proxyProtocol: true
+routes:
+- name: r2
+  backends:
+  - cluster: c
+`)
+	if err := w.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if hb.GetCluster("a") != nil || hb.GetCluster("c") == nil {
+		t.Error("Clusters not reconciled")
+	}
+	if hb.GetCluster("b") != clusterB {
+		t.Error("Unchanged cluster replaced")
+	}
+	if l := hb.GetListener("sni"); l == sni || !l.ProxyProtocol || !accepting(l) || accepting(sni) {
+		t.Error("Listener not restarted")
+	}
+	if len(hb.Routes) != 1 || hb.Routes[0].Name != "r2" {
+		t.Error("Routes not replaced", hb.Routes)
+	}
+	if st := w.Status(); st.Version != 1 || st.Error != "" {
+		t.Error("Unexpected status", st)
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, cfg := range []string{
+			"clusters:\n  d:\n    addr: d.test.svc\n",
+			"routes:\n- name: r3\n  backends:\n  - cluster: nope\n",
+			"listeners:\n  x:\n    address: 127.0.0.1:0\n    protocol: nope\n",
+			"clusters: [",
+		} {
+			write(cfg)
+			if err := w.Reload(); err == nil {
+				t.Error("Expecting config to be rejected", cfg)
+			}
+			if hb.GetCluster("c") == nil || hb.Routes[0].Name != "r2" || hb.GetListener("sni") == nil {
+				t.Error("Running config changed", cfg)
+			}
+		}
+
+		r := httptest.NewRecorder()
+		mux.ServeHTTP(r, httptest.NewRequest("GET", "/debug/config_reload", nil))
+		var st ConfigStatus
+		if err := json.Unmarshal(r.Body.Bytes(), &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.Version != 1 || st.Error == "" || st.Rejected.IsZero() || st.Path != path {
+			t.Error("Unexpected status", st)
+		}
+	})
+}
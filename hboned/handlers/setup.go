@@ -1,8 +1,8 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -49,19 +49,27 @@ func InitXDSCluster(hb *hbone.HBone) *hbone.Cluster {
 func Start(hb *hbone.HBone) {
 	hc := hb.MeshSettings
 	//id := hb.ID
-	var err error
 	InitMDS(hb)
 
 	InitExpvar(hb)
 
 	// TODO: replace with a label on clusters that need to maintain persistent connections.
 	// XDS is an example.
-	// H2R will be available in all clusters that support the Setting.
-	//// Create a reverse tunnel, also making this node accessible from the mesh
-	//h2r := hb.GetCluster("h2r")
-	//if h2r != nil {
-	//	go RemoteForward(hb, h2r.Addr, id.Namespace, id.Name)
-	//}
+	// Create a reverse tunnel, making this node accessible from the mesh using
+	// the gateway.
+	if gate := hb.GetEnv("MESH_ADDR", ""); gate != "" {
+		sn := hc.ServiceCluster
+		if sn == "" {
+			sn, _ = os.Hostname()
+		}
+		ns := hc.Namespace
+		if ns == "" {
+			ns = "default"
+		}
+		RemoteForward(hb, gate, sn, ns)
+	}
+
+	InitConfigAPI(hb, hb.AdminMux)
 
 	// Key is port (string), value is protocol or forward address
 	var hbonePort *hbone.Listener
@@ -69,68 +77,19 @@ func Start(hb *hbone.HBone) {
 		if l.Address == "" {
 			l.Address = lname
 		}
-		port := l.Address
-		v := l.Protocol
-
-		pn, _ := strconv.Atoi(port)
-
-		switch v {
-		case "sni": // 15003
-			listenServe(l, port, func(conn net.Conn) {
-				HandleSNIConn(hb, conn)
-			})
-		case "socks": // should be on 1080 for default
-			listenServe(l, "127.0.0.1:"+port, func(conn net.Conn) {
-				err = HandleSocksConn(hb, conn)
-				if err != nil {
-					log.Println("Error handling SOCKS", err)
-				}
-			})
-		case "hbone": // 15008
+		if l.Protocol == "hbone" { // 15008
 			hbonePort = l
-		case "hbonec": // 15009
-			listenServe(l, port, hb.HandleAcceptedH2C)
-		case "admin": // 15000
-			go func() {
-				err = http.ListenAndServe(port, nil)
-				if err != nil {
-					log.Fatal(err)
-				}
-			}()
-		case "metrics": // 15020
-			go func() {
-				err = http.ListenAndServe("0.0.0.0:"+port, http.HandlerFunc(tel.HandleMetrics))
-				if err != nil {
-					log.Fatal(err)
-				}
-			}()
-		case "tproxy":
-			utp, _ := nio.StartUDPTProxyListener6(pn)
-			if utp != nil {
-				nio.UDPAccept(utp, hb.HandleUdp)
-			}
-			nio.IptablesCapture(":"+port, hb.HandleTUN)
-		default:
-			hf1 := hb.Handlers[l.Protocol]
-			if hf1 == nil {
-				log.Println("Unspecified port, default to forward (in)")
-			} else {
-				listenServe(l, port, func(conn net.Conn) {
-					hf1.HandleConn(conn)
-				})
-			}
+			continue
+		}
+		if err := StartListener(hb, l); err != nil {
+			log.Fatal("Failed to start listener ", lname, " ", err)
 		}
 	}
 
 	for p, a := range hc.LocalForward {
-		port := p
-		addr := a
-		go func() {
-			err := hbone.LocalForwardPort(fmt.Sprintf("127.0.0.1:%d", port), addr, hb)
-			if err != nil {
-				log.Fatal("Failed to forward port", err)
-			}
-		}()
+		if err := hb.StartLocalForward(p, a); err != nil {
+			log.Fatal("Failed to forward port", err)
+		}
 	}
 
 	// Last - the HBone port
@@ -139,59 +98,227 @@ func Start(hb *hbone.HBone) {
 			Address: "15008",
 		}
 	}
-	listenServe(hbonePort, hbonePort.Address, hb.HandleAcceptedH2)
+	if err := listenServe(hbonePort, hbonePort.Address, hb.HandleAcceptedH2); err != nil {
+		log.Fatal("Failed to listen on ", hbonePort.Address, err)
+	}
 }
 
-func listenServe(listener *hbone.Listener, port string, f func(net.Conn)) {
-	if port != "-" && port != "" {
-		ll, err := nio.ListenAndServe(port, f)
-		listener.NetListener = ll
-		if err != nil {
-			log.Fatal("Failed to listen on ", port, err)
+// ValidateListener checks the listener protocol and settings.
+func ValidateListener(hb *hbone.HBone, l *hbone.Listener) error {
+	if l.Address == "" {
+		return errors.New("listener: missing address")
+	}
+	switch l.Protocol {
+	case "sni", "socks", "auto", "hbone", "hbonec", "h2r", "admin", "metrics", "tproxy":
+	case "mds":
+		// Tokens are returned without authentication.
+		if !loopbackAddress(l.Address) && !linkLocalAddress(l.Address) {
+			return fmt.Errorf("listener %s: mds must use a loopback or link-local address", l.Address)
+		}
+	case "http_proxy":
+		// Without auth, any client reaching the port can dial into the mesh.
+		if l.ProxyAuth == "" && !loopbackAddress(l.Address) {
+			return fmt.Errorf("listener %s: http_proxy on a non-loopback address requires proxyAuth", l.Address)
+		}
+	case "tls", "https":
+		if l.Protocol == "tls" && l.ForwardTo == "" {
+			return fmt.Errorf("listener %s: tls requires forwardTo", l.Address)
+		}
+		if _, err := l.TLSConfig(hb); err != nil {
+			return err
+		}
+	default:
+		if hb.Handlers[l.Protocol] == nil {
+			return fmt.Errorf("listener %s: unknown protocol %q", l.Address, l.Protocol)
 		}
 	}
+	return nil
 }
 
-func LoadMeshConfig(hc *hbone.MeshSettings, path string) error {
-	var cfg []byte
-	var err error
+// StartListener starts accepting connections for the listener, using the
+// handler for the protocol. The listener can be closed with StopListener.
+func StartListener(hb *hbone.HBone, l *hbone.Listener) error {
+	if err := ValidateListener(hb, l); err != nil {
+		return err
+	}
+	port := l.Address
+	v := l.Protocol
 
-	cfgEnv := os.Getenv("HBONE_CFG_YAML")
-	if cfgEnv != "" {
-		cfg = []byte(cfgEnv)
-	} else {
-		if path == "" {
-			path = os.Getenv("HBONE_CFG")
-		}
-		if path == "" {
-			path = "hbone.yaml"
+	switch v {
+	case "sni": // 15003
+		return listenServe(l, port, func(conn net.Conn) {
+			HandleSNIConn(hb, conn)
+		})
+	case "socks": // should be on 1080 for default
+		return listenServe(l, "127.0.0.1:"+port, func(conn net.Conn) {
+			err := HandleSocksConn(hb, conn)
+			if err != nil {
+				hb.ComponentLogger("socks").Warn("Error handling SOCKS", "remote", conn.RemoteAddr(), "err", err)
+			}
+		})
+	case "auto":
+		// The PROXY header is optional, detected with the protocol.
+		trustProxy := l.ProxyProtocol
+		return listenServe(l, port, func(conn net.Conn) {
+			HandleAutoConn(hb, conn, trustProxy)
+		})
+	case "http_proxy": // on 127.0.0.1 unless ProxyAuth is set
+		addr := port
+		if !strings.Contains(addr, ":") && l.ProxyAuth == "" {
+			addr = "127.0.0.1:" + addr
 		}
-		if _, err := os.Stat(path); err == nil {
-			cfg, err = ioutil.ReadFile(path)
+		auth := l.ProxyAuth
+		return listenServe(l, addr, func(conn net.Conn) {
+			err := HandleHTTPProxyConn(hb, conn, auth)
 			if err != nil {
-				return err
+				hb.ComponentLogger("http_proxy").Debug("Error handling HTTP proxy", "remote", conn.RemoteAddr(), "err", err)
 			}
+		})
+	case "tls", "https":
+		h := hb.HandleAcceptedTLS
+		if v == "https" {
+			h = hb.HandleAcceptedHTTPS
+		}
+		return listenServe(l, port, func(conn net.Conn) {
+			h(l, conn)
+		})
+	case "hbone": // 15008
+		return listenServe(l, port, hb.HandleAcceptedH2)
+	case "hbonec": // 15009
+		return listenServe(l, port, hb.HandleAcceptedH2C)
+	case "h2r": // reverse connections only, also accepted on the hbone port of gateways
+		return listenServe(l, port, hb.HandlerH2RConn)
+	case "admin": // 15000, on 127.0.0.1 unless an address is set
+		if !strings.Contains(port, ":") {
+			port = "127.0.0.1:" + port
+		}
+		return httpServe(l, port, AdminHandler(hb, hb.AdminMux))
+	case "mds": // GCE metadata server, for example 169.254.169.254:80
+		if !strings.Contains(port, ":") {
+			port = "127.0.0.1:" + port
 		}
+		mux := http.NewServeMux()
+		mux.HandleFunc(mdsPrefix, MDSHandler(hb))
+		return httpServe(l, port, mux)
+	case "metrics": // 15020
+		return httpServe(l, "0.0.0.0:"+port, http.HandlerFunc(tel.HandleMetrics))
+	case "tproxy":
+		pn, _ := strconv.Atoi(port)
+		utp, _ := nio.StartUDPTProxyListener6(pn)
+		if utp != nil {
+			nio.UDPAccept(utp, hb.HandleUdp)
+		}
+		nio.IptablesCapture(":"+port, hb.HandleTUN)
+		return nil
+	default:
+		hf1 := hb.Handlers[l.Protocol]
+		return listenServe(l, port, func(conn net.Conn) {
+			hf1.HandleConn(conn)
+		})
 	}
+}
 
-	err = yaml.Unmarshal(cfg, hc)
+// loopbackAddress returns true if the listener address is a port or uses
+// localhost or a loopback IP.
+func loopbackAddress(addr string) bool {
+	if !strings.Contains(addr, ":") {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
-		log.Fatal("Failed to decode config", err)
+		return false
 	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
 
-	// TODO: process env variables
-	for _, kvs := range os.Environ() {
-		kv := strings.SplitN(kvs, "=", 2)
-		k := kv[0]
-		switch k {
-		case "NAMESPACE":
-			hc.Namespace = kv[1]
-		}
+// linkLocalAddress returns true if the listener address uses a link-local IP,
+// like 169.254.169.254.
+func linkLocalAddress(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLinkLocalUnicast()
+}
+
+// StopListener closes the listener. Accepted connections are not closed.
+func StopListener(l *hbone.Listener) error {
+	if l == nil || l.NetListener == nil {
+		return nil
+	}
+	return l.NetListener.Close()
+}
 
-		if strings.HasPrefix(k, "PORT_") {
-			hc.Ports[k[5:]] = kv[1]
+func listenServe(listener *hbone.Listener, port string, f func(net.Conn)) error {
+	if listener.ProxyProtocol && listener.Protocol != "auto" {
+		f = nio.ProxyProtocolHandler(f)
+	}
+	if port != "-" && port != "" {
+		ll, err := nio.ListenAndServe(port, f)
+		if err != nil {
+			return err
 		}
+		listener.NetListener = ll
+	}
+	return nil
+}
+
+// httpServe serves HTTP/1.1 on the listener address.
+func httpServe(listener *hbone.Listener, port string, h http.Handler) error {
+	if !strings.Contains(port, ":") {
+		port = ":" + port
 	}
+	ll, err := net.Listen("tcp", port)
+	if err != nil {
+		return err
+	}
+	listener.NetListener = ll
+	go http.Serve(ll, h)
+	return nil
+}
 
-	return err
+// LoadAuthorizationPolicies loads Istio AuthorizationPolicy objects from a yaml
+// file or a directory of yaml files. Files may have multiple documents.
+func LoadAuthorizationPolicies(hc *hbone.MeshSettings, path string) error {
+	files := []string{path}
+	if st, err := os.Stat(path); err != nil {
+		return err
+	} else if st.IsDir() {
+		des, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		files = files[:0]
+		for _, de := range des {
+			if strings.HasSuffix(de.Name(), ".yaml") || strings.HasSuffix(de.Name(), ".json") {
+				files = append(files, path+"/"+de.Name())
+			}
+		}
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		for _, doc := range strings.Split(string(data), "\n---") {
+			if strings.TrimSpace(doc) == "" {
+				continue
+			}
+			jd, err := yaml.YAMLToJSON([]byte(doc))
+			if err != nil {
+				return fmt.Errorf("%s: %w", f, err)
+			}
+			p, err := hbone.ParseAuthorizationPolicy(jd)
+			if err != nil {
+				return fmt.Errorf("%s: %w", f, err)
+			}
+			hc.AuthzPolicies = append(hc.AuthzPolicies, p)
+		}
+	}
+	return nil
 }
@@ -1,9 +1,9 @@
 package handlers
 
 import (
-	"log"
+	"context"
+	"errors"
 	"net"
-	"strings"
 
 	"github.com/costinm/hbone"
 	"github.com/costinm/hbone/nio"
@@ -15,46 +15,57 @@ import (
 // This can be used for a legacy CNI to HBone bridge. The old Istio client expects an mTLS connection
 // to the other end - the HBone proxy is untrusted.
 func HandleSNIConn(hb *hbone.HBone, conn net.Conn) {
-	s := nio.NewBufferReader(conn)
+	log := hb.ComponentLogger("sni")
 	defer conn.Close()
+	if !hb.AcceptConn() {
+		log.Warn("Connection limit reached", "remote", conn.RemoteAddr())
+		return
+	}
+	defer hb.ReleaseConn()
+	release, err := hb.AcquireStream(conn.RemoteAddr().String())
+	if err != nil {
+		log.Warn("Stream limit reached", "remote", conn.RemoteAddr(), "err", err)
+		return
+	}
+	defer release()
+
+	s := nio.NewBufferReader(conn)
 	defer s.Buffer.Recycle()
 
 	sni, err := nio.ParseTLS(s)
 	if err != nil {
-		log.Println("SNI invalid TLS", sni, err)
+		log.Warn("SNI invalid TLS", "sni", sni, "remote", conn.RemoteAddr(), "err", err)
 		return
 	}
 
 	// At this point we have a SNI service name. Need to convert it to a real service
 	// name, RoundTripStart and proxy.
+	//
+	// Current Istio SNI looks like:
+	//
+	// outbound_.9090_._.prometheus-1-prometheus.mon.svc.cluster.local
+	//
+	// Also supports the 'natural' form and egress, using port 443.
+	addr := hbone.SNIAddr(sni)
 
-	addr := sni + ":443"
-	// Based on SNI, make a hbone request, using JWT auth.
-	if strings.HasPrefix(sni, "outbound_.") {
-		// Current Istio SNI looks like:
-		//
-		// outbound_.9090_._.prometheus-1-prometheus.mon.svc.cluster.local
-		// We need to map it to a cloudrun external address, add token based on the audience, and
-		// make the call using the tunnel.
-		//
-		// Also supports the 'natural' form and egress
-
-		//
-		//
-		parts := strings.SplitN(sni, ".", 4)
-		remoteService := parts[3]
-		// TODO: extract 'version' from URL, convert it to cloudrun revision ?
-		addr = net.JoinHostPort(remoteService, parts[1])
+	// Workloads connected with H2R (serverless, NAT) first, using a stream on
+	// the reverse connection. Otherwise, based on SNI, make a hbone request
+	// using the clusters.
+	// TODO: extract 'version' from URL, convert it to cloudrun revision ?
+	nc, err := hb.DialReverse(context.Background(), addr)
+	via := "h2r"
+	if errors.Is(err, hbone.ErrH2RNotConnected) {
+		nc, err = hb.Dial("tcp", addr)
+		via = "cluster"
 	}
-
-	nc, err := hb.Dial("tcp", addr)
 	if err != nil {
-		log.Println("Error connecting ", err)
+		log.Warn("Error connecting", "sni", sni, "dest", addr, "via", via, "err", err)
 		return
 	}
-	err = hbone.Proxy(nc, s, conn, addr)
+	log.Debug("SNI", "sni", sni, "dest", addr, "via", via)
+	err = hb.Proxy(nc, s, conn, addr)
 	if err != nil {
-		log.Println("Error proxy ", err)
+		log.Debug("Error proxy", "sni", sni, "dest", addr, "err", err)
 		return
 	}
 }
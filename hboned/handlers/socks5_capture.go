@@ -24,5 +24,5 @@ func HandleSocksConn(hb *hbone.HBone, conn net.Conn) error {
 	}
 	s.PostDialHandler(nc, nil)
 
-	return hbone.Proxy(nc, brin, conn, s.Dest)
+	return hb.Proxy(nc, brin, conn, s.Dest)
 }
@@ -16,13 +16,19 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
-	"log"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
-	_ "net/http/pprof"
-
 	"github.com/costinm/hbone"
 	"github.com/costinm/hbone/hboned/gcp"
 	"github.com/costinm/hbone/hboned/handlers"
@@ -31,55 +37,108 @@ import (
 	auth "github.com/costinm/meshauth"
 )
 
-var (
-	localForward = flag.String("L", "", "Local port, if set connections to this port will be forwarded to the mesh service")
-)
-
-// Create a HBONE tunnel, using provisioned certificates.
+// hboned is the mesh node daemon and CLI.
+//
+// Subcommands:
+//
+//	serve [-L port:dest] - run the node, default if no subcommand.
+//	connect host:port - tunnel stdin/stdout to a mesh address.
+//	forward -L [bind:]port:host:port -R port:[localhost:]port - port forwarding.
+//	get [-H 'name: value'] URL - HTTP request over the mesh, body on stdout.
+//	status [-admin addr] - state of a running daemon.
 //
 // For example, for ssh:
 //
-// ssh -o ProxyCommand='hbone %h:22' root@fortio-cr.fortio
-// If the server doesn't have persistent SSH key, add to the ssh parameters:
+//	ssh -o ProxyCommand='hboned connect %h:22' root@fortio-cr.fortio
 //
-//	-F /dev/null -o StrictHostKeyChecking=no -o "UserKnownHostsFile /dev/null"
+// 'hboned %h:22' is equivalent. If the server doesn't have persistent SSH key,
+// add to the ssh parameters:
 //
-// CLI:
-// - args[0], if present will be used to create a simple tunnel, suitable for ssh ProxyCommand
-// - "-L" is used to forward local ports to mesh addresses. Will also crete a reverse proxy if MESH_ADDR is set.
+//	-F /dev/null -o StrictHostKeyChecking=no -o "UserKnownHostsFile /dev/null"
 //
 // If XDS_ADDR is set, will connect and get configs from the mesh.
-// If MESH_ADDR is set, will register for reverse connections and use it as PEP/egress gateway.
+// MESH_ADDR is the gateway used for -R, accepting reverse connections.
 // Otherwise, the "dest" is expected to support HBone.
 func main() {
-	flag.Parse()
-	ctx, cf := context.WithTimeout(context.Background(), 10000*time.Second)
-	defer cf()
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+		if strings.Contains(cmd, ":") {
+			// ProxyCommand form - hboned host:port
+			cmd, args = "connect", os.Args[1:]
+		}
+	}
 
-	// Load mesh settings - may include settings for auth, etc.
-	hc := &hbone.MeshSettings{}
-	err := handlers.LoadMeshConfig(hc, "")
+	var err error
+	switch cmd {
+	case "serve":
+		err = cmdServe(args)
+	case "connect":
+		err = cmdConnect(args)
+	case "forward":
+		err = cmdForward(args)
+	case "get":
+		err = cmdGet(args)
+	case "status":
+		err = cmdStatus(args)
+	case "help":
+		usage()
+	default:
+		usage()
+		err = fmt.Errorf("unknown command %q", cmd)
+	}
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
 	}
+}
 
-	if *localForward != "" {
-		parts := strings.SplitN(*localForward, ":", 2)
-		if len(parts) != 2 {
-			log.Fatal("Expecting 2 parts" + *localForward)
-		}
-		dest := parts[1]
-		hc.LocalForward[0] = dest
+func usage() {
+	fmt.Fprint(os.Stderr, `Usage: hboned [command] [flags]
+
+Commands:
+  serve [-L port:dest] [-print-config]       run the node (default)
+  connect host:port                          tunnel stdin/stdout to a mesh address
+  forward -L [bind:]port:host:port ...       forward local ports to mesh addresses
+          -R port:[localhost:]port ...       accept on the gateway (MESH_ADDR), forward to local ports
+  get [-H 'name: value'] URL                 HTTP request over the mesh
+  status [-admin host:port]                  state of a running daemon
+`)
+}
+
+// listFlag is a repeated string flag.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// loadConfig loads the mesh settings - may include settings for auth, etc.
+// Exits if the config is invalid.
+func loadConfig() *hbone.MeshSettings {
+	hc := &hbone.MeshSettings{}
+	if err := handlers.LoadMeshConfig(hc, ""); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid config:", err)
+		os.Exit(2)
 	}
+	return hc
+}
 
+// initMesh creates the node, with the identity and optional K8S, GCP and
+// XDS integration. For serve, errors in the K8S environment are fatal.
+func initMesh(ctx context.Context, hc *hbone.MeshSettings, serve bool) (*hbone.HBone, error) {
 	// Initialize the identity from existing files.
 	id, err := auth.FromEnv(nil)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// Init H2 node.
 	hb := hbone.New(id, hc)
+	logger := hb.ComponentLogger("hboned")
 
 	// Initialize token-based auth. This is useful for making calls to GCP APIs
 	// Optional, env specific.
@@ -97,7 +156,10 @@ func main() {
 	// Init credentials and discovery server.
 	_, err = k8s.InitK8S(ctx, hb)
 	if err != nil {
-		log.Fatal("Invalid K8S environment", err)
+		if serve {
+			return nil, fmt.Errorf("invalid K8S environment: %w", err)
+		}
+		logger.Warn("Invalid K8S environment", "err", err)
 	}
 
 	xdsC := handlers.InitXDSCluster(hb)
@@ -105,23 +167,25 @@ func main() {
 		if id.Cert == nil {
 			// Need to get a cert - using Istio CA or equivalent.
 			err = urpc.GetCertificate(ctx, id, xdsC)
-			log.Println("Getting cert from Istiod", err)
+			logger.Info("Getting cert from Istiod", "err", err)
 		}
 
-		log.Println("XDS ", xdsC.Addr)
+		logger.Info("XDS", "addr", xdsC.Addr)
 		// TODO: connect and get policies/configs
 		err = urpc.SetupControlPlane(ctx, hb, xdsC)
 		if err != nil {
-			log.Println("Failed to connect to XDS ", err)
+			logger.Warn("Failed to connect to XDS", "err", err)
 		}
 	}
 
 	if id.Cert != nil {
-		log.Println("Certs: ", id.TrustDomain, id.Namespace, id.Name, len(id.Cert.Certificate))
+		logger.Info("Certs", "trustDomain", id.TrustDomain, "namespace", id.Namespace, "name", id.Name, "chain", len(id.Cert.Certificate))
 	} else {
 		id.InitSelfSigned("")
-		id.SaveCerts(".")
-		log.Println("No Certs: ", id.TrustDomain, id.Namespace, id.Name)
+		if serve {
+			id.SaveCerts(".")
+		}
+		logger.Info("No certs, using self-signed", "trustDomain", id.TrustDomain, "namespace", id.Namespace, "name", id.Name)
 	}
 
 	// OAuth2 WorkloadID Tokens are needed:
@@ -134,9 +198,296 @@ func main() {
 	//tokenProvider := sts.NewGSATokenSource(&sts.AuthConfig{}, "")
 	//tcache := sts.NewTokenCache(tokenProvider)
 	//hb.TokenCallback = tcache.Token
+	return hb, nil
+}
+
+func cmdServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var localForward listFlag
+	fs.Var(&localForward, "L", "Forward port:dest from localhost to the mesh service, can be repeated")
+	printConfig := fs.Bool("print-config", false, "Print the effective config and exit")
+	fs.Parse(args)
+
+	hc := loadConfig()
+	for _, f := range localForward {
+		// port:dest - dest is a cluster name or host:port.
+		ports, dest, _ := strings.Cut(f, ":")
+		port, err := strconv.Atoi(ports)
+		if err != nil || dest == "" {
+			return fmt.Errorf("invalid -L %q, expecting port:dest", f)
+		}
+		if hc.LocalForward == nil {
+			hc.LocalForward = map[int]string{}
+		}
+		hc.LocalForward[port] = dest
+	}
+
+	if *printConfig {
+		return handlers.PrintMeshConfig(os.Stdout, hc)
+	}
+
+	hb, err := initMesh(context.Background(), hc, true)
+	if err != nil {
+		return err
+	}
 
 	handlers.Start(hb)
 
+	// Apply changes to the config file without restart.
+	handlers.WatchMeshConfig(context.Background(), hb, hb.AdminMux, "", 0)
+
 	select {}
+}
+
+// cmdConnect tunnels stdin/stdout to the destination - for ssh ProxyCommand.
+func cmdConnect(args []string) error {
+	if len(args) != 1 {
+		return errors.New("expecting host:port")
+	}
+	dest := args[0]
+	hc := loadConfig()
+	ctx := context.Background()
+	hb, err := initMesh(ctx, hc, false)
+	if err != nil {
+		return err
+	}
+	nc, err := hb.DialContext(ctx, "tcp", dest)
+	if err != nil {
+		return err
+	}
+	return hbone.Proxy(nc, os.Stdin, os.Stdout, dest)
+}
+
+// cmdForward forwards local ports to mesh addresses (-L) and ports on the
+// gateway to local ports (-R), like ssh.
+func cmdForward(args []string) error {
+	fs := flag.NewFlagSet("forward", flag.ExitOnError)
+	var local, remote listFlag
+	fs.Var(&local, "L", "Forward [bind:]port:host:port to the mesh address, can be repeated")
+	fs.Var(&remote, "R", "Forward port:[localhost:]port from the gateway to the local port, can be repeated")
+	gate := fs.String("gate", os.Getenv("MESH_ADDR"), "Gateway accepting reverse connections, for -R")
+	host, _ := os.Hostname()
+	name := fs.String("name", host, "Service name registered on the gateway, for -R")
+	fs.Parse(args)
+	if len(local) == 0 && len(remote) == 0 {
+		return errors.New("expecting -L or -R")
+	}
+	if len(remote) > 0 && *gate == "" {
+		return errors.New("-R requires -gate or MESH_ADDR")
+	}
+
+	hc := loadConfig()
+	for _, r := range remote {
+		pn, v, err := parseRemoteForward(r)
+		if err != nil {
+			return err
+		}
+		// The remote port is remapped to the local port.
+		if hc.Ports == nil {
+			hc.Ports = map[string]string{}
+		}
+		hc.Ports[pn] = v
+	}
+
+	hb, err := initMesh(context.Background(), hc, false)
+	if err != nil {
+		return err
+	}
+
+	errc := make(chan error, len(local))
+	for _, l := range local {
+		bind, dest, err := parseForward(l)
+		if err != nil {
+			return err
+		}
+		go func() {
+			errc <- hbone.LocalForwardPort(bind, dest, hb)
+		}()
+	}
+	if len(remote) > 0 {
+		ns := hc.Namespace
+		if ns == "" {
+			ns = "default"
+		}
+		handlers.RemoteForward(hb, *gate, *name, ns)
+	}
+	return <-errc
+}
+
+// parseForward parses [bind:]port:host:port, returning the local address
+// and the destination.
+func parseForward(s string) (string, string, error) {
+	parts := strings.Split(s, ":")
+	switch len(parts) {
+	case 3:
+		return "127.0.0.1:" + parts[0], parts[1] + ":" + parts[2], nil
+	case 4:
+		return parts[0] + ":" + parts[1], parts[2] + ":" + parts[3], nil
+	}
+	return "", "", fmt.Errorf("invalid forward %q, expecting [bind:]port:host:port", s)
+}
+
+// parseRemoteForward parses port:[localhost:]port, returning the port name
+// and value.
+func parseRemoteForward(s string) (string, string, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) == 3 && (parts[1] == "localhost" || parts[1] == "127.0.0.1") {
+		parts = []string{parts[0], parts[2]}
+	}
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid remote forward %q, expecting port:[localhost:]port", s)
+	}
+	for _, p := range parts {
+		if n, err := strconv.Atoi(p); err != nil || n <= 0 || n > 65535 {
+			return "", "", fmt.Errorf("invalid port in remote forward %q", s)
+		}
+	}
+	return "tcp-" + parts[0], parts[0] + ":" + parts[1], nil
+}
+
+// adminAddress returns the address of the admin listener in the config, or
+// the default 127.0.0.1:15000.
+func adminAddress(hc *hbone.MeshSettings) string {
+	var names []string
+	for name, l := range hc.Listeners {
+		if l != nil && l.Protocol == "admin" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "127.0.0.1:15000"
+	}
+	sort.Strings(names)
+	if a := hc.Listeners[names[0]].Address; a != "" {
+		return a
+	}
+	return names[0]
+}
+
+// dialAddress converts a listen address - port, :port or unspecified IP - to
+// a loopback address for dialing.
+func dialAddress(addr string) string {
+	if !strings.Contains(addr, ":") {
+		return "127.0.0.1:" + addr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		return net.JoinHostPort("127.0.0.1", port)
+	}
+	return addr
+}
+
+// cmdGet makes a HTTP request over the mesh and writes the body to stdout.
+func cmdGet(args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	var headers listFlag
+	fs.Var(&headers, "H", "Request header 'name: value', can be repeated")
+	verbose := fs.Bool("v", false, "Print the response status and headers to stderr")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("expecting URL")
+	}
+	req, err := http.NewRequest(http.MethodGet, fs.Arg(0), nil)
+	if err != nil {
+		return err
+	}
+	for _, h := range headers {
+		k, v, ok := strings.Cut(h, ":")
+		if !ok {
+			return fmt.Errorf("invalid header %q", h)
+		}
+		req.Header.Add(strings.TrimSpace(k), strings.TrimSpace(v))
+	}
 
+	hc := loadConfig()
+	hb, err := initMesh(req.Context(), hc, false)
+	if err != nil {
+		return err
+	}
+	res, err := (&http.Client{Transport: hb.Http11Transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if *verbose {
+		fmt.Fprintln(os.Stderr, res.Proto, res.Status)
+		res.Header.Write(os.Stderr)
+	}
+	if _, err := io.Copy(os.Stdout, res.Body); err != nil {
+		return err
+	}
+	if res.StatusCode >= 400 {
+		return errors.New(res.Status)
+	}
+	return nil
+}
+
+// cmdStatus prints the listeners, clusters and connections of a running
+// daemon, using the debug endpoints on the admin port.
+func cmdStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	admin := fs.String("admin", "", "Admin address of the daemon, default from the admin listener or 127.0.0.1:15000")
+	fs.Parse(args)
+
+	addr := *admin
+	if addr == "" {
+		addr = adminAddress(loadConfig())
+	}
+	addr = dialAddress(addr)
+
+	get := func(path string, v interface{}) error {
+		res, err := http.Get("http://" + addr + path)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			return fmt.Errorf("%s: %s", path, res.Status)
+		}
+		return json.NewDecoder(res.Body).Decode(v)
+	}
+
+	var listeners []*hbone.ListenerInfo
+	if err := get("/debug/listeners", &listeners); err != nil {
+		return err
+	}
+	fmt.Println("Listeners:")
+	for _, l := range listeners {
+		fmt.Printf("  %-20s %-12s %-22s %s %s\n", l.Name, l.Protocol, l.Bound, l.ForwardTo, l.Error)
+	}
+
+	var clusters []*hbone.ClusterInfo
+	if err := get("/debug/clusters", &clusters); err != nil {
+		return err
+	}
+	fmt.Println("Clusters:")
+	for _, c := range clusters {
+		fmt.Printf("  %-40s endpoints=%d connections=%d\n", c.Addr, len(c.Endpoints), len(c.Connections))
+	}
+
+	var conns []*hbone.ConnInfo
+	if err := get("/debug/connections", &conns); err != nil {
+		return err
+	}
+	fmt.Println("Connections:")
+	for _, c := range conns {
+		dir := "in "
+		if !c.Server {
+			dir = "out"
+		}
+		fmt.Printf("  %s %-22s %-40s streams=%d since=%s\n", dir, c.Remote, c.Peer, c.ActiveStreams,
+			c.Start.Format(time.RFC3339))
+	}
+
+	var reload struct {
+		Version int    `json:"version"`
+		Error   string `json:"error"`
+	}
+	if get("/debug/config_reload", &reload) == nil {
+		fmt.Printf("Config: version=%d %s\n", reload.Version, reload.Error)
+	}
+	return nil
 }
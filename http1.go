@@ -0,0 +1,241 @@
+package hbone
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/costinm/hbone/h2"
+	"golang.org/x/net/http2"
+)
+
+// Plain HTTP/1.1 connections, accepted on a listener using protocol
+// detection. The peer has no identity - requests are authorized using the
+// source IP and request attributes, then handled by the Mux or forwarded to
+// the local app, like HTTP requests received over HBONE. Without an ALLOW
+// policy, only clients on the SecureCIDR networks are allowed.
+//
+// CONNECT is handled like a HBONE CONNECT stream without a peer identity: the
+// port must be declared, and only gateways forward to non-local
+// destinations.
+
+// HandleAcceptedHTTP serves a plain HTTP/1.1 connection. Blocks until the
+// connection is closed.
+func (hb *HBone) HandleAcceptedHTTP(conn net.Conn) {
+	if !hb.acceptConn() {
+		hb.log.Warn("Connection limit reached", "remote", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	defer hb.releaseConn()
+
+	serveHTTPConn(conn, http.HandlerFunc(hb.serveHTTP1), hb.HandsahakeTimeout)
+}
+
+// serveHTTPConn serves HTTP requests on an accepted connection, using h2 if
+// negotiated with ALPN. Blocks until the connection is closed.
+func serveHTTPConn(conn net.Conn, h http.Handler, headerTimeout time.Duration) {
+	if tc, ok := conn.(*tls.Conn); ok && tc.ConnectionState().NegotiatedProtocol == "h2" {
+		(&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: h})
+		return
+	}
+	l := &oneConnListener{conn: conn, addr: conn.LocalAddr(), done: make(chan struct{})}
+	srv := &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: headerTimeout,
+		ConnState: func(c net.Conn, s http.ConnState) {
+			if s == http.StateClosed || s == http.StateHijacked {
+				l.Close()
+			}
+		},
+	}
+	srv.Serve(l)
+}
+
+// serveHTTP1 handles a request received on a plain HTTP/1.1 connection.
+func (hb *HBone) serveHTTP1(w http.ResponseWriter, r *http.Request) {
+	t0 := time.Now()
+	var err error
+	defer func() {
+		hb.log.Info("HTTP1", "method", r.Method, "url", r.URL, "host", r.Host,
+			"remote", r.RemoteAddr, "dur", time.Since(t0), "err", err)
+	}()
+
+	release, err := hb.AcquireStream(r.RemoteAddr)
+	if err != nil {
+		w.Header().Set("retry-after", "1")
+		w.Header().Set(HeaderProxyStatus, hb.proxyStatus(ProxyErrConnectionLimit, err))
+		http.Error(w, errorText(http.StatusServiceUnavailable, err), http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	if r.Method == http.MethodConnect {
+		err = hb.connectHTTP1(w, r)
+		return
+	}
+
+	if err = hb.authorizeHTTP(r, nil); err != nil {
+		w.Header().Set(HeaderProxyStatus, hb.proxyStatus(ProxyErrDenied, err))
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	rh, pat := hb.Mux.Handler(r)
+	if pat != "" {
+		rh.ServeHTTP(w, r)
+		return
+	}
+
+	if rt := hb.matchRoute(r); rt != nil {
+		hb.setXFCC(r, nil)
+		hb.serveRoute(rt, w, r)
+		return
+	}
+
+	port, err := hb.localPort(r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	hb.setXFCC(r, nil)
+	hb.localProxy(port).ServeHTTP(w, r)
+}
+
+// connectHTTP1 tunnels a CONNECT request to the local app or, for gateways,
+// to a non-local destination.
+func (hb *HBone) connectHTTP1(w http.ResponseWriter, r *http.Request) error {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		w.Header().Set(HeaderProxyStatus, hb.proxyStatus(ProxyErrRequest, nil))
+		http.Error(w, "CONNECT not supported", http.StatusMethodNotAllowed)
+		return nil
+	}
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+
+	req := httpAuthzRequest(r, nil)
+	req.Gateway = hb.Gateway && !isLocalAddr(local, r.Host)
+	dest := r.Host
+	if !req.Gateway {
+		_, p, err := net.SplitHostPort(r.Host)
+		var port *InboundPort
+		if err == nil {
+			port, err = hb.ResolvePort(p)
+		}
+		if err != nil {
+			w.Header().Set(HeaderProxyStatus, hb.proxyStatus(ProxyErrDenied, err))
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return err
+		}
+		dest = "localhost:" + strconv.Itoa(port.TargetPort)
+	}
+	if err := hb.authorize(req); err != nil {
+		w.Header().Set(HeaderProxyStatus, hb.proxyStatus(ProxyErrDenied, err))
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return err
+	}
+
+	var nc net.Conn
+	var err error
+	switch {
+	case !req.Gateway:
+		nc, err = net.Dial("tcp", dest)
+	case hb.GetCluster(dest) == nil && hb.h2rCluster(dest) == nil:
+		nc, err = hb.dialRemote(r.Context(), local, dest)
+	default:
+		nc, err = hb.DialContext(r.Context(), "tcp", dest)
+	}
+	if err != nil {
+		status, t := dialStatus(err)
+		w.Header().Set(HeaderProxyStatus, hb.proxyStatus(t, err))
+		http.Error(w, errorText(status, err), status)
+		return err
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		nc.Close()
+		return err
+	}
+	if _, err = brw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n"); err == nil {
+		err = brw.Flush()
+	}
+	if err != nil {
+		nc.Close()
+		conn.Close()
+		return err
+	}
+	return hb.Proxy(nc, brw.Reader, conn, dest)
+}
+
+// authorizeHTTP checks the policies for a request received on a HTTP
+// listener. The peer is set for TLS listeners with client certificates.
+func (hb *HBone) authorizeHTTP(r *http.Request, peer *h2.PeerMetadata) error {
+	return hb.authorize(httpAuthzRequest(r, peer))
+}
+
+// httpAuthzRequest returns the authz attributes of a HTTP request.
+func httpAuthzRequest(r *http.Request, peer *h2.PeerMetadata) *AuthzRequest {
+	req := &AuthzRequest{
+		Peer:   peer,
+		Host:   r.Host,
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Header: r.Header,
+	}
+	if h, _, e := net.SplitHostPort(r.RemoteAddr); e == nil {
+		req.SourceIP = net.ParseIP(h)
+	}
+	if _, p, e := net.SplitHostPort(r.Host); e == nil {
+		req.Port, _ = strconv.Atoi(p)
+	}
+	if r.TLS != nil {
+		req.SNI = r.TLS.ServerName
+	}
+	return req
+}
+
+// authorize evaluates the policies for a request from a HTTP listener.
+func (hb *HBone) authorize(req *AuthzRequest) error {
+	res := hb.Authorize(req)
+	if res.Allow {
+		return nil
+	}
+	hb.log.Warn("Authz denied", "policy", res.Policy, "rule", res.Rule, "reason", res.Reason,
+		"peer", req.Peer, "source", req.SourceIP, "method", req.Method, "host", req.Host, "path", req.Path)
+	return errAuthzDenied
+}
+
+// oneConnListener is a net.Listener returning a single connection. Accept
+// blocks after the first call until the listener is closed.
+type oneConnListener struct {
+	mu   sync.Mutex
+	conn net.Conn
+	addr net.Addr
+	done chan struct{}
+	once sync.Once
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	c := l.conn
+	l.conn = nil
+	l.mu.Unlock()
+	if c != nil {
+		return c, nil
+	}
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *oneConnListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *oneConnListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,150 @@
+package hbone
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHandleAcceptedHTTP(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("app " + r.Header.Get(HeaderXFCC)))
+	}))
+	defer app.Close()
+	port := strconv.Itoa(app.Listener.Addr().(*net.TCPAddr).Port)
+
+	hb := New(nil, &MeshSettings{Ports: map[string]string{"http": port}, SecureCIDR: []string{"127.0.0.0/8"}})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go hb.HandleAcceptedHTTP(c)
+		}
+	}()
+
+	req, _ := http.NewRequest("GET", "http://"+l.Addr().String()+"/", nil)
+	req.Host = "svc"
+	req.Header.Set(HeaderXFCC, "By=spoofed")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != 200 || string(body) != "app " {
+		t.Fatal("Unexpected response", res.StatusCode, string(body))
+	}
+
+	// CONNECT to a declared port is tunneled to the local app.
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	echoPort := strconv.Itoa(echo.Addr().(*net.TCPAddr).Port)
+	hb.Ports["tcp-echo"] = echoPort
+	hb.AddAuthorizationPolicy(&AuthzPolicy{Name: "deny-header", Action: AuthzDeny,
+		Rules: []*AuthzRule{{When: []*AuthzCondition{{Key: "request.headers[x-deny]", Values: []string{"*"}}}}}})
+
+	connect := func(host, hdr string) (net.Conn, *http.Response) {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n%s\r\n", host, host, hdr)
+		br := bufio.NewReader(c)
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &bufConn{Conn: c, r: br}, res
+	}
+
+	for _, host := range []string{"svc:" + echoPort, "10.1.1.1:" + echoPort} {
+		c, res := connect(host, "")
+		if res.StatusCode != 200 {
+			t.Fatal("Unexpected CONNECT status", host, res.StatusCode)
+		}
+		c.Write([]byte("hello"))
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+			t.Fatal("Unexpected echo", string(b), err)
+		}
+		c.Close()
+	}
+
+	for _, tc := range []struct{ host, hdr string }{
+		{"svc:1", ""},
+		{"svc", ""},
+		{"svc:" + echoPort, "x-deny: 1\r\n"},
+	} {
+		c, res := connect(tc.host, tc.hdr)
+		if res.StatusCode != http.StatusForbidden {
+			t.Error("Expecting CONNECT denied", tc.host, res.StatusCode)
+		}
+		c.Close()
+	}
+}
+
+func TestHTTP1Unauthenticated(t *testing.T) {
+	// Not on a secure network - plain HTTP clients have no identity.
+	hb := New(nil, &MeshSettings{Ports: map[string]string{"http": "8080"}, Namespace: "test"})
+	hb.Mux.HandleFunc("/debug/x", func(w http.ResponseWriter, r *http.Request) {})
+	l := serveTest(t, hb.HandleAcceptedHTTP)
+
+	res, err := http.Get("http://" + l.Addr().String() + "/debug/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Error("Expecting mux handler denied", res.StatusCode)
+	}
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(c, "CONNECT localhost:8080 HTTP/1.1\r\nHost: localhost:8080\r\n\r\n")
+	res, err = http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil || res.StatusCode != http.StatusForbidden {
+		t.Error("Expecting CONNECT denied", res, err)
+	}
+}
+
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
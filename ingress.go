@@ -0,0 +1,211 @@
+package hbone
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/costinm/hbone/h2"
+)
+
+// TLS-terminating listeners, for the ingress role.
+//
+// - tls: the plain text is forwarded to ForwardTo using hb.Dial.
+// - https: HTTP/1.1 and h2 requests are forwarded using the routes, or to the
+// ForwardTo cluster using Cluster.RoundTrip.
+//
+// The certificate is selected by SNI from Listener.Certs: exact match, then
+// '*.domain' for the parent domain, then '*'. The value is a directory with
+// tls.crt and tls.key (K8S secret mount), or 'cert.pem,key.pem'. Without a
+// match the workload certificate is used.
+//
+// If ClientCA is set, clients must present a certificate signed by one of
+// the roots in the file. Requests are authorized like HBONE streams - clients
+// without a certificate are only allowed by an ALLOW policy or from the
+// SecureCIDR networks.
+
+// listenerState is the runtime state of a TLS listener, created on first
+// use.
+type listenerState struct {
+	tlsConf *tls.Config
+	err     error
+
+	// certs are the loaded certificates, by domain.
+	certs map[string]*tls.Certificate
+}
+
+// TLSConfig returns the server TLS config for the listener, loading the
+// certificates on first call.
+func (l *Listener) TLSConfig(hb *HBone) (*tls.Config, error) {
+	l.once.Do(func() {
+		l.state.certs = map[string]*tls.Certificate{}
+		l.state.tlsConf, l.state.err = l.newTLSConfig(hb, l.state.certs)
+	})
+	return l.state.tlsConf, l.state.err
+}
+
+func (l *Listener) newTLSConfig(hb *HBone, certs map[string]*tls.Certificate) (*tls.Config, error) {
+	for d, v := range l.Certs {
+		crt, key := filepath.Join(v, "tls.crt"), filepath.Join(v, "tls.key")
+		if c, k, ok := strings.Cut(v, ","); ok {
+			crt, key = c, k
+		}
+		cert, err := tls.LoadX509KeyPair(crt, key)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: cert for %s: %w", l.Address, d, err)
+		}
+		certs[d] = &cert
+	}
+
+	mesh := hb.Auth.GenerateTLSConfigServer()
+	alpn := l.ALPN
+	if len(alpn) == 0 && l.Protocol == "https" {
+		alpn = []string{"h2", "http/1.1"}
+	}
+	conf := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: alpn,
+		GetCertificate: func(ch *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if c := selectCert(certs, ch.ServerName); c != nil {
+				return c, nil
+			}
+			if mesh != nil && mesh.GetCertificate != nil {
+				return mesh.GetCertificate(ch)
+			}
+			if mesh != nil && len(mesh.Certificates) > 0 {
+				return &mesh.Certificates[0], nil
+			}
+			return nil, errors.New("no certificate for " + ch.ServerName)
+		},
+	}
+	if l.ClientCA != "" {
+		pem, err := os.ReadFile(l.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %w", l.Address, err)
+		}
+		conf.ClientCAs = x509.NewCertPool()
+		if !conf.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("listener %s: no certificates in %s", l.Address, l.ClientCA)
+		}
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// selectCert returns the certificate for the SNI: exact, wildcard for the
+// parent domain, then default.
+func selectCert(certs map[string]*tls.Certificate, sni string) *tls.Certificate {
+	sni = strings.ToLower(sni)
+	if c := certs[sni]; c != nil {
+		return c
+	}
+	if _, parent, ok := strings.Cut(sni, "."); ok {
+		if c := certs["*."+parent]; c != nil {
+			return c
+		}
+	}
+	return certs["*"]
+}
+
+// handshake terminates TLS on an accepted connection.
+func (hb *HBone) handshake(l *Listener, conn net.Conn) (*tls.Conn, error) {
+	conf, err := l.TLSConfig(hb)
+	if err != nil {
+		return nil, err
+	}
+	tc := tls.Server(conn, conf)
+	tc.SetDeadline(time.Now().Add(hb.HandsahakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// HandleAcceptedTLS terminates TLS and forwards the plain text stream to
+// the listener ForwardTo address.
+func (hb *HBone) HandleAcceptedTLS(l *Listener, conn net.Conn) {
+	defer conn.Close()
+	if !hb.acceptConn() {
+		hb.log.Warn("Connection limit reached", "remote", conn.RemoteAddr())
+		return
+	}
+	defer hb.releaseConn()
+
+	tc, err := hb.handshake(l, conn)
+	if err != nil {
+		hb.log.Warn("TLS handshake error", "listener", l.Address, "remote", conn.RemoteAddr(), "err", err)
+		return
+	}
+	if l.ForwardTo == "" {
+		hb.log.Warn("TLS listener without forwardTo", "listener", l.Address)
+		return
+	}
+	nc, err := hb.Dial("tcp", l.ForwardTo)
+	if err != nil {
+		hb.log.Warn("Error dialing", "dest", l.ForwardTo, "err", err)
+		return
+	}
+	err = hb.Proxy(nc, tc, tc, l.ForwardTo)
+	hb.log.Info("TLS-END", "listener", l.Address, "sni", tc.ConnectionState().ServerName,
+		"dest", l.ForwardTo, "err", err)
+}
+
+// HandleAcceptedHTTPS terminates TLS and forwards HTTP requests to the
+// listener ForwardTo cluster.
+func (hb *HBone) HandleAcceptedHTTPS(l *Listener, conn net.Conn) {
+	defer conn.Close()
+	if !hb.acceptConn() {
+		hb.log.Warn("Connection limit reached", "remote", conn.RemoteAddr())
+		return
+	}
+	defer hb.releaseConn()
+
+	tc, err := hb.handshake(l, conn)
+	if err != nil {
+		hb.log.Warn("TLS handshake error", "listener", l.Address, "remote", conn.RemoteAddr(), "err", err)
+		return
+	}
+	serveHTTPConn(tc, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hb.serveIngress(l, w, r)
+	}), hb.HandsahakeTimeout)
+}
+
+// serveIngress handles a request received on a https listener.
+func (hb *HBone) serveIngress(l *Listener, w http.ResponseWriter, r *http.Request) {
+	t0 := time.Now()
+	var peer *h2.PeerMetadata
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		peer = &h2.PeerMetadata{}
+		peer.SetTLSPeer(r.TLS)
+	}
+	err := hb.authorizeHTTP(r, peer)
+	defer func() {
+		hb.log.Info("HTTPS", "listener", l.Address, "method", r.Method, "url", r.URL, "host", r.Host,
+			"remote", r.RemoteAddr, "peer", peer, "dur", time.Since(t0), "err", err)
+	}()
+	if err != nil {
+		w.Header().Set(HeaderProxyStatus, hb.proxyStatus(ProxyErrDenied, err))
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if rt := hb.matchRoute(r); rt != nil {
+		hb.setXFCC(r, r.TLS)
+		hb.serveRoute(rt, w, r)
+		return
+	}
+	if l.ForwardTo == "" {
+		err = errors.New("no route")
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	hb.setXFCC(r, r.TLS)
+	hb.clusterProxy(l.ForwardTo).ServeHTTP(w, r)
+}
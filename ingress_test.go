@@ -0,0 +1,134 @@
+package hbone
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCert creates a self-signed certificate for the names in dir, as
+// tls.crt and tls.key.
+func writeCert(t *testing.T, dir string, names ...string) *x509.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, _ := x509.MarshalECPrivateKey(key)
+	os.MkdirAll(dir, 0700)
+	os.WriteFile(filepath.Join(dir, "tls.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(filepath.Join(dir, "tls.key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600)
+	c, _ := x509.ParseCertificate(der)
+	return c
+}
+
+func TestIngressHTTPS(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + " " + r.Header.Get(HeaderXFCC)))
+	}))
+	defer app.Close()
+
+	dir := t.TempDir()
+	wc := writeCert(t, filepath.Join(dir, "wildcard"), "*.example.com")
+	dc := writeCert(t, filepath.Join(dir, "default"), "other")
+	writeCert(t, filepath.Join(dir, "client"), "client")
+
+	hb := New(nil, &MeshSettings{SecureCIDR: []string{"127.0.0.0/8"}})
+	l := &Listener{
+		Address:   "127.0.0.1:0",
+		Protocol:  "https",
+		ForwardTo: app.Listener.Addr().String(),
+		Certs: map[string]string{
+			"*.example.com": filepath.Join(dir, "wildcard"),
+			"*":             filepath.Join(dir, "default"),
+		},
+		ClientCA: filepath.Join(dir, "client", "tls.crt"),
+	}
+	if _, err := l.TLSConfig(hb); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go hb.HandleAcceptedHTTPS(l, c)
+		}
+	}()
+
+	clientCert, _ := tls.LoadX509KeyPair(filepath.Join(dir, "client", "tls.crt"), filepath.Join(dir, "client", "tls.key"))
+	roots := x509.NewCertPool()
+	roots.AddCert(wc)
+	roots.AddCert(dc)
+	for _, tc := range []struct {
+		sni  string
+		cert *x509.Certificate
+		h2   bool
+	}{
+		{"a.example.com", wc, true},
+		{"other", dc, false},
+	} {
+		tr := &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: tc.sni, RootCAs: roots,
+				Certificates: []tls.Certificate{clientCert}},
+			ForceAttemptHTTP2: tc.h2,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return net.Dial("tcp", ln.Addr().String())
+			},
+		}
+		res, err := (&http.Client{Transport: tr}).Get("https://" + tc.sni + "/")
+		if err != nil {
+			t.Fatal(tc.sni, err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if !res.TLS.PeerCertificates[0].Equal(tc.cert) {
+			t.Error("Unexpected cert", tc.sni, res.TLS.PeerCertificates[0].Subject)
+		}
+		if res.StatusCode != 200 || (res.ProtoMajor == 2) != tc.h2 ||
+			!strings.HasPrefix(string(body), tc.sni+" Hash=") {
+			t.Error("Unexpected response", tc.sni, res.Proto, res.StatusCode, string(body))
+		}
+	}
+
+	// Client certificate required
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{ServerName: "other", RootCAs: roots},
+	}
+	if _, err := (&http.Client{Transport: tr}).Get("https://" + ln.Addr().String() + "/"); err == nil {
+		t.Error("Expecting client cert error")
+	}
+}
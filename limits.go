@@ -0,0 +1,228 @@
+package hbone
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/costinm/hbone/h2"
+)
+
+// Overload protection for the HBONE server.
+//
+// - MaxConnections: new connections over the limit are closed before the
+// TLS handshake.
+// - MaxStreamsPerConnection: sent as SETTINGS_MAX_CONCURRENT_STREAMS, extra
+// streams are refused by the H2 stack with REFUSED_STREAM.
+// - MaxStreamsPerPeer, StreamRate: streams over the limit get a 503 with
+// Proxy-Status connection_limit_reached.
+// - MaxGoroutines, MaxHeapBytes: when exceeded, new streams are reset with
+// REFUSED_STREAM - the client knows the stream was not processed and can
+// retry on a different endpoint.
+//
+// The peer is the SPIFFE identity, or the remote IP for unauthenticated
+// peers.
+//
+// The limits apply to all the listeners: HBONE, H2C, plain HTTP (each request
+// or CONNECT is a stream), TLS, H2R, and the SNI and HTTP proxy handlers using
+// AcceptConn and AcquireStream.
+
+// ServerLimits configures overload protection. Zero values mean no limit.
+type ServerLimits struct {
+	MaxConnections          int    `json:"maxConnections,omitempty"`
+	MaxStreamsPerConnection uint32 `json:"maxStreamsPerConnection,omitempty"`
+
+	// MaxStreamsPerPeer is the max number of concurrent streams for a peer
+	// identity, across all connections.
+	MaxStreamsPerPeer int `json:"maxStreamsPerPeer,omitempty"`
+
+	// StreamRate is the number of new streams per second for a peer, with
+	// StreamBurst (default: 2x rate) allowed in a burst.
+	StreamRate  float64 `json:"streamRate,omitempty"`
+	StreamBurst int     `json:"streamBurst,omitempty"`
+
+	MaxGoroutines int    `json:"maxGoroutines,omitempty"`
+	MaxHeapBytes  uint64 `json:"maxHeapBytes,omitempty"`
+}
+
+// limiter holds the state for ServerLimits.
+type limiter struct {
+	conns atomic.Int64
+
+	mu    sync.Mutex
+	peers map[string]*peerLimit
+
+	// Load shedding is checked at most once per shedInterval.
+	lastCheck atomic.Int64
+	shedding  atomic.Bool
+}
+
+type peerLimit struct {
+	active int
+	tokens float64
+	last   time.Time
+}
+
+const shedInterval = 100 * time.Millisecond
+
+var heapSample = []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+
+// acceptConn returns false if the connection limit is reached. If true,
+// releaseConn must be called when the connection is closed.
+func (hb *HBone) acceptConn() bool {
+	n := hb.limits.conns.Add(1)
+	if hb.Limits.MaxConnections > 0 && n > int64(hb.Limits.MaxConnections) {
+		hb.limits.conns.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (hb *HBone) releaseConn() {
+	hb.limits.conns.Add(-1)
+}
+
+// AcceptConn applies the connection limit to a connection accepted by a
+// handler in another package. If true, ReleaseConn must be called when the
+// connection is closed.
+func (hb *HBone) AcceptConn() bool {
+	return hb.acceptConn()
+}
+
+// ReleaseConn releases a connection accepted with AcceptConn.
+func (hb *HBone) ReleaseConn() {
+	hb.releaseConn()
+}
+
+// AcquireStream applies load shedding and the per-peer limits to a stream
+// from an unauthenticated peer - a proxied connection or request - using the
+// IP of the remote host:port as key. If allowed, the returned function must
+// be called when the stream is done.
+func (hb *HBone) AcquireStream(remote string) (func(), error) {
+	if hb.overloaded() {
+		return nil, errOverloaded
+	}
+	if h, _, err := net.SplitHostPort(remote); err == nil {
+		remote = h
+	}
+	return hb.acquireStream(remote)
+}
+
+// overloaded returns true if the goroutine or heap thresholds are exceeded.
+func (hb *HBone) overloaded() bool {
+	l := &hb.Limits
+	if l.MaxGoroutines == 0 && l.MaxHeapBytes == 0 {
+		return false
+	}
+	now := time.Now().UnixNano()
+	last := hb.limits.lastCheck.Load()
+	if now-last < int64(shedInterval) || !hb.limits.lastCheck.CompareAndSwap(last, now) {
+		return hb.limits.shedding.Load()
+	}
+	shed := l.MaxGoroutines > 0 && runtime.NumGoroutine() > l.MaxGoroutines
+	if !shed && l.MaxHeapBytes > 0 {
+		metrics.Read(heapSample)
+		shed = heapSample[0].Value.Uint64() > l.MaxHeapBytes
+	}
+	if shed != hb.limits.shedding.Swap(shed) {
+		hb.log.Warn("Load shedding", "enabled", shed, "goroutines", runtime.NumGoroutine())
+	}
+	return shed
+}
+
+// peerKey returns the key used for per-peer limits.
+func peerKey(stream *h2.H2Stream) string {
+	if stream.Peer != nil && stream.Peer.Principal != "" {
+		return stream.Peer.Principal
+	}
+	if ta, ok := stream.Conn().RemoteAddr().(*net.TCPAddr); ok {
+		return ta.IP.String()
+	}
+	return stream.Conn().RemoteAddr().String()
+}
+
+// acquireStream checks the per-peer limits for a new stream. If allowed,
+// the returned function must be called when the stream is done.
+func (hb *HBone) acquireStream(key string) (func(), error) {
+	l := &hb.Limits
+	if l.MaxStreamsPerPeer == 0 && l.StreamRate == 0 {
+		return func() {}, nil
+	}
+	hb.limits.mu.Lock()
+	defer hb.limits.mu.Unlock()
+	if hb.limits.peers == nil {
+		hb.limits.peers = map[string]*peerLimit{}
+	}
+	now := time.Now()
+	if len(hb.limits.peers) > maxIdlePeers {
+		hb.sweepPeers(now)
+	}
+	p := hb.limits.peers[key]
+	if p == nil {
+		p = &peerLimit{last: now, tokens: float64(hb.streamBurst())}
+		hb.limits.peers[key] = p
+	}
+
+	if l.MaxStreamsPerPeer > 0 && p.active >= l.MaxStreamsPerPeer {
+		return nil, fmt.Errorf("%w: %d active streams for %s", errOverloaded, p.active, key)
+	}
+	if l.StreamRate > 0 {
+		p.tokens += now.Sub(p.last).Seconds() * l.StreamRate
+		if max := float64(hb.streamBurst()); p.tokens > max {
+			p.tokens = max
+		}
+		p.last = now
+		if p.tokens < 1 {
+			return nil, fmt.Errorf("%w: stream rate exceeded for %s", errOverloaded, key)
+		}
+		p.tokens--
+	}
+	p.active++
+
+	return func() {
+		hb.limits.mu.Lock()
+		defer hb.limits.mu.Unlock()
+		p.active--
+		if p.active == 0 && hb.peerIdle(p, time.Now()) {
+			delete(hb.limits.peers, key)
+		}
+	}, nil
+}
+
+// maxIdlePeers is the number of tracked peers that triggers removing the
+// idle ones.
+const maxIdlePeers = 1024
+
+// peerIdle returns true if the peer has no streams and a full bucket - the
+// state can be dropped.
+func (hb *HBone) peerIdle(p *peerLimit, now time.Time) bool {
+	if p.active > 0 {
+		return false
+	}
+	return hb.Limits.StreamRate == 0 ||
+		p.tokens+now.Sub(p.last).Seconds()*hb.Limits.StreamRate >= float64(hb.streamBurst())
+}
+
+// sweepPeers removes the idle peers. Called with the lock held.
+func (hb *HBone) sweepPeers(now time.Time) {
+	for k, p := range hb.limits.peers {
+		if hb.peerIdle(p, now) {
+			delete(hb.limits.peers, k)
+		}
+	}
+}
+
+func (hb *HBone) streamBurst() int {
+	if hb.Limits.StreamBurst > 0 {
+		return hb.Limits.StreamBurst
+	}
+	b := int(2 * hb.Limits.StreamRate)
+	if b < 1 {
+		b = 1
+	}
+	return b
+}
@@ -0,0 +1,96 @@
+package hbone
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLimits(t *testing.T) {
+	hb := New(nil, &MeshSettings{Limits: ServerLimits{MaxConnections: 1, MaxStreamsPerPeer: 2,
+		StreamRate: 10, StreamBurst: 3, MaxGoroutines: 1}})
+
+	if !hb.acceptConn() || hb.acceptConn() {
+		t.Fatal("Expecting 1 connection")
+	}
+	hb.releaseConn()
+	if !hb.acceptConn() {
+		t.Fatal("Expecting connection after release")
+	}
+
+	r1, err := hb.acquireStream("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := hb.acquireStream("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hb.acquireStream("alice"); !errors.Is(err, errOverloaded) {
+		t.Fatal("Expecting concurrent streams limit", err)
+	}
+	if r, err := hb.acquireStream("bob"); err != nil {
+		t.Fatal("Expecting other peer allowed", err)
+	} else {
+		r()
+	}
+	r1()
+	r2()
+
+	// Burst of 3 - 2 already used.
+	r3, err := hb.acquireStream("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r3()
+	if _, err := hb.acquireStream("alice"); !errors.Is(err, errOverloaded) {
+		t.Fatal("Expecting rate limit", err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if r, err := hb.acquireStream("alice"); err != nil {
+		t.Fatal("Expecting refill", err)
+	} else {
+		r()
+	}
+
+	if !hb.overloaded() {
+		t.Fatal("Expecting load shedding with 1 goroutine")
+	}
+}
+
+func TestLimitsHTTP1(t *testing.T) {
+	hb := New(nil, &MeshSettings{SecureCIDR: []string{"127.0.0.0/8"},
+		Limits: ServerLimits{StreamRate: 0.001, StreamBurst: 1}})
+	hb.Mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {})
+	l := serveTest(t, hb.HandleAcceptedHTTP)
+
+	// Plain HTTP requests and CONNECT use the remote IP as peer.
+	for i, code := range []int{200, http.StatusServiceUnavailable} {
+		res, err := http.Get("http://" + l.Addr().String() + "/ok")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != code {
+			t.Fatal("Unexpected status", i, res.StatusCode)
+		}
+		if code != 200 && res.Header.Get(HeaderProxyStatus) != "hbone; error=connection_limit_reached; details=\"server overloaded\"" {
+			t.Error("Unexpected proxy status", res.Header.Get(HeaderProxyStatus))
+		}
+	}
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, "CONNECT localhost:8080 HTTP/1.1\r\nHost: localhost:8080\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil || res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal("Expecting CONNECT to be limited", res, err)
+	}
+}
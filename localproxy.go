@@ -0,0 +1,106 @@
+package hbone
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/costinm/hbone/h2"
+	"golang.org/x/net/http2"
+)
+
+// Local reverse proxy, for HTTP requests (not CONNECT) received on the HBONE
+// port. The local port is selected from the Host header:
+// - host:port - the port is resolved using MeshSettings.Ports
+// - host without port - MeshSettings.LocalHosts, then the http port.
+//
+// The protocol of the port selects the upstream protocol: HTTP/1.1 for http
+// and tcp, h2c with prior knowledge for http2/h2c and grpc. Responses are
+// streamed and trailers are preserved.
+
+// localPort returns the inbound port for a HTTP request.
+func (hb *HBone) localPort(host string) (*InboundPort, error) {
+	if _, p, err := net.SplitHostPort(host); err == nil {
+		return hb.ResolvePort(p)
+	}
+	if v, ok := hb.LocalHosts[host]; ok {
+		return hb.ResolvePort(v)
+	}
+	tp := hb.httpPort()
+	return &InboundPort{Name: "http", Protocol: ProtoHTTP, Port: tp, TargetPort: tp}, nil
+}
+
+// localProxy returns the reverse proxy for a local port, creating it on first
+// use.
+func (hb *HBone) localProxy(port *InboundPort) *httputil.ReverseProxy {
+	key := port.Protocol + "/" + strconv.Itoa(port.TargetPort)
+	hb.m.RLock()
+	rp := hb.localProxies[key]
+	hb.m.RUnlock()
+	if rp != nil {
+		return rp
+	}
+
+	u, _ := url.Parse("http://127.0.0.1:" + strconv.Itoa(port.TargetPort))
+	rp = httputil.NewSingleHostReverseProxy(u)
+	switch port.Protocol {
+	case ProtoH2C, ProtoGRPC:
+		rp.Transport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				d := &net.Dialer{}
+				return d.DialContext(ctx, network, addr)
+			},
+		}
+		// Streaming - gRPC and h2 apps may send data without ending the stream.
+		rp.FlushInterval = -1
+	}
+	rp.ErrorLog = nil
+	rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		hb.log.Warn("Local proxy error", "port", port.TargetPort, "proto", port.Protocol,
+			"url", r.URL, "err", err)
+		status, t := dialStatus(err)
+		w.Header().Set(HeaderProxyStatus, hb.proxyStatus(t, err))
+		w.WriteHeader(status)
+	}
+
+	hb.m.Lock()
+	if hb.localProxies == nil {
+		hb.localProxies = map[string]*httputil.ReverseProxy{}
+	}
+	if old := hb.localProxies[key]; old != nil {
+		rp = old
+	} else {
+		hb.localProxies[key] = rp
+	}
+	hb.m.Unlock()
+	return rp
+}
+
+// moveTrailers moves the trailers set by the reverse proxy in the response
+// headers - announced with 'Trailer' or using http.TrailerPrefix - to the
+// stream trailers, sent on CloseWrite.
+func moveTrailers(s *h2.H2Stream) {
+	h := s.Response.Header
+	if s.Response.Trailer == nil {
+		s.Response.Trailer = http.Header{}
+	}
+	for _, v := range h["Trailer"] {
+		for _, k := range strings.Split(v, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			if tv, ok := h[k]; ok {
+				s.Response.Trailer[k] = tv
+			}
+		}
+	}
+	for k, v := range h {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			s.Response.Trailer[http.CanonicalHeaderKey(k[len(http.TrailerPrefix):])] = v
+		}
+	}
+}
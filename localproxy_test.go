@@ -0,0 +1,54 @@
+package hbone
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestLocalProxy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	h := h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write([]byte(r.Proto))
+		w.Header().Set("Grpc-Status", "0")
+	}), &http2.Server{})
+	go http.Serve(l, h)
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	hb := New(nil, &MeshSettings{Ports: map[string]string{"grpc": port, "http": "8080"},
+		LocalHosts: map[string]string{"api": "grpc"}})
+
+	for _, host := range []string{"svc:" + port, "api"} {
+		p, err := hb.localPort(host)
+		if err != nil || p.Protocol != ProtoGRPC {
+			t.Fatal("Unexpected port", host, p, err)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "http://"+host+"/svc/Method", nil)
+		hb.localProxy(p).ServeHTTP(w, r)
+		res := w.Result()
+		body, _ := io.ReadAll(res.Body)
+		if string(body) != "HTTP/2.0" || res.Trailer.Get("Grpc-Status") != "0" {
+			t.Fatal("Unexpected response", string(body), res.Trailer)
+		}
+	}
+
+	if p, _ := hb.localPort("other"); p.TargetPort != 8080 || p.Protocol != ProtoHTTP {
+		t.Fatal("Expecting http port", p)
+	}
+	if _, err := hb.localPort("other:9999"); err == nil {
+		t.Fatal("Expecting error for undeclared port")
+	}
+}
@@ -0,0 +1,65 @@
+package hbone
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/costinm/hbone/h2"
+	"github.com/costinm/hbone/nio"
+)
+
+// Log is used by package level functions like Proxy, which are not associated
+// with a HBone instance. Nodes use their own loggers and don't change it.
+var Log = slog.Default().With("component", "hbone")
+
+// SetLogger replaces the base logger and re-creates the component loggers,
+// using the levels in MeshSettings.LogLevel.
+func (hb *HBone) SetLogger(l *slog.Logger) {
+	if l == nil {
+		l = slog.Default()
+	}
+	hb.Logger = l
+	hb.log = hb.ComponentLogger("hbone")
+	hb.h2Log = hb.ComponentLogger("h2")
+	hb.nioLog = hb.ComponentLogger("nio")
+}
+
+// ComponentLogger returns a logger with a 'component' attribute and the level
+// configured for the component in MeshSettings.LogLevel. Used by hbone, h2,
+// nio and by extensions like urpc or hboned handlers.
+func (hb *HBone) ComponentLogger(component string) *slog.Logger {
+	base := hb.Logger
+	if base == nil {
+		base = slog.Default()
+	}
+	lvl := hb.LogLevel[component]
+	if lvl == "" {
+		lvl = hb.LogLevel["*"]
+	}
+	if lvl == "" {
+		return base.With("component", component)
+	}
+	return nio.ComponentLogger(base, component, parseLevel(lvl))
+}
+
+// H2Logger returns the logger used for H2 transports created by this node.
+func (hb *HBone) H2Logger() *slog.Logger {
+	if hb.h2Log == nil {
+		return h2.Log
+	}
+	return hb.h2Log
+}
+
+// parseLevel converts a level name to a slog level. In addition to the slog
+// names, "trace" enables per-read/write logging in nio.
+// Invalid names are treated as info.
+func parseLevel(s string) slog.Level {
+	if strings.EqualFold(s, "trace") {
+		return nio.LevelTrace
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return slog.LevelInfo
+	}
+	return l
+}
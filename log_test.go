@@ -0,0 +1,30 @@
+package hbone
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/costinm/hbone/nio"
+)
+
+func TestNodeLoggers(t *testing.T) {
+	l, nl := Log, nio.Log
+	var wg sync.WaitGroup
+	nodes := make([]*HBone, 4)
+	for i := range nodes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			nodes[i] = New(nil, &MeshSettings{LogLevel: map[string]string{"*": "debug"}})
+		}(i)
+	}
+	wg.Wait()
+	if Log != l || nio.Log != nl {
+		t.Error("Package loggers changed by New")
+	}
+	for _, hb := range nodes {
+		if hb.nioLog == nil || hb.nioLog == nio.Log {
+			t.Error("Missing node nio logger")
+		}
+	}
+}
@@ -8,10 +8,13 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -28,6 +31,16 @@ type Auth interface {
 	GenerateTLSConfigClientRoots(name string, pool *x509.CertPool) *tls.Config
 }
 
+// HeaderFraming is used to request a framed stream for CONNECT or POST
+// tunnels. The server echoes the header in the response if it accepts the
+// framing - otherwise the stream is used unframed.
+const HeaderFraming = "x-hbone-framing"
+
+// FramingClose selects the gRPC-style framing with in-band FIN and RST
+// described in docs/closing.md, used for server-first protocols when the
+// tunnel goes trough frontends that can't half-close the response.
+const FramingClose = "close"
+
 // Cluster represents a set of endpoints, with a common configuration.
 // Can be a K8S Service with VIP and DNS name, an external service, etc.
 //
@@ -89,7 +102,7 @@ type Cluster struct {
 	Path string
 
 	// Active connections to endpoints, each is a multiplexed H2 connection.
-	EndpointCon []*EndpointCon
+	EndpointCon []*EndpointCon `json:"-"`
 
 	// Endpoint addresses associated with the cluster.
 	// If empty, the Cluster Addr will be used directly.
@@ -129,7 +142,7 @@ type Cluster struct {
 
 	// Optional TokenProvider - not needed if client wraps google oauth
 	// or mTLS is used.
-	TokenProvider func(context.Context, string) (string, error)
+	TokenProvider func(context.Context, string) (string, error) `json:"-"`
 
 	// Static token to use. May be a long lived K8S service account secret or other long-lived creds.
 	Token string
@@ -156,10 +169,10 @@ type Cluster struct {
 	// or non-mesh destination.
 	// TODO: customize Dialer to still use mesh LB
 	// TODO: attempt ws for tunneling H2
-	Client *http.Client
+	Client *http.Client `json:"-"`
 
 	// TLS config used when dialing using workload identity, shared
-	TLSClientConfig *tls.Config
+	TLSClientConfig *tls.Config `json:"-"`
 
 	//// Shared by all endpoints for this cluster
 	//H2T *http2.Transport
@@ -175,7 +188,15 @@ type Cluster struct {
 
 	Backoff time.Duration `json:"-"`
 
+	// Framing is sent as HeaderFraming when dialing tunnels, to request a
+	// framed stream. Only FramingClose is supported.
+	Framing string `json:"framing,omitempty"`
+
 	h2.Events
+
+	// h2r is set for clusters of services connected with H2R - the
+	// endpoints can't be dialed.
+	h2r bool
 }
 
 // Endpoint represents a connection/association with a cluster.
@@ -215,6 +236,9 @@ type EndpointCon struct {
 	Cluster  *Cluster
 	Endpoint *Endpoint
 
+	// mu guards rt, which is reset by the connection events, and the
+	// connection times read by the debug handlers.
+	mu     sync.Mutex
 	rt     http.RoundTripper // *http2.ClientConn or custom (wrapper)
 	tlsCon net.Conn
 	// The stream connection - may be a real TCP or not
@@ -223,6 +247,23 @@ type EndpointCon struct {
 	SSLEnd          time.Time
 }
 
+// errNotConnected is returned when the connection was closed concurrently.
+var errNotConnected = errors.New("endpoint not connected")
+
+// transport returns the connection, nil if not connected or closed.
+func (ep *EndpointCon) transport() http.RoundTripper {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return ep.rt
+}
+
+// setTransport sets the connection, or resets it with nil.
+func (ep *EndpointCon) setTransport(rt http.RoundTripper) {
+	ep.mu.Lock()
+	ep.rt = rt
+	ep.mu.Unlock()
+}
+
 func (c *Cluster) UpdateEndpoints(ep []*Endpoint) {
 	c.hb.m.Lock()
 	// TODO: preserve unmodified endpoints connections, by IP, refresh pending
@@ -230,12 +271,155 @@ func (c *Cluster) UpdateEndpoints(ep []*Endpoint) {
 	c.hb.m.Unlock()
 }
 
+// AddEndpoint adds an endpoint to the cluster.
+func (c *Cluster) AddEndpoint(ep *Endpoint) {
+	c.hb.m.Lock()
+	c.Endpoints = append(c.Endpoints, ep)
+	c.hb.m.Unlock()
+}
+
+// RemoveEndpoint removes the endpoints with the address, returning false if
+// not found.
+func (c *Cluster) RemoveEndpoint(addr string) bool {
+	c.hb.m.Lock()
+	defer c.hb.m.Unlock()
+	var eps []*Endpoint
+	for _, ep := range c.Endpoints {
+		if ep.Address != addr {
+			eps = append(eps, ep)
+		}
+	}
+	found := len(eps) != len(c.Endpoints)
+	c.Endpoints = eps
+	return found
+}
+
+// Validate checks the cluster address and endpoints.
+func (c *Cluster) Validate() error {
+	if c.Addr == "" {
+		return errors.New("cluster: missing addr")
+	}
+	if strings.Contains(c.Addr, "//") {
+		if _, err := url.Parse(c.Addr); err != nil {
+			return fmt.Errorf("cluster %s: %w", c.Addr, err)
+		}
+	} else if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		return fmt.Errorf("cluster %s: %w", c.Addr, err)
+	}
+	for i, ep := range c.Endpoints {
+		if err := ep.Validate(); err != nil {
+			return fmt.Errorf("cluster %s: endpoints[%d]: %w", c.Addr, i, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks the endpoint addresses.
+func (ep *Endpoint) Validate() error {
+	if ep == nil || ep.Address == "" {
+		return errors.New("missing address")
+	}
+	for _, a := range []string{ep.Address, ep.HBoneAddress, ep.SNIGate} {
+		if a == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetCluster adds or replaces the cluster with the name, like a Clusters
+// entry in the config. The cluster is also available by Addr and ID.
+// The entries are replaced with the lock held - dials use either the old or
+// the new cluster. Connections of the replaced cluster are closed after the
+// active streams are done.
+func (hb *HBone) SetCluster(name string, c *Cluster) error {
+	if c.Addr == "" {
+		c.Addr = name
+	}
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	hb.m.Lock()
+	var epc []*EndpointCon
+	if old := hb.Clusters[name]; old != c {
+		epc = hb.removeCluster(old)
+	}
+	hb.addService(c)
+	hb.Clusters[name] = c
+	hb.m.Unlock()
+
+	for _, ep := range epc {
+		go ep.drain(drainTimeout)
+	}
+	return nil
+}
+
+// RemoveCluster removes the cluster with the name and its aliases. Existing
+// connections are closed after the active streams are done.
+func (hb *HBone) RemoveCluster(name string) *Cluster {
+	hb.m.Lock()
+	c := hb.Clusters[name]
+	epc := hb.removeCluster(c)
+	hb.m.Unlock()
+
+	for _, ep := range epc {
+		go ep.drain(drainTimeout)
+	}
+	return c
+}
+
+// removeCluster deletes the entries of the cluster and returns its
+// connections, to drain. Called with the lock held.
+func (hb *HBone) removeCluster(c *Cluster) []*EndpointCon {
+	if c == nil {
+		return nil
+	}
+	for k, v := range hb.Clusters {
+		if v == c {
+			delete(hb.Clusters, k)
+		}
+	}
+	epc := c.EndpointCon
+	c.EndpointCon = nil
+	return epc
+}
+
+// drainTimeout is the max time to wait for active streams on removed
+// clusters and listeners.
+const drainTimeout = 30 * time.Second
+
+// drain closes the connection when there are no active streams, or after
+// the timeout.
+func (ep *EndpointCon) drain(timeout time.Duration) {
+	ct, ok := ep.transport().(*h2.H2ClientTransport)
+	if !ok {
+		return
+	}
+	t0 := time.Now()
+	for ct.Info().ActiveStreams > 0 && time.Since(t0) < timeout {
+		time.Sleep(time.Second)
+	}
+	ct.Close(nil)
+}
+
 // AddService will add a cluster to be used for Dial and RoundTrip.
 // The 'Addr' field can be a host:port or IP:port.
 // If id is set, it can be host:port or hostname - will be added as a destination.
 // The service can be IP:port or URLs
 func (hb *HBone) AddService(c *Cluster, service ...*Endpoint) *Cluster {
 	hb.m.Lock()
+	hb.addService(c)
+	c.Endpoints = append(c.Endpoints, service...)
+	hb.m.Unlock()
+	return c
+}
+
+// addService adds the Addr and ID entries for the cluster. Called with the
+// lock held.
+func (hb *HBone) addService(c *Cluster) {
 	hb.Clusters[c.Addr] = c
 	if c.ID != "" {
 		hb.Clusters[c.ID] = c
@@ -244,11 +428,6 @@ func (hb *HBone) AddService(c *Cluster, service ...*Endpoint) *Cluster {
 	if c.ConnectTimeout == 0 {
 		c.ConnectTimeout = hb.ConnectTimeout.Duration
 	}
-	hb.m.Unlock()
-	for _, s := range service {
-		c.Endpoints = append(c.Endpoints, s)
-	}
-	return c
 }
 
 func (hb *HBone) Dial(n, a string) (net.Conn, error) {
@@ -289,7 +468,9 @@ func (hb *HBone) Cluster(ctx context.Context, addr string) (*Cluster, error) {
 		c = &Cluster{Addr: addr, hb: hb, Dynamic: true}
 		hb.AddService(c)
 	}
+	hb.m.Lock()
 	c.LastUsed = time.Now()
+	hb.m.Unlock()
 	return c, nil
 }
 
@@ -314,7 +495,9 @@ func (hc *EndpointCon) Dial(ctx context.Context, addr string) (net.Conn, error)
 		return nil, err
 	}
 
+	hc.mu.Lock()
 	hc.ConnectionStart = time.Now()
+	hc.mu.Unlock()
 
 	// If net connection is cut, by default the socket may linger for up to 20 min without detecting this.
 	// Extracted from gRPC - needs to apply at TCP socket level
@@ -356,7 +539,9 @@ func (hc *EndpointCon) Dial(ctx context.Context, addr string) (net.Conn, error)
 
 	// tlsCon.VerifyHostname(c.SNI) is handled in the verifier
 
+	hc.mu.Lock()
 	hc.SSLEnd = time.Now()
+	hc.mu.Unlock()
 
 	hc.tlsCon = tlsCon
 	return tlsCon, nil
@@ -367,9 +552,7 @@ func (c *Cluster) DoRequest(req *http.Request) ([]byte, error) {
 	var err error
 
 	resp, err = c.RoundTrip(req) // Client.Do(req)
-	if Debug {
-		log.Println("DoRequest", req, resp, err)
-	}
+	c.hb.log.Debug("DoRequest", "cluster", c.Addr, "url", req.URL, "err", err)
 
 	if err != nil {
 		return nil, err
@@ -378,11 +561,11 @@ func (c *Cluster) DoRequest(req *http.Request) ([]byte, error) {
 	defer resp.Body.Close()
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Println("readall", err)
+		c.hb.log.Debug("DoRequest read error", "cluster", c.Addr, "url", req.URL, "err", err)
 		return nil, err
 	}
 	if len(data) == 0 {
-		log.Println("readall", err)
+		c.hb.log.Debug("DoRequest empty response", "cluster", c.Addr, "url", req.URL)
 		return nil, io.EOF
 	}
 
@@ -405,7 +588,7 @@ func (c *Cluster) trustRoots() *x509.CertPool {
 	if c.CACert != "" {
 		roots = x509.NewCertPool()
 		if !roots.AppendCertsFromPEM([]byte(c.CACert)) {
-			log.Println("Failed to decode PEM")
+			c.hb.log.Warn("Failed to decode PEM", "cluster", c.Addr)
 		}
 		c.roots = roots
 	}
@@ -422,11 +605,15 @@ func (c *Cluster) trustRoots() *x509.CertPool {
 func (hb *HBone) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	c := hb.GetCluster(addr)
 	if c == nil {
+		if nc, err := hb.DialReverse(ctx, addr); !errors.Is(err, ErrH2RNotConnected) {
+			return nc, err
+		}
 		// TODO: custom dialer
 		// TODO: if egress gateway is set, use it ( redirect all unknown to egress )
 		// TODO: CIDR range of Endpoints, Nodes, VIPs to use hbone
 		// TODO: if port, use SNI or match clusters
-		return net.Dial(network, addr)
+		d := &net.Dialer{Timeout: hb.ConnectTimeout.Duration}
+		return d.DialContext(ctx, network, addr)
 	}
 
 	c, err := hb.Cluster(ctx, addr)
@@ -508,7 +695,14 @@ func (c *Cluster) AddToken(req *http.Request, aut string) error {
 
 func (c *Cluster) FindTransport(ctx context.Context) (*h2.H2Transport, error) {
 	epc, err := c.findMux(ctx)
-	return &epc.rt.(*h2.H2ClientTransport).H2Transport, err
+	if err != nil {
+		return nil, err
+	}
+	ct, ok := epc.transport().(*h2.H2ClientTransport)
+	if !ok {
+		return nil, errNotConnected
+	}
+	return &ct.H2Transport, nil
 }
 
 func (c *Cluster) DialRequest(req *http.Request) (*h2.H2Stream, error) {
@@ -546,14 +740,23 @@ func (c *Cluster) dial(ctx context.Context, req *http.Request) (*EndpointCon, ne
 
 		req.Header.Add("x-service", c.Addr)
 		req.Header.Add("x-tun", epc.Endpoint.Address)
+		c.addFraming(req)
+		c.hb.addBaggage(req)
 
-		res, err := epc.rt.RoundTrip(req)
+		rt := epc.transport()
+		if rt == nil {
+			return nil, nil, errNotConnected
+		}
+		res, err := rt.RoundTrip(req)
 		if err != nil {
-			epc.rt = nil
+			epc.setTransport(nil)
+			return nil, nil, err
+		}
+		if err := checkResponse(res); err != nil {
 			return nil, nil, err
 		}
 
-		nc := res.Body.(net.Conn)
+		nc := framedConn(res)
 		// Do the mTLS handshake for the tunneled connection
 		// SNI is based on the service name - or the SNI override.
 		sni := c.SNI
@@ -582,17 +785,41 @@ func (c *Cluster) dial(ctx context.Context, req *http.Request) (*EndpointCon, ne
 	}
 
 	req.Header.Add("x-service", c.Addr)
+	c.addFraming(req)
+	c.hb.addBaggage(req)
 
 	res, _, err := c.rt(epc, req)
 	if err != nil {
 		return nil, nil, err
 	}
+	if err := checkResponse(res); err != nil {
+		return nil, nil, err
+	}
 
-	nc := res.Body.(net.Conn)
+	nc := framedConn(res)
 	// TODO: return nc directly instead of HTTPConn
 	return epc, nc, err
 }
 
+// addFraming requests a framed stream if the cluster is configured for it
+// and the caller didn't set the header.
+func (c *Cluster) addFraming(req *http.Request) {
+	if c.Framing != "" && req.Header.Get(HeaderFraming) == "" {
+		req.Header.Set(HeaderFraming, c.Framing)
+	}
+}
+
+// framedConn returns the response body as a net.Conn, wrapped if the server
+// accepted the framing.
+func framedConn(res *http.Response) net.Conn {
+	nc := res.Body.(net.Conn)
+	if res.Request != nil && res.Request.Header.Get(HeaderFraming) == FramingClose &&
+		res.Header.Get(HeaderFraming) == FramingClose {
+		return nio.NewFramedConn(nc)
+	}
+	return nc
+}
+
 //var InitH2ClientConn func(ctx context.Context, req *http.Request, epc *EndpointCon, c *Cluster) (*EndpointCon, net.Conn, error)
 
 func (c *Cluster) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -611,12 +838,25 @@ func (c *Cluster) rt(epc *EndpointCon, req *http.Request) (*http.Response, *Endp
 
 	c.AddToken(req, "https://"+c.Addr)
 
+	// failed are the reverse connections with errors, skipped on retry.
+	var failed []*EndpointCon
 	for i := 0; i < 3; i++ {
 
 		// Find a channel - LB would go here if multiple addresses and sockets
-		if epc == nil || epc.rt == nil {
-			epc, err = c.findMux(req.Context())
+		var rt http.RoundTripper
+		if epc != nil {
+			rt = epc.transport()
+		}
+		if rt == nil {
+			if c.h2r {
+				epc, err = c.reverseMux(failed...)
+			} else {
+				epc, err = c.findMux(req.Context())
+			}
 			if err != nil {
+				if rterr != nil {
+					return nil, nil, rterr
+				}
 				return nil, nil, err
 			}
 		}
@@ -627,14 +867,23 @@ func (c *Cluster) rt(epc *EndpointCon, req *http.Request) (*http.Response, *Endp
 		// to emulate the connection semantics - at least initially.
 		// For POST and other methods - we can't assume this. That means read() on the conn will need to be blocked
 		// and wait for the Header frame to be received, and any metadata too.
-		resp, rterr = epc.rt.RoundTrip(req)
-		if Debug {
-			log.Println("RoundTrip", req, resp, rterr)
+		if rt = epc.transport(); rt == nil {
+			rterr = errNotConnected
+			epc = nil
+			continue
 		}
+		resp, rterr = rt.RoundTrip(req)
+		c.hb.log.Debug("RoundTrip", "cluster", c.Addr, "method", req.Method, "url", req.URL, "err", rterr)
 
 		if rterr != nil {
-			// retry on different mux
-			epc.rt = nil
+			// retry on different mux - reverse connections are removed when
+			// closed, and can't be dialed.
+			if c.h2r {
+				failed = append(failed, epc)
+				epc = nil
+			} else {
+				epc.setTransport(nil)
+			}
 			continue
 		}
 
@@ -649,6 +898,10 @@ func (c *Cluster) rt(epc *EndpointCon, req *http.Request) (*http.Response, *Endp
 // WIP: just one, no retry, only for testing.
 // TODO: implement LB properly
 func (c *Cluster) findMux(ctx context.Context) (*EndpointCon, error) {
+	if c.h2r {
+		return c.reverseMux()
+	}
+	c.hb.m.Lock()
 	if len(c.EndpointCon) == 0 {
 		var endp *Endpoint
 		if len(c.Endpoints) > 0 {
@@ -665,16 +918,19 @@ func (c *Cluster) findMux(ctx context.Context) (*EndpointCon, error) {
 		c.EndpointCon = append(c.EndpointCon, ep)
 	}
 	ep := c.EndpointCon[0]
-	if cc, ok := ep.rt.(*h2.H2ClientTransport); ok {
+	c.hb.m.Unlock()
+	rt := ep.transport()
+	if cc, ok := rt.(*h2.H2ClientTransport); ok {
 		if !cc.CanTakeNewRequest() {
-			ep.rt = nil
+			rt = nil
+			ep.setTransport(nil)
 		}
 		//if cc.State().StreamsActive > 128 {
 		//	// TODO: create new endpoint
 		//}
 	}
 
-	if ep.rt == nil {
+	if rt == nil {
 		// TODO: on failure, try another endpoint
 		err := ep.dialH2ClientConn(ctx)
 		if err != nil {
@@ -717,11 +973,14 @@ func (ep *EndpointCon) dialH2ClientConn(ctx context.Context) error {
 		c.MaxFrameSize = 262144 // 2^18, 256k
 	}
 	okch := make(chan int, 1)
-	hc, err := h2.NewConnection(ctx,
+	// The connection is shared by all streams of the cluster - ctx only
+	// applies to the dial.
+	hc, err := h2.NewConnection(context.WithoutCancel(ctx),
 		h2.H2Config{
 			//InitialConnWindowSize: c.InitialConnWindowSize,
 			//InitialWindowSize:     c.InitialWindowSize, // 1 << 25,
 			MaxFrameSize: c.MaxFrameSize, // 1 << 24,
+			Logger:       c.hb.H2Logger(),
 		})
 	if err != nil {
 		return err
@@ -729,15 +988,15 @@ func (ep *EndpointCon) dialH2ClientConn(ctx context.Context) error {
 
 	hc.Events.OnEvent(h2.Event_Settings, h2.EventHandlerFunc(func(evt h2.EventType, t *h2.H2Transport, s *h2.H2Stream, f *nio.Buffer) {
 		okch <- 1
-		log.Println("Muxc: Preface received ", s)
+		t.Log.Debug("Muxc: Preface received", "addr", addr)
 	}))
 	hc.Events.OnEvent(h2.Event_GoAway, h2.EventHandlerFunc(func(evt h2.EventType, t *h2.H2Transport, s *h2.H2Stream, f *nio.Buffer) {
-		ep.rt = nil
+		ep.setTransport(nil)
 	}))
 	hc.Events.OnEvent(h2.Event_ConnClose, h2.EventHandlerFunc(func(evt h2.EventType, t *h2.H2Transport, s *h2.H2Stream, f *nio.Buffer) {
 		okch <- 0
-		log.Println("Muxc: Close ", addr)
-		ep.rt = nil
+		t.Log.Debug("Muxc: Close", "addr", addr)
+		ep.setTransport(nil)
 	}))
 
 	hc.Events.Add(ep.Cluster.hb.Events)
@@ -757,7 +1016,7 @@ func (ep *EndpointCon) dialH2ClientConn(ctx context.Context) error {
 
 	alpn := ep.tlsCon.(*tls.Conn).ConnectionState().NegotiatedProtocol
 	if alpn != "h2" {
-		log.Println("Invalid alpn")
+		c.hb.log.Warn("Invalid alpn", "addr", addr, "alpn", alpn)
 	}
 
 	err = hc.StartConn(ep.tlsCon)
@@ -767,69 +1026,7 @@ func (ep *EndpointCon) dialH2ClientConn(ctx context.Context) error {
 
 	<-okch
 
-	ep.rt = hc
-	return nil
-}
-
-// - H2R Server accepts mTLS connection from client, using h2r ALPN
-// - Client opens a H2 _server_ handler on the stream, H2R server acts as
-// a H2 client.
-// - EndpointCon is registered in k8s, using IP of the server holding the connection
-// - SNI requests on the H2R server are routed to existing connection
-// - if a connection is not found on local server, forward based on endpoint.
-// DialH2R connects to an H2R tunnel endpoint, and accepts connections from the tunnel
-// Not blocking.
-func DialH2R(ctx context.Context, hc *EndpointCon, addr string) error {
-	tc, err := hc.Dial(ctx, addr)
-	if err != nil {
-		return err
-	}
-	c := hc.Cluster
-	go func() {
-		backoff := 50 * time.Millisecond
-		for {
-			t0 := time.Now()
-			h2c, err := h2.NewConnection(ctx,
-				h2.H2Config{
-					InitialConnWindowSize: c.InitialConnWindowSize,
-					InitialWindowSize:     c.InitialWindowSize, // 1 << 25,
-					MaxFrameSize:          c.MaxFrameSize,      // 1 << 24,
-				})
-			if err != nil {
-				return
-			}
-			h2c.Events.OnEvent(h2.Event_ConnClose, h2.EventHandlerFunc(func(evt h2.EventType, t *h2.H2Transport, s *h2.H2Stream, f *nio.Buffer) {
-				log.Println("Muxc: Close ", addr)
-			}))
-
-			h2c.StartConn(tc)
-
-			//hc.c.hb.h2Server.ServeConn(tc, &http2.ServeConnOpts{
-			//	//Context:    ctx,
-			//	Handler:    &HBoneAcceptedConn{conn: hc.tlsCon, hb: hc.c.hb},
-			//	BaseConfig: &http.Server{},
-			//})
-			if Debug {
-				log.Println("H2RClient closed, redial", time.Since(t0))
-			}
-			for {
-				if ctx.Err() != nil {
-					log.Println("H2RClient canceled")
-					return
-				}
-				tc, err = hc.Dial(ctx, addr)
-				if err != nil {
-					time.Sleep(backoff)
-					backoff = backoff * 2
-				}
-				backoff = 50 * time.Millisecond
-				break
-			}
-			if Debug {
-				log.Println("H2RClient reconnected", time.Since(t0))
-			}
-		}
-	}()
+	ep.setTransport(hc)
 	return nil
 }
 
@@ -841,23 +1038,45 @@ var ProxyCnt atomic.Int32
 
 // Proxy forwards from nc to in/w.
 // nc is typically the result of DialContext
+//
+// Uses the package level loggers - HBone.Proxy uses the loggers of the node.
 func Proxy(nc net.Conn, in io.Reader, w io.Writer, dest string) error {
+	return proxy(Log, nio.Log, nc, in, w, dest)
+}
+
+// Proxy forwards from nc to in/w, logging with the node loggers.
+func (hb *HBone) Proxy(nc net.Conn, in io.Reader, w io.Writer, dest string) error {
+	nlog := hb.nioLog
+	if nlog == nil {
+		nlog = nio.Log
+	}
+	plog := hb.log
+	if plog == nil {
+		plog = Log
+	}
+	return proxy(plog, nlog, nc, in, w, dest)
+}
+
+func proxy(plog, nlog *slog.Logger, nc net.Conn, in io.Reader, w io.Writer, dest string) error {
 	t1 := time.Now()
 	id := ProxyCnt.Add(1)
 	ids := strconv.Itoa(int(id))
 	ch := make(chan int)
 	ch2 := make(chan int)
+	log := plog.With("proxy", id, "dest", dest)
 	s1 := &nio.ReaderCopier{
-		ID:  dest + "-o-" + ids,
-		Out: nc,
-		In:  in,
+		ID:     dest + "-o-" + ids,
+		Out:    nc,
+		In:     in,
+		Logger: nlog,
 	}
 	go s1.Copy(ch, true)
 
 	s2 := &nio.ReaderCopier{
-		ID:  dest + "-i-" + ids,
-		Out: w,
-		In:  nc,
+		ID:     dest + "-i-" + ids,
+		Out:    w,
+		In:     nc,
+		Logger: nlog,
 	}
 	go s2.Copy(ch2, true)
 
@@ -868,13 +1087,13 @@ func Proxy(nc net.Conn, in io.Reader, w io.Writer, dest string) error {
 				s2.Close()
 				break
 			}
-			log.Println("Proxy in done", id, s1.Err, s1.InError, s1.Written)
+			log.Debug("Proxy in done", "err", s1.Err, "inErr", s1.InError, "written", s1.Written)
 		case <-ch2:
 			if s2.Err != nil {
 				s1.Close()
 				break
 			}
-			log.Println("Proxy out done", id, s2.Err, s2.InError, s2.Written)
+			log.Debug("Proxy out done", "err", s2.Err, "inErr", s2.InError, "written", s2.Written)
 		}
 	}
 
@@ -882,13 +1101,12 @@ func Proxy(nc net.Conn, in io.Reader, w io.Writer, dest string) error {
 
 	err := proxyError(s1.Err, s2.Err, s1.InError, s2.InError)
 
-	log.Println("proxy-copy-done", id,
-		dest,
+	log.Info("proxy-copy-done",
 		//"conTime", t1.Sub(t0),
 		"dur", time.Since(t1),
-		"maxRead", s1.MaxRead, s2.MaxRead,
-		"readCnt", s1.ReadCnt, s2.ReadCnt,
-		"avgCnt", int(s1.Written)/(s1.ReadCnt+1), int(s2.Written)/(s2.ReadCnt+1),
+		"maxRead", s1.MaxRead, "maxWrite", s2.MaxRead,
+		"readCnt", s1.ReadCnt, "writeCnt", s2.ReadCnt,
+		"avgRead", int(s1.Written)/(s1.ReadCnt+1), "avgWrite", int(s2.Written)/(s2.ReadCnt+1),
 		"in", s1.Written,
 		"out", s2.Written,
 		"err", err)
@@ -924,30 +1142,97 @@ func LocalForwardPort(localAddr, dest string, hb *HBone) error {
 	if err != nil {
 		return err
 	}
+	return hb.serveLocalForward(l, localAddr, func() string { return dest })
+}
+
+// StartLocalForward listens on 127.0.0.1:port, forwarding to the mesh
+// dest. An existing forward on the port keeps listening, new connections
+// use the new dest.
+func (hb *HBone) StartLocalForward(port int, dest string) error {
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("localForward: invalid port %d", port)
+	}
+	if _, _, err := net.SplitHostPort(dest); err != nil {
+		return fmt.Errorf("localForward %d: %w", port, err)
+	}
+	hb.m.Lock()
+	if hb.localForwards[port] != nil {
+		hb.LocalForward[port] = dest
+		hb.m.Unlock()
+		return nil
+	}
+	hb.m.Unlock()
+	localAddr := fmt.Sprintf("127.0.0.1:%d", port)
+	l, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return err
+	}
+	hb.m.Lock()
+	if hb.localForwards == nil {
+		hb.localForwards = map[int]net.Listener{}
+	}
+	hb.localForwards[port] = l
+	if hb.LocalForward == nil {
+		hb.LocalForward = map[int]string{}
+	}
+	hb.LocalForward[port] = dest
+	hb.m.Unlock()
+	go hb.serveLocalForward(l, localAddr, func() string { return hb.LocalForwardDest(port) })
+	return nil
+}
+
+// LocalForwardDest returns the destination for the local port, or empty.
+func (hb *HBone) LocalForwardDest(port int) string {
+	hb.m.RLock()
+	defer hb.m.RUnlock()
+	return hb.LocalForward[port]
+}
+
+// StopLocalForward closes the forward on the port. Active connections are
+// not closed.
+func (hb *HBone) StopLocalForward(port int) bool {
+	hb.m.Lock()
+	l := hb.localForwards[port]
+	delete(hb.localForwards, port)
+	_, ok := hb.LocalForward[port]
+	delete(hb.LocalForward, port)
+	hb.m.Unlock()
+	if l != nil {
+		l.Close()
+	}
+	return ok || l != nil
+}
 
+// serveLocalForward accepts connections on l, forwarding to the current
+// destination.
+func (hb *HBone) serveLocalForward(l net.Listener, localAddr string, destFn func() string) error {
 	for {
 		a, err := l.Accept()
 		if err != nil {
-			log.Println("Error accepting", err)
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			hb.log.Warn("Error accepting", "addr", localAddr, "err", err)
 			return err
 		}
+		dest := destFn()
+		if dest == "" { // stopped
+			a.Close()
+			continue
+		}
 		go func() {
 			a := a
 
 			ctx := context.Background()
 
-			nc, err := hb.DialContext(ctx, "", dest)
+			nc, err := hb.DialContext(ctx, "tcp", dest)
 			if err != nil {
-				log.Println("RoundTripStart error", dest, err)
+				hb.log.Warn("LocalForward dial error", "dest", dest, "err", err)
 				a.Close()
 				return
 			}
-			err = Proxy(nc, a, a, dest)
-			if err != nil {
-				log.Println("FWD", localAddr, a.RemoteAddr(), err)
-			} else {
-				log.Println("FWD", localAddr, a.RemoteAddr())
-			}
+			err = hb.Proxy(nc, a, a, dest)
+			hb.log.Info("FWD", "addr", localAddr, "remote", a.RemoteAddr(), "dest", dest, "err", err)
 		}()
 	}
 }
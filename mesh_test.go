@@ -0,0 +1,134 @@
+package hbone
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSetCluster(t *testing.T) {
+	hb := New(nil, &MeshSettings{})
+
+	if err := hb.SetCluster("bad", &Cluster{}); err == nil {
+		t.Error("Expecting error for missing port")
+	}
+	if err := hb.SetCluster("echo", &Cluster{Addr: "echo.test.svc:8080", ID: "echo-id",
+		Endpoints: []*Endpoint{{Address: "noport"}}}); err == nil {
+		t.Error("Expecting endpoint error")
+	}
+
+	c := &Cluster{Addr: "echo.test.svc:8080", ID: "echo-id"}
+	if err := hb.SetCluster("echo", c); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []string{"echo", "echo.test.svc:8080", "echo-id"} {
+		if hb.GetCluster(n) != c {
+			t.Error("Missing cluster", n)
+		}
+	}
+
+	c.AddEndpoint(&Endpoint{Address: "10.0.0.1:8080"})
+	c.AddEndpoint(&Endpoint{Address: "10.0.0.2:8080"})
+	if !c.RemoveEndpoint("10.0.0.1:8080") || c.RemoveEndpoint("10.0.0.1:8080") ||
+		len(c.Endpoints) != 1 {
+		t.Error("Unexpected endpoints", c.Endpoints)
+	}
+
+	// Replacing removes the old aliases
+	c2 := &Cluster{}
+	if err := hb.SetCluster("echo.test.svc:8081", c2); err != nil {
+		t.Fatal(err)
+	}
+	if err := hb.SetCluster("echo", c2); err != nil {
+		t.Fatal(err)
+	}
+	if hb.GetCluster("echo-id") != nil || hb.GetCluster("echo.test.svc:8080") != nil {
+		t.Error("Old aliases not removed")
+	}
+
+	// Replacing is atomic - the name resolves to the old or new cluster.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			hb.SetCluster("echo", &Cluster{Addr: "echo.test.svc:8081"})
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		if hb.GetCluster("echo") == nil || hb.GetCluster("echo.test.svc:8081") == nil {
+			t.Fatal("Missing cluster while replacing")
+		}
+	}
+
+	if hb.RemoveCluster("echo") == nil || hb.GetCluster("echo.test.svc:8081") != nil ||
+		hb.RemoveCluster("echo") != nil {
+		t.Error("Unexpected remove")
+	}
+}
+
+func TestLocalForward(t *testing.T) {
+	serveMsg := func(msg string) net.Listener {
+		return serveTest(t, func(c net.Conn) {
+			c.Write([]byte(msg))
+			c.Close()
+		})
+	}
+	app := serveMsg("hi")
+
+	// Find a free port
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	hb := New(nil, &MeshSettings{})
+	if hb.StartLocalForward(port, "noport") == nil || hb.StartLocalForward(0, app.Addr().String()) == nil {
+		t.Error("Expecting validation error")
+	}
+	if err := hb.StartLocalForward(port, app.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if hb.LocalForwardDest(port) != app.Addr().String() {
+		t.Error("Missing forward")
+	}
+	read := func() string {
+		t.Helper()
+		c, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.(*net.TCPConn).CloseWrite()
+		b, _ := io.ReadAll(c)
+		c.Close()
+		return string(b)
+	}
+	if b := read(); b != "hi" {
+		t.Error("Unexpected response", b)
+	}
+
+	// Changing the destination keeps the listener.
+	l1 := hb.localForwards[port]
+	if err := hb.StartLocalForward(port, serveMsg("new").Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if hb.localForwards[port] != l1 {
+		t.Error("Listener replaced")
+	}
+	if b := read(); b != "new" {
+		t.Error("Unexpected response after change", b)
+	}
+
+	if !hb.StopLocalForward(port) || hb.StopLocalForward(port) {
+		t.Error("Unexpected stop")
+	}
+	if _, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port)); err == nil {
+		t.Error("Forward not closed")
+	}
+}
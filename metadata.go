@@ -0,0 +1,58 @@
+package hbone
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/costinm/hbone/h2"
+)
+
+// initMetadata fills the node metadata defaults and caches the baggage
+// header sent on tunnels.
+func (hb *HBone) initMetadata() {
+	md := hb.Metadata
+	if md == nil {
+		md = &h2.PeerMetadata{}
+		hb.Metadata = md
+	}
+	if md.Namespace == "" {
+		md.Namespace = hb.Namespace
+	}
+	if md.ServiceAccount == "" {
+		md.ServiceAccount = hb.ServiceAccount
+	}
+	if md.Service == "" {
+		md.Service = hb.ServiceCluster
+	}
+	hb.baggage = md.Baggage()
+}
+
+// addBaggage adds the node metadata to an outgoing tunnel request, unless the
+// caller already set a baggage header.
+func (hb *HBone) addBaggage(req *http.Request) {
+	if hb.baggage == "" || req.Header.Get(h2.HeaderBaggage) != "" {
+		return
+	}
+	req.Header.Set(h2.HeaderBaggage, hb.baggage)
+}
+
+// peerMetadata returns the metadata for an accepted stream, from the baggage
+// header and the peer certificate of the connection. Returns nil if neither
+// is available.
+func peerMetadata(stream *h2.H2Stream) *h2.PeerMetadata {
+	md := h2.ParseBaggage(stream.Request.Header.Get(h2.HeaderBaggage))
+	tc, ok := stream.Conn().(*tls.Conn)
+	if !ok {
+		return md
+	}
+	cs := tc.ConnectionState()
+	if md == nil {
+		md = &h2.PeerMetadata{}
+		if !md.SetTLSPeer(&cs) {
+			return nil
+		}
+		return md
+	}
+	md.SetTLSPeer(&cs)
+	return md
+}
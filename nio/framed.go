@@ -0,0 +1,215 @@
+package nio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Framing for streams where the server can't half-close, see docs/closing.md.
+//
+// Each chunk uses the gRPC message framing: 1 byte compression flag (0), 4 bytes
+// big endian length of the rest of the frame, followed by a type byte:
+//   - 0x02 - the rest of the frame is data.
+//   - 0x08 - close frame, next byte is 0 for FIN, 1 for RST. For RST the rest
+//     of the frame is an optional error message.
+const (
+	frameTypeData  = 0x02
+	frameTypeClose = 0x08
+
+	closeFIN = 0
+	closeRST = 1
+
+	// Max size of a data frame sent. Larger writes are split.
+	framedMaxData = 16 * 1024
+
+	// Max size of a received close frame, including the error message.
+	framedMaxClose = 1024
+
+	framedHeaderLen = 6
+)
+
+// ErrFramedReset is returned by FramedConn.Read when the peer sent a RST close
+// frame. The message from the peer, if any, is included in the error.
+var ErrFramedReset = errors.New("framed stream reset")
+
+// ErrFramedInvalid is returned by FramedConn.Read when the stream is not
+// using the expected framing.
+var ErrFramedInvalid = errors.New("invalid framed stream")
+
+// ResetWriter is implemented by writers that can signal an abnormal close
+// (RST) to the peer, in addition to CloseWriter.
+type ResetWriter interface {
+	ResetWrite(err error) error
+}
+
+// FramedConn wraps a stream (typically a H2Stream used for POST tunnels) and
+// adds framing that carries FIN and RST in-band. This allows the server
+// side to close its write direction first, or to signal errors, when the stream
+// goes trough HTTP stacks that can't half-close.
+type FramedConn struct {
+	net.Conn
+
+	rmu  sync.Mutex
+	rhdr [framedHeaderLen]byte
+	// Remaining data bytes in the current frame.
+	rem  int
+	rerr error
+
+	wmu     sync.Mutex
+	wbuf    []byte
+	wclosed bool
+}
+
+// NewFramedConn returns a net.Conn using the close framing on top of nc.
+// Both ends must use the framing - it is negotiated using headers by hbone.
+func NewFramedConn(nc net.Conn) *FramedConn {
+	return &FramedConn{Conn: nc}
+}
+
+// Read returns the data from data frames. After a FIN close frame it returns
+// io.EOF, after a RST it returns an error wrapping ErrFramedReset.
+func (f *FramedConn) Read(p []byte) (int, error) {
+	f.rmu.Lock()
+	defer f.rmu.Unlock()
+
+	for f.rem == 0 {
+		if f.rerr != nil {
+			return 0, f.rerr
+		}
+		f.rerr = f.readHeader()
+	}
+	if len(p) > f.rem {
+		p = p[:f.rem]
+	}
+	n, err := f.Conn.Read(p)
+	f.rem -= n
+	if err == io.EOF && f.rem > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		f.rerr = err
+		if err == io.EOF && n > 0 {
+			// Stream closed without a close frame, at a frame boundary.
+			// Return the data, next Read gets the EOF.
+			err = nil
+		}
+	}
+	return n, err
+}
+
+// readHeader reads the next frame header. Close frames are fully consumed,
+// returning the close error. Returns nil with f.rem set for data frames.
+func (f *FramedConn) readHeader() error {
+	_, err := io.ReadFull(f.Conn, f.rhdr[:])
+	if err != nil {
+		return err
+	}
+	if f.rhdr[0] != 0 {
+		return ErrFramedInvalid
+	}
+	flen := int(binary.BigEndian.Uint32(f.rhdr[1:5]))
+	if flen == 0 {
+		return ErrFramedInvalid
+	}
+	switch f.rhdr[5] {
+	case frameTypeData:
+		f.rem = flen - 1
+		return nil
+	case frameTypeClose:
+		if flen < 2 || flen > framedMaxClose {
+			return ErrFramedInvalid
+		}
+		b := make([]byte, flen-1)
+		_, err = io.ReadFull(f.Conn, b)
+		if err != nil {
+			return err
+		}
+		if b[0] == closeFIN {
+			return io.EOF
+		}
+		if len(b) > 1 {
+			return fmt.Errorf("%w: %s", ErrFramedReset, string(b[1:]))
+		}
+		return ErrFramedReset
+	default:
+		return ErrFramedInvalid
+	}
+}
+
+// Write sends p as one or more data frames.
+func (f *FramedConn) Write(p []byte) (int, error) {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+
+	if f.wclosed {
+		return 0, net.ErrClosed
+	}
+	if f.wbuf == nil {
+		f.wbuf = make([]byte, framedHeaderLen+framedMaxData)
+	}
+	n := 0
+	for len(p) > 0 {
+		c := len(p)
+		if c > framedMaxData {
+			c = framedMaxData
+		}
+		f.wbuf[0] = 0
+		binary.BigEndian.PutUint32(f.wbuf[1:], uint32(c+1))
+		f.wbuf[5] = frameTypeData
+		copy(f.wbuf[framedHeaderLen:], p[:c])
+		_, err := f.Conn.Write(f.wbuf[:framedHeaderLen+c])
+		if err != nil {
+			return n, err
+		}
+		n += c
+		p = p[c:]
+	}
+	return n, nil
+}
+
+// CloseWrite sends a FIN close frame. The underlying stream remains open,
+// the peer will see an EOF.
+func (f *FramedConn) CloseWrite() error {
+	return f.writeClose(closeFIN, nil)
+}
+
+// ResetWrite sends a RST close frame, with the error message. The peer Read
+// will return an error wrapping ErrFramedReset.
+func (f *FramedConn) ResetWrite(err error) error {
+	return f.writeClose(closeRST, err)
+}
+
+func (f *FramedConn) writeClose(code byte, err error) error {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+	if f.wclosed {
+		return nil
+	}
+	f.wclosed = true
+
+	var msg []byte
+	if err != nil {
+		msg = []byte(err.Error())
+		if len(msg) > framedMaxClose-2 {
+			msg = msg[:framedMaxClose-2]
+		}
+	}
+	b := make([]byte, framedHeaderLen+1+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(2+len(msg)))
+	b[5] = frameTypeClose
+	b[6] = code
+	copy(b[7:], msg)
+	_, werr := f.Conn.Write(b)
+	return werr
+}
+
+// Close sends a FIN close frame if CloseWrite or ResetWrite were not called,
+// similar with TCP and H2Stream, and closes the underlying stream.
+func (f *FramedConn) Close() error {
+	f.writeClose(closeFIN, nil)
+	return f.Conn.Close()
+}
@@ -0,0 +1,131 @@
+package nio
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func framedPipe(t *testing.T) (*FramedConn, *FramedConn) {
+	c, s := net.Pipe()
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	s.SetDeadline(time.Now().Add(5 * time.Second))
+	return NewFramedConn(c), NewFramedConn(s)
+}
+
+func TestFramedConn(t *testing.T) {
+	t.Run("server-first-close", func(t *testing.T) {
+		fc, fs := framedPipe(t)
+		// Large write, split in frames.
+		data := bytes.Repeat([]byte("0123456789"), 5000)
+		done := make(chan string, 1)
+		go func() {
+			fs.Write(data)
+			fs.CloseWrite()
+			// Server write side is closed, reads still work.
+			b, _ := io.ReadAll(fs)
+			done <- string(b)
+		}()
+		got, err := io.ReadAll(fc)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatal("Unexpected read", len(got), err)
+		}
+		if _, err := fc.Read(make([]byte, 1)); err != io.EOF {
+			t.Error("Expecting EOF after FIN", err)
+		}
+
+		// Client can still write after the server FIN
+		fc.Write([]byte("hello"))
+		fc.CloseWrite()
+		if b := <-done; b != "hello" {
+			t.Error("Unexpected server read", b)
+		}
+	})
+
+	t.Run("echo-after-fin", func(t *testing.T) {
+		fc, fs := framedPipe(t)
+		go func() {
+			b, _ := io.ReadAll(fs)
+			fs.Write(b)
+			fs.Close()
+		}()
+		go func() {
+			fc.Write([]byte("hello"))
+			fc.CloseWrite()
+		}()
+		got, err := io.ReadAll(fc)
+		if err != nil || string(got) != "hello" {
+			t.Fatal("Unexpected echo", string(got), err)
+		}
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		fc, fs := framedPipe(t)
+		go func() {
+			fs.Write([]byte("partial"))
+			fs.ResetWrite(errors.New("upstream failed"))
+			// Only the first close frame is sent.
+			fs.CloseWrite()
+		}()
+		got, err := io.ReadAll(fc)
+		if string(got) != "partial" || !errors.Is(err, ErrFramedReset) ||
+			!strings.Contains(err.Error(), "upstream failed") {
+			t.Fatal("Expecting reset", string(got), err)
+		}
+		if _, err := fs.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+			t.Error("Expecting write after reset to fail", err)
+		}
+	})
+
+	for name, raw := range map[string]string{
+		"compressed":  "\x01\x00\x00\x00\x02\x02a",
+		"zero-length": "\x00\x00\x00\x00\x00\x02",
+		"type":        "\x00\x00\x00\x00\x02\x05a",
+		"close-size":  "\x00\x00\x00\x10\x00\x08\x00",
+	} {
+		t.Run("invalid-"+name, func(t *testing.T) {
+			c, s := net.Pipe()
+			defer s.Close()
+			go func() {
+				s.Write([]byte(raw))
+			}()
+			_, err := io.ReadAll(NewFramedConn(c))
+			if !errors.Is(err, ErrFramedInvalid) {
+				t.Error("Expecting invalid", err)
+			}
+		})
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		c, s := net.Pipe()
+		go func() {
+			s.Write([]byte("\x00\x00\x00\x00\x10\x02abc"))
+			s.Close()
+		}()
+		_, err := io.ReadAll(NewFramedConn(c))
+		if err != io.ErrUnexpectedEOF {
+			t.Error("Expecting unexpected EOF", err)
+		}
+	})
+
+	t.Run("eof-at-frame-boundary", func(t *testing.T) {
+		c, s := net.Pipe()
+		go func() {
+			NewFramedConn(s).Write([]byte("abc"))
+			s.Close()
+		}()
+		got, err := io.ReadAll(NewFramedConn(c))
+		// Not a clean close, but the data is returned.
+		if string(got) != "abc" || err != nil {
+			t.Error("Unexpected read", string(got), err)
+		}
+	})
+}
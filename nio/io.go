@@ -6,7 +6,7 @@ import (
 	"expvar"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
@@ -16,10 +16,6 @@ import (
 	"time"
 )
 
-// TODO: benchmark different sizes.
-var Debug = false
-var DebugRW = false
-
 // ReaderCopier copies from In to Out, keeping track of copied bytes and errors.
 type ReaderCopier struct {
 	// Number of bytes copied.
@@ -43,6 +39,17 @@ type ReaderCopier struct {
 	// Set if out doesn't implement Flusher and a separate function is needed.
 	// Example: tunneled mTLS over http, Out is a tls.Conn which writes to a http Body.
 	Flusher http.Flusher
+
+	// Logger for the copy, defaults to nio.Log. Proxy sets it to a logger with
+	// the stream attributes.
+	Logger *slog.Logger
+}
+
+func (s *ReaderCopier) log() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return Log
 }
 
 func (rc *ReaderCopier) Close() {
@@ -120,16 +127,16 @@ func (s *ReaderCopier) Copy(ch chan int, close bool) {
 	if s.ID == "" {
 		s.ID = strconv.Itoa(int(atomic.AddUint32(&StreamId, 1)))
 	}
-	if Debug {
-		log.Println(s.ID, "startCopy()")
-	}
+	l := s.log().With("copy", s.ID)
+	trace := l.Enabled(context.Background(), LevelTrace)
+	l.Debug("startCopy()")
 	for {
 		if srcc, ok := s.In.(net.Conn); ok {
 			srcc.SetReadDeadline(time.Now().Add(15 * time.Minute))
 		}
 		nr, er := s.In.Read(buf)
-		if DebugRW && nr < 1024 {
-			log.Println(s.ID, "read()", nr, er)
+		if trace && nr < 1024 {
+			l.Log(context.Background(), LevelTrace, "read()", "n", nr, "err", er)
 		}
 		if nr > s.MaxRead {
 			s.MaxRead = nr
@@ -151,8 +158,8 @@ func (s *ReaderCopier) Copy(ch chan int, close bool) {
 			// DoneServing is checked - so it is possible to do this in background, but only works for proxy.
 
 			nw, ew := s.Out.Write(buf[0:nr])
-			if DebugRW && nw < 1024 {
-				log.Println(s.ID, "write()", nw, ew)
+			if trace && nw < 1024 {
+				l.Log(context.Background(), LevelTrace, "write()", "n", nw, "err", ew)
 			}
 			if nw > 0 {
 				s.Written += int64(nw)
@@ -162,18 +169,14 @@ func (s *ReaderCopier) Copy(ch chan int, close bool) {
 			}
 			if nr != nw && ew == nil { // Should not happen
 				ew = io.ErrShortWrite
-				if Debug {
-					log.Println(s.ID, "write error - short write", s.Err)
-				}
+				l.Debug("write error - short write", "err", s.Err)
 			}
 			if ew != nil {
 				s.Err = ew
 				if close {
 					s.rstWriter(ew)
 				}
-				if Debug {
-					log.Println(s.ID, "write error rst writer, close in", close, s.Err)
-				}
+				l.Debug("write error rst writer", "closeIn", close, "err", s.Err)
 				return
 			}
 		}
@@ -184,9 +187,7 @@ func (s *ReaderCopier) Copy(ch chan int, close bool) {
 				er = io.EOF
 			}
 			if er == io.EOF {
-				if Debug {
-					log.Println(s.ID, "EOF received, closing writer", close)
-				}
+				l.Debug("EOF received, closing writer", "close", close)
 				if close {
 					// read is already closed - we need to close out
 					// TODO: if err is not nil, we should send RST not FIN
@@ -200,9 +201,7 @@ func (s *ReaderCopier) Copy(ch chan int, close bool) {
 			} else {
 				s.Err = er
 				s.InError = true
-				if Debug {
-					log.Println(s.ID, "readError()", s.Err)
-				}
+				l.Debug("readError()", "err", s.Err)
 				if close {
 					// read is already closed - we need to close out
 					// TODO: if err is not nil, we should send RST not FIN
@@ -210,15 +209,22 @@ func (s *ReaderCopier) Copy(ch chan int, close bool) {
 				}
 			}
 
-			if Debug {
-				log.Println(s.ID, "read DONE", close, s.Err)
-			}
+			l.Debug("read DONE", "close", close, "err", s.Err)
 			return
 		}
 	}
 }
 
 func (s *ReaderCopier) rstWriter(err error) error {
+	if rw, ok := s.Out.(ResetWriter); ok {
+		// Framed streams can signal the error in-band, before the
+		// Close() below would send a FIN.
+		rw.ResetWrite(err)
+	}
+	if tc, ok := s.Out.(*net.TCPConn); ok {
+		// Close will send a RST instead of FIN.
+		tc.SetLinger(0)
+	}
 	if c, ok := s.In.(io.Closer); ok {
 		// Otherwise it keeps getting data - this should send a RST
 		// TODO: should have a method that also allows errr to be set.
@@ -247,7 +253,7 @@ func (s *ReaderCopier) rstWriter(err error) error {
 		rw.(http.Flusher).Flush()
 		return nil
 	}
-	log.Println("Server out not Closer nor CloseWriter nor ResponseWriter", dst)
+	s.log().Warn("Server out not Closer nor CloseWriter nor ResponseWriter", "out", fmt.Sprintf("%T", dst))
 	return nil
 }
 
@@ -272,7 +278,7 @@ func closeWriter(dst io.Writer) error {
 		rw.(http.Flusher).Flush()
 		return nil
 	}
-	log.Println("Server out not Closer nor CloseWriter nor ResponseWriter", dst)
+	Log.Warn("Server out not Closer nor CloseWriter nor ResponseWriter", "out", fmt.Sprintf("%T", dst))
 	return nil
 }
 
@@ -388,7 +394,7 @@ func ServeListener(l net.Listener, f func(conn net.Conn)) error {
 				continue
 			}
 			// TODO: callback to notify. This may happen if interface restarts, etc.
-			log.Println("Accepted done ", l)
+			Log.Info("Accept done", "addr", l.Addr().String(), "err", err)
 			return err
 		}
 
@@ -1,12 +1,14 @@
 package nio
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 // Dial raw TCP connections
@@ -83,6 +85,52 @@ func DialOriginalDestination(remote, local *net.TCPAddr) (*net.TCPConn, error) {
 	return remoteConn.(*net.TCPConn), nil
 }
 
+// IPV6_TRANSPARENT is not defined in syscall.
+const ipv6Transparent = 75
+
+// DialTransparent connects to remote using local as source address, which
+// doesn't need to be an address of this host. Used to preserve the original
+// client address when forwarding accepted streams to the application.
+//
+// Requires CAP_NET_ADMIN, and routing rules that send the replies back to this
+// host - packets are marked with mark, which can be used with 'ip rule fwmark'
+// and CONNMARK. See docs/transparent.md.
+func DialTransparent(ctx context.Context, remote, local *net.TCPAddr, mark int, timeout time.Duration) (*net.TCPConn, error) {
+	d := &net.Dialer{
+		LocalAddr: local,
+		Timeout:   timeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				if local.IP.To4() != nil {
+					serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				} else {
+					serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				}
+				if serr != nil {
+					serr = fmt.Errorf("set socket option: IP_TRANSPARENT: %w", serr)
+					return
+				}
+				if mark != 0 {
+					serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+					if serr != nil {
+						serr = fmt.Errorf("set socket option: SO_MARK: %w", serr)
+					}
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	nc, err := d.DialContext(ctx, "tcp", remote.String())
+	if err != nil {
+		return nil, err
+	}
+	return nc.(*net.TCPConn), nil
+}
+
 // tcpAddToSockerAddr will convert a TCPAddr
 // into a Sockaddr that may be used when
 // connecting and binding sockets
@@ -0,0 +1,80 @@
+//go:build linux
+
+package nio
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// TestDialTransparent runs in a new network namespace (using 'unshare'), with
+// the app on 10.99.0.2 and the client address 10.98.0.5 not assigned to any
+// interface - only routed locally, like in docs/transparent.md.
+func TestDialTransparent(t *testing.T) {
+	if os.Getenv("HBONE_NETNS") == "" {
+		if _, err := exec.LookPath("unshare"); err != nil {
+			t.Skip("unshare not available")
+		}
+		if _, err := exec.LookPath("ip"); err != nil {
+			t.Skip("ip not available")
+		}
+		cmd := exec.Command("unshare", "-rn", os.Args[0], "-test.run", "^TestDialTransparent$", "-test.v")
+		cmd.Env = append(os.Environ(), "HBONE_NETNS=1")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() == 1 {
+				t.Fatal(string(out))
+			}
+			t.Skip("Can't create network namespace", err, string(out))
+		}
+		t.Log(string(out))
+		return
+	}
+
+	for _, args := range [][]string{
+		{"link", "set", "lo", "up"},
+		{"addr", "add", "10.99.0.2/32", "dev", "lo"},
+		{"rule", "add", "to", "10.98.0.0/24", "lookup", "133"},
+		{"route", "add", "local", "default", "dev", "lo", "table", "133"},
+	} {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			t.Fatal(args, err, string(out))
+		}
+	}
+
+	l, err := net.Listen("tcp", "10.99.0.2:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	src := &net.TCPAddr{IP: net.ParseIP("10.98.0.5")}
+	nc, err := DialTransparent(context.Background(), l.Addr().(*net.TCPAddr), src, 1337, 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	ac, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	if ra := ac.RemoteAddr().(*net.TCPAddr); !ra.IP.Equal(src.IP) {
+		t.Fatal("Unexpected source", ra)
+	}
+
+	nc.Write([]byte("hi"))
+	b := make([]byte, 2)
+	if _, err := ac.Read(b); err != nil || string(b) != "hi" {
+		t.Fatal(err, string(b))
+	}
+	ac.Write([]byte("ok"))
+	if _, err := nc.Read(b); err != nil || string(b) != "ok" {
+		t.Fatal(err, string(b))
+	}
+}
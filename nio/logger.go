@@ -0,0 +1,53 @@
+package nio
+
+import (
+	"context"
+	"log/slog"
+)
+
+// LevelTrace is used for per-read/write logging, below slog.LevelDebug.
+// Replaces the old DebugRW flag - it is very verbose and should only be enabled
+// for a specific component while debugging.
+const LevelTrace = slog.LevelDebug - 4
+
+// Log is the logger used by the nio package. hbone.New replaces it with a
+// component-scoped logger derived from the HBone logger.
+var Log = slog.Default().With("component", "nio")
+
+// ComponentLogger returns a logger scoped to a component, using the handler of
+// base but with an independent minimum level. This allows 'h2' to log at debug
+// level while 'nio' is at warn, using the same output.
+//
+// If level is nil, the handler of base decides which records are enabled.
+func ComponentLogger(base *slog.Logger, component string, level slog.Leveler) *slog.Logger {
+	if base == nil {
+		base = slog.Default()
+	}
+	h := base.Handler()
+	if level != nil {
+		h = &levelHandler{level: level, h: h}
+	}
+	return slog.New(h).With("component", component)
+}
+
+// levelHandler overrides the minimum level of a wrapped handler.
+type levelHandler struct {
+	level slog.Leveler
+	h     slog.Handler
+}
+
+func (l *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= l.level.Level()
+}
+
+func (l *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return l.h.Handle(ctx, r)
+}
+
+func (l *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{level: l.level, h: l.h.WithAttrs(attrs)}
+}
+
+func (l *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{level: l.level, h: l.h.WithGroup(name)}
+}
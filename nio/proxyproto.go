@@ -0,0 +1,304 @@
+package nio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PROXY protocol support - https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+//
+// Used to pass the original client address to applications that are reached
+// trough the tunnel (the TCP connection is from localhost), and to recover the
+// client address when hboned is behind a TCP load balancer.
+
+// ProxyTLVSpiffe is the TLV type carrying the SPIFFE identity of the peer,
+// in the custom range of PROXY protocol v2.
+const ProxyTLVSpiffe = 0xE0
+
+// ProxyTLVAuthority is the standard PP2_TYPE_AUTHORITY, the host name requested
+// by the client.
+const ProxyTLVAuthority = 0x02
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV1MaxLen = 107
+	proxyV2MaxLen = 16 + 4096
+
+	// ProxyHeaderTimeout is the max time to wait for the PROXY header on accepted
+	// connections.
+	ProxyHeaderTimeout = 5 * time.Second
+)
+
+var errProxyProto = errors.New("invalid PROXY protocol header")
+
+// ProxyTLV is a type-length-value extension in PROXY protocol v2.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyHeader is a parsed PROXY protocol header.
+type ProxyHeader struct {
+	// Version is 1 or 2.
+	Version int
+
+	// Source and Destination are nil for LOCAL (v2) or UNKNOWN (v1).
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+
+	TLVs []ProxyTLV
+}
+
+// TLV returns the value of the first TLV with the given type, or nil.
+func (h *ProxyHeader) TLV(t byte) []byte {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == t {
+			return tlv.Value
+		}
+	}
+	return nil
+}
+
+// ProxyHeaderV1 returns a text PROXY header. If the addresses are not TCP
+// addresses of the same family, 'UNKNOWN' is used.
+func ProxyHeaderV1(src, dst net.Addr) []byte {
+	s, d, v4 := proxyAddrs(src, dst)
+	if s == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	fam := "TCP6"
+	if v4 {
+		fam = "TCP4"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", fam, s.IP, d.IP, s.Port, d.Port))
+}
+
+// ProxyHeaderV2 returns a binary PROXY header, with optional TLVs.
+func ProxyHeaderV2(src, dst net.Addr, tlvs ...ProxyTLV) []byte {
+	s, d, v4 := proxyAddrs(src, dst)
+
+	b := &bytes.Buffer{}
+	b.Write(proxyV2Sig)
+	b.WriteByte(0x21) // version 2, PROXY
+
+	var addr []byte
+	switch {
+	case s == nil:
+		b.WriteByte(0x00) // AF_UNSPEC
+	case v4:
+		b.WriteByte(0x11) // TCP over IPv4
+		addr = append(addr, s.IP.To4()...)
+		addr = append(addr, d.IP.To4()...)
+	default:
+		b.WriteByte(0x21) // TCP over IPv6
+		addr = append(addr, s.IP.To16()...)
+		addr = append(addr, d.IP.To16()...)
+	}
+	if s != nil {
+		addr = binary.BigEndian.AppendUint16(addr, uint16(s.Port))
+		addr = binary.BigEndian.AppendUint16(addr, uint16(d.Port))
+	}
+	l := len(addr)
+	for _, t := range tlvs {
+		l += 3 + len(t.Value)
+	}
+	binary.Write(b, binary.BigEndian, uint16(l))
+	b.Write(addr)
+	for _, t := range tlvs {
+		b.WriteByte(t.Type)
+		binary.Write(b, binary.BigEndian, uint16(len(t.Value)))
+		b.Write(t.Value)
+	}
+	return b.Bytes()
+}
+
+// proxyAddrs returns the TCP addresses, and true if both are IPv4.
+// Returns nil if either is not a TCP address.
+func proxyAddrs(src, dst net.Addr) (*net.TCPAddr, *net.TCPAddr, bool) {
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 || s == nil || d == nil {
+		return nil, nil, false
+	}
+	return s, d, s.IP.To4() != nil && d.IP.To4() != nil
+}
+
+// ParseProxyHeader reads a v1 or v2 PROXY header from br. On success the
+// header is consumed, the rest of the stream is available in br.
+func ParseProxyHeader(br *BufferReader) (*ProxyHeader, error) {
+	buf, err := br.Peek(8)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(buf, []byte("PROXY ")) {
+		return parseProxyV1(br)
+	}
+	if bytes.HasPrefix(buf, proxyV2Sig[0:8]) {
+		return parseProxyV2(br)
+	}
+	return nil, errProxyProto
+}
+
+func parseProxyV1(br *BufferReader) (*ProxyHeader, error) {
+	n := 8
+	var line string
+	for {
+		buf, err := br.Peek(n)
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) > proxyV1MaxLen {
+			buf = buf[:proxyV1MaxLen]
+		}
+		if i := bytes.Index(buf, []byte("\r\n")); i >= 0 {
+			line = string(buf[:i])
+			br.Discard(i + 2)
+			break
+		}
+		if len(buf) >= proxyV1MaxLen {
+			return nil, errProxyProto
+		}
+		n = len(buf) + 1
+	}
+
+	h := &ProxyHeader{Version: 1}
+	parts := strings.Split(line, " ")
+	if len(parts) >= 2 && parts[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(parts) != 6 || (parts[1] != "TCP4" && parts[1] != "TCP6") {
+		return nil, errProxyProto
+	}
+	sip, dip := net.ParseIP(parts[2]), net.ParseIP(parts[3])
+	sp, err1 := strconv.ParseUint(parts[4], 10, 16)
+	dp, err2 := strconv.ParseUint(parts[5], 10, 16)
+	if sip == nil || dip == nil || err1 != nil || err2 != nil {
+		return nil, errProxyProto
+	}
+	h.Source = &net.TCPAddr{IP: sip, Port: int(sp)}
+	h.Destination = &net.TCPAddr{IP: dip, Port: int(dp)}
+	return h, nil
+}
+
+func parseProxyV2(br *BufferReader) (*ProxyHeader, error) {
+	buf, err := br.Peek(16)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(buf[0:12], proxyV2Sig) || buf[12]>>4 != 2 {
+		return nil, errProxyProto
+	}
+	cmd := buf[12] & 0x0F
+	fam := buf[13]
+	l := int(binary.BigEndian.Uint16(buf[14:16]))
+	if 16+l > proxyV2MaxLen {
+		return nil, errProxyProto
+	}
+	buf, err = br.Peek(16 + l)
+	if err != nil {
+		return nil, err
+	}
+	// Copy - the buffer is reused after Discard.
+	data := append([]byte{}, buf[16:16+l]...)
+	br.Discard(16 + l)
+
+	h := &ProxyHeader{Version: 2}
+	var alen int
+	switch fam >> 4 {
+	case 1:
+		alen = 12
+	case 2:
+		alen = 36
+	case 3:
+		alen = 216 // AF_UNIX, not supported - skipped.
+	}
+	if len(data) < alen {
+		return nil, errProxyProto
+	}
+	if cmd == 1 && fam&0x0F == 1 && alen != 216 && alen > 0 {
+		ipl := (alen - 4) / 2
+		h.Source = &net.TCPAddr{IP: net.IP(data[0:ipl]),
+			Port: int(binary.BigEndian.Uint16(data[2*ipl:]))}
+		h.Destination = &net.TCPAddr{IP: net.IP(data[ipl : 2*ipl]),
+			Port: int(binary.BigEndian.Uint16(data[2*ipl+2:]))}
+	}
+
+	tlvs := data[alen:]
+	for len(tlvs) >= 3 {
+		tl := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+tl {
+			return nil, errProxyProto
+		}
+		h.TLVs = append(h.TLVs, ProxyTLV{Type: tlvs[0], Value: tlvs[3 : 3+tl]})
+		tlvs = tlvs[3+tl:]
+	}
+	return h, nil
+}
+
+// ProxyConn is a net.Conn where the remote and local address are the ones
+// from the PROXY header.
+type ProxyConn struct {
+	net.Conn
+	Reader *BufferReader
+	Header *ProxyHeader
+}
+
+func (pc *ProxyConn) Read(b []byte) (int, error) {
+	return pc.Reader.Read(b)
+}
+
+func (pc *ProxyConn) RemoteAddr() net.Addr {
+	if pc.Header.Source != nil {
+		return pc.Header.Source
+	}
+	return pc.Conn.RemoteAddr()
+}
+
+func (pc *ProxyConn) LocalAddr() net.Addr {
+	if pc.Header.Destination != nil {
+		return pc.Header.Destination
+	}
+	return pc.Conn.LocalAddr()
+}
+
+func (pc *ProxyConn) CloseWrite() error {
+	if cw, ok := pc.Conn.(CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return pc.Conn.Close()
+}
+
+// AcceptProxyHeader reads the PROXY header from an accepted connection, with
+// a timeout. The returned conn reports the addresses from the header.
+func AcceptProxyHeader(nc net.Conn) (*ProxyConn, error) {
+	nc.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout))
+	br := NewBufferReader(nc)
+	h, err := ParseProxyHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	nc.SetReadDeadline(time.Time{})
+	return &ProxyConn{Conn: nc, Reader: br, Header: h}, nil
+}
+
+// ProxyProtocolHandler wraps a connection handler for listeners behind a
+// load balancer sending the PROXY protocol. Connections without a valid
+// header are closed.
+func ProxyProtocolHandler(f func(net.Conn)) func(net.Conn) {
+	return func(nc net.Conn) {
+		pc, err := AcceptProxyHeader(nc)
+		if err != nil {
+			Log.Warn("PROXY header error", "remote", nc.RemoteAddr(), "err", err)
+			nc.Close()
+			return
+		}
+		f(pc)
+	}
+}
@@ -0,0 +1,125 @@
+package nio
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	v4s := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 41000}
+	v4d := &net.TCPAddr{IP: net.ParseIP("10.4.5.6"), Port: 8080}
+	v6s := &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 41000}
+	v6d := &net.TCPAddr{IP: net.ParseIP("fd00::2"), Port: 443}
+	spiffe := "spiffe://cluster.local/ns/test/sa/alice"
+
+	for _, tc := range []struct {
+		name     string
+		hdr      []byte
+		version  int
+		src, dst *net.TCPAddr
+	}{
+		{"v1-tcp4", ProxyHeaderV1(v4s, v4d), 1, v4s, v4d},
+		{"v1-tcp6", ProxyHeaderV1(v6s, v6d), 1, v6s, v6d},
+		{"v1-unknown", ProxyHeaderV1(v4s, &net.UDPAddr{}), 1, nil, nil},
+		{"v1-mixed", ProxyHeaderV1(v4s, v6d), 1, v4s, v6d},
+		{"v2-tcp4", ProxyHeaderV2(v4s, v4d, ProxyTLV{Type: ProxyTLVSpiffe, Value: []byte(spiffe)},
+			ProxyTLV{Type: ProxyTLVAuthority, Value: []byte("echo.test.svc")}), 2, v4s, v4d},
+		{"v2-tcp6", ProxyHeaderV2(v6s, v6d, ProxyTLV{Type: ProxyTLVSpiffe, Value: []byte(spiffe)}), 2, v6s, v6d},
+		{"v2-local", ProxyHeaderV2(nil, nil), 2, nil, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			br := NewBufferReader(bytes.NewReader(append(tc.hdr, "payload"...)))
+			h, err := ParseProxyHeader(br)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.Version != tc.version {
+				t.Error("Unexpected version", h.Version)
+			}
+			if tc.src == nil {
+				if h.Source != nil || h.Destination != nil {
+					t.Error("Unexpected addresses", h.Source, h.Destination)
+				}
+			} else if !h.Source.IP.Equal(tc.src.IP) || h.Source.Port != tc.src.Port ||
+				!h.Destination.IP.Equal(tc.dst.IP) || h.Destination.Port != tc.dst.Port {
+				t.Error("Unexpected addresses", h.Source, h.Destination)
+			}
+			if tc.version == 2 && tc.src != nil {
+				if string(h.TLV(ProxyTLVSpiffe)) != spiffe {
+					t.Error("Missing SPIFFE TLV", h.TLVs)
+				}
+			}
+			if h.TLV(0x30) != nil {
+				t.Error("Unexpected TLV")
+			}
+			rest, _ := io.ReadAll(br)
+			if string(rest) != "payload" {
+				t.Error("Payload not preserved", string(rest))
+			}
+		})
+	}
+}
+
+func TestProxyHeaderInvalid(t *testing.T) {
+	v4s := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 41000}
+	v4d := &net.TCPAddr{IP: net.ParseIP("10.4.5.6"), Port: 8080}
+	v2 := ProxyHeaderV2(v4s, v4d, ProxyTLV{Type: ProxyTLVSpiffe, Value: []byte("spiffe://a")})
+
+	badTLV := append([]byte{}, v2...)
+	// TLV length larger than the remaining header.
+	badTLV[16+12+2] = 0x10
+
+	badVersion := append([]byte{}, v2...)
+	badVersion[12] = 0x11
+
+	bigLen := append([]byte{}, v2[:16]...)
+	bigLen[14], bigLen[15] = 0xFF, 0xFF
+
+	shortAddr := append([]byte{}, v2[:16]...)
+	shortAddr[15] = 4
+	shortAddr = append(shortAddr, 1, 2, 3, 4)
+
+	for name, hdr := range map[string][]byte{
+		"not-proxy":         []byte("GET / HTTP/1.1\r\n\r\n"),
+		"v1-bad-family":     []byte("PROXY UDP4 10.0.0.1 10.0.0.2 1 2\r\n"),
+		"v1-bad-ip":         []byte("PROXY TCP4 10.0.0.300 10.0.0.2 1 2\r\n"),
+		"v1-bad-port":       []byte("PROXY TCP4 10.0.0.1 10.0.0.2 1 70000\r\n"),
+		"v1-missing-fields": []byte("PROXY TCP4 10.0.0.1 10.0.0.2 1\r\n"),
+		"v1-too-long":       append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), 200)...),
+		"v1-truncated":      []byte("PROXY TCP4 10.0.0.1 10.0"),
+		"v2-truncated":      v2[:len(v2)-3],
+		"v2-short-sig":      v2[:10],
+		"v2-bad-tlv":        badTLV,
+		"v2-bad-version":    badVersion,
+		"v2-too-long":       bigLen,
+		"v2-short-addr":     shortAddr,
+	} {
+		t.Run(name, func(t *testing.T) {
+			br := NewBufferReader(bytes.NewReader(hdr))
+			if h, err := ParseProxyHeader(br); err == nil {
+				t.Errorf("Expecting error, got %+v", h)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolHandler(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	src := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 41000}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.4.5.6"), Port: 8080}
+	res := make(chan net.Conn, 1)
+	go ProxyProtocolHandler(func(nc net.Conn) { res <- nc })(s)
+
+	c.Write(append(ProxyHeaderV2(src, dst), "hello"...))
+	nc := <-res
+	if nc.RemoteAddr().String() != src.String() || nc.LocalAddr().String() != dst.String() {
+		t.Error("Unexpected addresses", nc.RemoteAddr(), nc.LocalAddr())
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(nc, b); err != nil || string(b) != "hello" {
+		t.Error("Unexpected data", string(b), err)
+	}
+}
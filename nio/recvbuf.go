@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"context"
 	"io"
-	"log"
 	"sync"
 	"time"
 )
@@ -273,7 +272,7 @@ func (r *RecvBufferReader) Read(p []byte) (n int, err error) {
 	}
 
 	if r.Err == io.EOF {
-		log.Println("EOF", len(r.backlog))
+		Log.Debug("Read after EOF", "backlog", len(r.backlog))
 	}
 
 	n, err = r.readBlocking(p[copied:])
@@ -2,7 +2,6 @@ package nio
 
 import (
 	"errors"
-	"log"
 	"strings"
 )
 
@@ -15,6 +14,8 @@ type ClientHelloMsg struct { // 22
 	//CipherSuites        []uint16
 	//compressionMethods  []uint8
 	ServerName string
+	// ALPN protocols requested by the client.
+	ALPN []string
 	//ocspStapling        bool
 	//scts                bool
 	//supportedPoints     []uint8
@@ -26,6 +27,7 @@ type ClientHelloMsg struct { // 22
 // TLS extension numbers
 const (
 	extensionServerName uint16 = 0
+	extensionALPN       uint16 = 16
 )
 
 // TODO: if a session WorkloadID is provided, use it as a cookie and attempt
@@ -35,23 +37,33 @@ const (
 // TODO: in mesh, use one cypher suite (TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256)
 // maybe 2 ( since keys are ECDSA )
 func ParseTLS(acc *BufferReader) (string, error) {
-	buf, err := acc.Peek(5)
+	m, err := ParseClientHello(acc)
 	if err != nil {
 		return "", err
 	}
+	return m.ServerName, nil
+}
+
+// ParseClientHello peeks the TLS ClientHello, returning the SNI and ALPN.
+// The data is not consumed.
+func ParseClientHello(acc *BufferReader) (*ClientHelloMsg, error) {
+	buf, err := acc.Peek(5)
+	if err != nil {
+		return nil, err
+	}
 	typ := buf[0] // 22 3 1 2 0
 	if typ != 0x16 {
-		return "", sniErr
+		return nil, sniErr
 	}
 	vers := uint16(buf[1])<<8 | uint16(buf[2])
 	if vers != 0x301 {
-		log.Println("Version ", vers)
+		Log.Debug("SNI TLS record version", "vers", vers)
 	}
 
 	rlen := int(buf[3])<<8 | int(buf[4])
 	if rlen > 16*1024 {
-		log.Println("RLen ", rlen)
-		return "", sniErr
+		Log.Debug("SNI record too large", "len", rlen)
+		return nil, sniErr
 	}
 
 	off := 5
@@ -60,14 +72,14 @@ func ParseTLS(acc *BufferReader) (string, error) {
 	end := rlen + 5
 	buf, err = acc.Peek(end)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	clientHello := buf[5:end]
 	chLen := end - 5
 
 	if chLen < 38 {
-		log.Println("chLen ", chLen)
-		return "", sniErr
+		Log.Debug("SNI ClientHello too short", "len", chLen)
+		return nil, sniErr
 	}
 
 	// off is the last byte in the buffer - will be forwarded
@@ -77,8 +89,8 @@ func ParseTLS(acc *BufferReader) (string, error) {
 
 	sessionIdLen := int(clientHello[38])
 	if sessionIdLen > 32 || chLen < 39+sessionIdLen {
-		log.Println("sLen ", sessionIdLen)
-		return "", sniErr
+		Log.Debug("SNI invalid session id", "len", sessionIdLen)
+		return nil, sniErr
 	}
 	m.sessionId = clientHello[39 : 39+sessionIdLen]
 	off = 39 + sessionIdLen
@@ -88,7 +100,7 @@ func ParseTLS(acc *BufferReader) (string, error) {
 	cipherSuiteLen := int(clientHello[off])<<8 | int(clientHello[off+1])
 	off += 2
 	if cipherSuiteLen%2 == 1 || chLen-off < 2+cipherSuiteLen {
-		return "", sniErr
+		return nil, sniErr
 	}
 
 	//numCipherSuites := cipherSuiteLen / 2
@@ -101,51 +113,51 @@ func ParseTLS(acc *BufferReader) (string, error) {
 	compressionMethodsLen := int(clientHello[off])
 	off++
 	if chLen-off < 1+compressionMethodsLen {
-		return "", sniErr
+		return nil, sniErr
 	}
 	//m.compressionMethods = data[1 : 1+compressionMethodsLen]
 	off += compressionMethodsLen
 
 	if off+2 > chLen {
 		// ClientHello is optionally followed by extension data
-		return "", sniErr
+		return nil, sniErr
 	}
 
 	extensionsLength := int(clientHello[off])<<8 | int(clientHello[off+1])
 	off = off + 2
 	if extensionsLength != chLen-off {
-		return "", sniErr
+		return nil, sniErr
 	}
 
-	for off < chLen {
+	for off+4 <= chLen {
 		extension := uint16(clientHello[off])<<8 | uint16(clientHello[off+1])
 		off += 2
 		length := int(clientHello[off])<<8 | int(clientHello[off+1])
 		off += 2
-		if off >= end {
-			return "", sniErr
+		if off+length > chLen {
+			return nil, sniErr
 		}
 
 		switch extension {
 		case extensionServerName:
 			d := clientHello[off : off+length]
 			if len(d) < 2 {
-				return "", sniErr
+				return nil, sniErr
 			}
 			namesLen := int(d[0])<<8 | int(d[1])
 			d = d[2:]
 			if len(d) != namesLen {
-				return "", sniErr
+				return nil, sniErr
 			}
 			for len(d) > 0 {
 				if len(d) < 3 {
-					return "", sniErr
+					return nil, sniErr
 				}
 				nameType := d[0]
 				nameLen := int(d[1])<<8 | int(d[2])
 				d = d[3:]
 				if len(d) < nameLen {
-					return "", sniErr
+					return nil, sniErr
 				}
 				if nameType == 0 {
 					m.ServerName = string(d[:nameLen])
@@ -153,12 +165,26 @@ func ParseTLS(acc *BufferReader) (string, error) {
 					// trailing dot. See
 					// https://tools.ietf.org/html/rfc6066#section-3.
 					if strings.HasSuffix(m.ServerName, ".") {
-						return "", sniErr
+						return nil, sniErr
 					}
 					break
 				}
 				d = d[nameLen:]
 			}
+		case extensionALPN:
+			d := clientHello[off : off+length]
+			if len(d) < 2 {
+				return nil, sniErr
+			}
+			d = d[2:]
+			for len(d) > 0 {
+				l := int(d[0])
+				if len(d) < 1+l {
+					return nil, sniErr
+				}
+				m.ALPN = append(m.ALPN, string(d[1:1+l]))
+				d = d[1+l:]
+			}
 		default:
 			//log.Println("TLS Ext", extension, length)
 		}
@@ -170,5 +196,5 @@ func ParseTLS(acc *BufferReader) (string, error) {
 
 	// TODO: unmangle server name - port, mesh node
 
-	return m.ServerName, nil
+	return &m, nil
 }
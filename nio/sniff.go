@@ -0,0 +1,110 @@
+package nio
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Protocol detection for listeners accepting multiple protocols on the same
+// port - for example a Cloud Run service or a single load balancer port.
+//
+// Only the first bytes sent by the client are used - all supported protocols
+// are client-first:
+// - 0x16 - TLS handshake record
+// - 0x05 - SOCKS5
+// - "\r\n\r\n" or "PROXY " - PROXY protocol v2 or v1
+// - "PRI * HTTP/2.0" - h2c with prior knowledge
+// - "METHOD " - HTTP/1.x, including CONNECT
+
+// Protocols returned by Sniff.
+const (
+	SniffTLS    = "tls"
+	SniffHTTP   = "http"
+	SniffH2C    = "h2c"
+	SniffSOCKS5 = "socks5"
+	SniffProxy  = "proxy"
+)
+
+// SniffTimeout is the max time to wait for the first bytes.
+var SniffTimeout = 5 * time.Second
+
+var errSniff = errors.New("unknown protocol")
+
+// Sniff returns the protocol of the stream, based on the first bytes. The
+// data is not consumed.
+func Sniff(br *BufferReader) (string, error) {
+	buf, err := br.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	switch buf[0] {
+	case 0x16:
+		return SniffTLS, nil
+	case 0x05:
+		return SniffSOCKS5, nil
+	case '\r':
+		return SniffProxy, nil
+	}
+	if !isMethodChar(buf[0]) {
+		return "", errSniff
+	}
+
+	// Shortest HTTP request line is 'GET / HTTP/1.0\r\n' - 8 bytes are
+	// always available for the supported protocols.
+	buf, err = br.Peek(8)
+	if err != nil {
+		return "", err
+	}
+	s := string(buf[:8])
+	switch {
+	case s == "PRI * HT":
+		return SniffH2C, nil
+	case s[:6] == "PROXY ":
+		return SniffProxy, nil
+	}
+	for i := 1; i < 8; i++ {
+		if s[i] == ' ' {
+			return SniffHTTP, nil
+		}
+		if !isMethodChar(s[i]) {
+			break
+		}
+	}
+	return "", errSniff
+}
+
+func isMethodChar(c byte) bool {
+	return c >= 'A' && c <= 'Z'
+}
+
+// BufferedConn is a net.Conn with the initial data buffered in Reader - used
+// after sniffing or parsing a prefix of the stream.
+type BufferedConn struct {
+	net.Conn
+	Reader *BufferReader
+}
+
+func (bc *BufferedConn) Read(b []byte) (int, error) {
+	return bc.Reader.Read(b)
+}
+
+func (bc *BufferedConn) CloseWrite() error {
+	if cw, ok := bc.Conn.(CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return bc.Conn.Close()
+}
+
+// SniffConn detects the protocol of an accepted connection, with
+// SniffTimeout. The returned conn replays the sniffed bytes.
+func SniffConn(nc net.Conn) (*BufferedConn, string, error) {
+	nc.SetReadDeadline(time.Now().Add(SniffTimeout))
+	bc := &BufferedConn{Conn: nc, Reader: NewBufferReader(nc)}
+	proto, err := Sniff(bc.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	nc.SetReadDeadline(time.Time{})
+	return bc, proto, nil
+}
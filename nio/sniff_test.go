@@ -0,0 +1,58 @@
+package nio
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSniff(t *testing.T) {
+	for _, tc := range []struct {
+		data  string
+		proto string
+	}{
+		{"CONNECT a:443 HTTP/1.1\r\n\r\n", SniffHTTP},
+		{"GET / HTTP/1.1\r\n\r\n", SniffHTTP},
+		{"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", SniffH2C},
+		{"PROXY TCP4 10.0.0.1 10.0.0.2 1 2\r\n", SniffProxy},
+		{string(proxyV2Sig) + "....", SniffProxy},
+		{"\x05\x01\x00", SniffSOCKS5},
+		{"\x16\x03\x01\x00\x10", SniffTLS},
+		{"hello world", ""},
+	} {
+		br := NewBufferReader(bytes.NewReader([]byte(tc.data)))
+		p, err := Sniff(br)
+		if p != tc.proto || (tc.proto != "" && err != nil) {
+			t.Errorf("%q: got %q %v, want %q", tc.data, p, err, tc.proto)
+		}
+		// Nothing consumed
+		b, _ := br.Peek(1)
+		if len(b) == 0 || b[0] != tc.data[0] {
+			t.Errorf("%q: data consumed", tc.data)
+		}
+	}
+}
+
+func TestParseClientHello(t *testing.T) {
+	c, s := net.Pipe()
+	defer s.Close()
+	go func() {
+		tc := tls.Client(c, &tls.Config{ServerName: "svc.ns.svc", NextProtos: []string{"istio-peer-exchange", "h2"}})
+		tc.Handshake()
+	}()
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	bc, proto, err := SniffConn(s)
+	if err != nil || proto != SniffTLS {
+		t.Fatal(proto, err)
+	}
+	m, err := ParseClientHello(bc.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ServerName != "svc.ns.svc" || len(m.ALPN) != 2 || m.ALPN[0] != "istio-peer-exchange" || m.ALPN[1] != "h2" {
+		t.Error("Unexpected ClientHello", m.ServerName, m.ALPN)
+	}
+}
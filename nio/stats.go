@@ -16,12 +16,13 @@ type Stats struct {
 	LastRead time.Time
 
 	// Sent from client to server ( client is initiator of the proxy )
-	SentBytes   int
-	SentPackets int
+	// The counters are updated and read with atomic operations.
+	SentBytes   int64
+	SentPackets int64
 
 	// Received from server to client
-	RcvdBytes   int
-	RcvdPackets int
+	RcvdBytes   int64
+	RcvdPackets int64
 }
 
 var StreamId uint32
@@ -3,7 +3,6 @@ package nio
 import (
 	"errors"
 	"fmt"
-	"log"
 	"net"
 	"os"
 	"syscall"
@@ -51,7 +50,7 @@ func IptablesCapture(addr string, ug func(nc net.Conn, dest, la *net.TCPAddr)) e
 	na, err := net.ResolveTCPAddr("tcp", addr)
 	nl, err := ListenTProxy("tcp", na)
 	if err != nil {
-		log.Println("Failed to listen", err)
+		Log.Error("TProxy failed to listen", "addr", addr, "err", err)
 		return err
 	}
 	for {
@@ -65,7 +64,7 @@ func IptablesCapture(addr string, ug func(nc net.Conn, dest, la *net.TCPAddr)) e
 			}
 		}
 		if err != nil {
-			log.Println("Accept error, closing iptables listener ", err)
+			Log.Warn("Accept error, closing iptables listener", "addr", addr, "err", err)
 			return err
 		}
 
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"log"
 	"net"
 	"strconv"
 	"syscall"
@@ -98,7 +97,7 @@ func ReadFromUDP(conn *net.UDPConn, b []byte) (int, *net.UDPAddr, *net.UDPAddr,
 				return 0, nil, nil, fmt.Errorf("original destination is an unsupported network family")
 			}
 		} else {
-			log.Println(msg.Header.Level, msg.Header.Type)
+			Log.Debug("TProxy UDP unexpected control message", "level", msg.Header.Level, "type", msg.Header.Type)
 		}
 	}
 
@@ -116,7 +115,7 @@ func blockingLoop(con *net.UDPConn, u func(ip net.IP, port uint16, ip2 net.IP, u
 	for {
 		n, a1, addr, err := ReadFromUDP(con, data)
 		if err != nil {
-			log.Println("Read err", err)
+			Log.Warn("TProxy UDP read error", "err", err)
 			continue
 		}
 
@@ -190,7 +189,7 @@ func (tudp *TProxyUDP) WriteTo(data []byte, dstAddr *net.UDPAddr, srcAddr *net.U
 	if err != nil {
 		n, err = tudp.con.WriteToUDP(data, dstAddr)
 		if err != nil {
-			log.Print("Failed to send DNS ", dstAddr, srcAddr)
+			Log.Warn("TProxy UDP failed to send", "dst", dstAddr, "src", srcAddr, "err", err)
 		}
 	}
 
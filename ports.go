@@ -0,0 +1,161 @@
+package hbone
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Inbound port handling, based on MeshSettings.Ports.
+//
+// The key is the port name, following Istio conventions - the protocol is
+// the prefix of the name: "http", "http-web", "grpc-api", "tcp-db", "http2"
+// or "h2c" for HTTP/2 without TLS. Names without a known prefix are tcp.
+//
+// The value is the port number, or SERVICE_PORT:CONTAINER_PORT to remap a
+// service port to a different port on the local app.
+//
+// The "*" key allows any port by number, as tcp. Without it, only the
+// declared ports are allowed - if Ports is empty no port is reachable, hboned
+// defaults to http=8080.
+//
+// Names are checked in sorted order, and Validate rejects service ports
+// declared more than once.
+//
+// Ports used by hbone itself (BasePort to BasePort+99) are never reachable,
+// including as the target of a declared port.
+
+// Application protocols for inbound ports.
+const (
+	ProtoTCP  = "tcp"
+	ProtoHTTP = "http"
+	ProtoH2C  = "h2c"
+	ProtoGRPC = "grpc"
+)
+
+// InboundPort is a resolved inbound port.
+type InboundPort struct {
+	// Name of the port in MeshSettings.Ports, "*" for wildcard.
+	Name string
+
+	// Protocol of the application on the port.
+	Protocol string
+
+	// Port is the service port, as requested by the client.
+	Port int
+
+	// TargetPort is the port of the local application.
+	TargetPort int
+}
+
+// portProtocol returns the app protocol based on the port name.
+func portProtocol(name string) string {
+	prefix := strings.SplitN(name, "-", 2)[0]
+	switch prefix {
+	case "http", "http1":
+		return ProtoHTTP
+	case "http2", "h2c":
+		return ProtoH2C
+	case "grpc":
+		return ProtoGRPC
+	}
+	return ProtoTCP
+}
+
+// parsePortValue parses 'PORT' or 'SERVICE_PORT:TARGET_PORT'.
+func parsePortValue(v string) (int, int, error) {
+	parts := strings.SplitN(v, ":", 2)
+	p, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(parts) == 1 {
+		return p, p, nil
+	}
+	t, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	return p, t, nil
+}
+
+// ResolvePort finds the declared inbound port for a port number or name
+// requested by a peer. Returns an error if the port is not allowed.
+func (hb *HBone) ResolvePort(p string) (*InboundPort, error) {
+	ip, err := hb.resolvePort(p)
+	if err != nil {
+		return nil, err
+	}
+	if hb.reservedPort(ip.Port) || hb.reservedPort(ip.TargetPort) {
+		return nil, fmt.Errorf("port %d reserved", ip.TargetPort)
+	}
+	return ip, nil
+}
+
+func (hb *HBone) resolvePort(p string) (*InboundPort, error) {
+	if v, ok := hb.Ports[p]; ok && p != "*" {
+		sp, tp, err := parsePortValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %s=%q", p, v)
+		}
+		return &InboundPort{Name: p, Protocol: portProtocol(p), Port: sp, TargetPort: tp}, nil
+	}
+
+	n, err := strconv.Atoi(p)
+	if err != nil {
+		return nil, fmt.Errorf("unknown port %q", p)
+	}
+	for _, name := range portNames(hb.Ports) {
+		if name == "*" {
+			continue
+		}
+		sp, tp, err := parsePortValue(hb.Ports[name])
+		if err == nil && sp == n {
+			return &InboundPort{Name: name, Protocol: portProtocol(name), Port: sp, TargetPort: tp}, nil
+		}
+	}
+
+	if _, ok := hb.Ports["*"]; ok {
+		return &InboundPort{Name: "*", Protocol: ProtoTCP, Port: n, TargetPort: n}, nil
+	}
+	return nil, fmt.Errorf("port %d not declared", n)
+}
+
+// reservedPort returns true for the ports used by hbone - BasePort to
+// BasePort+99.
+func (hb *HBone) reservedPort(n int) bool {
+	base := hb.BasePort
+	if base == 0 {
+		base = 15000
+	}
+	return n >= base && n < base+100
+}
+
+// httpPort returns the target port of the first port with http protocol, or
+// 8080.
+func (hb *HBone) httpPort() int {
+	if v, ok := hb.Ports["http"]; ok {
+		if _, tp, err := parsePortValue(v); err == nil {
+			return tp
+		}
+	}
+	for _, name := range portNames(hb.Ports) {
+		if portProtocol(name) == ProtoHTTP {
+			if _, tp, err := parsePortValue(hb.Ports[name]); err == nil {
+				return tp
+			}
+		}
+	}
+	return 8080
+}
+
+// portNames returns the names of the ports, sorted.
+func portNames(ports map[string]string) []string {
+	names := make([]string, 0, len(ports))
+	for name := range ports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,87 @@
+package hbone
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolvePort(t *testing.T) {
+	hb := New(nil, &MeshSettings{Ports: map[string]string{
+		"http":     "8080",
+		"grpc-api": "80:9090",
+		"tcp-db":   "5432",
+	}})
+
+	for _, tc := range []struct {
+		req, name, proto string
+		target           int
+	}{
+		{"8080", "http", ProtoHTTP, 8080},
+		{"http", "http", ProtoHTTP, 8080},
+		{"80", "grpc-api", ProtoGRPC, 9090},
+		{"5432", "tcp-db", ProtoTCP, 5432},
+	} {
+		p, err := hb.ResolvePort(tc.req)
+		if err != nil || p.Name != tc.name || p.Protocol != tc.proto || p.TargetPort != tc.target {
+			t.Error(tc.req, p, err)
+		}
+	}
+	if _, err := hb.ResolvePort("15000"); err == nil {
+		t.Error("Expecting error for undeclared port")
+	}
+
+	hb.Ports["*"] = "*"
+	if p, err := hb.ResolvePort("22"); err != nil || p.TargetPort != 22 {
+		t.Error("Expecting wildcard", p, err)
+	}
+	if _, err := hb.ResolvePort("15000"); err == nil {
+		t.Error("Expecting error for reserved port")
+	}
+
+	// Reserved ports are rejected when declared, as remap target, or with
+	// no declared ports.
+	hb.Ports["tcp-admin"] = "15000"
+	hb.Ports["tcp-remap"] = "9000:15008"
+	for _, p := range []string{"15000", "tcp-admin", "9000", "tcp-remap"} {
+		if _, err := hb.ResolvePort(p); err == nil {
+			t.Error("Expecting error for reserved port", p)
+		}
+	}
+
+	// Without declared ports nothing is reachable.
+	hb = New(nil, &MeshSettings{BasePort: 16000})
+	if _, err := hb.ResolvePort("15000"); err == nil {
+		t.Error("Expecting error without declared ports")
+	}
+	hb.Ports = map[string]string{"*": "*"}
+	if _, err := hb.ResolvePort("16099"); err == nil {
+		t.Error("Expecting error for reserved port with wildcard")
+	}
+	if p, err := hb.ResolvePort("15000"); err != nil || p.TargetPort != 15000 {
+		t.Error("Expecting port outside the reserved range", p, err)
+	}
+}
+
+func TestResolvePortOrder(t *testing.T) {
+	hb := New(nil, &MeshSettings{Ports: map[string]string{
+		"tcp-b":  "80:9001",
+		"tcp-a":  "80:9000",
+		"http-b": "8081",
+		"http-a": "8082",
+	}})
+	// Duplicates are rejected by Validate, but resolve deterministically.
+	for i := 0; i < 10; i++ {
+		if p, err := hb.ResolvePort("80"); err != nil || p.Name != "tcp-a" {
+			t.Fatal("Unexpected port", p, err)
+		}
+		if p := hb.httpPort(); p != 8082 {
+			t.Fatal("Unexpected http port", p)
+		}
+	}
+	if err := hb.MeshSettings.Validate(); err == nil || !strings.Contains(err.Error(), `ports["tcp-b"]`) {
+		t.Error("Expecting duplicate port error", err)
+	}
+	if err := (&MeshSettings{Ports: map[string]string{"*": "*", "http": "8080"}}).Validate(); err != nil {
+		t.Error("Unexpected error for wildcard", err)
+	}
+}
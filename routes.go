@@ -0,0 +1,351 @@
+package hbone
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Static HTTP routing, for the ingress role. Routes are evaluated in order
+// for HTTP requests received on the HBONE port, the plain HTTP and https
+// listeners - the first match selects a weighted backend cluster. Requests
+// without a matching route use the default handling (local app or listener
+// forwardTo).
+
+// Route maps HTTP requests to mesh clusters.
+type Route struct {
+	Name string `json:"name,omitempty"`
+
+	// Hosts matched against the Host header, without port. "*.domain"
+	// matches subdomains, "*" or empty matches all.
+	Hosts []string `json:"hosts,omitempty"`
+
+	Match *RouteMatch `json:"match,omitempty"`
+
+	// Backends are the destination clusters, selected by weight.
+	Backends []*RouteBackend `json:"backends,omitempty"`
+
+	// PrefixRewrite replaces the matched path prefix.
+	PrefixRewrite string `json:"prefixRewrite,omitempty"`
+
+	RequestHeaders  *HeaderRewrite `json:"requestHeaders,omitempty"`
+	ResponseHeaders *HeaderRewrite `json:"responseHeaders,omitempty"`
+
+	// Timeout for the request, including the response body.
+	Timeout Duration `json:"timeout,omitempty"`
+
+	once  sync.Once
+	hosts []string
+	re    *regexp.Regexp
+	hre   []*regexp.Regexp
+	cErr  error
+	total int
+}
+
+// RouteMatch selects requests by path and headers. Only one of the path
+// fields should be set. All headers must match.
+type RouteMatch struct {
+	Prefix  string         `json:"prefix,omitempty"`
+	Exact   string         `json:"exact,omitempty"`
+	Regex   string         `json:"regex,omitempty"`
+	Headers []*HeaderMatch `json:"headers,omitempty"`
+}
+
+// HeaderMatch matches a request header. If Exact and Regex are empty, the
+// header must be present.
+type HeaderMatch struct {
+	Name  string `json:"name"`
+	Exact string `json:"exact,omitempty"`
+	Regex string `json:"regex,omitempty"`
+}
+
+// RouteBackend is a destination cluster - a key in Clusters, or a host:port
+// dialed like hb.Dial.
+type RouteBackend struct {
+	Cluster string `json:"cluster"`
+	Weight  int    `json:"weight,omitempty"`
+}
+
+// HeaderRewrite modifies request or response headers.
+type HeaderRewrite struct {
+	Set    map[string]string `json:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+}
+
+func (hr *HeaderRewrite) apply(h http.Header) {
+	if hr == nil {
+		return
+	}
+	for _, k := range hr.Remove {
+		h.Del(k)
+	}
+	for k, v := range hr.Set {
+		h.Set(k, v)
+	}
+	for k, v := range hr.Add {
+		h.Add(k, v)
+	}
+}
+
+// Validate checks the route, compiling the regular expressions.
+func (r *Route) Validate() error {
+	r.once.Do(r.compile)
+	return r.cErr
+}
+
+func (r *Route) compile() {
+	r.hosts = make([]string, len(r.Hosts))
+	for i, h := range r.Hosts {
+		r.hosts[i] = strings.ToLower(h)
+	}
+	if len(r.Backends) == 0 {
+		r.cErr = fmt.Errorf("route %s: no backends", r.Name)
+		return
+	}
+	for _, b := range r.Backends {
+		if b.Cluster == "" || b.Weight < 0 {
+			r.cErr = fmt.Errorf("route %s: invalid backend %q weight %d", r.Name, b.Cluster, b.Weight)
+			return
+		}
+		w := b.Weight
+		if w == 0 {
+			w = 1
+		}
+		r.total += w
+	}
+	m := r.Match
+	if m == nil {
+		return
+	}
+	var err error
+	if m.Regex != "" {
+		if r.re, err = regexp.Compile("^(?:" + m.Regex + ")$"); err != nil {
+			r.cErr = fmt.Errorf("route %s: %w", r.Name, err)
+			return
+		}
+	}
+	r.hre = make([]*regexp.Regexp, len(m.Headers))
+	for i, h := range m.Headers {
+		if h.Regex == "" {
+			continue
+		}
+		if r.hre[i], err = regexp.Compile("^(?:" + h.Regex + ")$"); err != nil {
+			r.cErr = fmt.Errorf("route %s: header %s: %w", r.Name, h.Name, err)
+			return
+		}
+	}
+}
+
+// AddRoute adds a route after the existing ones.
+func (hb *HBone) AddRoute(r *Route) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	hb.m.Lock()
+	hb.Routes = append(hb.Routes, r)
+	hb.m.Unlock()
+	return nil
+}
+
+// SetRoutes replaces the routes. If any route is invalid, the existing
+// routes are not changed.
+func (hb *HBone) SetRoutes(routes []*Route) error {
+	for _, r := range routes {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+	}
+	hb.m.Lock()
+	hb.Routes = routes
+	hb.m.Unlock()
+	return nil
+}
+
+// matchRoute returns the first route matching the request, or nil.
+func (hb *HBone) matchRoute(req *http.Request) *Route {
+	hb.m.RLock()
+	routes := hb.Routes
+	hb.m.RUnlock()
+	for _, r := range routes {
+		if r.Validate() != nil {
+			continue
+		}
+		if r.match(req) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (r *Route) match(req *http.Request) bool {
+	if !matchHost(r.hosts, req.Host) {
+		return false
+	}
+	m := r.Match
+	if m == nil {
+		return true
+	}
+	p := req.URL.Path
+	switch {
+	case m.Exact != "" && p != m.Exact:
+		return false
+	case m.Prefix != "" && !strings.HasPrefix(p, m.Prefix):
+		return false
+	case r.re != nil && !r.re.MatchString(p):
+		return false
+	}
+	for i, h := range m.Headers {
+		v, ok := req.Header[http.CanonicalHeaderKey(h.Name)]
+		switch {
+		case !ok:
+			return false
+		case h.Exact != "" && v[0] != h.Exact:
+			return false
+		case r.hre[i] != nil && !r.hre[i].MatchString(v[0]):
+			return false
+		}
+	}
+	return true
+}
+
+func matchHost(hosts []string, host string) bool {
+	if len(hosts) == 0 {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, h := range hosts {
+		switch {
+		case h == "*" || h == host:
+			return true
+		case strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:]):
+			return true
+		}
+	}
+	return false
+}
+
+// backend selects a backend cluster by weight.
+func (r *Route) backend() string {
+	if len(r.Backends) == 1 {
+		return r.Backends[0].Cluster
+	}
+	n := rand.Intn(r.total)
+	for _, b := range r.Backends {
+		w := b.Weight
+		if w == 0 {
+			w = 1
+		}
+		if n < w {
+			return b.Cluster
+		}
+		n -= w
+	}
+	return r.Backends[0].Cluster
+}
+
+// serveRoute forwards the request to a backend of the route.
+func (hb *HBone) serveRoute(rt *Route, w http.ResponseWriter, r *http.Request) {
+	if rt.Timeout.Duration > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), rt.Timeout.Duration)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	if rt.PrefixRewrite != "" && rt.Match != nil && rt.Match.Prefix != "" {
+		r.URL.Path = rt.PrefixRewrite + strings.TrimPrefix(r.URL.Path, rt.Match.Prefix)
+		r.URL.RawPath = ""
+	}
+	rt.RequestHeaders.apply(r.Header)
+	if rt.ResponseHeaders != nil {
+		w = &rewriteWriter{ResponseWriter: w, rw: rt.ResponseHeaders}
+	}
+	hb.clusterProxy(rt.backend()).ServeHTTP(w, r)
+}
+
+// clusterProxy returns the reverse proxy forwarding to a mesh cluster,
+// creating it on first use.
+func (hb *HBone) clusterProxy(dest string) *httputil.ReverseProxy {
+	hb.m.Lock()
+	defer hb.m.Unlock()
+	if rp := hb.clusterProxies[dest]; rp != nil {
+		return rp
+	}
+	rp := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = dest
+		},
+		Transport: &clusterTransport{hb: hb, dest: dest,
+			direct: &http.Transport{DialContext: hb.DialContext}},
+		// Streaming - gRPC and h2 apps may send data without ending the stream.
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			hb.log.Warn("Cluster proxy error", "dest", dest, "url", r.URL, "err", err)
+			status, t := dialStatus(err)
+			w.Header().Set(HeaderProxyStatus, hb.proxyStatus(t, err))
+			w.WriteHeader(status)
+		},
+	}
+	if hb.clusterProxies == nil {
+		hb.clusterProxies = map[string]*httputil.ReverseProxy{}
+	}
+	hb.clusterProxies[dest] = rp
+	return rp
+}
+
+// clusterTransport forwards requests to the mesh cluster for dest, or
+// directly if dest is not a mesh cluster - like hb.Dial.
+type clusterTransport struct {
+	hb     *HBone
+	dest   string
+	direct *http.Transport
+}
+
+func (t *clusterTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if c := t.hb.GetCluster(t.dest); c != nil {
+		return c.RoundTrip(r)
+	}
+	return t.direct.RoundTrip(r)
+}
+
+// rewriteWriter applies the response header rewrite before the headers are
+// sent.
+type rewriteWriter struct {
+	http.ResponseWriter
+	rw      *HeaderRewrite
+	written bool
+}
+
+func (w *rewriteWriter) WriteHeader(code int) {
+	if !w.written {
+		w.written = true
+		w.rw.apply(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *rewriteWriter) Write(b []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *rewriteWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *rewriteWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,120 @@
+package hbone
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRoutes(t *testing.T) {
+	backend := func(name string) string {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				time.Sleep(time.Second)
+			}
+			w.Header().Set("x-internal", "1")
+			w.Write([]byte(name + " " + r.URL.Path + " " + r.Header.Get("x-route")))
+		}))
+		t.Cleanup(s.Close)
+		return s.Listener.Addr().String()
+	}
+	a, b := backend("a"), backend("b")
+
+	hb := New(nil, &MeshSettings{Routes: []*Route{
+		{
+			Name:            "api",
+			Hosts:           []string{"*.example.com"},
+			Match:           &RouteMatch{Prefix: "/api/", Headers: []*HeaderMatch{{Name: "x-user", Regex: "u[0-9]+"}}},
+			Backends:        []*RouteBackend{{Cluster: a}},
+			PrefixRewrite:   "/v1/",
+			RequestHeaders:  &HeaderRewrite{Set: map[string]string{"x-route": "api"}},
+			ResponseHeaders: &HeaderRewrite{Remove: []string{"x-internal"}},
+		},
+		{
+			Name:     "exact",
+			Hosts:    []string{"B.Example.com"},
+			Match:    &RouteMatch{Exact: "/b"},
+			Backends: []*RouteBackend{{Cluster: b}},
+		},
+		{
+			Name:     "split",
+			Match:    &RouteMatch{Regex: "/split/[a-z]+"},
+			Backends: []*RouteBackend{{Cluster: a, Weight: 1}, {Cluster: b, Weight: 3}},
+		},
+		{
+			Name:     "timeout",
+			Match:    &RouteMatch{Exact: "/slow"},
+			Backends: []*RouteBackend{{Cluster: a}},
+			Timeout:  Duration{50 * time.Millisecond},
+		},
+	}})
+
+	get := func(url string, h ...string) (*http.Response, string) {
+		r := httptest.NewRequest("GET", url, nil)
+		for i := 0; i < len(h); i += 2 {
+			r.Header.Set(h[i], h[i+1])
+		}
+		rt := hb.matchRoute(r)
+		if rt == nil {
+			return nil, ""
+		}
+		w := httptest.NewRecorder()
+		hb.serveRoute(rt, w, r)
+		res := w.Result()
+		body, _ := io.ReadAll(res.Body)
+		return res, string(body)
+	}
+
+	res, body := get("http://x.example.com:8080/api/foo", "x-user", "u12")
+	if body != "a /v1/foo api" || res.Header.Get("x-internal") != "" {
+		t.Error("Unexpected api response", body, res.Header)
+	}
+	if res, _ := get("http://x.example.com/api/foo", "x-user", "admin"); res != nil {
+		t.Error("Header mismatch should not match")
+	}
+	if res, _ := get("http://other.com/api/foo", "x-user", "u1"); res != nil {
+		t.Error("Host mismatch should not match")
+	}
+	if _, body := get("http://b.example.com/b"); body != "b /b " {
+		t.Error("Unexpected exact response", body)
+	}
+	if _, body := get("http://B.EXAMPLE.COM/b"); body != "b /b " {
+		t.Error("Host match should ignore case", body)
+	}
+	if res, _ := get("http://b.example.com/b/c"); res != nil {
+		t.Error("Exact mismatch should not match")
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 200; i++ {
+		_, body := get("http://any/split/x")
+		counts[body[:1]]++
+	}
+	if counts["a"] == 0 || counts["b"] <= counts["a"] {
+		t.Error("Unexpected split", counts)
+	}
+
+	if res, _ := get("http://any/slow"); res.StatusCode != http.StatusGatewayTimeout {
+		t.Error("Expecting timeout", res.StatusCode)
+	}
+
+	if err := hb.AddRoute(&Route{Match: &RouteMatch{Regex: "("}, Backends: []*RouteBackend{{Cluster: a}}}); err == nil {
+		t.Error("Expecting invalid regex error")
+	}
+}
+
+func TestSetRoutes(t *testing.T) {
+	hb := New(nil, &MeshSettings{})
+	r := &Route{Name: "a", Backends: []*RouteBackend{{Cluster: "a.svc:80"}}}
+	if err := hb.SetRoutes([]*Route{r}); err != nil {
+		t.Fatal(err)
+	}
+	if err := hb.SetRoutes([]*Route{{Name: "bad"}}); err == nil {
+		t.Error("Expecting error for route without backends")
+	}
+	if len(hb.Routes) != 1 || hb.Routes[0] != r {
+		t.Error("Invalid routes replaced the existing ones", hb.Routes)
+	}
+}
@@ -0,0 +1,364 @@
+package hbone
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment overlay and validation for MeshSettings.
+//
+// HBONE_NAME=value sets the field with the (JSON or Go) name, ignoring case
+// and '_' - HBONE_CONNECT_TIMEOUT=5s, HBONE_NAMESPACE=test. Nested fields and
+// map entries are separated by '__' - HBONE_LIMITS__MAX_CONNECTIONS=100,
+// HBONE_ENV__PROJECT_ID=p1.
+//
+// Values: durations use Go syntax, lists are comma separated
+// (HBONE_SECURE_CIDR=10.0.0.0/8,192.168.0.0/16), maps are comma separated
+// k=v (HBONE_PORTS=http=8080,grpc=9090). Values starting with '{' or '['
+// are JSON.
+//
+// For compatibility, NAMESPACE and PORT_name=value are also used.
+
+// envPrefix is the prefix for settings in the environment.
+const envPrefix = "HBONE_"
+
+// envReserved are HBONE_ variables that are not settings.
+var envReserved = map[string]bool{
+	"HBONE_CFG":      true,
+	"HBONE_CFG_YAML": true,
+	"HBONE_AUTHZ":    true,
+	"HBONE_NETNS":    true,
+}
+
+// ApplyEnv overlays the settings from environment variables, in the
+// os.Environ format.
+func (ms *MeshSettings) ApplyEnv(environ []string) error {
+	var errs []error
+	for _, kv := range environ {
+		k, v, _ := strings.Cut(kv, "=")
+		switch {
+		case k == "NAMESPACE" && ms.Namespace == "":
+			ms.Namespace = v
+		case strings.HasPrefix(k, "PORT_"):
+			if ms.Ports == nil {
+				ms.Ports = map[string]string{}
+			}
+			ms.Ports[k[5:]] = v
+		}
+	}
+	for _, kv := range environ {
+		k, v, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(k, envPrefix) || envReserved[k] {
+			continue
+		}
+		path := strings.Split(k[len(envPrefix):], "__")
+		if err := setEnvValue(reflect.ValueOf(ms).Elem(), path, v); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", k, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setEnvValue sets the field for the path to the value.
+func setEnvValue(v reflect.Value, path []string, s string) error {
+	if len(path) == 0 {
+		return setValue(v, s)
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return setEnvValue(v.Elem(), path, s)
+	case reflect.Struct:
+		f, ok := envField(v, path[0])
+		if !ok {
+			return errors.New("unknown setting " + strings.ToLower(path[0]))
+		}
+		return setEnvValue(f, path[1:], s)
+	case reflect.Map:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		key, err := mapKey(v.Type().Key(), path[0])
+		if err != nil {
+			return err
+		}
+		// Map values are not addressable - update a copy.
+		e := reflect.New(v.Type().Elem()).Elem()
+		if cur := v.MapIndex(key); cur.IsValid() {
+			e.Set(cur)
+		}
+		if err := setEnvValue(e, path[1:], s); err != nil {
+			return err
+		}
+		v.SetMapIndex(key, e)
+		return nil
+	}
+	return errors.New("not a struct or map")
+}
+
+// envField finds the struct field matching the env name, ignoring case and
+// '_'.
+func envField(v reflect.Value, name string) (reflect.Value, bool) {
+	name = strings.ReplaceAll(name, "_", "")
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		jn, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+		if jn == "-" {
+			continue
+		}
+		if strings.EqualFold(sf.Name, name) || (jn != "" && strings.EqualFold(strings.ReplaceAll(jn, "_", ""), name)) {
+			switch sf.Type.Kind() {
+			case reflect.Func, reflect.Interface, reflect.Chan:
+				return reflect.Value{}, false
+			}
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func mapKey(t reflect.Type, s string) (reflect.Value, error) {
+	k := reflect.New(t).Elem()
+	return k, setValue(k, s)
+}
+
+// setValue parses the string into the value, based on the type.
+func setValue(v reflect.Value, s string) error {
+	if strings.HasPrefix(s, "{") || strings.HasPrefix(s, "[") {
+		return json.Unmarshal([]byte(s), v.Addr().Interface())
+	}
+	if _, ok := v.Addr().Interface().(json.Unmarshaler); ok {
+		b, _ := json.Marshal(s)
+		return json.Unmarshal(b, v.Addr().Interface())
+	}
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		var parts []string
+		if s != "" {
+			parts = strings.Split(s, ",")
+		}
+		sl := reflect.MakeSlice(v.Type(), len(parts), len(parts))
+		for i, p := range parts {
+			if err := setValue(sl.Index(i), strings.TrimSpace(p)); err != nil {
+				return err
+			}
+		}
+		v.Set(sl)
+	case reflect.Map:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for _, p := range strings.Split(s, ",") {
+			mk, mv, ok := strings.Cut(strings.TrimSpace(p), "=")
+			if !ok {
+				return fmt.Errorf("expecting key=value: %q", p)
+			}
+			if err := setEnvValue(v, []string{mk}, mv); err != nil {
+				return err
+			}
+		}
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return setValue(v.Elem(), s)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// SetDefaults sets the cluster and listener addresses from the map keys, if
+// not set.
+func (ms *MeshSettings) SetDefaults() {
+	for name, c := range ms.Clusters {
+		if c != nil && c.Addr == "" {
+			c.Addr = name
+		}
+	}
+	for name, l := range ms.Listeners {
+		if l != nil && l.Address == "" {
+			l.Address = name
+		}
+	}
+}
+
+// Validate checks the settings, returning all errors with the path of the
+// invalid setting - for example clusters["a.svc:80"].endpoints[0].
+func (ms *MeshSettings) Validate() error {
+	var errs []error
+	add := func(path string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		}
+	}
+	// dest is a cluster name or host:port.
+	dest := func(d string) error {
+		if _, ok := ms.Clusters[d]; ok {
+			return nil
+		}
+		if _, _, err := net.SplitHostPort(d); err != nil {
+			return fmt.Errorf("%q is not a cluster or host:port", d)
+		}
+		return nil
+	}
+	nonNegative := func(path string, d time.Duration) {
+		if d < 0 {
+			add(path, errors.New("negative duration"))
+		}
+	}
+
+	declared := map[int]string{}
+	for _, name := range portNames(ms.Ports) {
+		if name == "*" {
+			continue
+		}
+		sp, tp, err := parsePortValue(ms.Ports[name])
+		if err == nil && (!validPort(sp) || !validPort(tp)) {
+			err = errors.New("port out of range")
+		}
+		if prev, ok := declared[sp]; ok && err == nil {
+			err = fmt.Errorf("port %d already declared as %q", sp, prev)
+		}
+		declared[sp] = name
+		add(fmt.Sprintf("ports[%q]", name), err)
+	}
+	for host, p := range ms.LocalHosts {
+		if _, ok := ms.Ports[p]; ok {
+			continue
+		}
+		if n, err := strconv.Atoi(p); err != nil || !validPort(n) {
+			add(fmt.Sprintf("localHosts[%q]", host), fmt.Errorf("%q is not a port name or number", p))
+		}
+	}
+
+	nonNegative("connectTimeout", ms.ConnectTimeout.Duration)
+	nonNegative("tcpUserTimeout", ms.TCPUserTimeout)
+	nonNegative("handshakeTimeout", ms.HandsahakeTimeout)
+
+	for i, c := range ms.SecureCIDR {
+		_, _, err := net.ParseCIDR(c)
+		add(fmt.Sprintf("secureCIDR[%d]", i), err)
+	}
+
+	for name, c := range ms.Clusters {
+		path := fmt.Sprintf("clusters[%q]", name)
+		if c == nil {
+			add(path, errors.New("empty"))
+			continue
+		}
+		add(path, c.Validate())
+		nonNegative(path+".connectTimeout", c.ConnectTimeout)
+	}
+	for name, l := range ms.Listeners {
+		path := fmt.Sprintf("listeners[%q]", name)
+		if l == nil {
+			add(path, errors.New("empty"))
+			continue
+		}
+		if l.Address == "" {
+			add(path+".address", errors.New("missing"))
+		}
+		if l.ForwardTo != "" {
+			add(path+".forwardTo", dest(l.ForwardTo))
+		}
+	}
+	for port, d := range ms.LocalForward {
+		path := fmt.Sprintf("localForward[%d]", port)
+		if !validPort(port) {
+			add(path, errors.New("port out of range"))
+		}
+		add(path, dest(d))
+	}
+	for i, r := range ms.Routes {
+		path := fmt.Sprintf("routes[%d]", i)
+		if err := r.Validate(); err != nil {
+			add(path, err)
+			continue
+		}
+		nonNegative(path+".timeout", r.Timeout.Duration)
+		for j, b := range r.Backends {
+			add(fmt.Sprintf("%s.backends[%d]", path, j), dest(b.Cluster))
+		}
+	}
+	for i, p := range ms.AuthzPolicies {
+		add(fmt.Sprintf("authzPolicies[%d]", i), p.Validate())
+	}
+
+	lim := ms.Limits
+	if lim.MaxConnections < 0 || lim.MaxStreamsPerPeer < 0 || lim.StreamRate < 0 ||
+		lim.StreamBurst < 0 || lim.MaxGoroutines < 0 {
+		add("limits", errors.New("negative limit"))
+	}
+
+	switch ms.XFCC {
+	case "", XFCCSanitizeSet, XFCCSanitize, XFCCForward, XFCCAppend:
+	default:
+		add("xfcc", fmt.Errorf("invalid mode %q", ms.XFCC))
+	}
+	switch ms.LocalProxyProtocol {
+	case "", "v1", "v2":
+	default:
+		add("localProxyProtocol", fmt.Errorf("invalid version %q", ms.LocalProxyProtocol))
+	}
+	for c, l := range ms.LogLevel {
+		var lv slog.Level
+		if !strings.EqualFold(l, "trace") && lv.UnmarshalText([]byte(l)) != nil {
+			add(fmt.Sprintf("logLevel[%q]", c), fmt.Errorf("invalid level %q", l))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validPort(p int) bool {
+	return p > 0 && p <= 65535
+}
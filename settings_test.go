@@ -0,0 +1,93 @@
+package hbone
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyEnv(t *testing.T) {
+	ms := &MeshSettings{Ports: map[string]string{"grpc": "9090"}}
+	err := ms.ApplyEnv([]string{
+		"NAMESPACE=legacy",
+		"PORT_http=8081",
+		"HBONE_NAMESPACE=test",
+		"HBONE_CONNECT_TIMEOUT=5s",
+		"HBONE_TCP_USER_TIMEOUT=1m",
+		"HBONE_GATEWAY=true",
+		"HBONE_SECURE_CIDR=10.0.0.0/8, 192.168.0.0/16",
+		"HBONE_LIMITS__MAX_CONNECTIONS=100",
+		"HBONE_LIMITS__STREAM_RATE=2.5",
+		"HBONE_ENV__PROJECT_ID=p1",
+		"HBONE_LOCAL_FORWARD=8082=echo.svc:80",
+		"HBONE_METADATA__SERVICE=svc",
+		"HBONE_CFG=ignored.yaml",
+		"OTHER=1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ms.Namespace != "test" || ms.ConnectTimeout.Duration != 5*time.Second || ms.TCPUserTimeout != time.Minute ||
+		!ms.Gateway || len(ms.SecureCIDR) != 2 || ms.SecureCIDR[1] != "192.168.0.0/16" {
+		t.Errorf("Unexpected settings %+v", ms)
+	}
+	if ms.Ports["http"] != "8081" || ms.Ports["grpc"] != "9090" {
+		t.Error("Unexpected ports", ms.Ports)
+	}
+	if ms.Limits.MaxConnections != 100 || ms.Limits.StreamRate != 2.5 {
+		t.Error("Unexpected limits", ms.Limits)
+	}
+	if ms.Env["PROJECT_ID"] != "p1" || ms.LocalForward[8082] != "echo.svc:80" ||
+		ms.Metadata == nil || ms.Metadata.Service != "svc" {
+		t.Error("Unexpected maps", ms.Env, ms.LocalForward, ms.Metadata)
+	}
+
+	err = ms.ApplyEnv([]string{"HBONE_NOT_A_SETTING=1", "HBONE_LIMITS__MAX_CONNECTIONS=x"})
+	if err == nil || !strings.Contains(err.Error(), "HBONE_NOT_A_SETTING") ||
+		!strings.Contains(err.Error(), "HBONE_LIMITS__MAX_CONNECTIONS") {
+		t.Error("Expecting errors for both variables", err)
+	}
+}
+
+func TestValidateSettings(t *testing.T) {
+	ms := &MeshSettings{
+		Ports:      map[string]string{"http": "8080", "bad": "80:x", "big": "70000"},
+		LocalHosts: map[string]string{"a": "http", "b": "nope"},
+		SecureCIDR: []string{"10.0.0.0/8", "10.0.0.1"},
+		Clusters: map[string]*Cluster{
+			"echo": {Addr: "echo.svc:80"},
+			"ep":   {Addr: "ep.svc:80", Endpoints: []*Endpoint{{}}},
+		},
+		Listeners: map[string]*Listener{
+			"8443": {Protocol: "tls", ForwardTo: "echo"},
+			"9000": {Protocol: "tls", ForwardTo: "missing"},
+		},
+		LocalForward: map[int]string{8081: "echo", 0: "a.svc:80"},
+		Routes: []*Route{
+			{Backends: []*RouteBackend{{Cluster: "echo"}, {Cluster: "nope"}}},
+		},
+		XFCC:     "bad",
+		LogLevel: map[string]string{"h2": "trace", "nio": "loud"},
+	}
+	ms.SetDefaults()
+	err := ms.Validate()
+	if err == nil {
+		t.Fatal("Expecting errors")
+	}
+	for _, p := range []string{`ports["bad"]`, `ports["big"]`, `localHosts["b"]`, "secureCIDR[1]",
+		`clusters["ep"]`, `listeners["9000"].forwardTo`, "localForward[0]", "routes[0].backends[1]",
+		"xfcc", `logLevel["nio"]`} {
+		if !strings.Contains(err.Error(), p+":") {
+			t.Error("Missing error for", p)
+		}
+	}
+	for _, p := range []string{`ports["http"]`, `localHosts["a"]`, "secureCIDR[0]", `clusters["echo"]`,
+		`listeners["8443"]`, "localForward[8081]", "routes[0].backends[0]", `logLevel["h2"]`} {
+		if strings.Contains(err.Error(), p+":") {
+			t.Error("Unexpected error for", p)
+		}
+	}
+	if ms.Listeners["8443"].Address != "8443" {
+		t.Error("Missing default address")
+	}
+}
@@ -0,0 +1,124 @@
+package hbone
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/costinm/hbone/h2"
+	"github.com/costinm/hbone/nio"
+)
+
+// dialTransparent connects to the local app using the original client IP as
+// source. The app is dialed on the local IP of the accepted connection, since
+// connections from a non-local source to 127.0.0.1 are dropped.
+func (hb *HBone) dialTransparent(stream *h2.H2Stream, hostPort string) (net.Conn, error) {
+	_, p, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(localIP(stream), p))
+	if err != nil {
+		return nil, err
+	}
+	src := hb.originalSource(stream)
+	if src == nil {
+		return net.Dial("tcp", hostPort)
+	}
+
+	mark := hb.TransparentMark
+	if mark == 0 {
+		mark = 1337
+	}
+	nc, err := nio.DialTransparent(context.Background(), dst, &net.TCPAddr{IP: src}, mark, hb.ConnectTimeout.Duration)
+	if err != nil {
+		return nil, err
+	}
+	return nc, nil
+}
+
+// localIP returns the IP the stream was received on.
+func localIP(stream *h2.H2Stream) string {
+	if ta, ok := stream.Conn().LocalAddr().(*net.TCPAddr); ok {
+		return ta.IP.String()
+	}
+	return "127.0.0.1"
+}
+
+// originalSource returns the IP of the client that opened the tunnel.
+func (hb *HBone) originalSource(stream *h2.H2Stream) net.IP {
+	return hb.clientIP(stream.Peer, stream.Request.Header, stream.Conn().RemoteAddr())
+}
+
+// clientIP returns the original client IP for a stream from peer.
+//
+// Gateways and waypoints listed in TrustedProxies can set the original
+// client IP in the 'forwarded' or 'x-forwarded-for' headers - the first
+// address is used. Otherwise, and for all other peers, the address of the
+// peer connection.
+func (hb *HBone) clientIP(peer *h2.PeerMetadata, h http.Header, remote net.Addr) net.IP {
+	var rip net.IP
+	if ta, ok := remote.(*net.TCPAddr); ok {
+		rip = ta.IP
+	}
+	if hb.trustedProxy(peer, rip) {
+		if ip := forwardedFor(h.Get("forwarded")); ip != nil {
+			return ip
+		}
+		xff := h.Get("x-forwarded-for")
+		if xff != "" {
+			if ip := net.ParseIP(strings.TrimSpace(strings.Split(xff, ",")[0])); ip != nil {
+				return ip
+			}
+		}
+	}
+	return rip
+}
+
+// trustedProxy returns true if the peer principal or address matches
+// TrustedProxies. Principals are only used for authenticated peers.
+func (hb *HBone) trustedProxy(peer *h2.PeerMetadata, ip net.IP) bool {
+	var principal string
+	if peer != nil {
+		principal = strings.TrimPrefix(peer.Principal, "spiffe://")
+	}
+	for _, tp := range hb.TrustedProxies {
+		if net.ParseIP(tp) != nil || isCIDR(tp) {
+			if ipInBlocks([]string{tp}, ip) {
+				return true
+			}
+			continue
+		}
+		if principal != "" && matchValue(tp, principal) {
+			return true
+		}
+	}
+	return false
+}
+
+func isCIDR(s string) bool {
+	_, _, err := net.ParseCIDR(s)
+	return err == nil
+}
+
+// forwardedFor returns the 'for' IP in the first element of a RFC 7239
+// Forwarded header, or nil.
+func forwardedFor(h string) net.IP {
+	if h == "" {
+		return nil
+	}
+	first := strings.Split(h, ",")[0]
+	for _, kv := range strings.Split(first, ";") {
+		kv = strings.TrimSpace(kv)
+		if len(kv) < 4 || !strings.EqualFold(kv[:4], "for=") {
+			continue
+		}
+		v := strings.Trim(kv[4:], "\"")
+		if host, _, err := net.SplitHostPort(v); err == nil {
+			v = host
+		}
+		return net.ParseIP(strings.Trim(v, "[]"))
+	}
+	return nil
+}
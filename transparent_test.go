@@ -0,0 +1,47 @@
+package hbone
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/costinm/hbone/h2"
+)
+
+func TestClientIP(t *testing.T) {
+	hb := New(nil, &MeshSettings{TrustedProxies: []string{
+		"cluster.local/ns/istio-system/sa/*", "10.10.0.0/16", "192.168.1.1"}})
+	gw := &h2.PeerMetadata{Principal: "spiffe://cluster.local/ns/istio-system/sa/ingress"}
+	other := &h2.PeerMetadata{Principal: "spiffe://cluster.local/ns/test/sa/alice"}
+	remote := &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000}
+
+	for _, tc := range []struct {
+		name   string
+		peer   *h2.PeerMetadata
+		remote *net.TCPAddr
+		h      http.Header
+		want   string
+	}{
+		{"trusted-principal", gw, remote, http.Header{"Forwarded": {"for=1.2.3.4;proto=https, for=5.6.7.8"}}, "1.2.3.4"},
+		{"trusted-xff", gw, remote, http.Header{"X-Forwarded-For": {" 1.2.3.4, 5.6.7.8"}}, "1.2.3.4"},
+		{"trusted-v6", gw, remote, http.Header{"Forwarded": {`for="[fd00::1]:4000"`}}, "fd00::1"},
+		{"trusted-cidr", nil, &net.TCPAddr{IP: net.ParseIP("10.10.3.4")},
+			http.Header{"X-Forwarded-For": {"1.2.3.4"}}, "1.2.3.4"},
+		{"trusted-ip", nil, &net.TCPAddr{IP: net.ParseIP("192.168.1.1")},
+			http.Header{"X-Forwarded-For": {"1.2.3.4"}}, "1.2.3.4"},
+		{"untrusted-principal", other, remote, http.Header{"Forwarded": {"for=1.2.3.4"},
+			"X-Forwarded-For": {"1.2.3.4"}}, "10.1.1.1"},
+		{"unauthenticated", &h2.PeerMetadata{}, remote, http.Header{"X-Forwarded-For": {"1.2.3.4"}}, "10.1.1.1"},
+		{"trusted-invalid", gw, remote, http.Header{"X-Forwarded-For": {"nope"}}, "10.1.1.1"},
+	} {
+		if got := hb.clientIP(tc.peer, tc.h, tc.remote); got.String() != tc.want {
+			t.Errorf("%s: got %s want %s", tc.name, got, tc.want)
+		}
+	}
+
+	// No trusted proxies - headers are ignored.
+	hb = New(nil, &MeshSettings{})
+	if got := hb.clientIP(gw, http.Header{"Forwarded": {"for=1.2.3.4"}}, remote); got.String() != "10.1.1.1" {
+		t.Error("Headers trusted by default", got)
+	}
+}
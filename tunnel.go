@@ -0,0 +1,130 @@
+package hbone
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/costinm/hbone/h2"
+	"github.com/costinm/hbone/h2/frame"
+	"github.com/costinm/hbone/nio"
+)
+
+// POST tunnel mode: the client connects trough an untrusted proxy, using POST
+// with the 'x-tun' header holding the endpoint address and 'x-service' the
+// service. The stream carries an inner mTLS connection, terminated here - the
+// inner peer is the real client, the outer connection is from the proxy.
+//
+// The inner peer is authorized during the handshake - a denied peer gets a
+// TLS alert. Errors after the handshake reset the stream with CONNECT_ERROR,
+// since the 200 status was already sent.
+//
+// Routing:
+// - x-tun host is local (or gateway mode is disabled): the local app, on the
+// x-tun port.
+// - gateway mode and x-service is a known cluster: the cluster.
+// - gateway mode: the x-tun address.
+
+// tunStream handles a POST tunnel stream.
+func (hb *HBone) tunStream(st *h2.H2Transport, stream *h2.H2Stream, log *slog.Logger) {
+	r := stream.Request
+	tunDest := r.Header.Get("x-tun")
+	svc := r.Header.Get("x-service")
+
+	// Resolve the route before sending the 200 - errors can still use a status.
+	host, p, err := net.SplitHostPort(tunDest)
+	if err != nil || host == "" {
+		log.Warn("HBD-MTLS: invalid x-tun", "dest", tunDest)
+		hb.streamError(stream, http.StatusBadRequest, ProxyErrRequest, errors.New("invalid x-tun"))
+		return
+	}
+	gateway := hb.Gateway && !isLocalDest(stream, tunDest)
+	dest := tunDest
+	if gateway {
+		if svc != "" && hb.GetCluster(svc) != nil {
+			dest = svc
+		}
+	} else {
+		port, err := hb.ResolvePort(p)
+		if err != nil {
+			log.Warn("HBD-MTLS: port not allowed", "dest", tunDest, "err", err)
+			hb.denyStream(stream, err)
+			return
+		}
+		dest = "localhost:" + strconv.Itoa(port.TargetPort)
+	}
+
+	// Attributes of the inner stream - the peer is set from the inner
+	// certificate.
+	req := streamAuthzRequest(stream, "")
+	req.Host = tunDest
+	req.Port, _ = strconv.Atoi(p)
+	req.Gateway = gateway
+	// Baggage is kept, the proxy identity is not used.
+	peer := h2.ParseBaggage(r.Header.Get(h2.HeaderBaggage))
+	if peer == nil {
+		peer = &h2.PeerMetadata{}
+	}
+	req.Peer = peer
+
+	snc := acceptFraming(stream)
+	stream.Response.Status = "200"
+	stream.Response.Header.Add("x-status", "200")
+	st.WriteHeader(stream)
+
+	conf := hb.Auth.GenerateTLSConfigServer().Clone()
+	verify := conf.VerifyConnection
+	conf.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		peer.SetTLSPeer(&cs)
+		req.SNI = cs.ServerName
+		return hb.authorizeRequest(stream, req)
+	}
+	tc := tls.Server(snc, conf)
+
+	err = nio.HandshakeTimeout(tc, hb.HandsahakeTimeout, nil)
+	if err != nil {
+		log.Warn("HBD-MTLS: error inner mTLS", "err", err, "peer", peer)
+		if errors.Is(err, errAuthzDenied) {
+			// The alert was sent - let it reach the client.
+			stream.Close()
+		} else {
+			stream.CloseError(uint32(frame.ErrCodeConnect))
+		}
+		return
+	}
+	stream.SetPeer(peer)
+	log.Debug("HBD-MTLS: inner mTLS", "sni", req.SNI,
+		"alpn", tc.ConnectionState().NegotiatedProtocol, "peer", peer)
+
+	// TODO: if protocol is not matching wire protocol, convert.
+
+	var nc net.Conn
+	if gateway {
+		var upstream *h2.PeerMetadata
+		nc, upstream, err = hb.dialGateway(stream, dest)
+		if err == nil {
+			req.Destination = upstream
+			if err = hb.authorizeRequest(stream, req); err != nil {
+				nc.Close()
+			}
+		}
+	} else {
+		nc, err = hb.dialLocal(stream, dest)
+	}
+	if err != nil {
+		log.Warn("HBD-MTLS: error dialing", "dest", dest, "err", err)
+		tc.Close()
+		stream.CloseError(uint32(frame.ErrCodeConnect))
+		return
+	}
+	proxyErr := hb.Proxy(nc, tc, tc, dest)
+	log.Info("HBD-MTLS-END", "dest", dest, "err", proxyErr)
+}
@@ -0,0 +1,97 @@
+package hbone
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTunnel(t *testing.T) {
+	ca := newTestCA(t)
+	app := serveTest(t, func(c net.Conn) {
+		io.Copy(c, c)
+		c.Close()
+	})
+	_, appPort, _ := net.SplitHostPort(app.Addr().String())
+	ctx := context.Background()
+
+	allow := func(sa ...string) []*AuthzPolicy {
+		p := &AuthzPolicy{Name: "allow", Rules: []*AuthzRule{{From: []*AuthzFrom{{Source: &AuthzSource{}}}}}}
+		for _, s := range sa {
+			p.Rules[0].From[0].Source.Principals = append(p.Rules[0].From[0].Source.Principals,
+				"cluster.local/ns/test/sa/"+s)
+		}
+		return []*AuthzPolicy{p}
+	}
+
+	// bob allows alice - directly or trough the tunnel - and the gateway.
+	bob := New(ca.auth(t, "test", "bob"), &MeshSettings{Namespace: "test",
+		Ports:         map[string]string{"tcp": "9000:" + appPort},
+		AuthzPolicies: allow("alice", "gw")})
+	bobAddr := serveTest(t, bob.HandleAcceptedH2).Addr().String()
+
+	gw := New(ca.auth(t, "test", "gw"), &MeshSettings{Namespace: "test", Gateway: true,
+		AuthzPolicies: allow("alice")})
+	gw.AddService(&Cluster{Addr: "bob.test.svc:9000"},
+		&Endpoint{Address: "bob.test.svc:9000", HBoneAddress: bobAddr})
+	gwAddr := serveTest(t, gw.HandleAcceptedH2).Addr().String()
+
+	// tunnel dials a POST tunnel as sa, with x-tun set to tun. The outer
+	// connection uses the 'proxy' identity, which is not allowed by the
+	// policies - only the inner peer is authorized.
+	tunnel := func(sa, tun, hbAddr string) (net.Conn, error) {
+		hb := New(ca.auth(t, "test", sa), &MeshSettings{Namespace: "test"})
+		hb.AddService(&Cluster{Addr: "bob.test.svc:9000",
+			TLSClientConfig: ca.auth(t, "test", "proxy").GenerateTLSConfigClient("bob.test.svc")},
+			&Endpoint{Address: tun, HBoneAddress: hbAddr, Labels: map[string]string{"http_proxy": "1"}})
+		return hb.DialContext(ctx, "tcp", "bob.test.svc:9000")
+	}
+
+	// denied checks that the tunnel is rejected - at handshake or on first read.
+	denied := func(t *testing.T, nc net.Conn, err error) {
+		t.Helper()
+		if err != nil {
+			return
+		}
+		defer nc.Close()
+		nc.SetDeadline(time.Now().Add(5 * time.Second))
+		nc.Write([]byte("hello"))
+		if _, err := nc.Read(make([]byte, 5)); err == nil {
+			t.Error("Expecting tunnel to be rejected")
+		}
+	}
+
+	t.Run("local", func(t *testing.T) {
+		nc, err := tunnel("alice", "127.0.0.1:9000", bobAddr)
+		checkEcho(t, nc, err)
+	})
+
+	t.Run("local-inner-denied", func(t *testing.T) {
+		nc, err := tunnel("eve", "127.0.0.1:9000", bobAddr)
+		denied(t, nc, err)
+	})
+
+	t.Run("local-port-not-declared", func(t *testing.T) {
+		nc, err := tunnel("alice", "127.0.0.1:9001", bobAddr)
+		denied(t, nc, err)
+	})
+
+	t.Run("gateway", func(t *testing.T) {
+		// x-tun is not local - the gateway uses the x-service cluster.
+		nc, err := tunnel("alice", "bob.test.svc:9000", gwAddr)
+		checkEcho(t, nc, err)
+	})
+
+	t.Run("gateway-inner-denied", func(t *testing.T) {
+		nc, err := tunnel("eve", "bob.test.svc:9000", gwAddr)
+		denied(t, nc, err)
+	})
+
+	t.Run("gateway-disabled", func(t *testing.T) {
+		// bob is not a gateway - x-tun port is used for the local app.
+		nc, err := tunnel("alice", "10.1.1.1:9000", bobAddr)
+		checkEcho(t, nc, err)
+	})
+}
@@ -1,6 +1,6 @@
 module github.com/costinm/hbone/urpc
 
-go 1.18
+go 1.21
 
 replace github.com/costinm/hbone => ./..
 
@@ -22,5 +22,6 @@ require (
 	github.com/hashicorp/errwrap v1.0.0 // indirect
 	golang.org/x/net v0.1.0 // indirect
 	golang.org/x/sys v0.1.0 // indirect
+	golang.org/x/text v0.4.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
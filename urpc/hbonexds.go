@@ -2,7 +2,6 @@ package urpc
 
 import (
 	"context"
-	"log"
 	"net"
 	"strconv"
 	"strings"
@@ -39,7 +38,7 @@ func SetupControlPlane(ctx context.Context, hb *hbone.HBone, c *hbone.Cluster) e
 		for {
 			res := <-xdsc.Updates
 			if res == "close" {
-				log.Printf("XDS closed, re-dial", time.Since(t0))
+				xdsc.log.Info("XDS closed, re-dial", "dur", time.Since(t0))
 				xdsc, err = DialContext(ctx, "", &Config{
 					Cluster: c,
 					HBone:   hb,
@@ -4,7 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"math"
 	"net"
 	"sort"
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/costinm/hbone"
+	"github.com/costinm/hbone/nio"
 	"github.com/golang/protobuf/jsonpb"
 	"google.golang.org/protobuf/reflect/protoreflect"
 
@@ -22,7 +23,9 @@ import (
 	"github.com/costinm/hbone/urpc/gen/xds"
 )
 
-var dump = false // true
+// Log is the default logger for XDS clients, used if Config.Logger and
+// Config.HBone are not set. Full resources are dumped at nio.LevelTrace.
+var Log = slog.Default().With("component", "urpc")
 
 var marshal = &jsonpb.Marshaler{OrigName: true, Indent: "  "}
 
@@ -88,6 +91,9 @@ type Config struct {
 
 	HBone   *hbone.HBone
 	Cluster *hbone.Cluster
+
+	// Logger overrides the logger derived from HBone.
+	Logger *slog.Logger
 }
 
 // ADSC implements a basic client for ADS, for use in stress tests and tools
@@ -161,6 +167,8 @@ type ADSC struct {
 
 	sync      map[string]time.Time
 	sendCount int
+
+	log *slog.Logger
 }
 
 type Watch struct {
@@ -220,12 +228,22 @@ func DialContext(ctx context.Context, url string, opts *Config) (*ADSC, error) {
 	}
 	adsc.Metadata = opts.Meta
 
+	switch {
+	case opts.Logger != nil:
+		adsc.log = opts.Logger
+	case opts.HBone != nil:
+		adsc.log = opts.HBone.ComponentLogger("urpc")
+	default:
+		adsc.log = Log
+	}
+
 	adsc.nodeID = fmt.Sprintf("%s~%s~%s.%s~%s.svc.cluster.local", opts.NodeType, opts.IP,
 		opts.Workload, opts.Namespace, opts.Namespace)
 	if adsc.Config.NodeId != "" {
 		adsc.nodeID = adsc.Config.NodeId
 	}
 
+	adsc.log = adsc.log.With("node", adsc.nodeID)
 	adsc.node = adsc.makeNode()
 	err := adsc.Run()
 	return adsc, err
@@ -309,7 +327,7 @@ func (a *ADSC) handleRecv() {
 	for _, d := range a.Config.InitialDiscoveryRequests {
 		err := a.send(d, ReasonInit)
 		if err != nil {
-			log.Printf("Error sending request: %v", err)
+			a.log.Warn("Error sending request", "err", err)
 			a.Updates <- "error-" + err.Error()
 			return
 		}
@@ -323,7 +341,7 @@ func (a *ADSC) handleRecv() {
 		var msg xds.DiscoveryResponse
 		err := a.stream.RecvMsg(&msg)
 		if err != nil {
-			log.Printf("Connection closed for %v: %v", a.nodeID, err)
+			a.log.Info("Connection closed", "err", err)
 			a.Close()
 			a.WaitClear()
 			a.Updates <- "close"
@@ -332,8 +350,8 @@ func (a *ADSC) handleRecv() {
 		// Makes copy of byte[]
 		//proto.Unmarshal(raw.Bytes(), &msg)
 
-		if dump {
-			log.Printf("XDS in: %v %s %s %d", msg.TypeUrl, msg.Nonce, msg.VersionInfo, len(msg.Resources))
+		if a.dump() {
+			a.log.Log(a.ctx, nio.LevelTrace, "XDS in", "type", msg.TypeUrl, "nonce", msg.Nonce, "version", msg.VersionInfo, "resources", len(msg.Resources))
 		}
 		if a.Config.ResponseHandler != nil {
 			a.Config.ResponseHandler(a, &msg)
@@ -429,14 +447,14 @@ func (a *ADSC) handleLDS(ll map[string]*xds.Listener) {
 	}
 	sort.Strings(routes)
 
-	if dump {
+	if a.dump() {
 		for i, l := range ll {
 			b, err := marshal.MarshalToString(l)
 			if err != nil {
-				log.Printf("Error in LDS: %v", err)
+				a.log.Warn("Error in LDS", "err", err)
 			}
 
-			log.Printf("lds %d: %v", i, b)
+			a.log.Log(a.ctx, nio.LevelTrace, "lds", "name", i, "res", b)
 		}
 	}
 
@@ -456,8 +474,8 @@ func (a *ADSC) handleLDS(ll map[string]*xds.Listener) {
 // Used for RDS and EDS (via LDS/CDS handlers) - if the list of resources to watch is different, re-ask.
 func (a *ADSC) handleResourceUpdate(typeUrl string, resources []string) {
 	if !listEqual(a.watches[typeUrl].resources, resources) {
-		if dump {
-			log.Printf("%v type resources changed: %v -> %v", typeUrl, a.watches[typeUrl].resources, resources)
+		if a.dump() {
+			a.log.Log(a.ctx, nio.LevelTrace, "resources changed", "type", typeUrl, "old", a.watches[typeUrl].resources, "new", resources)
 		}
 		watch := a.watches[typeUrl]
 		watch.resources = resources
@@ -520,7 +538,7 @@ func (a *ADSC) handleCDS(ll map[string]*xds.Cluster) {
 
 	a.handleResourceUpdate(EndpointType, cn)
 
-	if dump {
+	if a.dump() {
 		for i, c := range ll {
 			// jsonpb deprecated, use protojson instead
 			//m := &protojson.MarshalOptions{
@@ -538,10 +556,10 @@ func (a *ADSC) handleCDS(ll map[string]*xds.Cluster) {
 
 			b, err := m.Marshal(c)
 			if err != nil {
-				log.Printf("Error in CDS: %v", err)
+				a.log.Warn("Error in CDS", "err", err)
 			}
 
-			log.Printf("cds %d: %v", i, string(b))
+			a.log.Log(a.ctx, nio.LevelTrace, "cds", "name", i, "res", string(b))
 		}
 	}
 
@@ -590,14 +608,14 @@ func (a *ADSC) makeNode() *xds.Node {
 }
 
 func (a *ADSC) handleEDS(eds map[string]*xds.ClusterLoadAssignment) {
-	if dump {
+	if a.dump() {
 		for i, e := range eds {
 			b, err := marshal.MarshalToString(e)
 			if err != nil {
-				log.Printf("Error in EDS: %v", err)
+				a.log.Warn("Error in EDS", "err", err)
 			}
 
-			log.Printf("eds %d: %v", i, b)
+			a.log.Log(a.ctx, nio.LevelTrace, "eds", "name", i, "res", b)
 		}
 	}
 
@@ -617,14 +635,14 @@ func (a *ADSC) handleRDS(configurations map[string]*xds.RouteConfiguration) {
 		rds[r.Name] = r
 	}
 
-	if dump {
+	if a.dump() {
 		for i, r := range configurations {
 			b, err := marshal.MarshalToString(r)
 			if err != nil {
-				log.Printf("Error in RDS: %v", err)
+				a.log.Warn("Error in RDS", "err", err)
 			}
 
-			log.Printf("rds %d: %v", i, b)
+			a.log.Log(a.ctx, nio.LevelTrace, "rds", "name", i, "res", b)
 		}
 	}
 
@@ -666,13 +684,16 @@ func (a *ADSC) Send(dr *xds.DiscoveryRequest) error {
 	return a.send(dr, ReasonRequest)
 }
 
-var Debug = false
+// dump returns true if full XDS resources should be logged.
+func (a *ADSC) dump() bool {
+	return a.log.Enabled(a.ctx, nio.LevelTrace)
+}
 
 func (a *ADSC) send(dr *xds.DiscoveryRequest, reason string) error {
 	dr.ResponseNonce = time.Now().String()
 
-	if dump {
-		log.Printf("send message for type %v (%v) for %v", dr.TypeUrl, reason, dr.ResourceNames)
+	if a.dump() {
+		a.log.Log(a.ctx, nio.LevelTrace, "send", "type", dr.TypeUrl, "reason", reason, "resources", dr.ResourceNames)
 	}
 
 	err := a.stream.SendMsg(dr)
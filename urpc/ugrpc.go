@@ -5,7 +5,6 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 
 	"github.com/costinm/hbone"
@@ -174,7 +173,7 @@ func (u *UGRPC) Recv() (*nio.Buffer, error) {
 		// grpc-message
 		// grpc-status-details-bin - base64 proto
 		if hc.Response != nil {
-			log.Println("Trailer", hc.Response.Trailer)
+			Log.Debug("Trailer", "trailer", hc.Response.Trailer)
 			hc.Response.Body.Close()
 		}
 	} else if err != nil {
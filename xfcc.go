@@ -0,0 +1,123 @@
+package hbone
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/costinm/hbone/h2"
+)
+
+// HeaderXFCC is the Envoy x-forwarded-client-cert header, used to pass the
+// peer certificate info to the app.
+const HeaderXFCC = "x-forwarded-client-cert"
+
+// XFCC modes, same as Envoy forward_client_cert_details.
+const (
+	// XFCCSanitizeSet removes the header from the request and sets it using
+	// the peer certificate. Default.
+	XFCCSanitizeSet = "sanitize_set"
+
+	// XFCCSanitize removes the header.
+	XFCCSanitize = "sanitize"
+
+	// XFCCForward keeps the header from the peer, without adding.
+	XFCCForward = "forward"
+
+	// XFCCAppend appends the peer certificate to the header from the peer.
+	XFCCAppend = "append"
+)
+
+// setXFCC updates the x-forwarded-client-cert header of a request received
+// on a stream, according to the XFCC mode. The header from the peer is only
+// kept if the peer is using a verified client certificate - like Envoy,
+// plain text peers can't forward.
+func (hb *HBone) setXFCC(r *http.Request, cs *tls.ConnectionState) {
+	var cert *x509.Certificate
+	if cs != nil && len(cs.PeerCertificates) > 0 {
+		cert = cs.PeerCertificates[0]
+	}
+
+	mode := hb.XFCC
+	if mode == "" {
+		mode = XFCCSanitizeSet
+	}
+	if cert == nil {
+		r.Header.Del(HeaderXFCC)
+		return
+	}
+
+	switch mode {
+	case XFCCForward:
+	case XFCCAppend:
+		el := xfccElement(hb.localIdentity(), cert)
+		if v := r.Header.Get(HeaderXFCC); v != "" {
+			el = v + "," + el
+		}
+		r.Header.Set(HeaderXFCC, el)
+	case XFCCSanitize:
+		r.Header.Del(HeaderXFCC)
+	default:
+		r.Header.Set(HeaderXFCC, xfccElement(hb.localIdentity(), cert))
+	}
+}
+
+// streamTLSState returns the TLS state of the connection of an accepted
+// stream, or nil for plain text.
+func streamTLSState(stream *h2.H2Stream) *tls.ConnectionState {
+	if tc, ok := stream.Conn().(*tls.Conn); ok {
+		cs := tc.ConnectionState()
+		return &cs
+	}
+	return nil
+}
+
+// xfccElement returns the XFCC element for a peer certificate, with the
+// By, Hash, URI and DNS keys.
+func xfccElement(by string, cert *x509.Certificate) string {
+	var sb strings.Builder
+	add := func(k, v string) {
+		if sb.Len() > 0 {
+			sb.WriteString(";")
+		}
+		sb.WriteString(k)
+		sb.WriteString("=")
+		sb.WriteString(xfccValue(v))
+	}
+	if by != "" {
+		add("By", by)
+	}
+	h := sha256.Sum256(cert.Raw)
+	add("Hash", hex.EncodeToString(h[:]))
+	if len(cert.URIs) > 0 {
+		add("URI", cert.URIs[0].String())
+	}
+	for _, d := range cert.DNSNames {
+		add("DNS", d)
+	}
+	return sb.String()
+}
+
+// xfccValue quotes values containing the XFCC separators.
+func xfccValue(v string) string {
+	if !strings.ContainsAny(v, ",;=\"") {
+		return v
+	}
+	return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+}
+
+// localIdentity returns the SPIFFE identity of this node, or empty if the
+// namespace or service account are not known.
+func (hb *HBone) localIdentity() string {
+	if hb.Namespace == "" || hb.ServiceAccount == "" {
+		return ""
+	}
+	td := "cluster.local"
+	if hb.ID != nil && hb.ID.TrustDomain != "" {
+		td = hb.ID.TrustDomain
+	}
+	return "spiffe://" + td + "/ns/" + hb.Namespace + "/sa/" + hb.ServiceAccount
+}
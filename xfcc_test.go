@@ -0,0 +1,56 @@
+package hbone
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"math/big"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestXFCC(t *testing.T) {
+	k, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	u, _ := url.Parse("spiffe://cluster.local/ns/alice/sa/default")
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), URIs: []*url.URL{u},
+		DNSNames: []string{"alice.example.com"}}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &k.PublicKey, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	cs := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	h := sha256.Sum256(der)
+
+	hb := New(nil, &MeshSettings{Namespace: "bob", ServiceAccount: "default"})
+	el := "By=spiffe://cluster.local/ns/bob/sa/default;Hash=" + hex.EncodeToString(h[:]) +
+		";URI=spiffe://cluster.local/ns/alice/sa/default;DNS=alice.example.com"
+
+	for _, tc := range []struct {
+		mode, in, out string
+		cs            *tls.ConnectionState
+	}{
+		{"", "fake", el, cs},
+		{XFCCSanitize, "fake", "", cs},
+		{XFCCForward, "prev", "prev", cs},
+		{XFCCAppend, "prev", "prev," + el, cs},
+		{XFCCAppend, "", el, cs},
+		// Plain text peers can't forward
+		{XFCCForward, "fake", "", nil},
+	} {
+		hb.XFCC = tc.mode
+		r := &http.Request{Header: http.Header{}}
+		if tc.in != "" {
+			r.Header.Set(HeaderXFCC, tc.in)
+		}
+		hb.setXFCC(r, tc.cs)
+		if got := r.Header.Get(HeaderXFCC); got != tc.out {
+			t.Errorf("%s: got %q want %q", tc.mode, got, tc.out)
+		}
+	}
+}